@@ -283,7 +283,11 @@ func main() {
 			log.WithError(err).Fatal("cannot set string option")
 		}
 	}
-	experiment := builder.NewExperiment()
+	experiment, err := builder.NewExperiment()
+	if err != nil {
+		log.WithError(err).Fatal("cannot create experiment")
+	}
+	defer experiment.Close()
 
 	if !globalOptions.noCollector {
 		if err := experiment.OpenReport(); err != nil {
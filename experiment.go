@@ -6,27 +6,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"reflect"
 	"time"
 
-	"github.com/iancoleman/strcase"
 	"github.com/ooni/probe-engine/collector"
-	"github.com/ooni/probe-engine/experiment/dash"
-	"github.com/ooni/probe-engine/experiment/example"
-	"github.com/ooni/probe-engine/experiment/fbmessenger"
 	"github.com/ooni/probe-engine/experiment/handler"
-	"github.com/ooni/probe-engine/experiment/hhfm"
-	"github.com/ooni/probe-engine/experiment/hirl"
-	"github.com/ooni/probe-engine/experiment/ndt5"
-	"github.com/ooni/probe-engine/experiment/ndt7"
-	"github.com/ooni/probe-engine/experiment/psiphon"
-	"github.com/ooni/probe-engine/experiment/sniblocking"
-	"github.com/ooni/probe-engine/experiment/telegram"
-	"github.com/ooni/probe-engine/experiment/tor"
-	"github.com/ooni/probe-engine/experiment/web_connectivity"
-	"github.com/ooni/probe-engine/experiment/whatsapp"
+	"github.com/ooni/probe-engine/experiment/registry"
 	"github.com/ooni/probe-engine/model"
+	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 const dateFormat = "2006-01-02 15:04:05"
@@ -37,7 +26,7 @@ func formatTimeNowUTC() string {
 
 // ExperimentBuilder is an experiment builder.
 type ExperimentBuilder struct {
-	build         func(interface{}) *Experiment
+	build         func(interface{}) (*Experiment, error)
 	callbacks     model.ExperimentCallbacks
 	config        interface{}
 	interruptible bool
@@ -61,7 +50,9 @@ type OptionInfo struct {
 	Type string
 }
 
-// Options returns info about all options
+// Options returns info about all options. The config fields whose ooni
+// tag is "-", e.g., callbacks, are only settable from code, hence we do
+// not consider them options.
 func (b *ExperimentBuilder) Options() (map[string]OptionInfo, error) {
 	result := make(map[string]OptionInfo)
 	ptrinfo := reflect.ValueOf(b.config)
@@ -74,6 +65,9 @@ func (b *ExperimentBuilder) Options() (map[string]OptionInfo, error) {
 	}
 	for i := 0; i < structinfo.NumField(); i++ {
 		field := structinfo.Field(i)
+		if field.Tag.Get("ooni") == "-" {
+			continue
+		}
 		result[field.Name] = OptionInfo{
 			Doc:  field.Tag.Get("ooni"),
 			Type: field.Type.String(),
@@ -136,41 +130,56 @@ func fieldbyname(v interface{}, key string) (reflect.Value, error) {
 	if structinfo.Kind() != reflect.Struct {
 		return reflect.Value{}, errors.New("value is not a pointer to struct")
 	}
-	field := structinfo.FieldByName(key)
-	if !field.IsValid() || !field.CanSet() {
+	fieldinfo, found := structinfo.Type().FieldByName(key)
+	if !found || fieldinfo.Tag.Get("ooni") == "-" {
+		return reflect.Value{}, errors.New("no such field")
+	}
+	field := structinfo.FieldByIndex(fieldinfo.Index)
+	if !field.CanSet() {
 		return reflect.Value{}, errors.New("no such field")
 	}
 	return field, nil
 }
 
 // NewExperiment creates the experiment
-func (b *ExperimentBuilder) NewExperiment() *Experiment {
-	experiment := b.build(b.config)
+func (b *ExperimentBuilder) NewExperiment() (*Experiment, error) {
+	experiment, err := b.build(b.config)
+	if err != nil {
+		return nil, err
+	}
 	experiment.callbacks = b.callbacks
-	return experiment
+	return experiment, nil
 }
 
 // canonicalizeExperimentName allows code to provide experiment names
 // in a more flexible way, where we have aliases.
 func canonicalizeExperimentName(name string) string {
-	switch name = strcase.ToSnake(name); name {
-	case "ndt_7":
-		name = "ndt" // since 2020-03-18, we use ndt7 to implement ndt by default
-	case "ndt_5":
-		name = "ndt5"
-	default:
-	}
-	return name
+	return registry.CanonicalName(name)
 }
 
 func newExperimentBuilder(session *Session, name string) (*ExperimentBuilder, error) {
-	factory, _ := experimentsByName[canonicalizeExperimentName(name)]
-	if factory == nil {
+	name = canonicalizeExperimentName(name)
+	info, found := experimentsByName[name]
+	if !found {
 		return nil, fmt.Errorf("no such experiment: %s", name)
 	}
-	builder := factory(session)
-	builder.callbacks = handler.NewPrinterCallbacks(session.Logger())
-	return builder, nil
+	config, err := registry.NewConfig(name, session)
+	if err != nil {
+		return nil, err
+	}
+	return &ExperimentBuilder{
+		build: func(config interface{}) (*Experiment, error) {
+			measurer, err := registry.NewExperimentMeasurer(name, config)
+			if err != nil {
+				return nil, err
+			}
+			return NewExperiment(session, measurer), nil
+		},
+		callbacks:     handler.NewPrinterCallbacks(session.Logger()),
+		config:        config,
+		interruptible: info.interruptible,
+		needsInput:    info.needsInput,
+	}, nil
 }
 
 // Experiment is an experiment instance.
@@ -248,6 +257,14 @@ func (e *Experiment) MeasureWithContext(
 		return
 	}
 	measurement = e.newMeasurement(input)
+	// Allow dialers and resolvers deep in the stack to know
+	// the network from which we are measuring.
+	ctx = modelx.WithVantagePoint(ctx, &modelx.VantagePoint{
+		ProbeASN:         e.session.ProbeASNString(),
+		ProbeCC:          e.session.ProbeCC(),
+		ProbeIP:          e.session.ProbeIP(),
+		ProbeNetworkName: e.session.ProbeNetworkName(),
+	})
 	start := time.Now()
 	err = e.measurer.Run(ctx, e.session, measurement, &sessionExperimentCallbacks{
 		inner: e.callbacks,
@@ -308,6 +325,16 @@ func (e *Experiment) CloseReport() (err error) {
 	return
 }
 
+// Close releases the resources used by the experiment measurer, if any,
+// e.g., interrupting its pending runs. It does not close the report,
+// which you should close using CloseReport.
+func (e *Experiment) Close() error {
+	if closer, ok := e.measurer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func (e *Experiment) newMeasurement(input string) *model.Measurement {
 	utctimenow := time.Now().UTC()
 	m := model.Measurement{
@@ -393,226 +420,50 @@ func (e *Experiment) saveMeasurement(
 	return filep.Close()
 }
 
-var experimentsByName = map[string]func(*Session) *ExperimentBuilder{
-	"dash": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, dash.NewExperimentMeasurer(
-					*config.(*dash.Config),
-				))
-			},
-			config:        &dash.Config{},
-			interruptible: true,
-			needsInput:    false,
-		}
-	},
-
-	"example": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, example.NewExperimentMeasurer(
-					*config.(*example.Config), "example",
-				))
-			},
-			config: &example.Config{
-				Message:   "Good day from the example experiment!",
-				SleepTime: int64(5 * time.Second),
-			},
-			interruptible: true,
-			needsInput:    false,
-		}
-	},
-
-	"example_with_input": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, example.NewExperimentMeasurer(
-					*config.(*example.Config), "example_with_input",
-				))
-			},
-			config: &example.Config{
-				Message:   "Good day from the example with input experiment!",
-				SleepTime: int64(5 * time.Second),
-			},
-			interruptible: true,
-			needsInput:    true,
-		}
-	},
+// experimentInfo contains the properties of an experiment that the
+// registry does not know about. We create the config, with its default
+// values, and the measurer using the registry.
+type experimentInfo struct {
+	interruptible bool
+	needsInput    bool
+}
+
+var experimentsByName = map[string]experimentInfo{
+	"dash": {interruptible: true},
+
+	"example": {interruptible: true},
+
+	"example_with_input": {interruptible: true, needsInput: true},
 
 	// TODO(bassosimone): when we can set experiment options using the JSON
 	// we need to get rid of all these multiple experiments.
 	//
 	// See https://github.com/ooni/probe-engine/issues/413
-	"example_with_input_non_interruptible": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, example.NewExperimentMeasurer(
-					*config.(*example.Config), "example_with_input_non_interruptible",
-				))
-			},
-			config: &example.Config{
-				Message:   "Good day from the example with input experiment!",
-				SleepTime: int64(5 * time.Second),
-			},
-			interruptible: false,
-			needsInput:    true,
-		}
-	},
-
-	"example_with_failure": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, example.NewExperimentMeasurer(
-					*config.(*example.Config), "example_with_failure",
-				))
-			},
-			config: &example.Config{
-				Message:     "Good day from the example with failure experiment!",
-				ReturnError: true,
-				SleepTime:   int64(5 * time.Second),
-			},
-			interruptible: true,
-			needsInput:    false,
-		}
-	},
-
-	"facebook_messenger": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, fbmessenger.NewExperimentMeasurer(
-					*config.(*fbmessenger.Config),
-				))
-			},
-			config:     &fbmessenger.Config{},
-			needsInput: false,
-		}
-	},
-
-	"http_header_field_manipulation": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, hhfm.NewExperimentMeasurer(
-					*config.(*hhfm.Config),
-				))
-			},
-			config:     &hhfm.Config{},
-			needsInput: false,
-		}
-	},
-
-	"http_invalid_request_line": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, hirl.NewExperimentMeasurer(
-					*config.(*hirl.Config),
-				))
-			},
-			config:     &hirl.Config{},
-			needsInput: false,
-		}
-	},
-
-	"ndt5": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, ndt5.NewExperimentMeasurer(
-					*config.(*ndt5.Config),
-				))
-			},
-			config:        &ndt5.Config{},
-			interruptible: true,
-			needsInput:    false,
-		}
-	},
-
-	"ndt": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, ndt7.NewExperimentMeasurer(
-					*config.(*ndt7.Config),
-				))
-			},
-			config:        &ndt7.Config{},
-			interruptible: true,
-			needsInput:    false,
-		}
-	},
-
-	"psiphon": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, psiphon.NewExperimentMeasurer(
-					*config.(*psiphon.Config),
-				))
-			},
-			config: &psiphon.Config{
-				WorkDir: session.TempDir(),
-			},
-			needsInput: false,
-		}
-	},
-
-	"sni_blocking": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, sniblocking.NewExperimentMeasurer(
-					*config.(*sniblocking.Config),
-				))
-			},
-			config: &sniblocking.Config{
-				ControlSNI: "example.com",
-			},
-			needsInput: true,
-		}
-	},
-
-	"telegram": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, telegram.NewExperimentMeasurer(
-					*config.(*telegram.Config),
-				))
-			},
-			config:     &telegram.Config{},
-			needsInput: false,
-		}
-	},
-
-	"tor": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, tor.NewExperimentMeasurer(
-					*config.(*tor.Config),
-				))
-			},
-			config:     &tor.Config{},
-			needsInput: false,
-		}
-	},
-
-	"web_connectivity": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, web_connectivity.NewExperimentMeasurer(
-					*config.(*web_connectivity.Config),
-				))
-			},
-			config:     &web_connectivity.Config{},
-			needsInput: true,
-		}
-	},
-
-	"whatsapp": func(session *Session) *ExperimentBuilder {
-		return &ExperimentBuilder{
-			build: func(config interface{}) *Experiment {
-				return NewExperiment(session, whatsapp.NewExperimentMeasurer(
-					*config.(*whatsapp.Config),
-				))
-			},
-			config:     &whatsapp.Config{},
-			needsInput: false,
-		}
-	},
+	"example_with_input_non_interruptible": {needsInput: true},
+
+	"example_with_failure": {interruptible: true},
+
+	"facebook_messenger": {},
+
+	"http_header_field_manipulation": {},
+
+	"http_invalid_request_line": {},
+
+	"ndt5": {interruptible: true},
+
+	"ndt": {interruptible: true},
+
+	"psiphon": {},
+
+	"sni_blocking": {needsInput: true},
+
+	"telegram": {},
+
+	"tor": {},
+
+	"web_connectivity": {needsInput: true},
+
+	"whatsapp": {},
 }
 
 // AllExperiments returns the name of all experiments
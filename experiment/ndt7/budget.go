@@ -0,0 +1,90 @@
+package ndt7
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	endReasonBytes    = "bytes"
+	endReasonCanceled = "canceled"
+	endReasonError    = "error"
+	endReasonTime     = "time"
+)
+
+// byteBudget is the number of bytes that all the streams of a phase
+// may transfer together. See Config.MaxBytes. The methods of byteBudget
+// are no-ops when the budget is nil, i.e., when there is no limit.
+type byteBudget struct {
+	total  int64 // must be first for atomic access on 32 bit systems
+	cancel context.CancelFunc
+	max    int64
+}
+
+// newByteBudget creates a new byteBudget allowing the streams to transfer
+// max bytes. The returned context is canceled when the budget is exhausted
+// so that the streams using it stop. Returns ctx and a nil budget if max
+// is not positive. The caller must call stop when the phase is over.
+func newByteBudget(ctx context.Context, max int64) (context.Context, *byteBudget) {
+	if max <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &byteBudget{cancel: cancel, max: max}
+}
+
+// consume accounts for n more bytes and returns whether the budget is
+// now exhausted, in which case it also cancels the budget context.
+func (b *byteBudget) consume(n int64) bool {
+	if b == nil {
+		return false
+	}
+	if atomic.AddInt64(&b.total, n) < b.max {
+		return false
+	}
+	b.cancel()
+	return true
+}
+
+// exhausted returns whether the streams have transferred the budget.
+func (b *byteBudget) exhausted() bool {
+	return b != nil && atomic.LoadInt64(&b.total) >= b.max
+}
+
+// stop releases the resources associated with the budget context.
+func (b *byteBudget) stop() {
+	if b != nil {
+		b.cancel()
+	}
+}
+
+// newEndReason returns why a phase that used ctx and budget has ended
+// with err. We check ctx first because cancellation wins over the byte
+// budget, which in turn wins over the errors caused by closing the other
+// streams when the budget is exhausted.
+func newEndReason(ctx context.Context, budget *byteBudget, err error) string {
+	switch {
+	case ctx.Err() != nil:
+		return endReasonCanceled
+	case budget.exhausted():
+		return endReasonBytes
+	case err != nil && !isExpectedEnd(err):
+		return endReasonError
+	default:
+		return endReasonTime
+	}
+}
+
+// isExpectedEnd returns whether err is how a phase normally ends, i.e.,
+// either the server closed the connection or the deadline expired.
+func isExpectedEnd(err error) bool {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,68 @@
+package ndt7
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUnitByteBudgetWithoutLimit(t *testing.T) {
+	ctx := context.Background()
+	budgetctx, budget := newByteBudget(ctx, 0)
+	if budgetctx != ctx || budget != nil {
+		t.Fatal("expected no budget")
+	}
+	if budget.consume(1<<30) || budget.exhausted() {
+		t.Fatal("a nil budget cannot be exhausted")
+	}
+	budget.stop() // must not panic
+}
+
+func TestUnitByteBudgetConsume(t *testing.T) {
+	ctx, budget := newByteBudget(context.Background(), 100)
+	defer budget.stop()
+	if budget.consume(60) || budget.exhausted() || ctx.Err() != nil {
+		t.Fatal("the budget should not be exhausted yet")
+	}
+	if !budget.consume(60) || !budget.exhausted() {
+		t.Fatal("the budget should be exhausted")
+	}
+	if ctx.Err() == nil {
+		t.Fatal("expected the budget context to be done")
+	}
+}
+
+func TestUnitNewEndReason(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, budget := newByteBudget(ctx, 10)
+	defer budget.stop()
+	if newEndReason(ctx, budget, nil) != endReasonTime {
+		t.Fatal("expected the time end reason")
+	}
+	if newEndReason(ctx, budget, errTimeoutForTesting{}) != endReasonTime {
+		t.Fatal("a timeout should be the time end reason")
+	}
+	closeErr := &websocket.CloseError{Code: websocket.CloseNormalClosure}
+	if newEndReason(ctx, budget, closeErr) != endReasonTime {
+		t.Fatal("a normal close should be the time end reason")
+	}
+	if newEndReason(ctx, budget, io.ErrUnexpectedEOF) != endReasonError {
+		t.Fatal("expected the error end reason")
+	}
+	budget.consume(10)
+	if newEndReason(ctx, budget, io.ErrUnexpectedEOF) != endReasonBytes {
+		t.Fatal("the budget should win over errors")
+	}
+	cancel()
+	if newEndReason(ctx, budget, io.ErrUnexpectedEOF) != endReasonCanceled {
+		t.Fatal("cancellation should win over the budget")
+	}
+}
+
+type errTimeoutForTesting struct{}
+
+func (errTimeoutForTesting) Error() string   { return "i/o timeout" }
+func (errTimeoutForTesting) Timeout() bool   { return true }
+func (errTimeoutForTesting) Temporary() bool { return true }
@@ -5,4 +5,5 @@ import "time"
 type (
 	callbackJSON        func(data []byte) error
 	callbackPerformance func(elapsed time.Duration, count int64)
+	callbackRTT         func(elapsed, rtt time.Duration)
 )
@@ -10,12 +10,16 @@ import (
 )
 
 type downloadManager struct {
+	budget          *byteBudget // optional: stops when exhausted
 	conn            mockableConn
 	maxMessageSize  int64
 	maxRuntime      time.Duration
 	measureInterval time.Duration
+	onDone          callbackPerformance // optional: reports the bytes read
 	onJSON          callbackJSON
 	onPerformance   callbackPerformance
+	onRTT           callbackRTT // optional: enables pings
+	readBufferSize  int64
 }
 
 func newDownloadManager(
@@ -29,6 +33,7 @@ func newDownloadManager(
 		measureInterval: paramMeasureInterval,
 		onJSON:          onJSON,
 		onPerformance:   onPerformance,
+		readBufferSize:  paramReadBufferSize,
 	}
 }
 
@@ -39,8 +44,18 @@ func (mgr downloadManager) run(ctx context.Context) error {
 		return err
 	}
 	mgr.conn.SetReadLimit(mgr.maxMessageSize)
+	var ping *pinger
+	if mgr.onRTT != nil {
+		ping = newPinger(mgr.conn, start, mgr.onRTT)
+	}
 	ticker := time.NewTicker(mgr.measureInterval)
 	defer ticker.Stop()
+	if mgr.onDone != nil {
+		defer func() {
+			mgr.onDone(time.Now().Sub(start), total)
+		}()
+	}
+	buffer := make([]byte, mgr.readBufferSize)
 	for ctx.Err() == nil {
 		kind, reader, err := mgr.conn.NextReader()
 		if err != nil {
@@ -55,7 +70,7 @@ func (mgr downloadManager) run(ctx context.Context) error {
 				return err
 			}
 		}
-		n, err := io.Copy(ioutil.Discard, reader)
+		n, err := discard(reader, buffer)
 		if err != nil {
 			return err
 		}
@@ -63,9 +78,32 @@ func (mgr downloadManager) run(ctx context.Context) error {
 		select {
 		case now := <-ticker.C:
 			mgr.onPerformance(now.Sub(start), total)
+			if ping != nil {
+				ping.maybePing(now)
+			}
 		default:
 			// NOTHING
 		}
+		if mgr.budget.consume(n) {
+			break
+		}
 	}
 	return nil
 }
+
+// discard reads reader until EOF using buffer and returns the number of
+// bytes read. Unlike io.Copy(ioutil.Discard, reader), which would use its
+// own buffer, this function allows us to control the read size.
+func discard(reader io.Reader, buffer []byte) (int64, error) {
+	var total int64
+	for {
+		n, err := reader.Read(buffer)
+		total += int64(n)
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -143,3 +144,125 @@ type goodJSONReader struct{}
 func (r *goodJSONReader) Read(p []byte) (int, error) {
 	return copy(p, []byte(`{}`)), io.EOF
 }
+
+func TestUnitDownloadWithPings(t *testing.T) {
+	conn := &pingConnMock{
+		mockableConnMock: mockableConnMock{
+			NextReaderMsgType: websocket.BinaryMessage,
+			NextReaderReader: func() io.Reader {
+				return &goodJSONReader{}
+			},
+		},
+	}
+	mgr := newDownloadManager(
+		conn, defaultCallbackPerformance, defaultCallbackJSON,
+	)
+	mgr.onRTT = func(elapsed, rtt time.Duration) {}
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	err := mgr.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.pongHandler == nil {
+		t.Fatal("pong handler not set")
+	}
+	if len(conn.pings) < 1 {
+		t.Fatal("expected to see at least a ping")
+	}
+}
+
+func TestUnitDownloadOnDone(t *testing.T) {
+	var total, performance int64
+	mgr := newDownloadManager(
+		&mockableConnMock{
+			NextReaderMsgType: websocket.BinaryMessage,
+			NextReaderReader: func() io.Reader {
+				return strings.NewReader(strings.Repeat("A", 1<<14))
+			},
+		},
+		func(elapsed time.Duration, count int64) {
+			performance = count
+		},
+		defaultCallbackJSON,
+	)
+	mgr.readBufferSize = 1 << 10
+	mgr.onDone = func(elapsed time.Duration, count int64) {
+		total = count
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := mgr.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if total <= 0 || total%(1<<14) != 0 || total < performance {
+		t.Fatal("unexpected number of bytes read")
+	}
+}
+
+func TestUnitDiscardUsesBuffer(t *testing.T) {
+	reader := &countingReader{Reader: strings.NewReader(strings.Repeat("A", 100))}
+	n, err := discard(reader, make([]byte, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 || reader.reads != 11 {
+		t.Fatal("unexpected number of bytes or reads")
+	}
+}
+
+type countingReader struct {
+	io.Reader
+	reads int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func TestUnitDownloadStopsWhenBudgetExhausted(t *testing.T) {
+	// Both streams share the same budget, hence they should stop once
+	// they have read the budget together. Each stream may overshoot by
+	// at most a single message.
+	const messageSize = 1 << 10
+	ctx, budget := newByteBudget(context.Background(), 1<<16)
+	defer budget.stop()
+	var (
+		mu    sync.Mutex
+		total int64
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 2; i++ {
+		mgr := newDownloadManager(
+			&mockableConnMock{
+				NextReaderMsgType: websocket.BinaryMessage,
+				NextReaderReader: func() io.Reader {
+					return strings.NewReader(strings.Repeat("A", messageSize))
+				},
+			},
+			defaultCallbackPerformance,
+			defaultCallbackJSON,
+		)
+		mgr.budget = budget
+		mgr.onDone = func(elapsed time.Duration, count int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			total += count
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := mgr.run(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if total < 1<<16 || total > 1<<16+2*messageSize {
+		t.Fatal("unexpected number of bytes read")
+	}
+	if !budget.exhausted() {
+		t.Fatal("expected the budget to be exhausted")
+	}
+}
@@ -9,8 +9,10 @@ import (
 
 type mockableConn interface {
 	NextReader() (int, io.Reader, error)
+	SetPongHandler(func(string) error)
 	SetReadDeadline(time.Time) error
 	SetReadLimit(int64)
 	SetWriteDeadline(time.Time) error
+	WriteControl(int, []byte, time.Time) error
 	WritePreparedMessage(*websocket.PreparedMessage) error
 }
@@ -12,6 +12,7 @@ type mockableConnMock struct {
 	NextReaderErr           error
 	NextReaderReader        func() io.Reader
 	ReadDeadlineErr         error
+	WriteControlErr         error
 	WriteDeadlineErr        error
 	WritePreparedMessageErr error
 }
@@ -28,12 +29,18 @@ func (c *mockableConnMock) SetReadDeadline(time.Time) error {
 	return c.ReadDeadlineErr
 }
 
+func (c *mockableConnMock) SetPongHandler(func(string) error) {}
+
 func (c *mockableConnMock) SetReadLimit(int64) {}
 
 func (c *mockableConnMock) SetWriteDeadline(time.Time) error {
 	return c.WriteDeadlineErr
 }
 
+func (c *mockableConnMock) WriteControl(int, []byte, time.Time) error {
+	return c.WriteControlErr
+}
+
 func (c *mockableConnMock) WritePreparedMessage(*websocket.PreparedMessage) error {
 	return c.WritePreparedMessageErr
 }
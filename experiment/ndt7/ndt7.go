@@ -4,10 +4,16 @@ package ndt7
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt7-client-go/spec"
 	"github.com/ooni/probe-engine/internal/mlablocate"
 	"github.com/ooni/probe-engine/model"
@@ -15,13 +21,176 @@ import (
 
 const (
 	testName    = "ndt"
-	testVersion = "0.4.0"
+	testVersion = "0.5.0"
+)
+
+const (
+	modeBoth     = "both"
+	modeDownload = "download"
+	modeUpload   = "upload"
 )
 
 // Config contains the experiment settings
-type Config struct{}
+type Config struct {
+	DiscoverRetries int64  `ooni:"Number of discovery retries: zero means default, negative means none"`
+	DryRun          bool   `ooni:"Validate the config and discover the server without running any phase"`
+	Hostname        string `ooni:"Use this server rather than discovering one"`
+	MaxBytes        int64  `ooni:"Stop each phase after transferring this many bytes: zero means no limit"`
+	MeasureInterval int64  `ooni:"Interval between client measurements in milliseconds: zero means default"`
+	Mode            string `ooni:"Phases to run: both (the default), download, or upload"`
+	NumStreams      int64  `ooni:"Number of parallel download streams: zero means one"`
+	ReadBufferSize  int64  `ooni:"Size of the download read buffer in bytes, at most 16 MiB: zero means default"`
+	ReadTimeout     int64  `ooni:"Duration of each phase in seconds, after which reads fail: zero means default"`
+
+	// OnProgress is an optional callback receiving live throughput
+	// samples during the download and the upload. We call it from
+	// a background goroutine and drop samples if it is slow. We stop
+	// calling it as soon as the context is done.
+	OnProgress func(ProgressSample) `ooni:"-"`
+
+	// ASNLookupper is an optional lookupper used to map the server
+	// IP address to its ASN. When it is nil, the ASN is empty.
+	ASNLookupper model.ASNLookupper `ooni:"-"`
+}
+
+func (c Config) discoverRetries() int64 {
+	if c.DiscoverRetries < 0 {
+		return 0
+	}
+	if c.DiscoverRetries == 0 {
+		return paramDiscoverRetries
+	}
+	return c.DiscoverRetries
+}
+
+// errInvalidNumStreams indicates that Config.NumStreams is not valid
+var errInvalidNumStreams = errors.New("ndt7: invalid number of streams")
+
+func (c Config) numStreams() (int64, error) {
+	if c.NumStreams < 0 || c.NumStreams > paramMaxNumStreams {
+		return 0, errInvalidNumStreams
+	}
+	if c.NumStreams == 0 {
+		return 1, nil
+	}
+	return c.NumStreams, nil
+}
+
+// errInvalidMaxBytes indicates that Config.MaxBytes is not valid
+var errInvalidMaxBytes = errors.New("ndt7: invalid maximum number of bytes")
+
+// maxBytes returns the number of bytes after which each phase stops,
+// which is zero if there is no limit. With multiple download streams,
+// this is the number of bytes read by all of them. Since we check the
+// limit after each message, a phase may transfer slightly more bytes.
+func (c Config) maxBytes() (int64, error) {
+	if c.MaxBytes < 0 {
+		return 0, errInvalidMaxBytes
+	}
+	return c.MaxBytes, nil
+}
+
+// errInvalidMeasureInterval indicates that Config.MeasureInterval is not valid
+var errInvalidMeasureInterval = errors.New("ndt7: invalid measure interval")
+
+// errInvalidReadTimeout indicates that Config.ReadTimeout is not valid
+var errInvalidReadTimeout = errors.New("ndt7: invalid read timeout")
+
+// timeouts returns the interval between the client measurements, which
+// is also the interval at which we check whether to send pings, and the
+// read timeout, i.e., the duration of each phase after which reads and
+// writes fail. A shorter interval gives us more samples at the cost of
+// more overhead, hence we refuse intervals shorter than a minimum. The
+// defaults are the values recommended by the ndt7 specification. The
+// config uses milliseconds and seconds, which are easier to type, hence
+// we also refuse values that would overflow a time.Duration.
+func (c Config) timeouts() (measureInterval, readTimeout time.Duration, err error) {
+	switch {
+	case c.MeasureInterval == 0:
+		measureInterval = paramMeasureInterval
+	case c.MeasureInterval < int64(paramMinMeasureInterval/time.Millisecond) ||
+		c.MeasureInterval > int64(math.MaxInt64/time.Millisecond):
+		return 0, 0, errInvalidMeasureInterval
+	default:
+		measureInterval = time.Duration(c.MeasureInterval) * time.Millisecond
+	}
+	switch {
+	case c.ReadTimeout == 0:
+		readTimeout = paramMaxRuntime
+	case c.ReadTimeout < 0 || c.ReadTimeout > int64(math.MaxInt64/time.Second):
+		return 0, 0, errInvalidReadTimeout
+	default:
+		readTimeout = time.Duration(c.ReadTimeout) * time.Second
+	}
+	return measureInterval, readTimeout, nil
+}
 
-// Summary is the measurement summary
+// errInvalidReadBufferSize indicates that Config.ReadBufferSize is not valid
+var errInvalidReadBufferSize = errors.New("ndt7: invalid read buffer size")
+
+// readBufferSize returns the size of the buffer used to read the download
+// messages. We refuse sizes larger than the maximum message size, since
+// the extra space would never be used, and we would allocate it anyway.
+func (c Config) readBufferSize() (int64, error) {
+	switch {
+	case c.ReadBufferSize == 0:
+		return paramReadBufferSize, nil
+	case c.ReadBufferSize < 0 || c.ReadBufferSize > paramMaxMessageSize:
+		return 0, errInvalidReadBufferSize
+	}
+	return c.ReadBufferSize, nil
+}
+
+// errInvalidMode indicates that Config.Mode is not valid
+var errInvalidMode = errors.New("ndt7: invalid mode")
+
+// errInvalidHostname indicates that Config.Hostname is not valid
+var errInvalidHostname = errors.New("ndt7: invalid hostname")
+
+// validateHostname checks whether hostname looks like a FQDN.
+func validateHostname(hostname string) error {
+	hostname = strings.TrimSuffix(hostname, ".")
+	if len(hostname) <= 0 || len(hostname) > 253 {
+		return errInvalidHostname
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) < 2 {
+		return errInvalidHostname
+	}
+	for _, label := range labels {
+		if len(label) <= 0 || len(label) > 63 {
+			return errInvalidHostname
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errInvalidHostname
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') &&
+				!(c >= '0' && c <= '9') && c != '-' {
+				return errInvalidHostname
+			}
+		}
+	}
+	return nil
+}
+
+func (c Config) phases() (download, upload bool, err error) {
+	switch c.Mode {
+	case "", modeBoth:
+		return true, true, nil
+	case modeDownload:
+		return true, false, nil
+	case modeUpload:
+		return false, true, nil
+	}
+	return false, false, errInvalidMode
+}
+
+// Summary is the measurement summary. With multiple download streams,
+// Download is the speed of all the streams together, while the RTT, MSS
+// and retransmission metrics come from the server measurements, which
+// we only collect for the first stream, hence they describe a single
+// connection rather than all of them.
 type Summary struct {
 	AvgRTT         float64 `json:"avg_rtt"`         // Average RTT [ms]
 	Download       float64 `json:"download"`        // download speed [kbit/s]
@@ -33,19 +202,225 @@ type Summary struct {
 	Upload         float64 `json:"upload"`          // upload speed [kbit/s]
 }
 
+const (
+	serverSourceDiscovered = "discovered"
+	serverSourceUser       = "user"
+)
+
+// ServerInfo contains information on the server we used
+type ServerInfo struct {
+	// ASN is the ASN of IP (e.g. "AS3356"). It is empty when we do
+	// not know the IP, when there is no Config.ASNLookupper, or when
+	// the lookup failed.
+	ASN string `json:"asn,omitempty"`
+
+	// City is the city where the server is located
+	City string `json:"city,omitempty"`
+
+	// Country is the country code of the server location
+	Country string `json:"country,omitempty"`
+
+	// Hostname is the server hostname
+	Hostname string `json:"hostname"`
+
+	// IP is the IP address of the server we connected to. It is empty
+	// when we're using an explicit proxy, since we only know the proxy
+	// address, and when we did not connect to the server.
+	IP string `json:"ip,omitempty"`
+
+	// Machine is the server machine name (e.g. "mlab1")
+	Machine string `json:"machine,omitempty"`
+
+	// MetadataAvailable indicates whether we know the location metadata
+	// (i.e. city, country, metro, machine, and site) of the server. It is
+	// false when the user specified the server, when we're using an
+	// explicit proxy, and when the locate service did not provide them.
+	MetadataAvailable bool `json:"metadata_available"`
+
+	// Metro is the metropolitan area code of the server (e.g. "mil")
+	Metro string `json:"metro,omitempty"`
+
+	// Site is the M-Lab site of the server (e.g. "mil04")
+	Site string `json:"site,omitempty"`
+
+	// Source is "discovered" if we used the locate service to find
+	// the server and "user" if the user specified the server.
+	Source string `json:"source"`
+}
+
+// setMetadata fills the location metadata using the result of the
+// locate service. M-Lab FQDNs look like "ndt-iupui-mlab1-mil04.mea..."
+// so we use the FQDN to obtain the machine name, as well as the site
+// when the locate service did not provide it.
+func (si *ServerInfo) setMetadata(result mlablocate.Result) {
+	if result.City == "" || result.Country == "" {
+		return
+	}
+	site := result.Site
+	var machine string
+	parts := strings.Split(strings.Split(result.FQDN, ".")[0], "-")
+	for idx, part := range parts {
+		if strings.HasPrefix(part, "mlab") && idx+1 < len(parts) {
+			machine = part
+			if site == "" {
+				site = parts[idx+1]
+			}
+			break
+		}
+	}
+	if machine == "" || len(site) < 3 {
+		return
+	}
+	si.City = result.City
+	si.Country = result.Country
+	si.Machine = machine
+	si.MetadataAvailable = true
+	si.Metro = site[:3]
+	si.Site = site
+}
+
+// setAddress sets the server IP using the remote address of the
+// first connection, and its ASN using lookupper, if not nil. A failure
+// in looking up the ASN is not fatal, hence we just log it.
+func (si *ServerInfo) setAddress(
+	addr net.Addr, lookupper model.ASNLookupper, logger model.Logger,
+) {
+	if si.IP != "" {
+		return
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	si.IP = ip
+	if lookupper == nil {
+		return
+	}
+	asn, _, err := lookupper.LookupASN(ip)
+	if err != nil {
+		logger.Debugf("ndt7: cannot lookup server ASN: %s", err.Error())
+		return
+	}
+	si.ASN = fmt.Sprintf("AS%d", asn)
+}
+
+// RTTSample is an application level RTT sample measured using
+// WebSocket ping and pong messages.
+type RTTSample struct {
+	// ElapsedTime is the time since the beginning of the
+	// test phase in microseconds
+	ElapsedTime int64 `json:"elapsed_time"`
+
+	// RTT is the round trip time [ms]
+	RTT float64 `json:"rtt"`
+
+	// Test is either "download" or "upload"
+	Test string `json:"test"`
+}
+
+// UploadBytes contains the number of bytes written by us during the
+// upload and the number of bytes that the server reports to have
+// received, along with the upload speed computed from each of them.
+// When there is packet loss, these values may diverge, and such a
+// divergence helps to diagnose asymmetric throttling.
+type UploadBytes struct {
+	ClientRate    float64 `json:"client_rate"`    // upload speed [kbit/s]
+	ClientWritten int64   `json:"client_written"` // bytes written by us
+	ServerAcked   int64   `json:"server_acked"`   // bytes received by the server
+	ServerRate    float64 `json:"server_rate"`    // upload speed [kbit/s]
+}
+
+// setClient sets the number of bytes written and the client rate.
+func (ub *UploadBytes) setClient(elapsed time.Duration, count int64) {
+	ub.ClientWritten = count
+	ub.ClientRate = computeSpeed(elapsed, count)
+}
+
+// maybeSetServer updates the number of bytes received by the server and
+// the server rate using info, if info is more recent than what we have.
+func (ub *UploadBytes) maybeSetServer(info *spec.AppInfo) {
+	if info == nil || info.NumBytes < ub.ServerAcked {
+		return
+	}
+	ub.ServerAcked = info.NumBytes
+	ub.ServerRate = computeSpeed(
+		time.Duration(info.ElapsedTime)*time.Microsecond, info.NumBytes)
+}
+
+// computeSpeed returns the speed in kbit/s or zero if elapsed is zero.
+func computeSpeed(elapsed time.Duration, count int64) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) * 8.0 / elapsed.Seconds() / 1e03 /* bit/s => kbit/s */
+}
+
+// DownloadStream contains the number of bytes read by a download
+// stream and the corresponding download speed.
+type DownloadStream struct {
+	NumBytes int64   `json:"num_bytes"` // bytes read
+	Rate     float64 `json:"rate"`      // download speed [kbit/s]
+}
+
 // TestKeys contains the test keys
 type TestKeys struct {
-	// Download contains download results
+	// Download contains download results. With multiple streams, the
+	// client measurements count the bytes read by all of them, while
+	// the server measurements only refer to the first stream.
 	Download []spec.Measurement `json:"download"`
 
+	// DownloadEndReason indicates why the download ended: "time" when
+	// the time budget expired or the server stopped, "bytes" when we
+	// reached Config.MaxBytes, "error" when a network error interrupted
+	// the transfer, and "canceled" when we were interrupted. It is empty
+	// if we did not download.
+	DownloadEndReason string `json:"download_end_reason,omitempty"`
+
+	// DownloadRTT contains statistics on the download RTT samples. Like
+	// the server measurements in Download, with multiple streams they only
+	// refer to the first stream.
+	DownloadRTT RTTStats `json:"download_rtt"`
+
+	// DownloadStreams contains the results of each download stream. It
+	// is empty unless we used multiple streams, in which case the download
+	// speed in the Summary is the sum of the speed of each stream. The
+	// first entry is the stream whose server measurements we keep.
+	DownloadStreams []DownloadStream `json:"download_streams,omitempty"`
+
+	// DryRun indicates that we only validated the config and discovered
+	// the server, hence the measurement contains no results.
+	DryRun bool `json:"dry_run,omitempty"`
+
 	// Failure is the failure string
 	Failure *string `json:"failure"`
 
+	// SkippedPhases lists the phases that we did not run because the
+	// user asked us to skip them. When a phase is skipped, its results
+	// are empty but that is not a failure.
+	SkippedPhases []string `json:"skipped_phases,omitempty"`
+
+	// Server contains information on the server we used
+	Server ServerInfo `json:"server"`
+
 	// Summary contains the measurement summary
 	Summary Summary `json:"summary"`
 
 	// Upload contains upload results
 	Upload []spec.Measurement `json:"upload"`
+
+	// UploadBytes compares the bytes we have written with the bytes
+	// the server has received. It is nil if we did not upload.
+	UploadBytes *UploadBytes `json:"upload_bytes,omitempty"`
+
+	// UploadEndReason is like DownloadEndReason but for the upload
+	UploadEndReason string `json:"upload_end_reason,omitempty"`
+
+	// UploadRTT contains statistics on the upload RTT samples
+	UploadRTT RTTStats `json:"upload_rtt"`
+
+	// WebSocketRTT contains the WebSocket ping/pong RTT samples. We
+	// may have no samples if the server does not answer to pings.
+	WebSocketRTT []RTTSample `json:"websocket_rtt"`
 }
 
 type measurer struct {
@@ -53,14 +428,91 @@ type measurer struct {
 	jsonUnmarshal   func(data []byte, v interface{}) error
 	preDownloadHook func()
 	preUploadHook   func()
+
+	// The following fields allow Close to interrupt pending runs.
+	cancels map[int64]context.CancelFunc
+	closed  bool
+	mu      sync.Mutex
+	nextID  int64
+	running sync.WaitGroup
+}
+
+// errClosed indicates that the measurer has been closed
+var errClosed = errors.New("ndt7: measurer closed")
+
+// start registers a new run and returns the context it should use,
+// or an error if the measurer has been closed. The caller must call
+// the returned function when the run is over.
+func (m *measurer) start(ctx context.Context) (context.Context, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, nil, errClosed
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if m.cancels == nil {
+		m.cancels = make(map[int64]context.CancelFunc)
+	}
+	id := m.nextID
+	m.nextID++
+	m.cancels[id] = cancel
+	m.running.Add(1)
+	return ctx, func() {
+		m.mu.Lock()
+		delete(m.cancels, id)
+		m.mu.Unlock()
+		cancel()
+		m.running.Done()
+	}, nil
+}
+
+// Close interrupts the pending runs, which return a context canceled
+// error, and waits for them to return. When Close returns, all the
+// WebSocket connections are closed and all the goroutines started by
+// the runs have terminated. After Close, Run fails immediately.
+func (m *measurer) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.mu.Unlock()
+	m.running.Wait()
+	return nil
 }
 
 func (m *measurer) discover(ctx context.Context, sess model.ExperimentSession) (string, error) {
+	result, err := m.discoverWithMetadata(ctx, sess)
+	return result.FQDN, err
+}
+
+func (m *measurer) discoverWithMetadata(
+	ctx context.Context, sess model.ExperimentSession,
+) (mlablocate.Result, error) {
+	if m.config.Hostname != "" {
+		return mlablocate.Result{FQDN: m.config.Hostname}, nil
+	}
 	client := mlablocate.NewClient(sess.DefaultHTTPClient(), sess.Logger(), sess.UserAgent())
 	if sess.ExplicitProxy() {
 		client.NewRequest = mlablocate.NewRequestWithProxy(sess.ProbeIP())
 	}
-	return client.Query(ctx, "ndt7")
+	backoff := paramDiscoverBackoff
+	retries := m.config.discoverRetries()
+	for i := int64(0); ; i++ {
+		result, err := client.QueryWithMetadata(ctx, "ndt7")
+		if err == nil || i >= retries || ctx.Err() != nil {
+			return result, err
+		}
+		sess.Logger().Warnf("ndt7: discover failed: %s (will retry)", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return mlablocate.Result{}, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
 }
 
 func (m *measurer) ExperimentName() string {
@@ -76,86 +528,262 @@ func (m *measurer) doDownload(
 	callbacks model.ExperimentCallbacks, tk *TestKeys,
 	hostname string,
 ) error {
-	conn, err := newDialManager(hostname).dialDownload(ctx)
+	numStreams, err := m.config.numStreams()
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
-	mgr := newDownloadManager(
-		conn,
-		func(timediff time.Duration, count int64) {
-			elapsed := timediff.Seconds()
-			// The percentage of completion of download goes from 0 to
-			// 50% of the whole experiment, hence the `/2.0`.
-			percentage := elapsed / paramMaxRuntimeUpperBound / 2.0
-			speed := float64(count) * 8.0 / elapsed
-			message := fmt.Sprintf("download-speed %s", humanize.SI(float64(speed), "bit/s"))
-			tk.Summary.Download = speed / 1e03 /* bit/s => kbit/s */
-			callbacks.OnProgress(percentage, message)
-			tk.Download = append(tk.Download, spec.Measurement{
-				AppInfo: &spec.AppInfo{
-					ElapsedTime: int64(timediff / time.Microsecond),
-					NumBytes:    count,
-				},
-				Origin: "client",
-				Test:   "download",
-			})
-		},
-		func(data []byte) error {
-			sess.Logger().Debugf("%s", string(data))
-			var measurement spec.Measurement
-			if err := m.jsonUnmarshal(data, &measurement); err != nil {
-				return err
+	maxBytes, err := m.config.maxBytes()
+	if err != nil {
+		return err
+	}
+	measureInterval, readTimeout, err := m.config.timeouts()
+	if err != nil {
+		return err
+	}
+	readBufferSize, err := m.config.readBufferSize()
+	if err != nil {
+		return err
+	}
+	var conns []*websocket.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for len(conns) < int(numStreams) {
+		conn, err := newDialManager(hostname).dialDownload(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+	}
+	m.setServerAddress(sess, tk, conns[0])
+	// The byte budget is shared by all the streams, hence exhausting it
+	// stops all of them, like canceling the context does.
+	runctx, budget := newByteBudget(ctx, maxBytes)
+	defer budget.stop()
+	// Closing the connections when the context is done unblocks all the
+	// streams, including the ones waiting for the next message.
+	runctx, cancel := context.WithCancel(runctx)
+	defer cancel()
+	go func() {
+		<-runctx.Done()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	progress := newProgressEmitter(runctx, "download", m.config.OnProgress)
+	defer progress.stop()
+	// The streams run in background goroutines, hence we need to
+	// serialize access to tk, to the per-stream counters, and to runErr,
+	// where we prefer unexpected errors over the expected ones.
+	var (
+		mu      sync.Mutex
+		counts  = make([]int64, numStreams)
+		elapsed = make([]time.Duration, numStreams)
+		runErr  error
+		wg      sync.WaitGroup
+	)
+	for idx, conn := range conns {
+		mgr := newDownloadManager(
+			conn,
+			m.newDownloadPerformanceCallback(
+				&mu, idx, counts, elapsed, readTimeout, callbacks, progress, tk),
+			m.newDownloadJSONCallback(&mu, idx, sess, tk),
+		)
+		mgr.budget = budget
+		mgr.maxRuntime = readTimeout
+		mgr.measureInterval = measureInterval
+		mgr.readBufferSize = readBufferSize
+		mgr.onDone = func(idx int) callbackPerformance {
+			return func(timediff time.Duration, count int64) {
+				mu.Lock()
+				defer mu.Unlock()
+				counts[idx], elapsed[idx] = count, timediff
 			}
-			if measurement.TCPInfo != nil {
-				rtt := float64(measurement.TCPInfo.RTT) / 1e03 /* us => ms */
-				tk.Summary.AvgRTT = rtt
-				tk.Summary.MSS = int64(measurement.TCPInfo.AdvMSS)
-				if tk.Summary.MaxRTT < rtt {
-					tk.Summary.MaxRTT = rtt
-				}
-				tk.Summary.MinRTT = float64(measurement.TCPInfo.MinRTT) / 1e03 /* us => ms */
-				tk.Summary.Ping = tk.Summary.MinRTT
-				if measurement.TCPInfo.BytesSent > 0 {
-					tk.Summary.RetransmitRate = (float64(measurement.TCPInfo.BytesRetrans) /
-						float64(measurement.TCPInfo.BytesSent))
+		}(idx)
+		if idx == 0 {
+			mgr.onRTT = func(elapsed, rtt time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				tk.WebSocketRTT = append(tk.WebSocketRTT, newRTTSample(elapsed, rtt, "download"))
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Exhausting the budget closes the connections of the
+			// other streams, so their errors are expected.
+			if err := mgr.run(runctx); err != nil && !budget.exhausted() {
+				sess.Logger().Warnf("download: %s", err)
+				mu.Lock()
+				defer mu.Unlock()
+				if runErr == nil || isExpectedEnd(runErr) {
+					runErr = err
 				}
-				measurement.BBRInfo = nil        // don't encourage people to use it
-				measurement.ConnectionInfo = nil // do we need to save it?
-				measurement.Origin = "server"
-				measurement.Test = "download"
-				tk.Download = append(tk.Download, measurement)
 			}
-			return nil
-		},
-	)
-	if err := mgr.run(ctx); err != nil {
-		sess.Logger().Warnf("download: %s", err)
+		}()
+	}
+	wg.Wait()
+	// It's safe to access tk and the counters since the streams have stopped.
+	tk.DownloadEndReason = newEndReason(ctx, budget, runErr)
+	tk.DownloadRTT = newRTTStats(tk.Download)
+	if numStreams > 1 {
+		tk.Summary.Download = 0
+		for idx := range conns {
+			stream := DownloadStream{
+				NumBytes: counts[idx],
+				Rate:     computeSpeed(elapsed[idx], counts[idx]),
+			}
+			tk.Summary.Download += stream.Rate
+			tk.DownloadStreams = append(tk.DownloadStreams, stream)
+		}
 	}
 	return nil // failure is only when we cannot connect
 }
 
+// phaseProgress returns the fraction of a phase lasting at most
+// maxRuntime that has elapsed. Since the phase may run slightly longer
+// than maxRuntime, e.g., because we're waiting for the server to close
+// the connection, we make sure the fraction is never larger than one.
+func phaseProgress(elapsed, maxRuntime time.Duration) float64 {
+	if elapsed >= maxRuntime {
+		return 1
+	}
+	return elapsed.Seconds() / maxRuntime.Seconds()
+}
+
+// newDownloadPerformanceCallback returns the callback receiving the
+// number of bytes read by the idx-th download stream. We only report
+// the progress from the first stream, using the bytes read by all the
+// streams, so that a single stream behaves like it always did. The
+// maxRuntime is the maximum duration of the download, which we use
+// to compute the percentage of completion.
+func (m *measurer) newDownloadPerformanceCallback(
+	mu *sync.Mutex, idx int, counts []int64, elapsed []time.Duration,
+	maxRuntime time.Duration, callbacks model.ExperimentCallbacks,
+	progress *progressEmitter,
+	tk *TestKeys,
+) callbackPerformance {
+	return func(timediff time.Duration, count int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[idx], elapsed[idx] = count, timediff
+		if idx != 0 {
+			return
+		}
+		count = 0
+		for _, c := range counts {
+			count += c
+		}
+		elapsed := timediff.Seconds()
+		// The percentage of completion of download goes from 0 to
+		// 50% of the whole experiment, hence the `/2.0`.
+		percentage := phaseProgress(timediff, maxRuntime) / 2.0
+		speed := float64(count) * 8.0 / elapsed
+		message := fmt.Sprintf("download-speed %s", humanize.SI(float64(speed), "bit/s"))
+		tk.Summary.Download = speed / 1e03 /* bit/s => kbit/s */
+		callbacks.OnProgress(percentage, message)
+		progress.emit(timediff, count)
+		tk.Download = append(tk.Download, spec.Measurement{
+			AppInfo: &spec.AppInfo{
+				ElapsedTime: int64(timediff / time.Microsecond),
+				NumBytes:    count,
+			},
+			Origin: "client",
+			Test:   "download",
+		})
+	}
+}
+
+// newDownloadJSONCallback returns the callback receiving the server
+// measurements of the idx-th download stream. We ignore the ones of
+// all streams but the first, since the summary refers to it.
+func (m *measurer) newDownloadJSONCallback(
+	mu *sync.Mutex, idx int, sess model.ExperimentSession, tk *TestKeys,
+) callbackJSON {
+	return func(data []byte) error {
+		if idx != 0 {
+			return nil
+		}
+		measurement := m.parseServerMeasurement(sess, "download", data)
+		if measurement == nil {
+			return nil // don't abort the whole test for a single sample
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if measurement.TCPInfo != nil {
+			rtt := float64(measurement.TCPInfo.RTT) / 1e03 /* us => ms */
+			tk.Summary.AvgRTT = rtt
+			tk.Summary.MSS = int64(measurement.TCPInfo.AdvMSS)
+			if tk.Summary.MaxRTT < rtt {
+				tk.Summary.MaxRTT = rtt
+			}
+			tk.Summary.MinRTT = float64(measurement.TCPInfo.MinRTT) / 1e03 /* us => ms */
+			tk.Summary.Ping = tk.Summary.MinRTT
+			if measurement.TCPInfo.BytesSent > 0 {
+				tk.Summary.RetransmitRate = (float64(measurement.TCPInfo.BytesRetrans) /
+					float64(measurement.TCPInfo.BytesSent))
+			}
+		}
+		measurement.Test = "download"
+		tk.Download = append(tk.Download, *measurement)
+		return nil
+	}
+}
+
+// setServerAddress sets the server IP and ASN using conn. We must call
+// it before starting the background goroutines that may access tk.
+func (m *measurer) setServerAddress(
+	sess model.ExperimentSession, tk *TestKeys, conn *websocket.Conn,
+) {
+	if sess.ExplicitProxy() {
+		return
+	}
+	tk.Server.setAddress(conn.RemoteAddr(), m.config.ASNLookupper, sess.Logger())
+}
+
 func (m *measurer) doUpload(
 	ctx context.Context, sess model.ExperimentSession,
 	callbacks model.ExperimentCallbacks, tk *TestKeys,
 	hostname string,
 ) error {
+	maxBytes, err := m.config.maxBytes()
+	if err != nil {
+		return err
+	}
+	measureInterval, readTimeout, err := m.config.timeouts()
+	if err != nil {
+		return err
+	}
 	conn, err := newDialManager(hostname).dialUpload(ctx)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
+	m.setServerAddress(sess, tk, conn)
+	runctx, budget := newByteBudget(ctx, maxBytes)
+	defer budget.stop()
+	progress := newProgressEmitter(runctx, "upload", m.config.OnProgress)
+	defer progress.stop()
+	// The server measurements are read by a background goroutine while
+	// we're uploading, hence we need to serialize access to tk.
+	var mu sync.Mutex
+	tk.UploadBytes = new(UploadBytes)
 	mgr := newUploadManager(
 		conn,
 		func(timediff time.Duration, count int64) {
+			mu.Lock()
+			defer mu.Unlock()
 			elapsed := timediff.Seconds()
 			// The percentage of completion of upload goes from 50% to 100% of
 			// the whole experiment, hence `0.5 +` and `/2.0`.
-			percentage := 0.5 + elapsed/paramMaxRuntimeUpperBound/2.0
+			percentage := 0.5 + phaseProgress(timediff, readTimeout)/2.0
 			speed := float64(count) * 8.0 / elapsed
 			message := fmt.Sprintf("upload-speed %s", humanize.SI(float64(speed), "bit/s"))
 			tk.Summary.Upload = speed / 1e03 /* bit/s => kbit/s */
 			callbacks.OnProgress(percentage, message)
+			progress.emit(timediff, count)
 			tk.Upload = append(tk.Upload, spec.Measurement{
 				AppInfo: &spec.AppInfo{
 					ElapsedTime: int64(timediff / time.Microsecond),
@@ -165,40 +793,153 @@ func (m *measurer) doUpload(
 				Test:   "upload",
 			})
 		},
+		func(data []byte) error {
+			measurement := m.parseServerMeasurement(sess, "upload", data)
+			if measurement == nil {
+				return nil // don't abort the whole test for a single sample
+			}
+			measurement.Test = "upload"
+			mu.Lock()
+			defer mu.Unlock()
+			tk.UploadBytes.maybeSetServer(measurement.AppInfo)
+			tk.Upload = append(tk.Upload, *measurement)
+			return nil
+		},
 	)
-	if err := mgr.run(ctx); err != nil {
+	mgr.onDone = func(elapsed time.Duration, count int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		tk.UploadBytes.setClient(elapsed, count)
+	}
+	mgr.onRTT = func(elapsed, rtt time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		tk.WebSocketRTT = append(tk.WebSocketRTT, newRTTSample(elapsed, rtt, "upload"))
+	}
+	mgr.budget = budget
+	mgr.maxRuntime = readTimeout
+	mgr.measureInterval = measureInterval
+	err = mgr.run(runctx)
+	if err != nil {
 		sess.Logger().Warnf("upload: %s", err)
 	}
+	// It's safe to access tk.Upload since the reader has stopped.
+	tk.UploadEndReason = newEndReason(ctx, budget, err)
+	tk.UploadRTT = newRTTStats(tk.Upload)
 	return nil // failure is only when we cannot connect
 }
 
+func newRTTSample(elapsed, rtt time.Duration, test string) RTTSample {
+	return RTTSample{
+		ElapsedTime: int64(elapsed / time.Microsecond),
+		RTT:         float64(rtt) / float64(time.Millisecond),
+		Test:        test,
+	}
+}
+
+// parseServerMeasurement parses a measurement sent by the server. We
+// return nil if we cannot parse it, because a single broken sample does
+// not invalidate the other samples we've collected.
+func (m *measurer) parseServerMeasurement(
+	sess model.ExperimentSession, test string, data []byte,
+) *spec.Measurement {
+	sess.Logger().Debugf("%s", string(data))
+	var measurement spec.Measurement
+	if err := m.jsonUnmarshal(data, &measurement); err != nil {
+		sess.Logger().Warnf("%s: cannot parse measurement: %s", test, err)
+		return nil
+	}
+	measurement.ConnectionInfo = nil // do we need to save it?
+	measurement.Origin = "server"
+	return &measurement
+}
+
 func (m *measurer) Run(
 	ctx context.Context, sess model.ExperimentSession,
 	measurement *model.Measurement, callbacks model.ExperimentCallbacks,
 ) error {
 	tk := new(TestKeys)
 	measurement.TestKeys = tk
-	hostname, err := m.discover(ctx, sess)
+	ctx, stop, err := m.start(ctx)
+	if err != nil {
+		tk.Failure = failureFromError(err)
+		return err
+	}
+	// Tearing down the run context when we return makes sure that
+	// no connection or goroutine outlives this run.
+	defer stop()
+	download, upload, err := m.config.phases()
 	if err != nil {
 		tk.Failure = failureFromError(err)
 		return err
 	}
-	callbacks.OnProgress(0, fmt.Sprintf("downloading: %s", hostname))
-	if m.preDownloadHook != nil {
-		m.preDownloadHook()
+	if _, err := m.config.numStreams(); err != nil {
+		tk.Failure = failureFromError(err)
+		return err
+	}
+	if _, err := m.config.maxBytes(); err != nil {
+		tk.Failure = failureFromError(err)
+		return err
+	}
+	if _, _, err := m.config.timeouts(); err != nil {
+		tk.Failure = failureFromError(err)
+		return err
 	}
-	if err := m.doDownload(ctx, sess, callbacks, tk, hostname); err != nil {
+	if _, err := m.config.readBufferSize(); err != nil {
 		tk.Failure = failureFromError(err)
 		return err
 	}
-	callbacks.OnProgress(0.5, fmt.Sprintf("uploading: %s", hostname))
-	if m.preUploadHook != nil {
-		m.preUploadHook()
+	tk.Server.Source = serverSourceDiscovered
+	if m.config.Hostname != "" {
+		tk.Server.Source = serverSourceUser
+		if err := validateHostname(m.config.Hostname); err != nil {
+			tk.Failure = failureFromError(err)
+			return err
+		}
 	}
-	if err := m.doUpload(ctx, sess, callbacks, tk, hostname); err != nil {
+	result, err := m.discoverWithMetadata(ctx, sess)
+	if err != nil {
 		tk.Failure = failureFromError(err)
 		return err
 	}
+	hostname := result.FQDN
+	tk.Server.Hostname = hostname
+	// With an explicit proxy, the locate service picks a server that is
+	// close to our IP but we reach it through the proxy, so the metadata
+	// would be misleading. Likewise, there's no metadata when the user
+	// has pinned the server.
+	if m.config.Hostname == "" && !sess.ExplicitProxy() {
+		tk.Server.setMetadata(result)
+	}
+	if m.config.DryRun {
+		tk.DryRun = true
+		callbacks.OnProgress(1, fmt.Sprintf("dry run: would use %s", hostname))
+		return nil
+	}
+	if download {
+		callbacks.OnProgress(0, fmt.Sprintf("downloading: %s", hostname))
+		if m.preDownloadHook != nil {
+			m.preDownloadHook()
+		}
+		if err := m.doDownload(ctx, sess, callbacks, tk, hostname); err != nil {
+			tk.Failure = failureFromError(err)
+			return err
+		}
+	} else {
+		tk.SkippedPhases = append(tk.SkippedPhases, modeDownload)
+	}
+	if upload {
+		callbacks.OnProgress(0.5, fmt.Sprintf("uploading: %s", hostname))
+		if m.preUploadHook != nil {
+			m.preUploadHook()
+		}
+		if err := m.doUpload(ctx, sess, callbacks, tk, hostname); err != nil {
+			tk.Failure = failureFromError(err)
+			return err
+		}
+	} else {
+		tk.SkippedPhases = append(tk.SkippedPhases, modeUpload)
+	}
 	callbacks.OnProgress(1, "done")
 	return nil
 }
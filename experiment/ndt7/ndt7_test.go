@@ -3,12 +3,23 @@ package ndt7
 import (
 	"context"
 	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/ndt7-client-go/spec"
 	"github.com/ooni/probe-engine/experiment/handler"
+	"github.com/ooni/probe-engine/internal/mlablocate"
 	"github.com/ooni/probe-engine/internal/mockable"
 	"github.com/ooni/probe-engine/model"
 )
@@ -18,7 +29,7 @@ func TestUnitNewExperimentMeasurer(t *testing.T) {
 	if measurer.ExperimentName() != "ndt" {
 		t.Fatal("unexpected name")
 	}
-	if measurer.ExperimentVersion() != "0.4.0" {
+	if measurer.ExperimentVersion() != "0.5.0" {
 		t.Fatal("unexpected version")
 	}
 }
@@ -77,6 +88,73 @@ func (txp *verifyRequestTransport) RoundTrip(req *http.Request) (*http.Response,
 	return nil, txp.ExpectedError
 }
 
+type flakyLocateTransport struct {
+	Count    int
+	Failures int
+}
+
+func (txp *flakyLocateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	txp.Count++
+	if txp.Count <= txp.Failures {
+		return nil, errors.New("mocked error")
+	}
+	return &http.Response{
+		StatusCode: 200,
+		Body: ioutil.NopCloser(strings.NewReader(
+			`{"fqdn":"ndt-mlab1-mil04.measurement-lab.org"}`)),
+	}, nil
+}
+
+func newFlakyLocateSession(txp *flakyLocateTransport) *mockable.ExperimentSession {
+	return &mockable.ExperimentSession{
+		MockableHTTPClient: &http.Client{Transport: txp},
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+}
+
+func TestUnitDiscoverRetrySuccess(t *testing.T) {
+	m := new(measurer)
+	txp := &flakyLocateTransport{Failures: 2}
+	fqdn, err := m.discover(context.Background(), newFlakyLocateSession(txp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fqdn != "ndt-mlab1-mil04.measurement-lab.org" {
+		t.Fatal("not the fqdn we expected")
+	}
+	if txp.Count != 3 {
+		t.Fatal("unexpected number of attempts")
+	}
+}
+
+func TestUnitDiscoverRetryExhausted(t *testing.T) {
+	m := &measurer{config: Config{DiscoverRetries: 1}}
+	txp := &flakyLocateTransport{Failures: 2}
+	fqdn, err := m.discover(context.Background(), newFlakyLocateSession(txp))
+	if err == nil || !strings.HasSuffix(err.Error(), "mocked error") {
+		t.Fatal("not the error we expected")
+	}
+	if fqdn != "" {
+		t.Fatal("not the fqdn we expected")
+	}
+	if txp.Count != 2 {
+		t.Fatal("unexpected number of attempts")
+	}
+}
+
+func TestUnitDiscoverNoRetries(t *testing.T) {
+	m := &measurer{config: Config{DiscoverRetries: -1}}
+	txp := &flakyLocateTransport{Failures: 1}
+	_, err := m.discover(context.Background(), newFlakyLocateSession(txp))
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if txp.Count != 1 {
+		t.Fatal("unexpected number of attempts")
+	}
+}
+
 func TestUnitDoDownloadWithCancelledContext(t *testing.T) {
 	m := new(measurer)
 	sess := &mockable.ExperimentSession{
@@ -122,6 +200,504 @@ func TestUnitRunWithCancelledContext(t *testing.T) {
 	}
 }
 
+func TestUnitConfigPhases(t *testing.T) {
+	var table = []struct {
+		mode     string
+		download bool
+		upload   bool
+		err      error
+	}{
+		{"", true, true, nil},
+		{"both", true, true, nil},
+		{"download", true, false, nil},
+		{"upload", false, true, nil},
+		{"antani", false, false, errInvalidMode},
+	}
+	for _, entry := range table {
+		download, upload, err := Config{Mode: entry.mode}.phases()
+		if download != entry.download || upload != entry.upload {
+			t.Fatalf("unexpected phases for mode %s", entry.mode)
+		}
+		if !errors.Is(err, entry.err) {
+			t.Fatalf("unexpected error for mode %s", entry.mode)
+		}
+	}
+}
+
+func TestUnitRunWithInvalidMode(t *testing.T) {
+	m := &measurer{config: Config{Mode: "antani"}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidMode) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errInvalidMode.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitConfigNumStreams(t *testing.T) {
+	var table = []struct {
+		numStreams int64
+		expected   int64
+		err        error
+	}{
+		{0, 1, nil},
+		{1, 1, nil},
+		{paramMaxNumStreams, paramMaxNumStreams, nil},
+		{-1, 0, errInvalidNumStreams},
+		{paramMaxNumStreams + 1, 0, errInvalidNumStreams},
+	}
+	for _, entry := range table {
+		numStreams, err := Config{NumStreams: entry.numStreams}.numStreams()
+		if numStreams != entry.expected || !errors.Is(err, entry.err) {
+			t.Fatalf("unexpected result for %d", entry.numStreams)
+		}
+	}
+}
+
+func TestUnitConfigMaxBytes(t *testing.T) {
+	var table = []struct {
+		maxBytes int64
+		expected int64
+		err      error
+	}{
+		{0, 0, nil},
+		{1 << 20, 1 << 20, nil},
+		{-1, 0, errInvalidMaxBytes},
+	}
+	for _, entry := range table {
+		maxBytes, err := Config{MaxBytes: entry.maxBytes}.maxBytes()
+		if maxBytes != entry.expected || !errors.Is(err, entry.err) {
+			t.Fatalf("unexpected result for %d", entry.maxBytes)
+		}
+	}
+}
+
+func TestUnitRunWithInvalidMaxBytes(t *testing.T) {
+	m := &measurer{config: Config{MaxBytes: -1}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidMaxBytes) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errInvalidMaxBytes.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitDoDownloadWithCancelledContextAndMaxBytes(t *testing.T) {
+	m := &measurer{config: Config{MaxBytes: 1 << 20, NumStreams: 2}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // immediately cancel
+	tk := new(TestKeys)
+	err := m.doDownload(ctx, sess, handler.NewPrinterCallbacks(log.Log), tk, "host.name")
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	if tk.DownloadEndReason != "" {
+		t.Fatal("unexpected end reason")
+	}
+}
+
+func TestUnitDoUploadWithCancelledContextAndMaxBytes(t *testing.T) {
+	m := &measurer{config: Config{MaxBytes: 1 << 20}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // immediately cancel
+	tk := new(TestKeys)
+	err := m.doUpload(ctx, sess, handler.NewPrinterCallbacks(log.Log), tk, "host.name")
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	if tk.UploadEndReason != "" {
+		t.Fatal("unexpected end reason")
+	}
+}
+
+func TestUnitConfigTimeouts(t *testing.T) {
+	var table = []struct {
+		measureInterval time.Duration
+		readTimeout     time.Duration
+		expectInterval  time.Duration
+		expectTimeout   time.Duration
+		err             error
+	}{
+		{0, 0, paramMeasureInterval, paramMaxRuntime, nil},
+		{time.Second, 5 * time.Second, time.Second, 5 * time.Second, nil},
+		{paramMinMeasureInterval, 0, paramMinMeasureInterval, paramMaxRuntime, nil},
+		{time.Millisecond, 0, 0, 0, errInvalidMeasureInterval},
+		{-time.Second, 0, 0, 0, errInvalidMeasureInterval},
+		{0, -time.Second, 0, 0, errInvalidReadTimeout},
+	}
+	for _, entry := range table {
+		interval, timeout, err := Config{
+			MeasureInterval: int64(entry.measureInterval / time.Millisecond),
+			ReadTimeout:     int64(entry.readTimeout / time.Second),
+		}.timeouts()
+		if interval != entry.expectInterval || timeout != entry.expectTimeout ||
+			!errors.Is(err, entry.err) {
+			t.Fatalf("unexpected result for %+v", entry)
+		}
+	}
+	if _, _, err := (Config{MeasureInterval: math.MaxInt64}).timeouts(); !errors.Is(
+		err, errInvalidMeasureInterval) {
+		t.Fatal("expected an overflowing interval to be invalid")
+	}
+	if _, _, err := (Config{ReadTimeout: math.MaxInt64}).timeouts(); !errors.Is(
+		err, errInvalidReadTimeout) {
+		t.Fatal("expected an overflowing timeout to be invalid")
+	}
+}
+
+func TestUnitRunWithInvalidMeasureInterval(t *testing.T) {
+	m := &measurer{config: Config{MeasureInterval: 1}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidMeasureInterval) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errInvalidMeasureInterval.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitShorterMeasureIntervalMoreSamples(t *testing.T) {
+	samples := func(interval time.Duration) int {
+		m := &measurer{config: Config{MeasureInterval: int64(interval / time.Millisecond)}}
+		measureInterval, _, err := m.config.timeouts()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var mu sync.Mutex
+		tk := new(TestKeys)
+		mgr := newDownloadManager(
+			&mockableConnMock{
+				NextReaderMsgType: websocket.BinaryMessage,
+				NextReaderReader: func() io.Reader {
+					return strings.NewReader(strings.Repeat("A", 1<<10))
+				},
+			},
+			m.newDownloadPerformanceCallback(
+				&mu, 0, make([]int64, 1), make([]time.Duration, 1),
+				paramMaxRuntime, handler.NewPrinterCallbacks(log.Log), nil, tk),
+			defaultCallbackJSON,
+		)
+		mgr.measureInterval = measureInterval
+		ctx, cancel := context.WithTimeout(context.Background(), 600*time.Millisecond)
+		defer cancel()
+		if err := mgr.run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return len(tk.Download)
+	}
+	if slow, fast := samples(0), samples(paramMinMeasureInterval); fast <= slow {
+		t.Fatalf("expected more samples with a shorter interval: %d <= %d", fast, slow)
+	}
+}
+
+func TestUnitConfigReadBufferSize(t *testing.T) {
+	var table = []struct {
+		readBufferSize int64
+		expected       int64
+		err            error
+	}{
+		{0, paramReadBufferSize, nil},
+		{1 << 16, 1 << 16, nil},
+		{paramMaxMessageSize, paramMaxMessageSize, nil},
+		{paramMaxMessageSize + 1, 0, errInvalidReadBufferSize},
+		{-1, 0, errInvalidReadBufferSize},
+	}
+	for _, entry := range table {
+		size, err := Config{ReadBufferSize: entry.readBufferSize}.readBufferSize()
+		if size != entry.expected || !errors.Is(err, entry.err) {
+			t.Fatalf("unexpected result for %d", entry.readBufferSize)
+		}
+	}
+}
+
+func TestUnitRunWithInvalidReadBufferSize(t *testing.T) {
+	m := &measurer{config: Config{ReadBufferSize: -1}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidReadBufferSize) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errInvalidReadBufferSize.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitRunWithInvalidNumStreams(t *testing.T) {
+	m := &measurer{config: Config{NumStreams: -1}}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: http.DefaultClient,
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidNumStreams) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errInvalidNumStreams.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitDownloadPerformanceAggregatesStreams(t *testing.T) {
+	m := new(measurer)
+	var mu sync.Mutex
+	counts := make([]int64, 2)
+	elapsed := make([]time.Duration, 2)
+	tk := new(TestKeys)
+	callbacks := handler.NewPrinterCallbacks(log.Log)
+	second := m.newDownloadPerformanceCallback(
+		&mu, 1, counts, elapsed, paramMaxRuntime, callbacks, nil, tk)
+	first := m.newDownloadPerformanceCallback(
+		&mu, 0, counts, elapsed, paramMaxRuntime, callbacks, nil, tk)
+	second(time.Second, 1000)
+	if len(tk.Download) != 0 {
+		t.Fatal("only the first stream should report progress")
+	}
+	first(time.Second, 500)
+	if len(tk.Download) != 1 || tk.Download[0].AppInfo.NumBytes != 1500 {
+		t.Fatal("expected the bytes read by both streams")
+	}
+	if tk.Summary.Download != 12 {
+		t.Fatal("unexpected download speed")
+	}
+}
+
+type progressRecorder struct {
+	percentages []float64
+}
+
+func (pr *progressRecorder) OnDataUsage(dloadKiB, uploadKiB float64) {}
+
+func (pr *progressRecorder) OnProgress(percentage float64, message string) {
+	pr.percentages = append(pr.percentages, percentage)
+}
+
+func TestUnitDownloadProgressUsesReadTimeout(t *testing.T) {
+	m := new(measurer)
+	var mu sync.Mutex
+	recorder := new(progressRecorder)
+	callback := m.newDownloadPerformanceCallback(
+		&mu, 0, make([]int64, 1), make([]time.Duration, 1),
+		40*time.Second, recorder, nil, new(TestKeys))
+	for _, elapsed := range []time.Duration{
+		10 * time.Second, 20 * time.Second, 40 * time.Second, 45 * time.Second,
+	} {
+		callback(elapsed, 1000)
+	}
+	expected := []float64{0.125, 0.25, 0.5, 0.5}
+	if !reflect.DeepEqual(recorder.percentages, expected) {
+		t.Fatalf("unexpected percentages: %+v", recorder.percentages)
+	}
+}
+
+func TestIntegrationDownloadOnly(t *testing.T) {
+	measurer := NewExperimentMeasurer(Config{Mode: "download"}).(*measurer)
+	measurer.preUploadHook = func() {
+		t.Fatal("should not be called")
+	}
+	measurement := new(model.Measurement)
+	err := measurer.Run(
+		context.Background(),
+		&mockable.ExperimentSession{
+			MockableHTTPClient: http.DefaultClient,
+			MockableLogger:     log.Log,
+		},
+		measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if len(tk.SkippedPhases) != 1 || tk.SkippedPhases[0] != "upload" {
+		t.Fatal("unexpected skipped phases")
+	}
+	if len(tk.Upload) != 0 {
+		t.Fatal("unexpected upload results")
+	}
+}
+
+func TestUnitParseServerMeasurement(t *testing.T) {
+	m := NewExperimentMeasurer(Config{}).(*measurer)
+	sess := &mockable.ExperimentSession{MockableLogger: log.Log}
+	if m.parseServerMeasurement(sess, "download", []byte(`{`)) != nil {
+		t.Fatal("expected nil measurement")
+	}
+	measurement := m.parseServerMeasurement(sess, "download", []byte(
+		`{"BBRInfo":{"BW":1},"ConnectionInfo":{"UUID":"x"},"TCPInfo":{"RTT":10}}`,
+	))
+	if measurement == nil {
+		t.Fatal("expected non-nil measurement")
+	}
+	if measurement.BBRInfo == nil || measurement.TCPInfo == nil {
+		t.Fatal("expected BBRInfo and TCPInfo")
+	}
+	if measurement.ConnectionInfo != nil {
+		t.Fatal("expected nil ConnectionInfo")
+	}
+	if measurement.Origin != "server" {
+		t.Fatal("unexpected origin")
+	}
+}
+
+func TestUnitValidateHostname(t *testing.T) {
+	var table = []struct {
+		hostname string
+		valid    bool
+	}{
+		{"ndt-mlab1-mil04.measurement-lab.org", true},
+		{"ndt-mlab1-mil04.measurement-lab.org.", true},
+		{"ndt7.example.com", true},
+		{"", false},
+		{"localhost", false},
+		{"-antani.example.com", false},
+		{"antani..example.com", false},
+		{"antani.example.com:443", false},
+		{"antani_mascetti.example.com", false},
+		{strings.Repeat("a", 64) + ".example.com", false},
+	}
+	for _, entry := range table {
+		err := validateHostname(entry.hostname)
+		if (err == nil) != entry.valid {
+			t.Fatalf("unexpected result for %s", entry.hostname)
+		}
+	}
+}
+
+func TestUnitDiscoverWithExplicitHostname(t *testing.T) {
+	m := &measurer{config: Config{Hostname: "ndt7.example.com"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // would fail if we contacted the locate service
+	fqdn, err := m.discover(ctx, &mockable.ExperimentSession{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fqdn != "ndt7.example.com" {
+		t.Fatal("not the fqdn we expected")
+	}
+}
+
+func TestUnitRunWithInvalidHostname(t *testing.T) {
+	m := &measurer{config: Config{Hostname: "antani"}}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), &mockable.ExperimentSession{}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidHostname) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Server.Source != "user" {
+		t.Fatal("unexpected server source")
+	}
+}
+
+func TestUnitRunWithExplicitHostname(t *testing.T) {
+	m := &measurer{config: Config{Hostname: "ndt7.example.com"}}
+	var called bool
+	m.preDownloadHook = func() {
+		called = true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // make sure we fail when dialing
+	measurement := new(model.Measurement)
+	err := m.Run(
+		ctx, &mockable.ExperimentSession{MockableLogger: log.Log}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	if !called {
+		t.Fatal("did not reach the download phase")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Server.Hostname != "ndt7.example.com" || tk.Server.Source != "user" {
+		t.Fatal("unexpected server info")
+	}
+	if tk.Server.MetadataAvailable {
+		t.Fatal("expected no server metadata")
+	}
+}
+
+func TestUnitRunUploadOnlySkipsDownload(t *testing.T) {
+	m := &measurer{config: Config{Hostname: "ndt7.example.com", Mode: "upload"}}
+	m.preDownloadHook = func() {
+		t.Fatal("should not be called")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // make sure we fail when dialing
+	measurement := new(model.Measurement)
+	err := m.Run(
+		ctx, &mockable.ExperimentSession{MockableLogger: log.Log}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if len(tk.SkippedPhases) != 1 || tk.SkippedPhases[0] != "download" {
+		t.Fatal("unexpected skipped phases")
+	}
+}
+
 func TestIntegration(t *testing.T) {
 	measurer := NewExperimentMeasurer(Config{})
 	err := measurer.Run(
@@ -204,3 +780,319 @@ func TestIntegrationDownloadJSONUnmarshalFail(t *testing.T) {
 		t.Fatal("did not see expected error")
 	}
 }
+
+func TestUnitServerInfoSetMetadata(t *testing.T) {
+	var testcases = []struct {
+		name   string
+		result mlablocate.Result
+		expect ServerInfo
+	}{{
+		name: "with complete metadata",
+		result: mlablocate.Result{
+			City: "Milan", Country: "IT", Site: "mil04",
+			FQDN: "ndt-iupui-mlab1-mil04.measurement-lab.org",
+		},
+		expect: ServerInfo{
+			City: "Milan", Country: "IT", Machine: "mlab1",
+			MetadataAvailable: true, Metro: "mil", Site: "mil04",
+		},
+	}, {
+		name: "with site from the FQDN",
+		result: mlablocate.Result{
+			City: "Milan", Country: "IT",
+			FQDN: "ndt-mlab2-mil03.measurement-lab.org",
+		},
+		expect: ServerInfo{
+			City: "Milan", Country: "IT", Machine: "mlab2",
+			MetadataAvailable: true, Metro: "mil", Site: "mil03",
+		},
+	}, {
+		name: "without city",
+		result: mlablocate.Result{
+			Country: "IT", Site: "mil04",
+			FQDN: "ndt-iupui-mlab1-mil04.measurement-lab.org",
+		},
+	}, {
+		name: "with unexpected FQDN",
+		result: mlablocate.Result{
+			City: "Milan", Country: "IT", Site: "mil04",
+			FQDN: "ndt7.example.com",
+		},
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var si ServerInfo
+			si.setMetadata(tc.result)
+			if si != tc.expect {
+				t.Fatalf("expected %+v, got %+v", tc.expect, si)
+			}
+		})
+	}
+}
+
+type stubASNLookupper struct {
+	asn uint
+	err error
+}
+
+func (l *stubASNLookupper) LookupASN(ip string) (uint, string, error) {
+	return l.asn, "Stub Org", l.err
+}
+
+func TestUnitServerInfoSetAddress(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("130.192.91.211"), Port: 443}
+	var testcases = []struct {
+		name      string
+		initial   ServerInfo
+		lookupper model.ASNLookupper
+		expect    ServerInfo
+	}{{
+		name:      "with successful lookup",
+		lookupper: &stubASNLookupper{asn: 137},
+		expect:    ServerInfo{ASN: "AS137", IP: "130.192.91.211"},
+	}, {
+		name:      "with failing lookup",
+		lookupper: &stubASNLookupper{err: errors.New("mocked error")},
+		expect:    ServerInfo{IP: "130.192.91.211"},
+	}, {
+		name:   "without lookupper",
+		expect: ServerInfo{IP: "130.192.91.211"},
+	}, {
+		name:      "with IP already set",
+		initial:   ServerInfo{IP: "8.8.8.8"},
+		lookupper: &stubASNLookupper{asn: 137},
+		expect:    ServerInfo{IP: "8.8.8.8"},
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			si := tc.initial
+			si.setAddress(addr, tc.lookupper, log.Log)
+			if si != tc.expect {
+				t.Fatalf("expected %+v, got %+v", tc.expect, si)
+			}
+		})
+	}
+}
+
+type metadataLocateTransport struct{}
+
+func (txp *metadataLocateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body: ioutil.NopCloser(strings.NewReader(`{
+			"city": "Milan", "country": "IT", "site": "mil04",
+			"fqdn": "ndt-iupui-mlab1-mil04.measurement-lab.org"
+		}`)),
+	}, nil
+}
+
+func runWithMetadataLocate(t *testing.T, explicitProxy bool) *TestKeys {
+	m := &measurer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.preDownloadHook = cancel // make sure we fail when dialing
+	measurement := new(model.Measurement)
+	err := m.Run(
+		ctx, &mockable.ExperimentSession{
+			MockableExplicitProxy: explicitProxy,
+			MockableHTTPClient: &http.Client{
+				Transport: &metadataLocateTransport{},
+			},
+			MockableLogger:    log.Log,
+			MockableProbeIP:   "1.2.3.4",
+			MockableUserAgent: "miniooni/0.1.0-dev",
+		}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	return measurement.TestKeys.(*TestKeys)
+}
+
+func TestUnitRunRecordsServerMetadata(t *testing.T) {
+	tk := runWithMetadataLocate(t, false)
+	if !tk.Server.MetadataAvailable || tk.Server.City != "Milan" {
+		t.Fatalf("unexpected server info: %+v", tk.Server)
+	}
+	if tk.Server.Source != "discovered" {
+		t.Fatal("unexpected server source")
+	}
+}
+
+func TestUnitRunWithExplicitProxyHasNoServerMetadata(t *testing.T) {
+	tk := runWithMetadataLocate(t, true)
+	if tk.Server.MetadataAvailable || tk.Server.City != "" {
+		t.Fatalf("unexpected server info: %+v", tk.Server)
+	}
+	if tk.Server.Hostname != "ndt-iupui-mlab1-mil04.measurement-lab.org" {
+		t.Fatal("unexpected server hostname")
+	}
+}
+
+func TestUnitRunDryRun(t *testing.T) {
+	m := &measurer{config: Config{DryRun: true}}
+	m.preDownloadHook = func() {
+		t.Fatal("should not be called")
+	}
+	m.preUploadHook = func() {
+		t.Fatal("should not be called")
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), &mockable.ExperimentSession{
+			MockableHTTPClient: &http.Client{
+				Transport: &metadataLocateTransport{},
+			},
+			MockableLogger:    log.Log,
+			MockableUserAgent: "miniooni/0.1.0-dev",
+		}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if !tk.DryRun || tk.Failure != nil {
+		t.Fatal("expected a successful dry run")
+	}
+	if tk.Server.Hostname != "ndt-iupui-mlab1-mil04.measurement-lab.org" {
+		t.Fatal("expected to discover the server")
+	}
+	if tk.Download != nil || tk.Upload != nil || tk.WebSocketRTT != nil {
+		t.Fatal("expected no results")
+	}
+	if tk.Summary != (Summary{}) {
+		t.Fatal("expected no throughput values")
+	}
+}
+
+func TestUnitRunDryRunWithInvalidMode(t *testing.T) {
+	m := &measurer{config: Config{DryRun: true, Mode: "antani"}}
+	measurement := new(model.Measurement)
+	err := m.Run(
+		context.Background(), &mockable.ExperimentSession{}, measurement,
+		handler.NewPrinterCallbacks(log.Log),
+	)
+	if !errors.Is(err, errInvalidMode) {
+		t.Fatal("not the error we expected")
+	}
+	if measurement.TestKeys.(*TestKeys).DryRun {
+		t.Fatal("did not expect to reach the dry run")
+	}
+}
+
+func TestUnitUploadBytes(t *testing.T) {
+	ub := new(UploadBytes)
+	ub.setClient(2*time.Second, 1000)
+	if ub.ClientWritten != 1000 || ub.ClientRate != 4 {
+		t.Fatalf("unexpected client values: %+v", ub)
+	}
+	ub.maybeSetServer(nil)
+	ub.maybeSetServer(&spec.AppInfo{ElapsedTime: 1e06, NumBytes: 500})
+	if ub.ServerAcked != 500 || ub.ServerRate != 4 {
+		t.Fatalf("unexpected server values: %+v", ub)
+	}
+	// We ignore stale samples reporting fewer bytes
+	ub.maybeSetServer(&spec.AppInfo{ElapsedTime: 2e06, NumBytes: 100})
+	if ub.ServerAcked != 500 || ub.ServerRate != 4 {
+		t.Fatalf("unexpected server values: %+v", ub)
+	}
+	ub.maybeSetServer(&spec.AppInfo{NumBytes: 700})
+	if ub.ServerAcked != 700 || ub.ServerRate != 0 {
+		t.Fatalf("unexpected server values: %+v", ub)
+	}
+}
+
+func TestUnitDoUploadWithCancelledContextHasNoUploadBytes(t *testing.T) {
+	m := new(measurer)
+	sess := &mockable.ExperimentSession{MockableLogger: log.Log}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // immediately cancel
+	tk := new(TestKeys)
+	err := m.doUpload(ctx, sess, handler.NewPrinterCallbacks(log.Log), tk, "host.name")
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	if tk.UploadBytes != nil {
+		t.Fatal("expected nil UploadBytes")
+	}
+}
+
+// blockingLocateTransport blocks until the request context is done.
+type blockingLocateTransport struct {
+	Started chan interface{}
+}
+
+func (txp *blockingLocateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	close(txp.Started)
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+// waitForGoroutines waits for the number of goroutines to drop to
+// expected and returns the number of goroutines it has seen last.
+func waitForGoroutines(expected int) (count int) {
+	for i := 0; i < 100; i++ {
+		if count = runtime.NumGoroutine(); count <= expected {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+func TestUnitCloseInterruptsRun(t *testing.T) {
+	before := runtime.NumGoroutine()
+	m := &measurer{config: Config{DiscoverRetries: -1}}
+	txp := &blockingLocateTransport{Started: make(chan interface{})}
+	sess := &mockable.ExperimentSession{
+		MockableHTTPClient: &http.Client{Transport: txp},
+		MockableLogger:     log.Log,
+		MockableUserAgent:  "miniooni/0.1.0-dev",
+	}
+	done := make(chan error)
+	go func() {
+		done <- m.Run(context.Background(), sess, new(model.Measurement),
+			handler.NewPrinterCallbacks(log.Log))
+	}()
+	<-txp.Started
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+	if count := waitForGoroutines(before); count > before {
+		t.Fatalf("goroutines are leaking: %d > %d", count, before)
+	}
+	measurement := new(model.Measurement)
+	err := m.Run(context.Background(), sess, measurement,
+		handler.NewPrinterCallbacks(log.Log))
+	if !errors.Is(err, errClosed) {
+		t.Fatal("not the error we expected")
+	}
+	tk := measurement.TestKeys.(*TestKeys)
+	if tk.Failure == nil || *tk.Failure != errClosed.Error() {
+		t.Fatal("unexpected failure")
+	}
+}
+
+func TestUnitRunWithCancelledContextDoesNotLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	m := &measurer{config: Config{Hostname: "ndt7.example.com"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // make sure we fail when dialing
+	err := m.Run(
+		ctx, &mockable.ExperimentSession{MockableLogger: log.Log},
+		new(model.Measurement), handler.NewPrinterCallbacks(log.Log),
+	)
+	if err == nil || !strings.HasSuffix(err.Error(), "operation was canceled") {
+		t.Fatal("not the error we expected")
+	}
+	if count := waitForGoroutines(before); count > before {
+		t.Fatalf("goroutines are leaking: %d > %d", count, before)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,11 +3,17 @@ package ndt7
 import "time"
 
 const (
+	paramDiscoverBackoff      = 500 * time.Millisecond
+	paramDiscoverRetries      = 2
 	paramFractionForScaling   = 16
 	paramMinMessageSize       = 1 << 10
 	paramMaxScaledMessageSize = 1 << 20
 	paramMaxMessageSize       = 1 << 24
-	paramMaxRuntimeUpperBound = 15.0 // seconds
+	paramMaxNumStreams        = 8
 	paramMaxRuntime           = 10 * time.Second
 	paramMeasureInterval      = 250 * time.Millisecond
+	paramMinMeasureInterval   = 50 * time.Millisecond
+	paramPingInterval         = 1 * time.Second
+	paramPingWriteTimeout     = 1 * time.Second
+	paramReadBufferSize       = 1 << 13
 )
@@ -0,0 +1,56 @@
+package ndt7
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pinger sends WebSocket pings and measures the application level RTT
+// when the corresponding pongs are received. The pong handler runs as
+// part of reading messages, so RTT samples are only collected while
+// someone is reading from the connection. If the server does not reply
+// to pings, we just won't have any sample.
+type pinger struct {
+	conn         mockableConn
+	interval     time.Duration
+	lastPing     time.Time
+	onRTT        callbackRTT
+	start        time.Time
+	writeTimeout time.Duration
+}
+
+func newPinger(conn mockableConn, start time.Time, onRTT callbackRTT) *pinger {
+	p := &pinger{
+		conn:         conn,
+		interval:     paramPingInterval,
+		onRTT:        onRTT,
+		start:        start,
+		writeTimeout: paramPingWriteTimeout,
+	}
+	conn.SetPongHandler(p.onPong)
+	return p
+}
+
+// maybePing sends a ping if enough time has elapsed since the last one. We
+// ignore errors because a failed ping is just a missing sample.
+func (p *pinger) maybePing(now time.Time) {
+	if now.Sub(p.lastPing) < p.interval {
+		return
+	}
+	p.lastPing = now
+	payload := strconv.FormatInt(int64(now.Sub(p.start)), 10)
+	p.conn.WriteControl(
+		websocket.PingMessage, []byte(payload), now.Add(p.writeTimeout))
+}
+
+func (p *pinger) onPong(data string) error {
+	sent, err := strconv.ParseInt(data, 10, 64)
+	if err != nil {
+		return nil // not a pong for one of our pings
+	}
+	elapsed := time.Now().Sub(p.start)
+	p.onRTT(elapsed, elapsed-time.Duration(sent))
+	return nil
+}
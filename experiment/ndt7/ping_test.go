@@ -0,0 +1,58 @@
+package ndt7
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+type pingConnMock struct {
+	mockableConnMock
+	pings       [][]byte
+	pongHandler func(string) error
+}
+
+func (c *pingConnMock) SetPongHandler(h func(string) error) {
+	c.pongHandler = h
+}
+
+func (c *pingConnMock) WriteControl(kind int, data []byte, deadline time.Time) error {
+	c.pings = append(c.pings, data)
+	return nil
+}
+
+func TestUnitPingerMaybePing(t *testing.T) {
+	conn := new(pingConnMock)
+	start := time.Now()
+	p := newPinger(conn, start, func(elapsed, rtt time.Duration) {})
+	p.maybePing(start.Add(time.Second))
+	p.maybePing(start.Add(time.Second + time.Millisecond)) // too early
+	p.maybePing(start.Add(2 * time.Second))
+	if len(conn.pings) != 2 {
+		t.Fatal("unexpected number of pings")
+	}
+	if string(conn.pings[0]) != strconv.FormatInt(int64(time.Second), 10) {
+		t.Fatal("unexpected ping payload")
+	}
+}
+
+func TestUnitPingerOnPong(t *testing.T) {
+	conn := new(pingConnMock)
+	var samples []time.Duration
+	start := time.Now().Add(-2 * time.Second)
+	newPinger(conn, start, func(elapsed, rtt time.Duration) {
+		samples = append(samples, rtt)
+	})
+	if err := conn.pongHandler("antani"); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Fatal("unexpected sample for invalid pong")
+	}
+	if err := conn.pongHandler(strconv.FormatInt(int64(time.Second), 10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0] < time.Second {
+		t.Fatal("unexpected RTT sample")
+	}
+}
@@ -0,0 +1,97 @@
+package ndt7
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ProgressSample is a live throughput sample. See Config.OnProgress.
+type ProgressSample struct {
+	// Direction is either "download" or "upload"
+	Direction string
+
+	// Elapsed is the time elapsed since the beginning of the phase
+	Elapsed time.Duration
+
+	// Speed is the speed since the previous sample [kbit/s]
+	Speed float64
+}
+
+// progressEmitter delivers ProgressSamples to a callback. It calls the
+// callback in a background goroutine, so that a slow callback does not
+// block the measurement loop, and drops samples when the callback is
+// still busy with a previous sample.
+type progressEmitter struct {
+	cancel      context.CancelFunc
+	ch          chan ProgressSample
+	direction   string
+	lastCount   int64
+	lastElapsed time.Duration
+	wg          sync.WaitGroup
+}
+
+// newProgressEmitter creates a new progressEmitter. The callback will
+// not be called anymore once ctx is done. Returns nil if callback is
+// nil, which is fine since the methods of progressEmitter are no-ops
+// when the emitter is nil.
+func newProgressEmitter(
+	ctx context.Context, direction string, callback func(ProgressSample),
+) *progressEmitter {
+	if callback == nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	pe := &progressEmitter{
+		cancel:    cancel,
+		ch:        make(chan ProgressSample, 1),
+		direction: direction,
+	}
+	pe.wg.Add(1)
+	go func() {
+		defer pe.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sample := <-pe.ch:
+				if ctx.Err() != nil {
+					return // the select may choose this case after ctx is done
+				}
+				callback(sample)
+			}
+		}
+	}()
+	return pe
+}
+
+// emit emits a sample computed using the number of bytes transferred
+// since the beginning of the phase. This method is not goroutine safe,
+// so we should only call it from the measurement loop.
+func (pe *progressEmitter) emit(elapsed time.Duration, count int64) {
+	if pe == nil || elapsed <= pe.lastElapsed {
+		return
+	}
+	sample := ProgressSample{
+		Direction: pe.direction,
+		Elapsed:   elapsed,
+		Speed:     computeSpeed(elapsed-pe.lastElapsed, count-pe.lastCount),
+	}
+	pe.lastCount, pe.lastElapsed = count, elapsed
+	select {
+	case pe.ch <- sample:
+	default:
+		// The callback is slow, so we drop this sample
+	}
+}
+
+// stop stops calling the callback and waits for the background
+// goroutine to terminate. After stop returns, the callback will
+// not be called anymore.
+func (pe *progressEmitter) stop() {
+	if pe == nil {
+		return
+	}
+	pe.cancel()
+	pe.wg.Wait()
+}
@@ -0,0 +1,80 @@
+package ndt7
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUnitProgressEmitterNilCallback(t *testing.T) {
+	pe := newProgressEmitter(context.Background(), "download", nil)
+	if pe != nil {
+		t.Fatal("expected a nil emitter")
+	}
+	pe.emit(time.Second, 1000) // should not crash
+	pe.stop()                  // ditto
+}
+
+func TestUnitProgressEmitterSamples(t *testing.T) {
+	samples := make(chan ProgressSample)
+	pe := newProgressEmitter(context.Background(), "upload", func(s ProgressSample) {
+		samples <- s
+	})
+	defer pe.stop()
+	pe.emit(time.Second, 1000)
+	sample := <-samples
+	if sample.Direction != "upload" || sample.Elapsed != time.Second || sample.Speed != 8 {
+		t.Fatalf("unexpected sample: %+v", sample)
+	}
+	pe.emit(2*time.Second, 3000)
+	sample = <-samples
+	if sample.Elapsed != 2*time.Second || sample.Speed != 16 {
+		t.Fatalf("unexpected sample: %+v", sample)
+	}
+}
+
+func TestUnitProgressEmitterSlowCallback(t *testing.T) {
+	unblock := make(chan struct{})
+	var count int
+	pe := newProgressEmitter(context.Background(), "download", func(s ProgressSample) {
+		<-unblock
+		count++
+	})
+	for i := 1; i <= 100; i++ {
+		pe.emit(time.Duration(i)*time.Second, int64(i)*1000) // must not block
+	}
+	close(unblock)
+	pe.stop()
+	if count >= 100 {
+		t.Fatal("expected some samples to be dropped")
+	}
+}
+
+func TestUnitProgressEmitterCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var called bool
+	pe := newProgressEmitter(ctx, "download", func(s ProgressSample) {
+		called = true
+	})
+	pe.emit(time.Second, 1000)
+	pe.stop()
+	if called {
+		t.Fatal("should not have been called")
+	}
+}
+
+func TestUnitProgressEmitterIgnoresStaleSamples(t *testing.T) {
+	samples := make(chan ProgressSample, 4)
+	pe := newProgressEmitter(context.Background(), "download", func(s ProgressSample) {
+		samples <- s
+	})
+	pe.emit(0, 1000)
+	pe.emit(time.Second, 1000)
+	<-samples
+	pe.emit(time.Second, 2000)
+	pe.stop()
+	if len(samples) != 0 {
+		t.Fatal("expected stale samples to be ignored")
+	}
+}
@@ -0,0 +1,85 @@
+package ndt7
+
+import (
+	"math"
+	"sort"
+
+	"github.com/m-lab/ndt7-client-go/spec"
+)
+
+// RTTStats contains statistics on the RTT samples included in the
+// TCPInfo sent by the server during a phase. All the values are in
+// milliseconds and are null when we have not collected any sample,
+// e.g., because we skipped the phase or the phase was too short.
+type RTTStats struct {
+	// Jitter is the mean absolute difference between consecutive
+	// samples, where samples are ordered by elapsed time.
+	Jitter *float64 `json:"jitter"`
+
+	// Max is the maximum RTT sample.
+	Max *float64 `json:"max"`
+
+	// Median is the median of the RTT samples.
+	Median *float64 `json:"median"`
+
+	// Min is the minimum RTT sample.
+	Min *float64 `json:"min"`
+
+	// NumSamples is the number of samples we used.
+	NumSamples int64 `json:"num_samples"`
+}
+
+// rttSample is an RTT sample along with the time when it was taken.
+type rttSample struct {
+	elapsed int64   // since the beginning of the phase [us]
+	rtt     float64 // [ms]
+}
+
+// newRTTStats computes the RTTStats of the measurements sent by the
+// server. We skip the measurements without TCPInfo and with a zero RTT,
+// since the kernel reports zero when it does not know the RTT. Because
+// the server may send measurements out of order, we sort the samples
+// by elapsed time before computing the jitter.
+func newRTTStats(measurements []spec.Measurement) (stats RTTStats) {
+	var samples []rttSample
+	for _, measurement := range measurements {
+		if measurement.Origin != "server" || measurement.TCPInfo == nil {
+			continue
+		}
+		if measurement.TCPInfo.RTT <= 0 || measurement.TCPInfo.ElapsedTime < 0 {
+			continue
+		}
+		samples = append(samples, rttSample{
+			elapsed: measurement.TCPInfo.ElapsedTime,
+			rtt:     float64(measurement.TCPInfo.RTT) / 1e03, /* us => ms */
+		})
+	}
+	if len(samples) <= 0 {
+		return
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].elapsed < samples[j].elapsed
+	})
+	var jitter float64
+	for idx := 1; idx < len(samples); idx++ {
+		jitter += math.Abs(samples[idx].rtt - samples[idx-1].rtt)
+	}
+	if len(samples) > 1 {
+		jitter /= float64(len(samples) - 1)
+	}
+	rtts := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		rtts = append(rtts, sample.rtt)
+	}
+	sort.Float64s(rtts)
+	median := rtts[len(rtts)/2]
+	if len(rtts)%2 == 0 {
+		median = (rtts[len(rtts)/2-1] + median) / 2
+	}
+	stats.Jitter = &jitter
+	stats.Max = &rtts[len(rtts)-1]
+	stats.Median = &median
+	stats.Min = &rtts[0]
+	stats.NumSamples = int64(len(rtts))
+	return
+}
@@ -0,0 +1,77 @@
+package ndt7
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/m-lab/ndt7-client-go/spec"
+)
+
+func newServerMeasurement(elapsed int64, rtt uint32) spec.Measurement {
+	return spec.Measurement{
+		Origin:  "server",
+		TCPInfo: &spec.TCPInfo{ElapsedTime: elapsed, RTT: rtt},
+	}
+}
+
+func TestUnitRTTStatsNoSamples(t *testing.T) {
+	stats := newRTTStats([]spec.Measurement{
+		{Origin: "client", AppInfo: &spec.AppInfo{NumBytes: 1}},
+		{Origin: "server"},
+		newServerMeasurement(1000, 0),
+	})
+	if stats.NumSamples != 0 {
+		t.Fatal("unexpected number of samples")
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"jitter":null,"max":null,"median":null,"min":null,"num_samples":0}`
+	if string(data) != expected {
+		t.Fatalf("unexpected serialization: %s", string(data))
+	}
+}
+
+func TestUnitRTTStatsOutOfOrder(t *testing.T) {
+	stats := newRTTStats([]spec.Measurement{
+		newServerMeasurement(3000, 30000),
+		newServerMeasurement(1000, 10000),
+		{Origin: "server"},
+		newServerMeasurement(4000, 0),
+		newServerMeasurement(2000, 40000),
+		newServerMeasurement(-1, 50000),
+	})
+	if stats.NumSamples != 3 {
+		t.Fatal("unexpected number of samples")
+	}
+	// In order, the samples are 10, 40, and 30 ms.
+	if *stats.Min != 10 || *stats.Max != 40 || *stats.Median != 30 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if *stats.Jitter != 20 {
+		t.Fatalf("unexpected jitter: %f", *stats.Jitter)
+	}
+}
+
+func TestUnitRTTStatsEvenSamples(t *testing.T) {
+	stats := newRTTStats([]spec.Measurement{
+		newServerMeasurement(1000, 10000),
+		newServerMeasurement(2000, 20000),
+		newServerMeasurement(3000, 40000),
+		newServerMeasurement(4000, 30000),
+	})
+	if *stats.Median != 25 {
+		t.Fatalf("unexpected median: %f", *stats.Median)
+	}
+}
+
+func TestUnitRTTStatsSingleSample(t *testing.T) {
+	stats := newRTTStats([]spec.Measurement{newServerMeasurement(1000, 10000)})
+	if *stats.Min != 10 || *stats.Max != 10 || *stats.Median != 10 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if *stats.Jitter != 0 {
+		t.Fatal("expected zero jitter")
+	}
+}
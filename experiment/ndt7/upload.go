@@ -2,6 +2,8 @@ package ndt7
 
 import (
 	"context"
+	"io/ioutil"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,6 +14,7 @@ func newMessage(n int) (*websocket.PreparedMessage, error) {
 }
 
 type uploadManager struct {
+	budget               *byteBudget // optional: stops when exhausted
 	conn                 mockableConn
 	fractionForScaling   int64
 	maxRuntime           time.Duration
@@ -20,11 +23,15 @@ type uploadManager struct {
 	measureInterval      time.Duration
 	minMessageSize       int
 	newMessage           func(int) (*websocket.PreparedMessage, error)
+	onDone               callbackPerformance // optional: reports the bytes written
+	onJSON               callbackJSON
 	onPerformance        callbackPerformance
+	onRTT                callbackRTT // optional: enables pings
 }
 
 func newUploadManager(
 	conn mockableConn, onPerformance callbackPerformance,
+	onJSON callbackJSON,
 ) uploadManager {
 	return uploadManager{
 		conn:                 conn,
@@ -35,6 +42,7 @@ func newUploadManager(
 		measureInterval:      paramMeasureInterval,
 		minMessageSize:       paramMinMessageSize,
 		newMessage:           newMessage,
+		onJSON:               onJSON,
 		onPerformance:        onPerformance,
 	}
 }
@@ -50,8 +58,35 @@ func (mgr uploadManager) run(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := mgr.conn.SetReadDeadline(start.Add(mgr.maxRuntime)); err != nil {
+		return err
+	}
+	mgr.conn.SetReadLimit(int64(mgr.maxMessageSize))
+	readctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		mgr.readMeasurements(readctx)
+	}()
+	defer func() {
+		cancel()
+		mgr.conn.SetReadDeadline(time.Now()) // unblock the reader
+		wg.Wait()
+	}()
+	var ping *pinger
+	if mgr.onRTT != nil {
+		ping = newPinger(mgr.conn, start, mgr.onRTT)
+	}
 	ticker := time.NewTicker(mgr.measureInterval)
 	defer ticker.Stop()
+	if mgr.onDone != nil {
+		// Report the bytes written also when we fail, because the
+		// bytes we managed to write are still useful for diagnosis.
+		defer func() {
+			mgr.onDone(time.Now().Sub(start), total)
+		}()
+	}
 	for ctx.Err() == nil {
 		if err := mgr.conn.WritePreparedMessage(message); err != nil {
 			return err
@@ -60,9 +95,15 @@ func (mgr uploadManager) run(ctx context.Context) error {
 		select {
 		case now := <-ticker.C:
 			mgr.onPerformance(now.Sub(start), total)
+			if ping != nil {
+				ping.maybePing(now)
+			}
 		default:
 			// NOTHING
 		}
+		if mgr.budget.consume(int64(size)) {
+			break
+		}
 		if size >= mgr.maxScaledMessageSize || int64(size) >= (total/mgr.fractionForScaling) {
 			continue
 		}
@@ -73,3 +114,24 @@ func (mgr uploadManager) run(ctx context.Context) error {
 	}
 	return nil
 }
+
+// readMeasurements reads the measurements sent by the server while we
+// are uploading until there is an error or ctx is done.
+func (mgr uploadManager) readMeasurements(ctx context.Context) {
+	for ctx.Err() == nil {
+		kind, reader, err := mgr.conn.NextReader()
+		if err != nil {
+			return
+		}
+		if kind != websocket.TextMessage {
+			continue // NextReader discards unread messages
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return
+		}
+		if err := mgr.onJSON(data); err != nil {
+			return
+		}
+	}
+}
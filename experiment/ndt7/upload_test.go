@@ -3,6 +3,8 @@ package ndt7
 import (
 	"context"
 	"errors"
+	"io"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ func TestUnitUploadSetWriteDeadlineFailure(t *testing.T) {
 			WriteDeadlineErr: expected,
 		},
 		defaultCallbackPerformance,
+		defaultCallbackJSON,
 	)
 	err := mgr.run(context.Background())
 	if !errors.Is(err, expected) {
@@ -28,6 +31,7 @@ func TestUnitUploadNewMessageFailure(t *testing.T) {
 	mgr := newUploadManager(
 		&mockableConnMock{},
 		defaultCallbackPerformance,
+		defaultCallbackJSON,
 	)
 	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
 		return nil, expected
@@ -45,6 +49,7 @@ func TestUnitUploadWritePreparedMessageFailure(t *testing.T) {
 			WritePreparedMessageErr: expected,
 		},
 		defaultCallbackPerformance,
+		defaultCallbackJSON,
 	)
 	err := mgr.run(context.Background())
 	if !errors.Is(err, expected) {
@@ -57,6 +62,7 @@ func TestUnitUploadWritePreparedMessageSubsequentFailure(t *testing.T) {
 	mgr := newUploadManager(
 		&mockableConnMock{},
 		defaultCallbackPerformance,
+		defaultCallbackJSON,
 	)
 	var already bool
 	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
@@ -76,6 +82,7 @@ func TestUnitUploadLoop(t *testing.T) {
 	mgr := newUploadManager(
 		&mockableConnMock{},
 		defaultCallbackPerformance,
+		defaultCallbackJSON,
 	)
 	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
 		return new(websocket.PreparedMessage), nil
@@ -87,3 +94,123 @@ func TestUnitUploadLoop(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestUnitUploadSetReadDeadlineFailure(t *testing.T) {
+	expected := errors.New("mocked error")
+	mgr := newUploadManager(
+		&mockableConnMock{
+			ReadDeadlineErr: expected,
+		},
+		defaultCallbackPerformance,
+		defaultCallbackJSON,
+	)
+	err := mgr.run(context.Background())
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitUploadReadsMeasurements(t *testing.T) {
+	var count int64
+	mgr := newUploadManager(
+		&mockableConnMock{
+			NextReaderMsgType: websocket.TextMessage,
+			NextReaderReader: func() io.Reader {
+				return &goodJSONReader{}
+			},
+		},
+		defaultCallbackPerformance,
+		func(data []byte) error {
+			atomic.AddInt64(&count, 1)
+			return nil
+		},
+	)
+	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
+		return new(websocket.PreparedMessage), nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err := mgr.run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt64(&count) <= 0 {
+		t.Fatal("did not read any measurement")
+	}
+}
+
+func TestUnitUploadOnDone(t *testing.T) {
+	var total, performance int64
+	mgr := newUploadManager(
+		&mockableConnMock{},
+		func(elapsed time.Duration, count int64) {
+			performance = count
+		},
+		defaultCallbackJSON,
+	)
+	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
+		return new(websocket.PreparedMessage), nil
+	}
+	mgr.onDone = func(elapsed time.Duration, count int64) {
+		total = count
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := mgr.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if total <= 0 || total < performance {
+		t.Fatal("unexpected number of bytes written")
+	}
+}
+
+func TestUnitUploadOnDoneWithFailure(t *testing.T) {
+	expected := errors.New("mocked error")
+	var called bool
+	mgr := newUploadManager(
+		&mockableConnMock{
+			WritePreparedMessageErr: expected,
+		},
+		defaultCallbackPerformance,
+		defaultCallbackJSON,
+	)
+	mgr.onDone = func(elapsed time.Duration, count int64) {
+		called = true
+		if count != 0 {
+			t.Fatal("expected no bytes written")
+		}
+	}
+	err := mgr.run(context.Background())
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+	if !called {
+		t.Fatal("onDone not called")
+	}
+}
+
+func TestUnitUploadStopsWhenBudgetExhausted(t *testing.T) {
+	var total int64
+	mgr := newUploadManager(
+		&mockableConnMock{},
+		defaultCallbackPerformance,
+		defaultCallbackJSON,
+	)
+	mgr.newMessage = func(int) (*websocket.PreparedMessage, error) {
+		return new(websocket.PreparedMessage), nil
+	}
+	mgr.onDone = func(elapsed time.Duration, count int64) {
+		total = count
+	}
+	ctx, budget := newByteBudget(context.Background(), 1<<20)
+	defer budget.stop()
+	mgr.budget = budget
+	if err := mgr.run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// We scale the message size up to 1<<20 bytes, hence the
+	// last message may have exceeded the budget by that much.
+	if total < 1<<20 || total >= 1<<21 {
+		t.Fatal("unexpected number of bytes written")
+	}
+}
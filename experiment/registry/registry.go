@@ -0,0 +1,259 @@
+// Package registry maps experiment names to the functions creating the
+// corresponding measurers, so that we can run experiments by name, e.g.,
+// when the experiment to run is specified by a config file.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/iancoleman/strcase"
+	"github.com/ooni/probe-engine/experiment/dash"
+	"github.com/ooni/probe-engine/experiment/example"
+	"github.com/ooni/probe-engine/experiment/fbmessenger"
+	"github.com/ooni/probe-engine/experiment/hhfm"
+	"github.com/ooni/probe-engine/experiment/hirl"
+	"github.com/ooni/probe-engine/experiment/ndt5"
+	"github.com/ooni/probe-engine/experiment/ndt7"
+	"github.com/ooni/probe-engine/experiment/psiphon"
+	"github.com/ooni/probe-engine/experiment/sniblocking"
+	"github.com/ooni/probe-engine/experiment/telegram"
+	"github.com/ooni/probe-engine/experiment/tor"
+	"github.com/ooni/probe-engine/experiment/web_connectivity"
+	"github.com/ooni/probe-engine/experiment/whatsapp"
+	"github.com/ooni/probe-engine/model"
+)
+
+// ErrNoSuchExperiment indicates that there is no experiment with
+// the name passed to NewConfig or NewExperimentMeasurer.
+var ErrNoSuchExperiment = errors.New("registry: no such experiment")
+
+// ErrInvalidConfig indicates that the config passed to NewExperimentMeasurer
+// is not the Config of the experiment we are creating.
+var ErrInvalidConfig = errors.New("registry: invalid config")
+
+// CanonicalName allows code to provide experiment names in a more
+// flexible way, where we have aliases, e.g. "ndt7" for "ndt".
+func CanonicalName(name string) string {
+	switch name = strcase.ToSnake(name); name {
+	case "ndt_7":
+		name = "ndt" // since 2020-03-18, we use ndt7 to implement ndt by default
+	case "ndt_5":
+		name = "ndt5"
+	default:
+	}
+	return name
+}
+
+// Names returns the sorted names of all the registered experiments.
+func Names() []string {
+	var names []string
+	for name := range experimentsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Session is the part of a session that experiments may need
+// to initialize their Config, e.g. psiphon's WorkDir.
+type Session interface {
+	// TempDir returns the session's temporary directory.
+	TempDir() string
+}
+
+// NewConfig returns a pointer to a new Config of the experiment called
+// name, initialized with the default values. When sess is not nil, we
+// also initialize the fields that depend on the session. We return
+// ErrNoSuchExperiment if there is no such experiment.
+func NewConfig(name string, sess Session) (interface{}, error) {
+	reg, found := experimentsByName[CanonicalName(name)]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchExperiment, name)
+	}
+	config := reg.newConfig()
+	if sess != nil && reg.initConfig != nil {
+		reg.initConfig(config, sess)
+	}
+	return config, nil
+}
+
+// NewExperimentMeasurer creates the measurer of the experiment called
+// name. The config may be nil, meaning we should use the default config,
+// or the experiment's Config, passed either by value or by pointer. We
+// return ErrNoSuchExperiment if there is no such experiment and
+// ErrInvalidConfig if config is not the experiment's Config.
+func NewExperimentMeasurer(name string, config interface{}) (model.ExperimentMeasurer, error) {
+	reg, found := experimentsByName[CanonicalName(name)]
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrNoSuchExperiment, name)
+	}
+	c := reg.newConfig()
+	if err := assign(c, config); err != nil {
+		return nil, err
+	}
+	return reg.newMeasurer(c), nil
+}
+
+// assign assigns config to the Config pointed by dest, unless config is
+// nil, in which case we leave dest unchanged.
+func assign(dest interface{}, config interface{}) error {
+	if config == nil {
+		return nil
+	}
+	destValue := reflect.ValueOf(dest).Elem()
+	value := reflect.ValueOf(config)
+	if value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if value.Type() != destValue.Type() {
+		return fmt.Errorf("%w: expected %s, got %T", ErrInvalidConfig, destValue.Type(), config)
+	}
+	destValue.Set(value)
+	return nil
+}
+
+// registration tells us how to create an experiment.
+type registration struct {
+	// newConfig returns a pointer to a new Config with the defaults.
+	newConfig func() interface{}
+
+	// initConfig, if not nil, initializes the fields of the Config
+	// pointed by config that depend on the session.
+	initConfig func(config interface{}, sess Session)
+
+	// newMeasurer creates a measurer given a pointer to its Config.
+	newMeasurer func(config interface{}) model.ExperimentMeasurer
+}
+
+// newExampleRegistration returns the registration of the example
+// experiment with the given name and default config.
+func newExampleRegistration(name string, defaults example.Config) registration {
+	return registration{
+		newConfig: func() interface{} {
+			c := defaults
+			return &c
+		},
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return example.NewExperimentMeasurer(*config.(*example.Config), name)
+		},
+	}
+}
+
+var experimentsByName = map[string]registration{
+	"dash": {
+		newConfig: func() interface{} { return &dash.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return dash.NewExperimentMeasurer(*config.(*dash.Config))
+		},
+	},
+
+	"example": newExampleRegistration("example", example.Config{
+		Message:   "Good day from the example experiment!",
+		SleepTime: int64(5 * time.Second),
+	}),
+
+	"example_with_input": newExampleRegistration("example_with_input", example.Config{
+		Message:   "Good day from the example with input experiment!",
+		SleepTime: int64(5 * time.Second),
+	}),
+
+	"example_with_input_non_interruptible": newExampleRegistration(
+		"example_with_input_non_interruptible", example.Config{
+			Message:   "Good day from the example with input experiment!",
+			SleepTime: int64(5 * time.Second),
+		}),
+
+	"example_with_failure": newExampleRegistration("example_with_failure", example.Config{
+		Message:     "Good day from the example with failure experiment!",
+		ReturnError: true,
+		SleepTime:   int64(5 * time.Second),
+	}),
+
+	"facebook_messenger": {
+		newConfig: func() interface{} { return &fbmessenger.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return fbmessenger.NewExperimentMeasurer(*config.(*fbmessenger.Config))
+		},
+	},
+
+	"http_header_field_manipulation": {
+		newConfig: func() interface{} { return &hhfm.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return hhfm.NewExperimentMeasurer(*config.(*hhfm.Config))
+		},
+	},
+
+	"http_invalid_request_line": {
+		newConfig: func() interface{} { return &hirl.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return hirl.NewExperimentMeasurer(*config.(*hirl.Config))
+		},
+	},
+
+	"ndt5": {
+		newConfig: func() interface{} { return &ndt5.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return ndt5.NewExperimentMeasurer(*config.(*ndt5.Config))
+		},
+	},
+
+	"ndt": {
+		newConfig: func() interface{} { return &ndt7.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return ndt7.NewExperimentMeasurer(*config.(*ndt7.Config))
+		},
+	},
+
+	// Note that psiphon needs Config.WorkDir, which has no sensible
+	// default outside of a session, so we set it using the session.
+	"psiphon": {
+		newConfig: func() interface{} { return &psiphon.Config{} },
+		initConfig: func(config interface{}, sess Session) {
+			config.(*psiphon.Config).WorkDir = sess.TempDir()
+		},
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return psiphon.NewExperimentMeasurer(*config.(*psiphon.Config))
+		},
+	},
+
+	"sni_blocking": {
+		newConfig: func() interface{} {
+			return &sniblocking.Config{ControlSNI: "example.com"}
+		},
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return sniblocking.NewExperimentMeasurer(*config.(*sniblocking.Config))
+		},
+	},
+
+	"telegram": {
+		newConfig: func() interface{} { return &telegram.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return telegram.NewExperimentMeasurer(*config.(*telegram.Config))
+		},
+	},
+
+	"tor": {
+		newConfig: func() interface{} { return &tor.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return tor.NewExperimentMeasurer(*config.(*tor.Config))
+		},
+	},
+
+	"web_connectivity": {
+		newConfig: func() interface{} { return &web_connectivity.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return web_connectivity.NewExperimentMeasurer(*config.(*web_connectivity.Config))
+		},
+	},
+
+	"whatsapp": {
+		newConfig: func() interface{} { return &whatsapp.Config{} },
+		newMeasurer: func(config interface{}) model.ExperimentMeasurer {
+			return whatsapp.NewExperimentMeasurer(*config.(*whatsapp.Config))
+		},
+	},
+}
@@ -0,0 +1,134 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ooni/probe-engine/experiment/example"
+	"github.com/ooni/probe-engine/experiment/ndt7"
+	"github.com/ooni/probe-engine/experiment/psiphon"
+	"github.com/ooni/probe-engine/experiment/sniblocking"
+)
+
+func TestUnitNDT(t *testing.T) {
+	for _, name := range []string{"ndt", "ndt7", "Ndt7"} {
+		measurer, err := NewExperimentMeasurer(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if measurer.ExperimentName() != "ndt" {
+			t.Fatal("unexpected name")
+		}
+		if measurer.ExperimentVersion() != "0.5.0" {
+			t.Fatal("unexpected version")
+		}
+	}
+}
+
+func TestUnitNoSuchExperiment(t *testing.T) {
+	measurer, err := NewExperimentMeasurer("antani", nil)
+	if !errors.Is(err, ErrNoSuchExperiment) {
+		t.Fatal("not the error we expected")
+	}
+	if measurer != nil {
+		t.Fatal("expected nil measurer here")
+	}
+}
+
+func TestUnitConfig(t *testing.T) {
+	for _, config := range []interface{}{
+		ndt7.Config{Mode: "download"}, &ndt7.Config{Mode: "download"},
+	} {
+		if _, err := NewExperimentMeasurer("ndt", config); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnitInvalidConfig(t *testing.T) {
+	for _, config := range []interface{}{
+		example.Config{}, (*ndt7.Config)(nil), 17,
+	} {
+		measurer, err := NewExperimentMeasurer("ndt", config)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%T: not the error we expected", config)
+		}
+		if measurer != nil {
+			t.Fatal("expected nil measurer here")
+		}
+	}
+}
+
+func TestUnitExampleDefaults(t *testing.T) {
+	c := example.Config{Message: "antani"}
+	if err := assign(&c, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.Message != "antani" {
+		t.Fatal("nil config should not change the defaults")
+	}
+	measurer, err := NewExperimentMeasurer("example_with_input", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measurer.ExperimentName() != "example_with_input" {
+		t.Fatal("unexpected name")
+	}
+}
+
+func TestUnitAllExperiments(t *testing.T) {
+	names := Names()
+	if len(names) != len(experimentsByName) {
+		t.Fatal("unexpected number of names")
+	}
+	for _, name := range names {
+		measurer, err := NewExperimentMeasurer(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if measurer == nil {
+			t.Fatal("expected non-nil measurer here")
+		}
+	}
+}
+
+func TestUnitNewConfig(t *testing.T) {
+	config, err := NewConfig("sni_blocking", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := config.(*sniblocking.Config)
+	if !ok || c.ControlSNI != "example.com" {
+		t.Fatal("unexpected default config")
+	}
+	c.ControlSNI = "ooni.io"
+	if other, _ := NewConfig("sni_blocking", nil); other.(*sniblocking.Config).ControlSNI != "example.com" {
+		t.Fatal("NewConfig should return a new config each time")
+	}
+	if _, err := NewConfig("antani", nil); !errors.Is(err, ErrNoSuchExperiment) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+type fakeSession struct{}
+
+func (fakeSession) TempDir() string {
+	return "/tmp/antani"
+}
+
+func TestUnitNewConfigWithSession(t *testing.T) {
+	config, err := NewConfig("psiphon", fakeSession{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.(*psiphon.Config).WorkDir != "/tmp/antani" {
+		t.Fatal("NewConfig did not use the session")
+	}
+	config, err = NewConfig("psiphon", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.(*psiphon.Config).WorkDir != "" {
+		t.Fatal("NewConfig should not set WorkDir without a session")
+	}
+}
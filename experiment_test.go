@@ -10,9 +10,12 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/ooni/probe-engine/experiment/example"
+	"github.com/ooni/probe-engine/experiment/registry"
 	"github.com/ooni/probe-engine/measurementkit"
 	"github.com/ooni/probe-engine/model"
 )
@@ -25,7 +28,10 @@ func TestCreateAll(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		exp := builder.NewExperiment()
+		exp, err := builder.NewExperiment()
+		if err != nil {
+			t.Fatal(err)
+		}
 		var good bool
 		switch name {
 		case "ndt5":
@@ -39,6 +45,46 @@ func TestCreateAll(t *testing.T) {
 	}
 }
 
+func TestUnitExperimentsMatchRegistry(t *testing.T) {
+	names := AllExperiments()
+	sort.Strings(names)
+	if !reflect.DeepEqual(registry.Names(), names) {
+		t.Fatalf("experiments %v do not match the registry", names)
+	}
+	sess := newSessionForTestingNoLookups(t)
+	defer sess.Close()
+	for _, name := range names {
+		builder, err := sess.NewExperimentBuilder(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := registry.NewConfig(name, sess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(config, builder.config) {
+			t.Fatalf("%s: the config does not match the registry", name)
+		}
+	}
+}
+
+func TestUnitNewExperimentInvalidConfig(t *testing.T) {
+	sess := newSessionForTestingNoLookups(t)
+	defer sess.Close()
+	builder, err := sess.NewExperimentBuilder("example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder.config = "antani"
+	exp, err := builder.NewExperiment()
+	if !errors.Is(err, registry.ErrInvalidConfig) {
+		t.Fatal("not the error we expected")
+	}
+	if exp != nil {
+		t.Fatal("expected nil experiment here")
+	}
+}
+
 func TestRunDASH(t *testing.T) {
 	sess := newSessionForTesting(t)
 	defer sess.Close()
@@ -49,7 +95,11 @@ func TestRunDASH(t *testing.T) {
 	if !builder.Interruptible() {
 		t.Fatal("dash not marked as interruptible")
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestRunExample(t *testing.T) {
@@ -59,7 +109,11 @@ func TestRunExample(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestRunNdt7(t *testing.T) {
@@ -72,7 +126,11 @@ func TestRunNdt7(t *testing.T) {
 	if !builder.Interruptible() {
 		t.Fatal("ndt7 not marked as interruptible")
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestRunPsiphon(t *testing.T) {
@@ -82,7 +140,11 @@ func TestRunPsiphon(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestRunSNIBlocking(t *testing.T) {
@@ -92,7 +154,11 @@ func TestRunSNIBlocking(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "kernel.org")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "kernel.org")
 }
 
 func TestRunTelegram(t *testing.T) {
@@ -102,7 +168,11 @@ func TestRunTelegram(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestRunTor(t *testing.T) {
@@ -112,7 +182,11 @@ func TestRunTor(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func TestNeedsInput(t *testing.T) {
@@ -139,7 +213,11 @@ func TestSetCallbacks(t *testing.T) {
 	}
 	register := &registerCallbacksCalled{}
 	builder.SetCallbacks(register)
-	if _, err := builder.NewExperiment().Measure(""); err != nil {
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exp.Measure(""); err != nil {
 		t.Fatal(err)
 	}
 	if register.onDataUsageCalled == false {
@@ -185,7 +263,11 @@ func TestMeasurementFailure(t *testing.T) {
 	if err := builder.SetOptionBool("ReturnError", true); err != nil {
 		t.Fatal(err)
 	}
-	measurement, err := builder.NewExperiment().Measure("")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	measurement, err := exp.Measure("")
 	if err == nil {
 		t.Fatal("expected an error here")
 	}
@@ -286,7 +368,11 @@ func TestRunHHFM(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	runexperimentflow(t, builder.NewExperiment(), "")
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runexperimentflow(t, exp, "")
 }
 
 func runexperimentflow(t *testing.T, experiment *Experiment, input string) {
@@ -352,6 +438,25 @@ func TestOptions(t *testing.T) {
 			t.Fatal("expected nil here")
 		}
 	})
+	t.Run("with fields only settable from code", func(t *testing.T) {
+		b := &ExperimentBuilder{
+			config: &struct {
+				Callback func() `ooni:"-"`
+				Enabled  bool   `ooni:"Whether it is enabled"`
+				Hidden   string `ooni:"-"`
+			}{},
+		}
+		options, err := b.Options()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(options) != 1 || options["Enabled"].Doc != "Whether it is enabled" {
+			t.Fatalf("unexpected options: %+v", options)
+		}
+		if err := b.SetOptionString("Hidden", "antani"); err == nil {
+			t.Fatal("expected an error here")
+		}
+	})
 }
 
 func TestSetOption(t *testing.T) {
@@ -429,7 +534,10 @@ func TestLoadMeasurement(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	experiment := builder.NewExperiment()
+	experiment, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
 	testflow := func(t *testing.T, name string) (*model.Measurement, error) {
 		path := fmt.Sprintf(
 			"testdata/loadable-measurement-%s.jsonl", name,
@@ -482,7 +590,10 @@ func TestSaveMeasurementErrors(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	exp := builder.NewExperiment()
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
 	dirname, err := ioutil.TempDir("", "ooniprobe-engine-save-measurement")
 	if err != nil {
 		t.Fatal(err)
@@ -528,7 +639,10 @@ func TestOpenReportIdempotent(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	exp := builder.NewExperiment()
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
 	if exp.ReportID() != "" {
 		t.Fatal("unexpected initial report ID")
 	}
@@ -566,7 +680,10 @@ func TestOpenReportFailure(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	exp := builder.NewExperiment()
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
 	exp.session.availableCollectors = []model.Service{
 		model.Service{
 			Address: server.URL,
@@ -586,7 +703,10 @@ func TestSubmitAndUpdateMeasurementWithClosedReport(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	exp := builder.NewExperiment()
+	exp, err := builder.NewExperiment()
+	if err != nil {
+		t.Fatal(err)
+	}
 	m := new(model.Measurement)
 	err = exp.SubmitAndUpdateMeasurement(m)
 	if err == nil {
@@ -636,3 +756,29 @@ func (am *antaniMeasurer) Run(
 ) error {
 	return nil
 }
+
+type closingMeasurer struct {
+	antaniMeasurer
+	closed bool
+}
+
+func (cm *closingMeasurer) Close() error {
+	cm.closed = true
+	return nil
+}
+
+func TestUnitExperimentClose(t *testing.T) {
+	sess := newSessionForTestingNoLookups(t)
+	defer sess.Close()
+	measurer := new(closingMeasurer)
+	if err := NewExperiment(sess, measurer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !measurer.closed {
+		t.Fatal("expected the measurer to be closed")
+	}
+	// Measurers that cannot be closed are fine as well
+	if err := NewExperiment(sess, new(antaniMeasurer)).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
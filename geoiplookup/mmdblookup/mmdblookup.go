@@ -33,6 +33,20 @@ func LookupASN(
 	return
 }
 
+// ASNLookupper is a model.ASNLookupper using LookupASN.
+type ASNLookupper struct {
+	// Logger is the logger to use.
+	Logger model.Logger
+
+	// Path is the path of the MMDB database.
+	Path string
+}
+
+// LookupASN calls LookupASN using the configured database and logger.
+func (l ASNLookupper) LookupASN(ip string) (uint, string, error) {
+	return LookupASN(l.Path, ip, l.Logger)
+}
+
 // LookupCC is like LookupASN but for the country code.
 func LookupCC(
 	path, ip string, logger model.Logger,
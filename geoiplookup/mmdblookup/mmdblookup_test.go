@@ -39,6 +39,21 @@ func TestLookupProbeASN(t *testing.T) {
 	t.Log(org)
 }
 
+func TestASNLookupper(t *testing.T) {
+	maybeFetchResources(t)
+	var lookupper model.ASNLookupper = mmdblookup.ASNLookupper{
+		Logger: log.Log,
+		Path:   asnDBPath,
+	}
+	asn, _, err := lookupper.LookupASN(ipAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asn == model.DefaultProbeASN {
+		t.Fatal("expected a nonzero ASN")
+	}
+}
+
 func TestLookupProbeASNInvalidFile(t *testing.T) {
 	maybeFetchResources(t)
 	asn, org, err := mmdblookup.LookupASN("/nonexistent", ipAddr, log.Log)
@@ -23,6 +23,10 @@ type Client struct {
 	// BaseURL is the base URL of the API.
 	BaseURL string
 
+	// Headers contains optional extra headers. They cannot override
+	// the Authorization, Content-Type, and User-Agent headers.
+	Headers http.Header
+
 	// HTTPClient is the http client to use.
 	HTTPClient *http.Client
 
@@ -33,6 +37,17 @@ type Client struct {
 	UserAgent string
 }
 
+// StatusError is the error returned when the server responds with
+// a status code equal to or greater than 400.
+type StatusError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Request failed: %s", e.Status)
+}
+
 func (c *Client) makeRequestWithJSONBody(
 	ctx context.Context, method, resourcePath string,
 	query url.Values, body interface{},
@@ -63,6 +78,11 @@ func (c *Client) makeRequest(
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range c.Headers {
+		for _, value := range values {
+			request.Header.Add(key, value)
+		}
+	}
 	if body != nil {
 		request.Header.Set("Content-Type", "application/json")
 	}
@@ -85,7 +105,10 @@ func (c *Client) dox(
 	}
 	defer response.Body.Close()
 	if response.StatusCode >= 400 {
-		return fmt.Errorf("Request failed: %s", response.Status)
+		return &StatusError{
+			Status:     response.Status,
+			StatusCode: response.StatusCode,
+		}
 	}
 	data, err := readall(response.Body)
 	if err != nil {
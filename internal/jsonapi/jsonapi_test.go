@@ -171,6 +171,26 @@ func TestUnitMakeRequestWithAuthorization(t *testing.T) {
 	}
 }
 
+func TestUnitMakeRequestWithHeaders(t *testing.T) {
+	client := makeclient()
+	client.Headers = http.Header{
+		"User-Agent": []string{"antani/1.0"},
+		"X-Trace-Id": []string{"1234"},
+	}
+	req, err := client.makeRequest(
+		context.Background(), "GET", "/", nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("X-Trace-Id") != "1234" {
+		t.Fatal("custom header not set")
+	}
+	if req.Header.Get("User-Agent") != "miniooni/0.1.0-dev" {
+		t.Fatal("custom header overrode the User-Agent")
+	}
+}
+
 func TestIntegrationDoBadRequest(t *testing.T) {
 	client := makeclient()
 	req, err := client.makeRequest(
@@ -229,3 +249,34 @@ func TestUnitDoxReadallFailure(t *testing.T) {
 		t.Fatal("not the error we expected")
 	}
 }
+
+func TestUnitDoxStatusError(t *testing.T) {
+	client := makeclient()
+	req, err := client.makeRequest(
+		context.Background(), "GET", "/status/503", nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.dox(
+		func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+				Status:     "503 Service Unavailable",
+				StatusCode: 503,
+			}, nil
+		},
+		ioutil.ReadAll,
+		req, nil,
+	)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatal("not the error we expected")
+	}
+	if statusErr.StatusCode != 503 {
+		t.Fatal("unexpected status code")
+	}
+	if err.Error() != "Request failed: 503 Service Unavailable" {
+		t.Fatal("unexpected error string")
+	}
+}
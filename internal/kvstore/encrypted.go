@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// ErrInvalidEncryptionKey indicates that the encryption key passed to
+// NewEncryptedKeyValueStore is not exactly 32 bytes long.
+var ErrInvalidEncryptionKey = errors.New("kvstore: encryption key must be 32 bytes")
+
+// ErrTampered indicates that a value read from the underlying store
+// failed authentication, i.e., it has been corrupted or tampered with.
+var ErrTampered = errors.New("kvstore: value failed authentication")
+
+// EncryptedKeyValueStore is a KeyValueStore that encrypts values
+// using AES-GCM before storing them into the wrapped store. Each value
+// is stored as the random nonce followed by the ciphertext. Keys are
+// not encrypted, so do not store sensitive data inside keys. We use the
+// key as additional data, so a value moved to another key fails
+// authentication.
+type EncryptedKeyValueStore struct {
+	aead       cipher.AEAD
+	randReader io.Reader
+	store      KeyValueStore
+}
+
+// NewEncryptedKeyValueStore creates a new EncryptedKeyValueStore
+// wrapping store and using the specified 32-byte key.
+func NewEncryptedKeyValueStore(
+	store KeyValueStore, key []byte) (*EncryptedKeyValueStore, error) {
+	if len(key) != 32 {
+		return nil, ErrInvalidEncryptionKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedKeyValueStore{
+		aead:       aead,
+		randReader: rand.Reader,
+		store:      store,
+	}, nil
+}
+
+// Delete removes a key from the wrapped store
+func (kvs *EncryptedKeyValueStore) Delete(key string) error {
+	return kvs.store.Delete(key)
+}
+
+// Get reads and decrypts the value of key. It returns the same error
+// of the wrapped store when the key is missing and ErrTampered when
+// the stored value fails authentication.
+func (kvs *EncryptedKeyValueStore) Get(key string) ([]byte, error) {
+	data, err := kvs.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := kvs.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, ErrTampered
+	}
+	value, err := kvs.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return value, nil
+}
+
+// List returns the keys in the wrapped store
+func (kvs *EncryptedKeyValueStore) List() ([]string, error) {
+	return kvs.store.List()
+}
+
+// Set encrypts value and writes it into the wrapped store
+func (kvs *EncryptedKeyValueStore) Set(key string, value []byte) error {
+	nonce := make([]byte, kvs.aead.NonceSize())
+	if _, err := io.ReadFull(kvs.randReader, nonce); err != nil {
+		return err
+	}
+	return kvs.store.Set(key, kvs.aead.Seal(nonce, nonce, value, []byte(key)))
+}
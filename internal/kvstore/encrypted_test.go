@@ -0,0 +1,133 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newEncryptedStore(t *testing.T) (*EncryptedKeyValueStore, *MemoryKeyValueStore) {
+	store := NewMemoryKeyValueStore()
+	kvs, err := NewEncryptedKeyValueStore(store, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs, store
+}
+
+func TestUnitEncryptedInvalidKey(t *testing.T) {
+	kvs, err := NewEncryptedKeyValueStore(NewMemoryKeyValueStore(), []byte("short"))
+	if !errors.Is(err, ErrInvalidEncryptionKey) {
+		t.Fatal("not the error we expected")
+	}
+	if kvs != nil {
+		t.Fatal("expected nil store here")
+	}
+}
+
+func TestUnitEncryptedRoundTrip(t *testing.T) {
+	kvs, store := newEncryptedStore(t)
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := store.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("mascetti")) {
+		t.Fatal("value is stored in cleartext")
+	}
+	value, err := kvs.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "mascetti" {
+		t.Fatal("not the value we expected")
+	}
+	keys, err := kvs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "antani" {
+		t.Fatal("not the keys we expected")
+	}
+	if err := kvs.Delete("antani"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitEncryptedNonceIsRandom(t *testing.T) {
+	kvs, store := newEncryptedStore(t)
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := store.Get("antani")
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := store.Get("antani")
+	if bytes.Equal(first, second) {
+		t.Fatal("expected different ciphertexts")
+	}
+}
+
+func TestUnitEncryptedTampered(t *testing.T) {
+	kvs, store := newEncryptedStore(t)
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := store.Get("antani")
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-1] ^= 0x01
+	if err := store.Set("antani", tampered); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); !errors.Is(err, ErrTampered) {
+		t.Fatal("not the error we expected")
+	}
+	if err := store.Set("antani", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); !errors.Is(err, ErrTampered) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitEncryptedSwappedValues(t *testing.T) {
+	kvs, store := newEncryptedStore(t)
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("melandri", []byte("perozzi")); err != nil {
+		t.Fatal(err)
+	}
+	antani, _ := store.Get("antani")
+	melandri, _ := store.Get("melandri")
+	if err := store.Set("antani", melandri); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("melandri", antani); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kvs.Get("antani"); !errors.Is(err, ErrTampered) {
+		t.Fatal("not the error we expected")
+	}
+	if _, err := kvs.Get("melandri"); !errors.Is(err, ErrTampered) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitEncryptedRandFailure(t *testing.T) {
+	kvs, _ := newEncryptedStore(t)
+	kvs.randReader = strings.NewReader("")
+	if err := kvs.Set("antani", []byte("mascetti")); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := kvs.Get("antani"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatal("not the error we expected")
+	}
+}
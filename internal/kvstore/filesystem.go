@@ -0,0 +1,113 @@
+package kvstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidKey indicates that a key cannot be used as a file name
+var ErrInvalidKey = errors.New("invalid key")
+
+// FileSystemKeyValueStore is a key-value store where each key is
+// saved as a file inside a base directory. We write a temporary file
+// and then rename it, so that we never leave a truncated value around
+// if we crash in the middle of writing a key.
+type FileSystemKeyValueStore struct {
+	basedir string
+}
+
+// NewFileSystemKeyValueStore creates a new file system key-value store
+// that saves keys inside basedir, creating basedir if needed.
+func NewFileSystemKeyValueStore(basedir string) (*FileSystemKeyValueStore, error) {
+	if err := os.MkdirAll(basedir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSystemKeyValueStore{basedir: basedir}, nil
+}
+
+// filename returns the file name for key. We reject keys that are not
+// plain file names, as well as keys starting with a dot, which we use
+// for temporary files.
+func (kvs *FileSystemKeyValueStore) filename(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, ".") || filepath.Base(key) != key {
+		return "", ErrInvalidKey
+	}
+	return filepath.Join(kvs.basedir, key), nil
+}
+
+// Delete removes a key from the key value store
+func (kvs *FileSystemKeyValueStore) Delete(key string) error {
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Get returns a key from the key value store
+func (kvs *FileSystemKeyValueStore) Get(key string) ([]byte, error) {
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchKey
+	}
+	return value, err
+}
+
+// List returns the sorted list of keys in the key value store
+func (kvs *FileSystemKeyValueStore) List() ([]string, error) {
+	files, err := ioutil.ReadDir(kvs.basedir)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue // not a key or temporary file
+		}
+		keys = append(keys, file.Name())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Set sets a key into the key value store
+func (kvs *FileSystemKeyValueStore) Set(key string, value []byte) error {
+	filename, err := kvs.filename(key)
+	if err != nil {
+		return err
+	}
+	filep, err := ioutil.TempFile(kvs.basedir, "."+key+".")
+	if err != nil {
+		return err
+	}
+	if _, err := filep.Write(value); err != nil {
+		filep.Close()
+		os.Remove(filep.Name())
+		return err
+	}
+	if err := filep.Sync(); err != nil {
+		filep.Close()
+		os.Remove(filep.Name())
+		return err
+	}
+	if err := filep.Close(); err != nil {
+		os.Remove(filep.Name())
+		return err
+	}
+	if err := os.Rename(filep.Name(), filename); err != nil {
+		os.Remove(filep.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTempFileSystemKeyValueStore(t *testing.T) (*FileSystemKeyValueStore, string) {
+	dir, err := ioutil.TempDir("", "ooniprobe-engine-kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kvs, err := NewFileSystemKeyValueStore(filepath.Join(dir, "kvstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kvs, dir
+}
+
+func TestUnitFileSystemNoSuchKey(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	value, err := kvs.Get("nonexistent")
+	if !errors.Is(err, ErrNoSuchKey) {
+		t.Fatal("not the error we expected")
+	}
+	if value != nil {
+		t.Fatal("expected nil value here")
+	}
+}
+
+func TestUnitFileSystemExistingKey(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	if err := kvs.Set("antani", []byte("mascetti")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("antani", []byte("melandri")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := kvs.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "melandri" {
+		t.Fatal("not the result we expected")
+	}
+	files, err := ioutil.ReadDir(kvs.basedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("expected no leftover temporary files")
+	}
+}
+
+func TestUnitFileSystemInvalidKey(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	for _, key := range []string{"", ".antani", "../antani", "antani/mascetti"} {
+		if err := kvs.Set(key, []byte("x")); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("Set: unexpected error for %s", key)
+		}
+		if _, err := kvs.Get(key); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("Get: unexpected error for %s", key)
+		}
+	}
+}
+
+func TestUnitFileSystemConcurrentAccess(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+			if err := kvs.Set(key, []byte(value)); err != nil {
+				t.Error(err)
+				return
+			}
+			data, err := kvs.Get(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(data) != value {
+				t.Error("not the value we expected")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestUnitFileSystemMkdirFailure(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	if err := kvs.Set("antani", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// cannot create a directory below a regular file
+	store, err := NewFileSystemKeyValueStore(filepath.Join(kvs.basedir, "antani", "x"))
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if store != nil {
+		t.Fatal("expected nil store here")
+	}
+}
+
+func TestUnitFileSystemDeleteAndList(t *testing.T) {
+	kvs, dir := newTempFileSystemKeyValueStore(t)
+	defer os.RemoveAll(dir)
+	var store KeyValueStore = kvs
+	for _, key := range []string{"mascetti", "antani", "melandri"} {
+		if err := store.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("mascetti"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "antani" || keys[1] != "melandri" {
+		t.Fatal("not the keys we expected")
+	}
+}
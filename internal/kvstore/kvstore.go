@@ -3,42 +3,108 @@ package kvstore
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"time"
 )
 
+// KeyValueStore is a goroutine-safe key-value store.
+type KeyValueStore interface {
+	// Delete removes a key. Deleting a nonexistent key is not an error.
+	Delete(key string) error
+
+	// Get returns the value of a key or ErrNoSuchKey.
+	Get(key string) ([]byte, error)
+
+	// List returns the keys in the store sorted in ascending order.
+	List() ([]string, error)
+
+	// Set sets the value of a key.
+	Set(key string, value []byte) error
+}
+
+// ErrNoSuchKey indicates that a key does not exist
+var ErrNoSuchKey = errors.New("no such key")
+
+// memoryEntry is an entry of the MemoryKeyValueStore. A zero expiry
+// means that the entry never expires.
+type memoryEntry struct {
+	expiry time.Time
+	value  []byte
+}
+
 // MemoryKeyValueStore is an in-memory key-value store
 type MemoryKeyValueStore struct {
-	m  map[string][]byte
-	mu sync.Mutex
+	m       map[string]memoryEntry
+	mu      sync.Mutex
+	timeNow func() time.Time
 }
 
 // NewMemoryKeyValueStore creates a new in-memory key-value store
 func NewMemoryKeyValueStore() *MemoryKeyValueStore {
 	return &MemoryKeyValueStore{
-		m: make(map[string][]byte),
+		m:       make(map[string]memoryEntry),
+		timeNow: time.Now,
+	}
+}
+
+// Delete removes a key from the key value store
+func (kvs *MemoryKeyValueStore) Delete(key string) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	delete(kvs.m, key)
+	return nil
+}
+
+// expired tells us whether entry is expired. It also removes the
+// entry from the store, if expired, so we lazily free memory.
+func (kvs *MemoryKeyValueStore) expired(key string, entry memoryEntry) bool {
+	if entry.expiry.IsZero() || kvs.timeNow().Before(entry.expiry) {
+		return false
 	}
+	delete(kvs.m, key)
+	return true
 }
 
 // Get returns a key from the key value store
 func (kvs *MemoryKeyValueStore) Get(key string) ([]byte, error) {
-	var (
-		err   error
-		ok    bool
-		value []byte
-	)
 	kvs.mu.Lock()
 	defer kvs.mu.Unlock()
-	value, ok = kvs.m[key]
-	if !ok {
-		err = errors.New("no such key")
+	entry, ok := kvs.m[key]
+	if !ok || kvs.expired(key, entry) {
+		return nil, ErrNoSuchKey
 	}
-	return value, err
+	return entry.value, nil
+}
+
+// List returns the sorted list of keys in the key value store
+func (kvs *MemoryKeyValueStore) List() ([]string, error) {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	keys := make([]string, 0, len(kvs.m))
+	for key, entry := range kvs.m {
+		if !kvs.expired(key, entry) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
 }
 
 // Set sets a key into the key value store
 func (kvs *MemoryKeyValueStore) Set(key string, value []byte) error {
 	kvs.mu.Lock()
 	defer kvs.mu.Unlock()
-	kvs.m[key] = value
+	kvs.m[key] = memoryEntry{value: value}
+	return nil
+}
+
+// SetWithTTL is like Set except that the key expires after ttl. After
+// a key is expired, Get will behave like the key does not exist.
+func (kvs *MemoryKeyValueStore) SetWithTTL(
+	key string, value []byte, ttl time.Duration) error {
+	kvs.mu.Lock()
+	defer kvs.mu.Unlock()
+	kvs.m[key] = memoryEntry{expiry: kvs.timeNow().Add(ttl), value: value}
 	return nil
 }
@@ -1,6 +1,10 @@
 package kvstore
 
-import "testing"
+import (
+	"errors"
+	"testing"
+	"time"
+)
 
 func TestUnitNoSuchKey(t *testing.T) {
 	kvs := NewMemoryKeyValueStore()
@@ -26,3 +30,67 @@ func TestUnitExistingKey(t *testing.T) {
 		t.Fatal("not the result we expected")
 	}
 }
+
+func TestUnitDeleteAndList(t *testing.T) {
+	var kvs KeyValueStore = NewMemoryKeyValueStore()
+	for _, key := range []string{"mascetti", "antani", "melandri"} {
+		if err := kvs.Set(key, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kvs.Delete("mascetti"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Delete("nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := kvs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != "antani" || keys[1] != "melandri" {
+		t.Fatal("not the keys we expected")
+	}
+	if _, err := kvs.Get("mascetti"); !errors.Is(err, ErrNoSuchKey) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitSetWithTTL(t *testing.T) {
+	kvs := NewMemoryKeyValueStore()
+	now := time.Now()
+	kvs.timeNow = func() time.Time {
+		return now
+	}
+	if err := kvs.SetWithTTL("antani", []byte("mascetti"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvs.Set("melandri", []byte("necchi")); err != nil {
+		t.Fatal(err)
+	}
+	value, err := kvs.Get("antani")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "mascetti" {
+		t.Fatal("not the result we expected")
+	}
+	now = now.Add(time.Minute)
+	value, err = kvs.Get("antani")
+	if !errors.Is(err, ErrNoSuchKey) {
+		t.Fatal("not the error we expected")
+	}
+	if value != nil {
+		t.Fatal("expected nil value here")
+	}
+	keys, err := kvs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "melandri" {
+		t.Fatal("not the keys we expected")
+	}
+	if _, err := kvs.Get("melandri"); err != nil {
+		t.Fatal(err)
+	}
+}
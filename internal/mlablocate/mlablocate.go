@@ -58,12 +58,25 @@ func NewRequestWithProxy(probeIP string) NewRequestFunc {
 	}
 }
 
-type locateResult struct {
-	FQDN string `json:"fqdn"`
+// Result is the result of a locate.measurementlab.net query. Besides the
+// FQDN of the server, it contains the server location metadata. Such
+// metadata may be empty if the service did not provide it.
+type Result struct {
+	City    string `json:"city"`
+	Country string `json:"country"`
+	FQDN    string `json:"fqdn"`
+	Site    string `json:"site"`
 }
 
 // Query performs a locate.measurementlab.net query.
 func (c *Client) Query(ctx context.Context, tool string) (string, error) {
+	result, err := c.QueryWithMetadata(ctx, tool)
+	return result.FQDN, err
+}
+
+// QueryWithMetadata is like Query but also returns the server location
+// metadata returned by locate.measurementlab.net.
+func (c *Client) QueryWithMetadata(ctx context.Context, tool string) (Result, error) {
 	URL := &url.URL{
 		Scheme: c.Scheme,
 		Host:   c.Hostname,
@@ -71,29 +84,29 @@ func (c *Client) Query(ctx context.Context, tool string) (string, error) {
 	}
 	req, err := c.NewRequest(ctx, URL)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 	req.Header.Add("User-Agent", c.UserAgent)
 	c.Logger.Debugf("mlablocate: GET %s", URL.String())
 	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("mlablocate: non-200 status code: %d", resp.StatusCode)
+		return Result{}, fmt.Errorf("mlablocate: non-200 status code: %d", resp.StatusCode)
 	}
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return Result{}, err
 	}
 	c.Logger.Debugf("mlablocate: %s", string(data))
-	var result locateResult
+	var result Result
 	if err := json.Unmarshal(data, &result); err != nil {
-		return "", err
+		return Result{}, err
 	}
 	if result.FQDN == "" {
-		return "", errors.New("mlablocate: returned empty FQDN")
+		return Result{}, errors.New("mlablocate: returned empty FQDN")
 	}
-	return result.FQDN, nil
+	return result, nil
 }
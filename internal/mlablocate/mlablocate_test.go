@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"strings"
 	"testing"
@@ -222,3 +223,34 @@ func (b *emptyFQDNBody) Read(p []byte) (int, error) {
 func (b *emptyFQDNBody) Close() error {
 	return nil
 }
+
+type metadataTransport struct{}
+
+func (txp *metadataTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: 200,
+		Body: ioutil.NopCloser(strings.NewReader(`{
+			"city": "Milan", "country": "IT", "site": "mil04",
+			"fqdn": "ndt-iupui-mlab1-mil04.measurement-lab.org"
+		}`)),
+	}, nil
+}
+
+func TestUnitQueryWithMetadata(t *testing.T) {
+	client := mlablocate.NewClient(
+		http.DefaultClient,
+		log.Log,
+		"miniooni/0.1.0-dev",
+	)
+	client.HTTPClient = &http.Client{Transport: &metadataTransport{}}
+	result, err := client.QueryWithMetadata(context.Background(), "ndt7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FQDN != "ndt-iupui-mlab1-mil04.measurement-lab.org" {
+		t.Fatal("unexpected FQDN")
+	}
+	if result.City != "Milan" || result.Country != "IT" || result.Site != "mil04" {
+		t.Fatal("unexpected metadata")
+	}
+}
@@ -0,0 +1,89 @@
+package mockable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// ErrNoSnapshot indicates that ReplayTransport has no snapshot
+// matching the method and the URL of a request.
+var ErrNoSnapshot = errors.New("mockable: no snapshot matching the request")
+
+// ReplayMode controls how ReplayTransport replays the snapshots
+// matching a request that is sent more than once.
+type ReplayMode int
+
+const (
+	// ReplaySequential replays the matching snapshots in order, each one
+	// only once. Once all of them are used, requests fail with ErrNoSnapshot.
+	ReplaySequential = ReplayMode(iota)
+
+	// ReplaySticky always replays the first matching snapshot.
+	ReplaySticky
+)
+
+// ReplayTransport is a http.RoundTripper that replays the round trips
+// previously recorded by netx, e.g., using handlers.SavingHandler, so
+// that we can test experiments without using the network. A snapshot
+// matches a request if it has the same method and URL. When the recorded
+// round trip failed, we return its error. Otherwise, we return a response
+// with the recorded status code, headers and body. Note that the body is
+// truncated if the recorded body snapshot was truncated.
+type ReplayTransport struct {
+	Mode      ReplayMode
+	Snapshots []*modelx.HTTPRoundTripDoneEvent
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (txp *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	snap := txp.match(req.Method, req.URL.String())
+	if snap == nil {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoSnapshot, req.Method, req.URL)
+	}
+	if snap.Error != nil {
+		return nil, snap.Error
+	}
+	return &http.Response{
+		Body:          ioutil.NopCloser(bytes.NewReader(snap.ResponseBodySnap)),
+		ContentLength: int64(len(snap.ResponseBodySnap)),
+		Header:        snap.ResponseHeaders.Clone(),
+		Proto:         snap.ResponseProto,
+		Request:       req,
+		Status: fmt.Sprintf("%d %s", snap.ResponseStatusCode,
+			http.StatusText(int(snap.ResponseStatusCode))),
+		StatusCode: int(snap.ResponseStatusCode),
+	}, nil
+}
+
+func (txp *ReplayTransport) match(method, URL string) *modelx.HTTPRoundTripDoneEvent {
+	txp.mu.Lock()
+	defer txp.mu.Unlock()
+	if txp.used == nil {
+		txp.used = make(map[int]bool)
+	}
+	for idx, snap := range txp.Snapshots {
+		if snap.RequestMethod != method || snap.RequestURL != URL {
+			continue
+		}
+		if txp.Mode == ReplaySticky {
+			return snap
+		}
+		if !txp.used[idx] {
+			txp.used[idx] = true
+			return snap
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package mockable
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newSnapshot(URL string, status int64, body string) *modelx.HTTPRoundTripDoneEvent {
+	return &modelx.HTTPRoundTripDoneEvent{
+		RequestMethod:      "GET",
+		RequestURL:         URL,
+		ResponseBodySnap:   []byte(body),
+		ResponseHeaders:    http.Header{"Content-Type": {"text/plain"}},
+		ResponseStatusCode: status,
+	}
+}
+
+func get(t *testing.T, client *http.Client, URL string) (*http.Response, string, error) {
+	resp, err := client.Get(URL)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data), nil
+}
+
+func TestUnitReplaySequential(t *testing.T) {
+	client := &http.Client{Transport: &ReplayTransport{
+		Snapshots: []*modelx.HTTPRoundTripDoneEvent{
+			newSnapshot("http://www.example.com/", 500, "first"),
+			newSnapshot("http://www.example.org/", 200, "other"),
+			newSnapshot("http://www.example.com/", 200, "second"),
+		},
+	}}
+	for _, expected := range []string{"first", "second"} {
+		resp, body, err := get(t, client, "http://www.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != expected {
+			t.Fatal("unexpected body")
+		}
+		if resp.Header.Get("Content-Type") != "text/plain" {
+			t.Fatal("unexpected headers")
+		}
+	}
+	if _, _, err := get(t, client, "http://www.example.com/"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitReplaySticky(t *testing.T) {
+	client := &http.Client{Transport: &ReplayTransport{
+		Mode: ReplaySticky,
+		Snapshots: []*modelx.HTTPRoundTripDoneEvent{
+			newSnapshot("http://www.example.com/", 404, "first"),
+			newSnapshot("http://www.example.com/", 200, "second"),
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		resp, body, err := get(t, client, "http://www.example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 404 || body != "first" {
+			t.Fatal("expected the first snapshot")
+		}
+	}
+}
+
+func TestUnitReplayMismatch(t *testing.T) {
+	client := &http.Client{Transport: &ReplayTransport{
+		Snapshots: []*modelx.HTTPRoundTripDoneEvent{
+			newSnapshot("http://www.example.com/", 200, "antani"),
+		},
+	}}
+	req, err := http.NewRequest("POST", "http://www.example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatal("not the error we expected")
+	}
+	if _, _, err := get(t, client, "http://www.example.org/"); !errors.Is(err, ErrNoSnapshot) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitReplayError(t *testing.T) {
+	expected := errors.New("mocked error")
+	snap := newSnapshot("http://www.example.com/", 0, "")
+	snap.Error = expected
+	client := &http.Client{Transport: &ReplayTransport{
+		Snapshots: []*modelx.HTTPRoundTripDoneEvent{snap},
+	}}
+	if _, _, err := get(t, client, "http://www.example.com/"); !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+}
@@ -18,8 +18,30 @@ type Logger interface {
 	Debugf(format string, v ...interface{})
 }
 
+// DialFilter selects which dial events we log.
+type DialFilter int
+
+const (
+	// DialFilterAll logs both successful and failed dials.
+	DialFilterAll = DialFilter(iota)
+
+	// DialFilterFailures only logs failed dials.
+	DialFilterFailures
+
+	// DialFilterSuccesses only logs successful dials.
+	DialFilterSuccesses
+)
+
 // Handler is a handler that logs events.
 type Handler struct {
+	// DialAddresses indicates whether to also log, when a dial is
+	// complete, all the resolved addresses we tried to connect to.
+	DialAddresses bool
+
+	// DialFilter selects which dial events to log. By default we
+	// log both successful and failed dials.
+	DialFilter DialFilter
+
 	logger Logger
 }
 
@@ -48,7 +70,7 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 	}
 
 	// Syscalls
-	if m.Connect != nil {
+	if m.Connect != nil && h.shouldLogDial(m.Connect.Error) {
 		h.logger.Debugf(
 			"[httpTxID: %d] connect done: %s, %s (rtt=%s)",
 			m.Connect.TransactionID,
@@ -58,6 +80,22 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 		)
 	}
 
+	// Dial
+	if m.DialDone != nil && h.DialAddresses && h.shouldLogDial(m.DialDone.Error) {
+		addresses := m.DialDone.FailedAddresses
+		if m.DialDone.RemoteAddress != "" {
+			addresses = append(addresses[:len(addresses):len(addresses)],
+				m.DialDone.RemoteAddress)
+		}
+		h.logger.Debugf(
+			"[httpTxID: %d] dial done: %s, %s (tried=%s)",
+			m.DialDone.TransactionID,
+			fmtError(m.DialDone.Error),
+			m.DialDone.Address,
+			addresses,
+		)
+	}
+
 	// TLS
 	if m.TLSHandshakeStart != nil {
 		h.logger.Debugf(
@@ -147,6 +185,16 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 			"[httpTxID: %d] <", m.HTTPRoundTripDone.TransactionID)
 	}
 
+	if m.HTTPRedirect != nil {
+		h.logger.Debugf(
+			"[httpTxID: %d] redirect: %d %s => %s",
+			m.HTTPRedirect.TransactionID,
+			m.HTTPRedirect.StatusCode,
+			m.HTTPRedirect.From,
+			m.HTTPRedirect.To,
+		)
+	}
+
 	// HTTP response body
 	if m.HTTPResponseBodyPart != nil {
 		h.logger.Debugf(
@@ -164,6 +212,17 @@ func (h *Handler) OnMeasurement(m modelx.Measurement) {
 	}
 }
 
+func (h *Handler) shouldLogDial(err error) bool {
+	switch h.DialFilter {
+	case DialFilterFailures:
+		return err != nil
+	case DialFilterSuccesses:
+		return err == nil
+	default:
+		return true
+	}
+}
+
 func fmtError(err error) (s string) {
 	s = "success"
 	if err != nil {
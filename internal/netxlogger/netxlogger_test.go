@@ -1,6 +1,8 @@
 package netxlogger
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"testing"
@@ -38,3 +40,80 @@ func TestIntegration(t *testing.T) {
 	}
 	client.HTTPClient.CloseIdleConnections()
 }
+
+type savingLogger struct {
+	lines []string
+}
+
+func (sl *savingLogger) Debug(msg string) {
+	sl.lines = append(sl.lines, msg)
+}
+
+func (sl *savingLogger) Debugf(format string, v ...interface{}) {
+	sl.Debug(fmt.Sprintf(format, v...))
+}
+
+var (
+	successfulConnect = modelx.Measurement{Connect: &modelx.ConnectEvent{
+		RemoteAddress: "1.1.1.1:443",
+	}}
+	failedConnect = modelx.Measurement{Connect: &modelx.ConnectEvent{
+		Error:         errors.New("connection_refused"),
+		RemoteAddress: "1.0.0.1:443",
+	}}
+	successfulDial = modelx.Measurement{DialDone: &modelx.DialDoneEvent{
+		Address:         "one.one.one.one:443",
+		FailedAddresses: []string{"1.0.0.1:443"},
+		RemoteAddress:   "1.1.1.1:443",
+	}}
+)
+
+func TestUnitDialFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter   DialFilter
+		expected int
+	}{
+		{DialFilterAll, 2},
+		{DialFilterFailures, 1},
+		{DialFilterSuccesses, 1},
+	} {
+		logger := new(savingLogger)
+		handler := NewHandler(logger)
+		handler.DialFilter = tc.filter
+		handler.OnMeasurement(successfulConnect)
+		handler.OnMeasurement(failedConnect)
+		handler.OnMeasurement(successfulDial) // DialAddresses is false
+		if len(logger.lines) != tc.expected {
+			t.Fatal("unexpected number of lines", tc.filter, logger.lines)
+		}
+	}
+}
+
+func TestUnitDialFilterFailuresWithSuccessfulDial(t *testing.T) {
+	logger := new(savingLogger)
+	handler := NewHandler(logger)
+	handler.DialAddresses = true
+	handler.DialFilter = DialFilterFailures
+	handler.OnMeasurement(successfulConnect)
+	handler.OnMeasurement(successfulDial)
+	if len(logger.lines) != 0 {
+		t.Fatal("expected no log lines", logger.lines)
+	}
+}
+
+func TestUnitDialAddresses(t *testing.T) {
+	logger := new(savingLogger)
+	handler := NewHandler(logger)
+	handler.DialAddresses = true
+	handler.OnMeasurement(successfulDial)
+	if len(logger.lines) != 1 {
+		t.Fatal("unexpected number of lines", logger.lines)
+	}
+	expected := "[httpTxID: 0] dial done: success, one.one.one.one:443 (tried=[1.0.0.1:443 1.1.1.1:443])"
+	if logger.lines[0] != expected {
+		t.Fatal("unexpected log line", logger.lines[0])
+	}
+	if len(successfulDial.DialDone.FailedAddresses) != 1 {
+		t.Fatal("the event should not have been modified")
+	}
+}
@@ -0,0 +1,105 @@
+package netxlogger
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// StructuredHandler is a handler that emits a single structured log
+// entry for each HTTP transaction, with method, url, status, duration,
+// and bytes fields. Unlike Handler, whose output is meant for humans,
+// its output is easy to index by log collectors.
+type StructuredHandler struct {
+	logger log.Interface
+	mu     sync.Mutex
+	txs    map[int64]*structuredTx
+}
+
+type structuredTx struct {
+	bytes   int64
+	method  string
+	started time.Duration
+	status  int64
+	url     string
+}
+
+// NewStructuredHandler returns a new structured logging handler.
+func NewStructuredHandler(logger log.Interface) *StructuredHandler {
+	return &StructuredHandler{
+		logger: logger,
+		txs:    make(map[int64]*structuredTx),
+	}
+}
+
+// OnMeasurement logs the specific measurement
+func (h *StructuredHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.HTTPRequestHeadersDone != nil {
+		var URL string
+		if m.HTTPRequestHeadersDone.URL != nil {
+			URL = m.HTTPRequestHeadersDone.URL.String()
+		}
+		h.txs[m.HTTPRequestHeadersDone.TransactionID] = &structuredTx{
+			method:  m.HTTPRequestHeadersDone.Method,
+			started: m.HTTPRequestHeadersDone.DurationSinceBeginning,
+			url:     URL,
+		}
+	}
+	if m.HTTPRoundTripDone != nil {
+		if tx := h.txs[m.HTTPRoundTripDone.TransactionID]; tx != nil {
+			tx.status = m.HTTPRoundTripDone.ResponseStatusCode
+		}
+		if m.HTTPRoundTripDone.Error != nil {
+			h.emit(m.HTTPRoundTripDone.TransactionID,
+				m.HTTPRoundTripDone.DurationSinceBeginning,
+				m.HTTPRoundTripDone.Error)
+		}
+	}
+	if m.HTTPResponseBodyPart != nil {
+		if tx := h.txs[m.HTTPResponseBodyPart.TransactionID]; tx != nil {
+			tx.bytes += int64(len(m.HTTPResponseBodyPart.Data))
+		}
+		// The transaction is complete when we reach the end of the body
+		// or fail reading it, even if the body is never closed.
+		if err := m.HTTPResponseBodyPart.Error; err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			h.emit(m.HTTPResponseBodyPart.TransactionID,
+				m.HTTPResponseBodyPart.DurationSinceBeginning, err)
+		}
+	}
+	if m.HTTPResponseDone != nil {
+		h.emit(m.HTTPResponseDone.TransactionID,
+			m.HTTPResponseDone.DurationSinceBeginning, nil)
+	}
+}
+
+// emit logs the entry of the transaction with the given ID and forgets
+// about such transaction, so that we log each transaction once, when it
+// first completes. This function assumes we hold the mutex.
+func (h *StructuredHandler) emit(txid int64, now time.Duration, err error) {
+	tx := h.txs[txid]
+	if tx == nil {
+		return
+	}
+	delete(h.txs, txid)
+	entry := h.logger.WithFields(log.Fields{
+		"bytes":    tx.bytes,
+		"duration": (now - tx.started).Seconds(),
+		"method":   tx.method,
+		"status":   tx.status,
+		"txid":     txid,
+		"url":      tx.url,
+	})
+	if err != nil {
+		entry.WithError(err).Debug("http transaction failed")
+		return
+	}
+	entry.Debug("http transaction done")
+}
@@ -0,0 +1,183 @@
+package netxlogger
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/memory"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newStructuredLogger() (*log.Logger, *memory.Handler) {
+	handler := memory.New()
+	return &log.Logger{Handler: handler, Level: log.DebugLevel}, handler
+}
+
+func TestUnitStructuredHandlerSuccess(t *testing.T) {
+	logger, memory := newStructuredLogger()
+	handler := NewStructuredHandler(logger)
+	URL, _ := url.Parse("https://www.example.com/")
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRequestHeadersDone: &modelx.HTTPRequestHeadersDoneEvent{
+			DurationSinceBeginning: time.Second,
+			Method:                 "GET",
+			TransactionID:          1,
+			URL:                    URL,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			ResponseStatusCode: 200,
+			TransactionID:      1,
+		},
+	})
+	for i := 0; i < 2; i++ {
+		handler.OnMeasurement(modelx.Measurement{
+			HTTPResponseBodyPart: &modelx.HTTPResponseBodyPartEvent{
+				Data:          []byte("antani"),
+				TransactionID: 1,
+			},
+		})
+	}
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPResponseDone: &modelx.HTTPResponseDoneEvent{
+			DurationSinceBeginning: 3 * time.Second,
+			TransactionID:          1,
+		},
+	})
+	if len(memory.Entries) != 1 {
+		t.Fatal("unexpected number of entries")
+	}
+	fields := memory.Entries[0].Fields
+	if fields.Get("method") != "GET" {
+		t.Fatal("unexpected method")
+	}
+	if fields.Get("url") != "https://www.example.com/" {
+		t.Fatal("unexpected url")
+	}
+	if fields.Get("status") != int64(200) {
+		t.Fatal("unexpected status")
+	}
+	if fields.Get("duration") != 2.0 {
+		t.Fatal("unexpected duration")
+	}
+	if fields.Get("bytes") != int64(12) {
+		t.Fatal("unexpected bytes")
+	}
+	if len(handler.txs) != 0 {
+		t.Fatal("transaction not forgotten")
+	}
+}
+
+func TestUnitStructuredHandlerFailure(t *testing.T) {
+	logger, memory := newStructuredLogger()
+	handler := NewStructuredHandler(logger)
+	URL, _ := url.Parse("https://www.example.com/")
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRequestHeadersDone: &modelx.HTTPRequestHeadersDoneEvent{
+			Method:        "GET",
+			TransactionID: 1,
+			URL:           URL,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			Error:         errors.New("mocked error"),
+			TransactionID: 1,
+		},
+	})
+	if len(memory.Entries) != 1 {
+		t.Fatal("unexpected number of entries")
+	}
+	if memory.Entries[0].Fields.Get("error") != "mocked error" {
+		t.Fatal("unexpected error field")
+	}
+	if len(handler.txs) != 0 {
+		t.Fatal("transaction not forgotten")
+	}
+}
+
+func TestUnitStructuredHandlerUnknownTransaction(t *testing.T) {
+	logger, memory := newStructuredLogger()
+	handler := NewStructuredHandler(logger)
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{TransactionID: 1},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPResponseDone: &modelx.HTTPResponseDoneEvent{TransactionID: 1},
+	})
+	if len(memory.Entries) != 0 {
+		t.Fatal("unexpected number of entries")
+	}
+}
+
+func TestUnitStructuredHandlerBodyEOFWithoutClose(t *testing.T) {
+	logger, memory := newStructuredLogger()
+	handler := NewStructuredHandler(logger)
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRequestHeadersDone: &modelx.HTTPRequestHeadersDoneEvent{
+			Method:        "GET",
+			TransactionID: 1,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			ResponseStatusCode: 200,
+			TransactionID:      1,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPResponseBodyPart: &modelx.HTTPResponseBodyPartEvent{
+			Data:          []byte("antani"),
+			Error:         io.EOF,
+			TransactionID: 1,
+		},
+	})
+	if len(handler.txs) != 0 {
+		t.Fatal("transaction not forgotten")
+	}
+	if len(memory.Entries) != 1 || memory.Entries[0].Fields.Get("error") != nil {
+		t.Fatal("unexpected entries")
+	}
+	if memory.Entries[0].Fields.Get("url") != "" {
+		t.Fatal("expected an empty url with a nil URL")
+	}
+	if memory.Entries[0].Fields.Get("bytes") != int64(6) {
+		t.Fatal("unexpected bytes")
+	}
+	// Closing the body later does not log the transaction again
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPResponseDone: &modelx.HTTPResponseDoneEvent{TransactionID: 1},
+	})
+	if len(memory.Entries) != 1 {
+		t.Fatal("unexpected number of entries")
+	}
+}
+
+func TestUnitStructuredHandlerBodyFailure(t *testing.T) {
+	logger, memory := newStructuredLogger()
+	handler := NewStructuredHandler(logger)
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPRequestHeadersDone: &modelx.HTTPRequestHeadersDoneEvent{
+			Method:        "GET",
+			TransactionID: 1,
+		},
+	})
+	handler.OnMeasurement(modelx.Measurement{
+		HTTPResponseBodyPart: &modelx.HTTPResponseBodyPartEvent{
+			Error:         errors.New("connection_reset"),
+			TransactionID: 1,
+		},
+	})
+	if len(handler.txs) != 0 {
+		t.Fatal("transaction not forgotten")
+	}
+	if len(memory.Entries) != 1 ||
+		memory.Entries[0].Fields.Get("error") != "connection_reset" {
+		t.Fatal("unexpected entries")
+	}
+}
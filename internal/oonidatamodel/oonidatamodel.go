@@ -227,17 +227,28 @@ type RequestEntry struct {
 	Failure       *string      `json:"failure"`
 	Request       HTTPRequest  `json:"request"`
 	Response      HTTPResponse `json:"response"`
+	T             float64      `json:"t"`
 	TransactionID int64        `json:"transaction_id,omitempty"`
 }
 
 // RequestList is a list of RequestEntry
 type RequestList []RequestEntry
 
+// addheaders adds the headers in source to destMap and destList. When
+// sourceList is not empty, we use it to fill destList, because it also
+// preserves the order of headers, which the map instead loses.
 func addheaders(
 	source http.Header,
+	sourceList []modelx.HTTPHeaderField,
 	destList *HTTPHeadersList,
 	destMap *HTTPHeaders,
 ) {
+	for _, field := range sourceList {
+		*destList = append(*destList, HTTPHeader{
+			Key:   field.Key,
+			Value: MaybeBinaryValue{Value: field.Value},
+		})
+	}
 	for key, values := range source {
 		for index, value := range values {
 			value := MaybeBinaryValue{Value: value}
@@ -246,6 +257,9 @@ func addheaders(
 			if index == 0 {
 				(*destMap)[key] = value
 			}
+			if len(sourceList) > 0 {
+				continue
+			}
 			*destList = append(*destList, HTTPHeader{
 				Key:   key,
 				Value: value,
@@ -256,15 +270,33 @@ func addheaders(
 
 // NewRequestList returns the list for "requests"
 func NewRequestList(results oonitemplates.Results) RequestList {
+	return newRequestList(results.HTTPRequests)
+}
+
+// NewRequestListFromEvents is like NewRequestList but uses the events
+// saved by a netx handler, e.g., handlers.SavingHandler. We only use the
+// HTTPRoundTripDone events, which contain the request and the response
+// along with a snapshot of their bodies, and ignore all the others.
+func NewRequestListFromEvents(events []modelx.Measurement) RequestList {
+	var in []*modelx.HTTPRoundTripDoneEvent
+	for _, ev := range events {
+		if ev.HTTPRoundTripDone != nil {
+			in = append(in, ev.HTTPRoundTripDone)
+		}
+	}
+	return newRequestList(in)
+}
+
+func newRequestList(in []*modelx.HTTPRoundTripDoneEvent) RequestList {
 	var out RequestList
-	in := results.HTTPRequests
 	// OONI's data format wants more recent request first
 	for idx := len(in) - 1; idx >= 0; idx-- {
 		var entry RequestEntry
 		entry.Failure = makeFailure(in[idx].Error)
 		entry.Request.Headers = make(HTTPHeaders)
 		addheaders(
-			in[idx].RequestHeaders, &entry.Request.HeadersList,
+			in[idx].RequestHeaders, in[idx].RequestHeadersList,
+			&entry.Request.HeadersList,
 			&entry.Request.Headers,
 		)
 		entry.Request.Method = in[idx].RequestMethod
@@ -274,13 +306,15 @@ func NewRequestList(results oonitemplates.Results) RequestList {
 			int64(len(in[idx].RequestBodySnap)) >= in[idx].MaxBodySnapSize
 		entry.Response.Headers = make(HTTPHeaders)
 		addheaders(
-			in[idx].ResponseHeaders, &entry.Response.HeadersList,
+			in[idx].ResponseHeaders, nil,
+			&entry.Response.HeadersList,
 			&entry.Response.Headers,
 		)
 		entry.Response.Code = in[idx].ResponseStatusCode
 		entry.Response.Body.Value = string(in[idx].ResponseBodySnap)
 		entry.Response.BodyIsTruncated = in[idx].MaxBodySnapSize > 0 &&
 			int64(len(in[idx].ResponseBodySnap)) >= in[idx].MaxBodySnapSize
+		entry.T = in[idx].DurationSinceBeginning.Seconds()
 		entry.TransactionID = in[idx].TransactionID
 		out = append(out, entry)
 	}
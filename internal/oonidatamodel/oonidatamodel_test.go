@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"testing"
@@ -346,6 +347,87 @@ func TestUnitNewRequestsSnaps(t *testing.T) {
 	}
 }
 
+func TestUnitNewRequestsHeadersList(t *testing.T) {
+	out := NewRequestList(oonitemplates.Results{
+		HTTPRequests: []*modelx.HTTPRoundTripDoneEvent{
+			&modelx.HTTPRoundTripDoneEvent{
+				RequestHeaders: http.Header{
+					"User-Agent": []string{"miniooni"},
+					"Accept":     []string{"*/*", "text/html"},
+				},
+				RequestHeadersList: []modelx.HTTPHeaderField{
+					{Key: "User-Agent", Value: "miniooni"},
+					{Key: "Accept", Value: "*/*"},
+					{Key: "Accept", Value: "text/html"},
+				},
+			},
+		},
+	})
+	if len(out) != 1 {
+		t.Fatal("unexpected output length")
+	}
+	expected := HTTPHeadersList{
+		{Key: "User-Agent", Value: MaybeBinaryValue{Value: "miniooni"}},
+		{Key: "Accept", Value: MaybeBinaryValue{Value: "*/*"}},
+		{Key: "Accept", Value: MaybeBinaryValue{Value: "text/html"}},
+	}
+	if !reflect.DeepEqual(out[0].Request.HeadersList, expected) {
+		t.Fatal("unexpected out[0].Request.HeadersList")
+	}
+	if len(out[0].Request.Headers) != 2 || out[0].Request.Headers["Accept"].Value != "*/*" {
+		t.Fatal("unexpected out[0].Request.Headers")
+	}
+}
+
+func TestUnitNewRequestListFromEvents(t *testing.T) {
+	events := []modelx.Measurement{{
+		HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			Method: "GET",
+			URL:    "http://www.example.com/",
+		},
+	}, {
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: 1500 * time.Millisecond,
+			RequestHeaders:         http.Header{"User-Agent": []string{"miniooni/0.1.0-dev"}},
+			RequestHeadersList: []modelx.HTTPHeaderField{
+				{Key: "User-Agent", Value: "miniooni/0.1.0-dev"},
+			},
+			RequestMethod:    "GET",
+			RequestURL:       "http://www.example.com/",
+			ResponseBodySnap: []byte("<html>blocked</html>"),
+			ResponseHeaders: http.Header{
+				"Set-Cookie": []string{"a=b", "c=d"},
+			},
+			ResponseStatusCode: 200,
+			MaxBodySnapSize:    1 << 17,
+			TransactionID:      1,
+		},
+	}, {
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: 2250 * time.Millisecond,
+			Error:                  errors.New("connection_reset"),
+			RequestBodySnap:        []byte{0xde, 0xad, 0xbe, 0xef},
+			RequestHeaders:         http.Header{},
+			RequestMethod:          "POST",
+			RequestURL:             "https://www.example.com/",
+			MaxBodySnapSize:        1 << 17,
+			TransactionID:          2,
+		},
+	}}
+	out := NewRequestListFromEvents(events)
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ioutil.ReadFile("../../testdata/oonidatamodel-requests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace(expected)) {
+		t.Fatalf("mismatch with the expected JSON:\n%s", string(data))
+	}
+}
+
 func TestMarshalUnmarshalHTTPBodyString(t *testing.T) {
 	mbv := HTTPBody{
 		Value: "1234",
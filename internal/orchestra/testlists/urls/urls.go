@@ -3,52 +3,322 @@ package urls
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/ooni/probe-engine/internal/jsonapi"
 	"github.com/ooni/probe-engine/model"
 )
 
+// ErrNoURLs indicates that the server successfully responded but did not
+// return any URL for the requested country and categories. When strict
+// categories are enabled, it also indicates that no URL survived filtering.
+var ErrNoURLs = errors.New("urls: no URLs returned")
+
 // Config contains configs for querying tests-lists/urls
 type Config struct {
+	ASNLookupper      model.ASNLookupper // optional: enables the server ASN lookup
 	BaseURL           string
-	CountryCode       string
+	CacheMaxAge       time.Duration       // cache freshness window: zero disables caching
+	CacheStore        model.KeyValueStore // optional: enables caching
+	CountryCode       string              // empty or "ZZ" means the server chooses
 	EnabledCategories []string
+	Headers           http.Header // optional: extra request headers
 	HTTPClient        *http.Client
-	Limit             int64
+	Limit             int64 // zero means server default
 	Logger            model.Logger
+	MaxRetries        int64         // zero means no retries
+	Offset            int64         // zero means first page
+	ProbeIP           string        // hint used when the server chooses
+	RetryBackoff      time.Duration // initial backoff, doubled at each retry
+	StrictCategories  bool          // filter results and remove duplicates
 	UserAgent         string
 }
 
+// Metadata contains the pagination metadata returned by tests-lists/urls
+type Metadata struct {
+	Count   int64  `json:"count"`
+	NextURL string `json:"next_url"`
+}
+
 // Result contains the result returned by tests-lists/urls
 type Result struct {
+	// Filtered is the number of results removed because they did not
+	// belong to EnabledCategories or were duplicate. It is only set
+	// when Config.StrictCategories is true.
+	Filtered int64 `json:"-"`
+
+	// HasMore indicates whether there are more pages to fetch.
+	HasMore bool `json:"-"`
+
+	// Metadata contains the pagination metadata.
+	Metadata Metadata `json:"metadata"`
+
+	// NextOffset is the offset to use to fetch the next page.
+	NextOffset int64 `json:"-"`
+
+	// Results contains the URLs in the current page.
 	Results []model.URLInfo `json:"results"`
+
+	// ServerASN is the ASN of ServerIP. It is zero when ServerIP is
+	// empty, when Config.ASNLookupper is nil, or when the lookup fails.
+	ServerASN uint `json:"-"`
+
+	// ServerIP is the IP address of the server that returned this result,
+	// or of the proxy, when using a proxy. It is empty when the result
+	// comes from the cache, since we did not contact the server.
+	ServerIP string `json:"-"`
+}
+
+// ByCategory groups the results by their category code. Within each
+// category, the results have the same order they have in Results. The
+// results without a category code are grouped under the empty string.
+func (r *Result) ByCategory() map[string][]model.URLInfo {
+	out := make(map[string][]model.URLInfo)
+	for _, entry := range r.Results {
+		out[entry.CategoryCode] = append(out[entry.CategoryCode], entry)
+	}
+	return out
 }
 
-// Query retrieves the test list for the specified country.
+// Query retrieves the test list for the specified country. Use the
+// Offset field of config along with the HasMore and NextOffset fields
+// of the result to iterate over all the pages of the test list.
+//
+// When config.CountryCode is empty or "ZZ", the server selects the
+// country based on the probe location. In such case, config.ProbeIP,
+// if set, helps the server to figure out the probe location. An
+// explicit two-letter country code always takes precedence.
+//
+// When config.CacheStore is set and config.CacheMaxAge is positive, Query
+// returns the result stored into the cache, if it is not older than
+// config.CacheMaxAge. Otherwise, it fetches the result from the network
+// and updates the cache. The cache key depends on config.BaseURL as well
+// as on the query, so that distinct servers do not share entries.
 func Query(ctx context.Context, config Config) (*Result, error) {
 	query := url.Values{}
-	if config.CountryCode != "" {
+	if config.CountryCode != "" && config.CountryCode != "ZZ" {
 		query.Set("probe_cc", config.CountryCode)
+	} else if config.ProbeIP != "" {
+		query.Set("probe_ip", config.ProbeIP)
 	}
 	if config.Limit > 0 {
 		query.Set("limit", fmt.Sprintf("%d", config.Limit))
 	}
+	if config.Offset > 0 {
+		query.Set("offset", fmt.Sprintf("%d", config.Offset))
+	}
 	if len(config.EnabledCategories) > 0 {
 		query.Set("category_codes", strings.Join(config.EnabledCategories, ","))
 	}
-	var response Result
-	err := (&jsonapi.Client{
+	response, write, err := fetch(ctx, config, query)
+	if err != nil {
+		return nil, err
+	}
+	raw := *response // filter does not modify the original results
+	response.HasMore = response.Metadata.NextURL != ""
+	response.NextOffset = config.Offset + int64(len(response.Results))
+	if config.StrictCategories {
+		filter(response, config.EnabledCategories)
+	}
+	if len(response.Results) < 1 {
+		// Do not cache this result, otherwise we would keep failing with
+		// ErrNoURLs until the entry expires, even if the server recovers.
+		return nil, ErrNoURLs
+	}
+	if write != nil {
+		write(raw)
+	}
+	return response, nil
+}
+
+// cacheEntry is an entry stored into the cache.
+type cacheEntry struct {
+	Result Result    `json:"result"`
+	Time   time.Time `json:"time"`
+}
+
+// fetch returns the result from the cache, if possible, and otherwise
+// fetches it from the network. In the latter case, when caching is
+// enabled, it also returns a function to write the result into the
+// cache, which the caller should call only if the result is usable.
+func fetch(ctx context.Context, config Config, query url.Values) (
+	*Result, func(result Result), error) {
+	cacheEnabled := config.CacheStore != nil && config.CacheMaxAge > 0
+	key := cacheKey(config, query)
+	if cacheEnabled {
+		if result := readCache(config, key); result != nil {
+			return result, nil, nil
+		}
+	}
+	response, err := readWithRetry(ctx, config, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	lookupServerASN(config, response)
+	if !cacheEnabled {
+		return response, nil, nil
+	}
+	return response, func(result Result) {
+		writeCache(config, key, result)
+	}, nil
+}
+
+// cacheKey returns the key of the cache entry for query sent to
+// the server at config.BaseURL.
+func cacheKey(config Config, query url.Values) string {
+	return "testlists-urls:" + config.BaseURL + "?" + query.Encode()
+}
+
+// defaultRetryBackoff is the initial backoff used when the
+// config does not specify any backoff.
+const defaultRetryBackoff = time.Second
+
+// readWithRetry fetches the result from the network, retrying when
+// the error is retryable and config allows us to retry.
+func readWithRetry(ctx context.Context, config Config, query url.Values) (*Result, error) {
+	client := &jsonapi.Client{
 		BaseURL:    config.BaseURL,
+		Headers:    config.Headers,
 		HTTPClient: config.HTTPClient,
 		Logger:     config.Logger,
 		UserAgent:  config.UserAgent,
-	}).ReadWithQuery(ctx, "/api/v1/test-list/urls", query, &response)
+	}
+	backoff := config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := int64(0); ; i++ {
+		var (
+			response Result
+			serverIP string
+		)
+		tracectx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				serverIP = remoteIP(info.Conn)
+			},
+		})
+		err := client.ReadWithQuery(tracectx, "/api/v1/test-list/urls", query, &response)
+		if err == nil {
+			response.ServerIP = serverIP
+			return &response, nil
+		}
+		if i >= config.MaxRetries || ctx.Err() != nil || !retryable(err) {
+			return nil, err
+		}
+		config.Logger.Debugf("urls: query failed: %s (will retry)", err.Error())
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// remoteIP returns the IP address of the remote endpoint of conn, or
+// an empty string if the remote address is not an IP endpoint.
+func remoteIP(conn net.Conn) string {
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || net.ParseIP(ip) == nil {
+		return ""
+	}
+	return ip
+}
+
+// lookupServerASN sets the ServerASN of result, if possible. A failure
+// in looking up the ASN is not fatal, hence we just log it.
+func lookupServerASN(config Config, result *Result) {
+	if config.ASNLookupper == nil || result.ServerIP == "" {
+		return
+	}
+	asn, _, err := config.ASNLookupper.LookupASN(result.ServerIP)
 	if err != nil {
-		return nil, err
+		config.Logger.Debugf("urls: cannot lookup server ASN: %s", err.Error())
+		return
+	}
+	result.ServerASN = asn
+}
+
+// retryable returns true when err is a 5xx status code or a
+// transient network error, i.e., a timeout, a failure in dialing,
+// reading, or writing, or the server closing the connection early.
+func retryable(err error) bool {
+	var statusErr *jsonapi.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// readCache returns the cached result for key, or nil if there is
+// no cached result or the cached result is stale.
+func readCache(config Config, key string) *Result {
+	data, err := config.CacheStore.Get(key)
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		config.Logger.Debugf("urls: cannot parse cache entry: %s", err.Error())
+		return nil
+	}
+	if time.Since(entry.Time) > config.CacheMaxAge {
+		return nil
+	}
+	config.Logger.Debugf("urls: using cached result for %s", key)
+	return &entry.Result
+}
+
+// writeCache writes result into the cache using key.
+func writeCache(config Config, key string, result Result) {
+	data, err := json.Marshal(cacheEntry{Result: result, Time: time.Now()})
+	if err != nil {
+		return
+	}
+	if err := config.CacheStore.Set(key, data); err != nil {
+		config.Logger.Debugf("urls: cannot write cache entry: %s", err.Error())
+	}
+}
+
+// filter removes from result the URLs whose category is not in
+// categories, unless categories is empty, as well as the duplicate
+// URLs. It preserves the order of the results.
+func filter(result *Result, categories []string) {
+	allowed := make(map[string]bool)
+	for _, category := range categories {
+		allowed[category] = true
+	}
+	seen := make(map[string]bool)
+	var out []model.URLInfo
+	for _, entry := range result.Results {
+		if len(allowed) > 0 && !allowed[entry.CategoryCode] {
+			continue
+		}
+		if seen[entry.URL] {
+			continue
+		}
+		seen[entry.URL] = true
+		out = append(out, entry)
 	}
-	return &response, nil
+	result.Filtered = int64(len(result.Results) - len(out))
+	result.Results = out
 }
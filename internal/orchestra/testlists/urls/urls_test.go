@@ -2,10 +2,21 @@ package urls
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/ooni/probe-engine/internal/kvstore"
+	"github.com/ooni/probe-engine/model"
 )
 
 func TestIntegrationSuccess(t *testing.T) {
@@ -47,3 +58,794 @@ func TestIntegrationFailure(t *testing.T) {
 		t.Fatal("expected nil result here")
 	}
 }
+
+func TestUnitResultMetadata(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"metadata":{"count":4},"results":[
+				{"category_code":"NEWS","country_code":"IT","url":"https://a.it"},
+				{"category_code":"CULTR","country_code":"XX","url":"https://b.org"},
+				{"category_code":"NEWS","country_code":"XX","url":"https://c.org"},
+				{"url":"https://d.org"}]}`))
+		}))
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:           server.URL,
+		CountryCode:       "IT",
+		EnabledCategories: []string{"NEWS", "CULTR"},
+		HTTPClient:        http.DefaultClient,
+		Logger:            log.Log,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 4 {
+		t.Fatal("unexpected number of results")
+	}
+	first := result.Results[0]
+	if first.CategoryCode != "NEWS" || first.CountryCode != "IT" || first.URL != "https://a.it" {
+		t.Fatalf("unexpected first result: %+v", first)
+	}
+	groups := result.ByCategory()
+	if len(groups) != 3 {
+		t.Fatal("unexpected number of categories")
+	}
+	news := groups["NEWS"]
+	if len(news) != 2 || news[0].URL != "https://a.it" || news[1].URL != "https://c.org" {
+		t.Fatal("unexpected NEWS results")
+	}
+	cultr := groups["CULTR"]
+	if len(cultr) != 1 || cultr[0].CountryCode != "XX" {
+		t.Fatal("unexpected CULTR results")
+	}
+	if len(groups[""]) != 1 || groups[""][0].URL != "https://d.org" {
+		t.Fatal("unexpected results without category")
+	}
+}
+
+func TestUnitPagination(t *testing.T) {
+	var gotQuery url.Values
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Write([]byte(`{"metadata":{"count":4,"next_url":"https://x.org/?offset=4"},
+				"results":[{"category_code":"NEWS","url":"https://a.org"},
+				{"category_code":"CULTR","url":"https://b.org"}]}`))
+		}))
+	defer server.Close()
+	config := Config{
+		BaseURL:           server.URL,
+		CountryCode:       "IT",
+		EnabledCategories: []string{"NEWS", "CULTR"},
+		HTTPClient:        http.DefaultClient,
+		Limit:             2,
+		Logger:            log.Log,
+		Offset:            2,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotQuery.Get("offset") != "2" || gotQuery.Get("limit") != "2" {
+		t.Fatal("offset or limit not sent")
+	}
+	if gotQuery.Get("category_codes") != "NEWS,CULTR" {
+		t.Fatal("category_codes not sent")
+	}
+	if !result.HasMore {
+		t.Fatal("expected more results")
+	}
+	if result.NextOffset != 4 {
+		t.Fatal("unexpected next offset")
+	}
+}
+
+func TestUnitPaginationLastPage(t *testing.T) {
+	var gotQuery url.Values
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Write([]byte(`{"metadata":{"count":1},
+				"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	config := Config{
+		BaseURL:    server.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := gotQuery["limit"]; found {
+		t.Fatal("zero limit should not be sent")
+	}
+	if _, found := gotQuery["offset"]; found {
+		t.Fatal("zero offset should not be sent")
+	}
+	if result.HasMore {
+		t.Fatal("expected no more results")
+	}
+	if result.NextOffset != 1 {
+		t.Fatal("unexpected next offset")
+	}
+}
+
+func newFilterServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"results":[
+				{"category_code":"NEWS","url":"https://a.org"},
+				{"category_code":"GAME","url":"https://b.org"},
+				{"category_code":"NEWS","url":"https://a.org"},
+				{"category_code":"CULTR","url":"https://c.org"}]}`))
+		}))
+}
+
+func TestUnitStrictCategories(t *testing.T) {
+	server := newFilterServer()
+	defer server.Close()
+	config := Config{
+		BaseURL:           server.URL,
+		EnabledCategories: []string{"NEWS", "CULTR"},
+		HTTPClient:        http.DefaultClient,
+		Logger:            log.Log,
+		StrictCategories:  true,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 2 {
+		t.Fatal("unexpected number of results")
+	}
+	if result.Results[0].URL != "https://a.org" || result.Results[1].URL != "https://c.org" {
+		t.Fatal("unexpected results order")
+	}
+	if result.Filtered != 2 {
+		t.Fatal("unexpected filtered count")
+	}
+	if result.NextOffset != 4 {
+		t.Fatal("next offset should not depend on filtering")
+	}
+}
+
+func TestUnitStrictCategoriesNoCategories(t *testing.T) {
+	server := newFilterServer()
+	defer server.Close()
+	config := Config{
+		BaseURL:          server.URL,
+		HTTPClient:       http.DefaultClient,
+		Logger:           log.Log,
+		StrictCategories: true,
+		UserAgent:        "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 3 || result.Filtered != 1 {
+		t.Fatal("expected only duplicates to be removed")
+	}
+}
+
+func TestUnitNoStrictCategories(t *testing.T) {
+	server := newFilterServer()
+	defer server.Close()
+	config := Config{
+		BaseURL:           server.URL,
+		EnabledCategories: []string{"NEWS", "CULTR"},
+		HTTPClient:        http.DefaultClient,
+		Logger:            log.Log,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 4 || result.Filtered != 0 {
+		t.Fatal("expected no filtering")
+	}
+}
+
+func TestUnitCountryCodeSelection(t *testing.T) {
+	var gotQuery url.Values
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.Query()
+			w.Write([]byte(`{"results":[{"url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	var testcases = []struct {
+		countryCode string
+		probeIP     string
+		expectCC    string
+		expectIP    string
+	}{
+		{countryCode: "", probeIP: "", expectCC: "", expectIP: ""},
+		{countryCode: "ZZ", probeIP: "", expectCC: "", expectIP: ""},
+		{countryCode: "", probeIP: "1.2.3.4", expectCC: "", expectIP: "1.2.3.4"},
+		{countryCode: "ZZ", probeIP: "1.2.3.4", expectCC: "", expectIP: "1.2.3.4"},
+		{countryCode: "IT", probeIP: "1.2.3.4", expectCC: "IT", expectIP: ""},
+	}
+	for _, tc := range testcases {
+		config := Config{
+			BaseURL:     server.URL,
+			CountryCode: tc.countryCode,
+			HTTPClient:  http.DefaultClient,
+			Logger:      log.Log,
+			ProbeIP:     tc.probeIP,
+			UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+		}
+		if _, err := Query(context.Background(), config); err != nil {
+			t.Fatal(err)
+		}
+		if gotQuery.Get("probe_cc") != tc.expectCC {
+			t.Fatalf("unexpected probe_cc for %+v", tc)
+		}
+		if gotQuery.Get("probe_ip") != tc.expectIP {
+			t.Fatalf("unexpected probe_ip for %+v", tc)
+		}
+	}
+}
+
+func TestUnitFailureWithServerSelectedCountry(t *testing.T) {
+	config := Config{
+		BaseURL:    "\t\t\t",
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+		ProbeIP:    "1.2.3.4",
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	}
+	result, err := Query(context.Background(), config)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+}
+
+func TestUnitCache(t *testing.T) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			w.Write([]byte(`{"metadata":{"next_url":"https://x.org/"},
+				"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	store := kvstore.NewMemoryKeyValueStore()
+	config := Config{
+		BaseURL:     server.URL,
+		CacheMaxAge: time.Hour,
+		CacheStore:  store,
+		CountryCode: "IT",
+		HTTPClient:  http.DefaultClient,
+		Limit:       1,
+		Logger:      log.Log,
+		UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+	}
+	for i := 0; i < 2; i++ {
+		result, err := Query(context.Background(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Results) != 1 || !result.HasMore || result.NextOffset != 1 {
+			t.Fatal("unexpected result")
+		}
+	}
+	if count != 1 {
+		t.Fatal("expected the second query to hit the cache")
+	}
+	config.CountryCode = "DE"
+	if _, err := Query(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatal("expected a different key to miss the cache")
+	}
+	other := httptest.NewServer(server.Config.Handler)
+	defer other.Close()
+	config.BaseURL = other.URL
+	if _, err := Query(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatal("expected a different server to miss the cache")
+	}
+}
+
+func TestUnitCacheSkipsEmptyResults(t *testing.T) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			if count == 1 {
+				w.Write([]byte(`{"metadata":{"count":0},"results":[]}`))
+				return
+			}
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	store := kvstore.NewMemoryKeyValueStore()
+	config := Config{
+		BaseURL:     server.URL,
+		CacheMaxAge: time.Hour,
+		CacheStore:  store,
+		CountryCode: "IT",
+		HTTPClient:  http.DefaultClient,
+		Logger:      log.Log,
+		UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+	}
+	if _, err := Query(context.Background(), config); !errors.Is(err, ErrNoURLs) {
+		t.Fatal("not the error we expected")
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || len(result.Results) != 1 {
+		t.Fatal("expected the empty result not to be cached")
+	}
+}
+
+func TestUnitCacheSkipsFilteredOutResults(t *testing.T) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			if count == 1 {
+				w.Write([]byte(`{"results":[{"category_code":"GAME","url":"https://a.org"}]}`))
+				return
+			}
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	config := Config{
+		BaseURL:           server.URL,
+		CacheMaxAge:       time.Hour,
+		CacheStore:        kvstore.NewMemoryKeyValueStore(),
+		CountryCode:       "IT",
+		EnabledCategories: []string{"NEWS"},
+		HTTPClient:        http.DefaultClient,
+		Logger:            log.Log,
+		StrictCategories:  true,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	}
+	if _, err := Query(context.Background(), config); !errors.Is(err, ErrNoURLs) {
+		t.Fatal("not the error we expected")
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || len(result.Results) != 1 {
+		t.Fatal("expected the filtered out result not to be cached")
+	}
+}
+
+func TestUnitCacheDisabledWithZeroMaxAge(t *testing.T) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	store := kvstore.NewMemoryKeyValueStore()
+	config := Config{
+		BaseURL:     server.URL,
+		CacheStore:  store,
+		CountryCode: "IT",
+		HTTPClient:  http.DefaultClient,
+		Logger:      log.Log,
+		UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := Query(context.Background(), config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count != 2 {
+		t.Fatal("expected each query to hit the network")
+	}
+	key := cacheKey(config, url.Values{"probe_cc": {"IT"}})
+	if _, err := store.Get(key); err == nil {
+		t.Fatal("expected nothing to be written into the cache")
+	}
+}
+
+func TestUnitCacheStale(t *testing.T) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	store := kvstore.NewMemoryKeyValueStore()
+	config := Config{
+		BaseURL:     server.URL,
+		CacheMaxAge: time.Hour,
+		CacheStore:  store,
+		CountryCode: "IT",
+		HTTPClient:  http.DefaultClient,
+		Logger:      log.Log,
+		UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+	}
+	key := cacheKey(config, url.Values{"probe_cc": {"IT"}})
+	data, err := json.Marshal(cacheEntry{
+		Result: Result{Results: []model.URLInfo{{URL: "https://old.org"}}},
+		Time:   time.Now().Add(-2 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(key, data); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || result.Results[0].URL != "https://a.org" {
+		t.Fatal("expected the stale entry to be refreshed")
+	}
+	data, err = store.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Result.Results[0].URL != "https://a.org" {
+		t.Fatal("expected the cache to be repopulated")
+	}
+}
+
+func TestUnitCacheInvalidEntryAndNetworkFailure(t *testing.T) {
+	store := kvstore.NewMemoryKeyValueStore()
+	config := Config{
+		BaseURL:     "\t\t\t",
+		CacheMaxAge: time.Hour,
+		CacheStore:  store,
+		CountryCode: "IT",
+		HTTPClient:  http.DefaultClient,
+		Logger:      log.Log,
+		UserAgent:   "ooniprobe-engine/v0.1.0-dev",
+	}
+	key := cacheKey(config, url.Values{"probe_cc": {"IT"}})
+	if err := store.Set(key, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Query(context.Background(), config)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+}
+
+func TestUnitNoURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"metadata":{"count":0},"results":[]}`))
+		}))
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:    server.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	})
+	if !errors.Is(err, ErrNoURLs) {
+		t.Fatal("not the error we expected")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+}
+
+func TestUnitNoURLsAfterFiltering(t *testing.T) {
+	server := newFilterServer()
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:           server.URL,
+		EnabledCategories: []string{"XED"},
+		HTTPClient:        http.DefaultClient,
+		Logger:            log.Log,
+		StrictCategories:  true,
+		UserAgent:         "ooniprobe-engine/v0.1.0-dev",
+	})
+	if !errors.Is(err, ErrNoURLs) {
+		t.Fatal("not the error we expected")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+}
+
+type headersSaver struct {
+	headers http.Header
+}
+
+func (hs *headersSaver) RoundTrip(req *http.Request) (*http.Response, error) {
+	hs.headers = req.Header
+	return &http.Response{
+		Body: ioutil.NopCloser(strings.NewReader(
+			`{"results":[{"url":"https://a.org"}]}`)),
+		Header:     http.Header{},
+		Request:    req,
+		StatusCode: 200,
+	}, nil
+}
+
+func TestUnitCustomHeaders(t *testing.T) {
+	saver := new(headersSaver)
+	_, err := Query(context.Background(), Config{
+		BaseURL: "https://orchestrate.ooni.io",
+		Headers: http.Header{
+			"Authorization": []string{"Bearer xo"},
+			"User-Agent":    []string{"antani/1.0"},
+		},
+		HTTPClient: &http.Client{Transport: saver},
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saver.headers.Get("Authorization") != "Bearer xo" {
+		t.Fatal("custom header did not reach the request")
+	}
+	if saver.headers.Get("User-Agent") != "ooniprobe-engine/v0.1.0-dev" {
+		t.Fatal("custom header overrode the User-Agent")
+	}
+}
+
+func TestUnitEmptyHeaders(t *testing.T) {
+	saver := new(headersSaver)
+	_, err := Query(context.Background(), Config{
+		BaseURL:    "https://orchestrate.ooni.io",
+		Headers:    http.Header{},
+		HTTPClient: &http.Client{Transport: saver},
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saver.headers) != 1 {
+		t.Fatal("unexpected headers", saver.headers)
+	}
+}
+
+func newFlakyServer(failures int, status int) (*httptest.Server, *int) {
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			if count <= failures {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(`{"results":[{"url":"https://a.org"}]}`))
+		}))
+	return server, &count
+}
+
+func TestUnitRetryOnServerError(t *testing.T) {
+	server, count := newFlakyServer(2, 503)
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:      server.URL,
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 1 {
+		t.Fatal("unexpected number of results")
+	}
+	if *count != 3 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestUnitRetryGivesUp(t *testing.T) {
+	server, count := newFlakyServer(3, 503)
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:      server.URL,
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+	if *count != 3 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestUnitNoRetryOnClientError(t *testing.T) {
+	server, count := newFlakyServer(1, 404)
+	defer server.Close()
+	result, err := Query(context.Background(), Config{
+		BaseURL:      server.URL,
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+	if *count != 1 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestUnitNoRetryWithInvalidBaseURL(t *testing.T) {
+	result, err := Query(context.Background(), Config{
+		BaseURL:      "\t\t\t",
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		MaxRetries:   2,
+		RetryBackoff: time.Hour,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+}
+
+func TestUnitRetryContextCancelled(t *testing.T) {
+	server, count := newFlakyServer(1, 503)
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	result, err := Query(ctx, Config{
+		BaseURL:      server.URL,
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		MaxRetries:   2,
+		RetryBackoff: time.Hour,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result != nil {
+		t.Fatal("expected nil result here")
+	}
+	if *count != 1 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestUnitRetryable(t *testing.T) {
+	if retryable(errors.New("mocked error")) {
+		t.Fatal("generic errors should not be retryable")
+	}
+	if !retryable(&url.Error{Op: "Get", Err: io.ErrUnexpectedEOF}) {
+		t.Fatal("unexpected EOF should be retryable")
+	}
+	if !retryable(&net.OpError{Op: "dial", Err: errors.New("connection refused")}) {
+		t.Fatal("dial errors should be retryable")
+	}
+}
+
+type stubASNLookupper struct {
+	asn   uint
+	err   error
+	input string
+}
+
+func (l *stubASNLookupper) LookupASN(ip string) (uint, string, error) {
+	l.input = ip
+	return l.asn, "Stub Org", l.err
+}
+
+func queryServerASN(t *testing.T, lookupper model.ASNLookupper) *Result {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	config := Config{
+		BaseURL:    server.URL,
+		HTTPClient: http.DefaultClient,
+		Logger:     log.Log,
+		UserAgent:  "ooniprobe-engine/v0.1.0-dev",
+	}
+	if lookupper != nil {
+		config.ASNLookupper = lookupper
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ServerIP != "127.0.0.1" {
+		t.Fatalf("unexpected server IP: %s", result.ServerIP)
+	}
+	return result
+}
+
+func TestUnitServerASN(t *testing.T) {
+	lookupper := &stubASNLookupper{asn: 30722}
+	result := queryServerASN(t, lookupper)
+	if lookupper.input != "127.0.0.1" {
+		t.Fatal("the lookupper did not receive the server IP")
+	}
+	if result.ServerASN != 30722 {
+		t.Fatal("unexpected server ASN")
+	}
+}
+
+func TestUnitServerASNLookupFailure(t *testing.T) {
+	lookupper := &stubASNLookupper{asn: 30722, err: errors.New("mocked error")}
+	result := queryServerASN(t, lookupper)
+	if result.ServerASN != 0 {
+		t.Fatal("expected zero server ASN on failure")
+	}
+}
+
+func TestUnitServerASNNoLookupper(t *testing.T) {
+	result := queryServerASN(t, nil)
+	if result.ServerASN != 0 {
+		t.Fatal("expected zero server ASN without a lookupper")
+	}
+}
+
+func TestUnitServerIPEmptyWhenCached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"results":[{"category_code":"NEWS","url":"https://a.org"}]}`))
+		}))
+	defer server.Close()
+	config := Config{
+		ASNLookupper: &stubASNLookupper{asn: 30722},
+		BaseURL:      server.URL,
+		CacheMaxAge:  time.Hour,
+		CacheStore:   kvstore.NewMemoryKeyValueStore(),
+		HTTPClient:   http.DefaultClient,
+		Logger:       log.Log,
+		UserAgent:    "ooniprobe-engine/v0.1.0-dev",
+	}
+	if _, err := Query(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Query(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ServerIP != "" || result.ServerASN != 0 {
+		t.Fatal("expected empty server IP and ASN for a cached result")
+	}
+}
@@ -284,6 +284,12 @@ type URLInfo struct {
 	URL          string `json:"url"`
 }
 
+// ASNLookupper maps an IP address to the number of the autonomous
+// system it belongs to and to the name of the organization owning it.
+type ASNLookupper interface {
+	LookupASN(ip string) (asn uint, org string, err error)
+}
+
 // KeyValueStore is a key-value store used by the session.
 type KeyValueStore interface {
 	Get(key string) (value []byte, err error)
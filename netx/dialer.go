@@ -8,20 +8,31 @@ import (
 	"errors"
 	"io/ioutil"
 	"net"
+	"net/url"
 	"time"
 
 	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/internal/dialer"
+	"github.com/ooni/probe-engine/netx/internal/dialer/dialerbase"
+	"github.com/ooni/probe-engine/netx/internal/dialer/dnsdialer"
+	"github.com/ooni/probe-engine/netx/internal/dialer/tlsdialer"
 	"github.com/ooni/probe-engine/netx/internal/resolver"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 // Dialer performs measurements while dialing.
 type Dialer struct {
-	Beginning time.Time
-	Handler   modelx.Handler
-	Resolver  modelx.DNSResolver
-	TLSConfig *tls.Config
+	Beginning       time.Time
+	Handler         modelx.Handler
+	Resolver        modelx.DNSResolver
+	TLSConfig       *tls.Config
+	forceIPv6       bool
+	keepAlive       time.Duration
+	localIP         net.IP
+	port            string
+	proxyURL        *url.URL
+	skipResolution  bool
+	skipVerifyHosts []string
 }
 
 func newDialer(beginning time.Time, handler modelx.Handler) *Dialer {
@@ -61,9 +72,36 @@ func (d *Dialer) DialContext(
 	ctx context.Context, network, address string,
 ) (conn net.Conn, err error) {
 	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
-	return dialer.New(
-		d.Resolver, new(net.Dialer),
-	).DialContext(ctx, network, address)
+	address, err = dnsdialer.OverridePort(address, d.port)
+	if err != nil {
+		return nil, err
+	}
+	child, err := d.newDialer()
+	if err != nil {
+		return nil, err
+	}
+	return child.DialContext(ctx, network, address)
+}
+
+func (d *Dialer) newDialer() (modelx.Dialer, error) {
+	child := dialer.New(d.Resolver, &dialerbase.NetDialer{
+		KeepAlive: d.keepAlive,
+		LocalIP:   d.localIP,
+	})
+	child.ForceIPv6 = d.forceIPv6
+	child.SkipResolution = d.skipResolution
+	if d.proxyURL != nil {
+		proxy, err := dialer.NewProxy(child, d.proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		// Use the configured CA bundle also to verify an "https" proxy.
+		if d.TLSConfig != nil {
+			proxy.TLSConfig = &tls.Config{RootCAs: d.TLSConfig.RootCAs}
+		}
+		return proxy, nil
+	}
+	return child, nil
 }
 
 // DialTLS is like Dial, but creates TLS connections.
@@ -77,10 +115,17 @@ func (d *Dialer) DialTLSContext(
 	ctx context.Context, network, address string,
 ) (net.Conn, error) {
 	ctx = maybeWithMeasurementRoot(ctx, d.Beginning, d.Handler)
-	return dialer.NewTLS(
-		dialer.New(d.Resolver, new(net.Dialer)),
-		d.TLSConfig,
-	).DialTLSContext(ctx, network, address)
+	address, err := dnsdialer.OverridePort(address, d.port)
+	if err != nil {
+		return nil, err
+	}
+	child, err := d.newDialer()
+	if err != nil {
+		return nil, err
+	}
+	tlsDialer := dialer.NewTLS(child, d.TLSConfig)
+	tlsDialer.SkipVerifyHosts = d.skipVerifyHosts
+	return tlsDialer.DialTLSContext(ctx, network, address)
 }
 
 // SetCABundle configures the dialer to use a specific CA bundle. This
@@ -111,6 +156,57 @@ func (d *Dialer) ForceSkipVerify() error {
 	return nil
 }
 
+// SetSkipVerifyHosts configures the hosts for which DialTLS does not
+// verify the certificate, e.g., to accept a self-signed certificate for
+// a test endpoint while still verifying the certificates of the other
+// hosts, including the OONI backend. We match hosts against the SNI in
+// a case insensitive way. By default, we verify all hosts, unless you
+// call ForceSkipVerify. Whether we verified the certificate is recorded
+// in the InsecureSkipVerify field of the TLS handshake done event. This
+// setting has no effect on TLS handshakes performed by net/http.
+//
+// This functionality is not goroutine safe. You should only change
+// this setting before starting to use the Dialer.
+func (d *Dialer) SetSkipVerifyHosts(hosts []string) {
+	d.skipVerifyHosts = hosts
+}
+
+// ErrInvalidPin indicates that a pin passed to SetPinnedKeys is
+// not the base64 encoding of a SHA256 hash.
+var ErrInvalidPin = tlsdialer.ErrInvalidPin
+
+// SetPinnedKeys pins the public keys that we expect to see in the
+// certificate chain, like HPKP (RFC7469) does, which protects traffic
+// with, e.g., the OONI backend against MITM. Each pin is the base64
+// encoding of the SHA256 hash of a SubjectPublicKeyInfo. The handshake
+// fails with the ssl_pin_mismatch failure unless a certificate in the
+// chain matches a pin. An empty list of pins disables pinning.
+//
+// This functionality is not goroutine safe. You should only change
+// the pinned keys before starting to use the Dialer.
+func (d *Dialer) SetPinnedKeys(pins []string) error {
+	verifier, err := tlsdialer.NewPinVerifier(pins)
+	if err == nil {
+		d.TLSConfig.VerifyPeerCertificate = verifier
+	}
+	return err
+}
+
+// SetClientSessionCache configures the cache used to resume TLS
+// sessions. By default there is no cache, hence every TLS handshake is
+// a full handshake. Whether a handshake resumed a session is recorded
+// in the DidResume field of the TLS connection state.
+func (d *Dialer) SetClientSessionCache(cache tls.ClientSessionCache) {
+	d.TLSConfig.ClientSessionCache = cache
+}
+
+// ForceFullHandshake forces every TLS handshake to be a full handshake,
+// even when a session cache has been configured.
+func (d *Dialer) ForceFullHandshake() {
+	d.TLSConfig.ClientSessionCache = nil
+	d.TLSConfig.SessionTicketsDisabled = true
+}
+
 // ConfigureDNS configures the DNS resolver. The network argument
 // selects the type of resolver. The address argument indicates the
 // resolver address and depends on the network.
@@ -128,15 +224,25 @@ func (d *Dialer) ForceSkipVerify() error {
 // not ConfigureDNS, this is the default resolver used.
 //
 // - "udp": indicates that we should send queries using UDP. In this
-// case the address is a host, port UDP endpoint.
+// case the address is a host, port UDP endpoint. When a response is
+// truncated, we retry the query using TCP.
 //
-// - "tcp": like "udp" but we use TCP.
+// - "tcp": like "udp" but we always use TCP.
 //
 // - "dot": we use DNS over TLS (DoT). In this case the address is
 // the domain name of the DoT server.
 //
-// - "doh": we use DNS over HTTPS (DoH). In this case the address is
-// the URL of the DoH server.
+// - "doh": we use DNS over HTTPS (DoH) with the POST method, which
+// prevents caching and keeps the query out of the URL. In this case the
+// address is the URL of the DoH server.
+//
+// - "doh-get": like "doh" but we use the GET method, for compatibility
+// with servers that only support GET. The address may also be the URI
+// template of the DoH server, e.g. "https://dns.google/dns-query{?dns}".
+//
+// With both "doh" and "doh-get", the method and the URL are recorded
+// in the resolve events, and the HTTP events of the round trip with
+// the DoH server are emitted along with the DNS events.
 //
 // For example:
 //
@@ -145,8 +251,9 @@ func (d *Dialer) ForceSkipVerify() error {
 //   d.ConfigureDNS("tcp", "8.8.8.8:53")
 //   d.ConfigureDNS("dot", "dns.quad9.net")
 //   d.ConfigureDNS("doh", "https://cloudflare-dns.com/dns-query")
+//   d.ConfigureDNS("doh-get", "https://dns.google/dns-query{?dns}")
 func (d *Dialer) ConfigureDNS(network, address string) error {
-	r, err := newResolver(d.Beginning, d.Handler, network, address)
+	r, err := newResolver(d.Beginning, d.Handler, network, address, ResolverOptions{})
 	if err == nil {
 		d.Resolver = r
 	}
@@ -158,3 +265,103 @@ func (d *Dialer) ConfigureDNS(network, address string) error {
 func (d *Dialer) SetResolver(r modelx.DNSResolver) {
 	d.Resolver = r
 }
+
+// ErrLocalAddrNotAvailable is returned by SetLocalAddr when the address
+// is not assigned to any of the interfaces of this host.
+var ErrLocalAddrNotAvailable = dialerbase.ErrLocalAddrNotAvailable
+
+// SetLocalAddr forces the connections to leave from a specific local
+// address, which is useful on multi-homed hosts. The address argument is
+// either an IP address or the name of a network interface, in which case
+// we use its first IPv4 address, or its first IPv6 address if it has no
+// IPv4 addresses. The chosen address is recorded in the LocalAddress
+// field of the connect events.
+//
+// This functionality is not goroutine safe. You should only change
+// the local address before starting to use the Dialer.
+func (d *Dialer) SetLocalAddr(address string) error {
+	ip, err := dialerbase.LookupLocalIP(address)
+	if err == nil {
+		d.localIP = ip
+	}
+	return err
+}
+
+// SetProxy configures the dialer to connect through the proxy at
+// proxyURL, whose scheme must be "socks5", "http", or "https". With
+// "http" and "https", we use the CONNECT method and, with "https", we
+// also use TLS to talk with the proxy, verifying its certificate using
+// the CA bundle configured with SetCABundle, if any. The target hostnames
+// are resolved by the proxy. Each dial emits the ProxyConnectStart and
+// ProxyConnectDone events, which allow to tell proxy failures apart
+// from failures of the target. A nil proxyURL disables the proxy.
+//
+// This functionality is not goroutine safe. You should only change
+// the proxy before starting to use the Dialer.
+func (d *Dialer) SetProxy(proxyURL *url.URL) error {
+	if proxyURL != nil {
+		if _, err := dialer.NewProxy(nil, proxyURL); err != nil {
+			return err
+		}
+	}
+	d.proxyURL = proxyURL
+	return nil
+}
+
+// SetKeepAlive configures the TCP keep-alive period. Zero, which is
+// the default, means that we use Go's default period, while a negative
+// value disables keep-alives. The configured value is recorded in the
+// KeepAlive field of the connect events.
+//
+// This functionality is not goroutine safe. You should only change
+// the keep-alive period before starting to use the Dialer.
+func (d *Dialer) SetKeepAlive(period time.Duration) {
+	d.keepAlive = period
+}
+
+// ErrMissingPort is returned when dialing an address that does not
+// contain a port if no port has been configured using SetPort.
+var ErrMissingPort = dnsdialer.ErrMissingPort
+
+// SetPort configures the port we connect to, which overrides the port
+// in the addresses passed to Dial, DialTLS, and their variants. Such
+// addresses may then contain only the host, e.g., "www.google.com" or
+// "2001:db8::1". This allows to scan several ports of a host using a
+// Dialer for each port. When using a proxy, we ask the proxy to connect
+// to this port. An empty port, which is the default, disables the
+// override, in which case dialing an address without a port fails
+// with ErrMissingPort.
+//
+// This functionality is not goroutine safe. You should only change
+// the port before starting to use the Dialer.
+func (d *Dialer) SetPort(port string) {
+	d.port = port
+}
+
+// SetForceIPv6 controls whether we should always try the IPv6 addresses
+// in the order returned by the resolver. By default, once we know that
+// this host has no IPv6 connectivity, we try IPv6 addresses after IPv4
+// addresses, to avoid wasting time. We check IPv6 connectivity once, in
+// the background, the first time we dial. Measurements that specifically
+// test IPv6 should force IPv6, so that attempts are not reordered.
+//
+// This functionality is not goroutine safe. You should only change
+// this setting before starting to use the Dialer.
+func (d *Dialer) SetForceIPv6(force bool) {
+	d.forceIPv6 = force
+}
+
+// SetSkipResolution controls whether we should skip resolving the
+// hostnames passed to Dial, DialTLS, and their variants. When skipping,
+// we pass the hostname to the underlying dialer, which resolves it using
+// the operating system, so that the configured resolver is not used and
+// we do not emit any resolve event. This is what you want when the
+// hostnames must be resolved by some other party, e.g., by a proxy
+// that is not configured using SetProxy. Note that, with SetProxy, the
+// proxy already resolves the target hostnames.
+//
+// This functionality is not goroutine safe. You should only change
+// this setting before starting to use the Dialer.
+func (d *Dialer) SetSkipResolution(skip bool) {
+	d.skipResolution = skip
+}
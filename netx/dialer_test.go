@@ -1,11 +1,19 @@
 package netx_test
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
 	"github.com/ooni/probe-engine/netx"
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 func TestIntegrationDialerDial(t *testing.T) {
@@ -113,3 +121,238 @@ func TestIntegrationDialerForceSpecificSNI(t *testing.T) {
 		t.Fatal("expected a nil connection here")
 	}
 }
+
+func dialTLSTwice(t *testing.T, dialer *netx.Dialer, address string) (resumed []bool) {
+	saver := &handlers.SavingHandler{}
+	dialer.Handler = saver
+	dialer.TLSConfig.MaxVersion = tls.VersionTLS12
+	for i := 0; i < 2; i++ {
+		conn, err := dialer.DialTLS("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	for _, ev := range saver.Read() {
+		if ev.TLSHandshakeDone != nil {
+			resumed = append(resumed, ev.TLSHandshakeDone.ConnectionState.DidResume)
+		}
+	}
+	if len(resumed) != 2 {
+		t.Fatal("unexpected number of TLS handshakes")
+	}
+	return
+}
+
+func TestIntegrationDialerSessionResumption(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	dialer := netx.NewDialer()
+	dialer.ForceSkipVerify()
+	dialer.SetClientSessionCache(tls.NewLRUClientSessionCache(0))
+	resumed := dialTLSTwice(t, dialer, server.Listener.Addr().String())
+	if resumed[0] || !resumed[1] {
+		t.Fatal("expected only the second handshake to resume")
+	}
+}
+
+func TestIntegrationDialerForceFullHandshake(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	dialer := netx.NewDialer()
+	dialer.ForceSkipVerify()
+	dialer.SetClientSessionCache(tls.NewLRUClientSessionCache(0))
+	dialer.ForceFullHandshake()
+	resumed := dialTLSTwice(t, dialer, server.Listener.Addr().String())
+	if resumed[0] || resumed[1] {
+		t.Fatal("expected no handshake to resume")
+	}
+}
+
+func TestIntegrationDialerSetSkipVerifyHosts(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	saver := new(handlers.SavingHandler)
+	dialer := netx.NewDialer()
+	dialer.Handler = saver
+	dialer.SetSkipVerifyHosts([]string{"127.0.0.1"})
+	conn, err := dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	handshakes := saver.TLSHandshakes()
+	if len(handshakes) != 1 || !handshakes[0].InsecureSkipVerify {
+		t.Fatal("expected a handshake without verification")
+	}
+	dialer.SetSkipVerifyHosts([]string{"www.example.com"})
+	conn, err = dialer.DialTLS("tcp", server.Listener.Addr().String())
+	if err == nil || err.Error() != modelx.FailureSSLUnknownAuthority {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+}
+
+func TestIntegrationDialerSetLocalAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialer := netx.NewDialer()
+	if err := dialer.SetLocalAddr("127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestIntegrationDialerSetLocalAddrNotAvailable(t *testing.T) {
+	dialer := netx.NewDialer()
+	err := dialer.SetLocalAddr("192.0.2.1")
+	if !errors.Is(err, netx.ErrLocalAddrNotAvailable) {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestIntegrationDialerSetKeepAlive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	saver := &handlers.SavingHandler{}
+	dialer := netx.NewDialer()
+	dialer.Handler = saver
+	dialer.SetKeepAlive(-1)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for _, ev := range saver.Read() {
+		if ev.Connect != nil && ev.Connect.KeepAlive != -1 {
+			t.Fatal("unexpected keep-alive period")
+		}
+	}
+}
+
+func TestIntegrationDialerSetPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := netx.NewDialer()
+	if _, err := dialer.Dial("tcp", "127.0.0.1"); !errors.Is(err, netx.ErrMissingPort) {
+		t.Fatal("not the error we expected", err)
+	}
+	saver := &handlers.SavingHandler{}
+	dialer.Handler = saver
+	dialer.SetPort(port)
+	conn, err := dialer.Dial("tcp", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	var found bool
+	for _, ev := range saver.Read() {
+		if ev.DialDone != nil {
+			found = true
+			if ev.DialDone.Address != listener.Addr().String() {
+				t.Fatal("unexpected address", ev.DialDone.Address)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no dial done event")
+	}
+}
+
+func TestIntegrationDialerSetSkipResolution(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := net.JoinHostPort("localhost", port)
+	dialer := netx.NewDialer()
+	dialer.SetResolver(brokenresolver.New())
+	if _, err := dialer.Dial("tcp", address); err == nil {
+		t.Fatal("expected an error here")
+	}
+	saver := &handlers.SavingHandler{}
+	dialer.Handler = saver
+	dialer.SetSkipResolution(true)
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(saver.Resolves()) != 0 {
+		t.Fatal("expected no resolve events")
+	}
+	var found bool
+	for _, ev := range saver.Read() {
+		if ev.DialDone != nil {
+			found = true
+			if ev.DialDone.Address != address {
+				t.Fatal("unexpected address", ev.DialDone.Address)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no dial done event")
+	}
+}
+
+func TestIntegrationDialerSetProxy(t *testing.T) {
+	dialer := netx.NewDialer()
+	err := dialer.SetProxy(&url.URL{Scheme: "ftp", Host: "127.0.0.1:21"})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddr := listener.Addr().String()
+	listener.Close() // so the connection to the proxy is refused
+	saver := &handlers.SavingHandler{}
+	dialer.Handler = saver
+	if err := dialer.SetProxy(&url.URL{Scheme: "socks5", Host: proxyAddr}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.Dial("tcp", "www.example.com:80")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	var done *modelx.ProxyConnectDoneEvent
+	for _, ev := range saver.Read() {
+		if ev.ResolveStart != nil && ev.ResolveStart.Hostname == "www.example.com" {
+			t.Fatal("the target should not be resolved locally")
+		}
+		if ev.ProxyConnectDone != nil {
+			done = ev.ProxyConnectDone
+		}
+	}
+	if done == nil || done.Error == nil || done.ProxyAddress != proxyAddr {
+		t.Fatal("unexpected ProxyConnectDone event")
+	}
+}
@@ -0,0 +1,46 @@
+package handlers
+
+// Cookies contains the cookies sent and received by the HTTP round
+// trip identified by TransactionID.
+type Cookies struct {
+	// Received contains the values of the Set-Cookie headers that
+	// we have received, in the order in which we received them.
+	Received []string
+
+	// Sent contains the values of the Cookie headers that we have
+	// sent, including the ones added by the http.Client's jar.
+	Sent []string
+
+	// TransactionID is the identifier of the transaction.
+	TransactionID int64
+
+	// URL is the request URL.
+	URL string
+}
+
+// Cookies returns the cookies sent and received by each saved HTTP
+// round trip that sent or received at least a cookie, in chronological
+// order. With redirects, each hop is a distinct round trip, so we can
+// see, e.g., which hop set a cookie. We read the cookies from the saved
+// headers, therefore we don't interfere with the cookie handling of
+// http.Client. Unlike Read, this method does not clear the internal buffer.
+func (h *SavingHandler) Cookies() (out []Cookies) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.snapshot() {
+		ev := m.HTTPRoundTripDone
+		if ev == nil {
+			continue
+		}
+		entry := Cookies{
+			Received:      ev.ResponseHeaders["Set-Cookie"],
+			Sent:          ev.RequestHeaders["Cookie"],
+			TransactionID: ev.TransactionID,
+			URL:           ev.RequestURL,
+		}
+		if len(entry.Received) > 0 || len(entry.Sent) > 0 {
+			out = append(out, entry)
+		}
+	}
+	return
+}
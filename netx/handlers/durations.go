@@ -0,0 +1,130 @@
+package handlers
+
+import "time"
+
+// PhaseDuration is the duration of a phase of an HTTP round trip. When
+// the phase did not happen, e.g. there was no DNS lookup because we
+// reused a connection, Skipped is true and Duration is zero.
+type PhaseDuration struct {
+	Duration time.Duration
+	Skipped  bool
+}
+
+// RoundTripDurations contains the timing breakdown of the HTTP round
+// trip identified by TransactionID.
+type RoundTripDurations struct {
+	// Connect is the time we were blocked in CONNECT. When we had
+	// to try several addresses, it is the sum of all the attempts.
+	Connect PhaseDuration
+
+	// DNS is the time from the start to the end of the lookup.
+	DNS PhaseDuration
+
+	// TLS is the time spent in the TLS handshake.
+	TLS PhaseDuration
+
+	// TimeToFirstByte is the time from the beginning of the
+	// round trip until we've received the first response byte.
+	TimeToFirstByte PhaseDuration
+
+	// Total is the time from the beginning of the round trip until
+	// we've read the whole body. If the body was not read, it stops
+	// when we've got the response headers or an error.
+	Total PhaseDuration
+
+	// TransactionID is the identifier of the transaction.
+	TransactionID int64
+}
+
+type roundTripTimes struct {
+	connect       time.Duration
+	connected     bool
+	dnsStart      *time.Duration
+	dnsDone       *time.Duration
+	tlsStart      *time.Duration
+	tlsDone       *time.Duration
+	start         *time.Duration
+	firstByte     *time.Duration
+	roundTripDone *time.Duration
+	responseDone  *time.Duration
+}
+
+func newPhaseDuration(start, end *time.Duration) PhaseDuration {
+	if start == nil || end == nil || *end < *start {
+		return PhaseDuration{Skipped: true}
+	}
+	return PhaseDuration{Duration: *end - *start}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
+// Durations returns the timing breakdown of each saved HTTP round
+// trip, ordered by the time at which the round trip started. Unlike
+// Read, this method does not clear the internal buffer.
+func (h *SavingHandler) Durations() (out []RoundTripDurations) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var order []int64
+	times := make(map[int64]*roundTripTimes)
+	get := func(tid int64) *roundTripTimes {
+		if times[tid] == nil {
+			times[tid] = new(roundTripTimes)
+		}
+		return times[tid]
+	}
+	for _, m := range h.snapshot() {
+		switch {
+		case m.ResolveStart != nil && m.ResolveStart.TransactionID != 0:
+			get(m.ResolveStart.TransactionID).dnsStart = durationPtr(
+				m.ResolveStart.DurationSinceBeginning)
+		case m.ResolveDone != nil && m.ResolveDone.TransactionID != 0:
+			get(m.ResolveDone.TransactionID).dnsDone = durationPtr(
+				m.ResolveDone.DurationSinceBeginning)
+		case m.Connect != nil && m.Connect.TransactionID != 0:
+			rtt := get(m.Connect.TransactionID)
+			rtt.connect += m.Connect.SyscallDuration
+			rtt.connected = true
+		case m.TLSHandshakeStart != nil && m.TLSHandshakeStart.TransactionID != 0:
+			get(m.TLSHandshakeStart.TransactionID).tlsStart = durationPtr(
+				m.TLSHandshakeStart.DurationSinceBeginning)
+		case m.TLSHandshakeDone != nil && m.TLSHandshakeDone.TransactionID != 0:
+			get(m.TLSHandshakeDone.TransactionID).tlsDone = durationPtr(
+				m.TLSHandshakeDone.DurationSinceBeginning)
+		case m.HTTPRoundTripStart != nil:
+			order = append(order, m.HTTPRoundTripStart.TransactionID)
+			get(m.HTTPRoundTripStart.TransactionID).start = durationPtr(
+				m.HTTPRoundTripStart.DurationSinceBeginning)
+		case m.HTTPResponseStart != nil:
+			get(m.HTTPResponseStart.TransactionID).firstByte = durationPtr(
+				m.HTTPResponseStart.DurationSinceBeginning)
+		case m.HTTPRoundTripDone != nil:
+			get(m.HTTPRoundTripDone.TransactionID).roundTripDone = durationPtr(
+				m.HTTPRoundTripDone.DurationSinceBeginning)
+		case m.HTTPResponseDone != nil:
+			get(m.HTTPResponseDone.TransactionID).responseDone = durationPtr(
+				m.HTTPResponseDone.DurationSinceBeginning)
+		}
+	}
+	for _, tid := range order {
+		rtt := times[tid]
+		end := rtt.responseDone
+		if end == nil {
+			end = rtt.roundTripDone
+		}
+		entry := RoundTripDurations{
+			Connect:         PhaseDuration{Duration: rtt.connect},
+			DNS:             newPhaseDuration(rtt.dnsStart, rtt.dnsDone),
+			TLS:             newPhaseDuration(rtt.tlsStart, rtt.tlsDone),
+			TimeToFirstByte: newPhaseDuration(rtt.start, rtt.firstByte),
+			Total:           newPhaseDuration(rtt.start, end),
+			TransactionID:   tid,
+		}
+		if !rtt.connected {
+			entry.Connect = PhaseDuration{Skipped: true}
+		}
+		out = append(out, entry)
+	}
+	return
+}
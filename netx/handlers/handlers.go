@@ -27,3 +27,23 @@ func (noHandler) OnMeasurement(m modelx.Measurement) {
 
 // NoHandler is a Handler that does not print anything
 var NoHandler noHandler
+
+type multiHandler []modelx.Handler
+
+func (h multiHandler) OnMeasurement(m modelx.Measurement) {
+	for _, handler := range h {
+		handler.OnMeasurement(m)
+	}
+}
+
+// NewMultiHandler returns a Handler that forwards each measurement
+// to all the handlers, in order. Nil handlers are skipped.
+func NewMultiHandler(handlers ...modelx.Handler) modelx.Handler {
+	var h multiHandler
+	for _, handler := range handlers {
+		if handler != nil {
+			h = append(h, handler)
+		}
+	}
+	return h
+}
@@ -1,6 +1,8 @@
 package handlers_test
 
 import (
+	"errors"
+	"net/http"
 	"testing"
 
 	"github.com/ooni/probe-engine/netx/handlers"
@@ -11,3 +13,310 @@ func TestIntegration(t *testing.T) {
 	handlers.NoHandler.OnMeasurement(modelx.Measurement{})
 	handlers.StdoutHandler.OnMeasurement(modelx.Measurement{})
 }
+
+func TestUnitSavingHandlerUnbounded(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	for i := 0; i < 10; i++ {
+		saver.OnMeasurement(modelx.Measurement{
+			Close: &modelx.CloseEvent{ConnID: int64(i)},
+		})
+	}
+	events := saver.Read()
+	if len(events) != 10 {
+		t.Fatal("unexpected number of events")
+	}
+	for i, ev := range events {
+		if ev.Close.ConnID != int64(i) {
+			t.Fatal("events not in chronological order")
+		}
+	}
+	if saver.Dropped() != 0 {
+		t.Fatal("unexpected number of dropped events")
+	}
+	if len(saver.Read()) != 0 {
+		t.Fatal("Read did not drain the events")
+	}
+}
+
+func TestUnitSavingHandlerBounded(t *testing.T) {
+	saver := &handlers.SavingHandler{MaxEvents: 4}
+	for i := 0; i < 10; i++ {
+		saver.OnMeasurement(modelx.Measurement{
+			Close: &modelx.CloseEvent{ConnID: int64(i)},
+		})
+	}
+	events := saver.Read()
+	if len(events) != 4 {
+		t.Fatal("unexpected number of events")
+	}
+	for i, ev := range events {
+		if ev.Close.ConnID != int64(6+i) {
+			t.Fatal("events not in chronological order")
+		}
+	}
+	if saver.Dropped() != 6 {
+		t.Fatal("unexpected number of dropped events")
+	}
+	saver.OnMeasurement(modelx.Measurement{
+		Close: &modelx.CloseEvent{ConnID: 10},
+	})
+	events = saver.Read()
+	if len(events) != 1 || events[0].Close.ConnID != 10 {
+		t.Fatal("Read did not drain the events")
+	}
+}
+
+func TestUnitSavingHandlerGetters(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	saver.OnMeasurement(modelx.Measurement{
+		ResolveStart: &modelx.ResolveStartEvent{Hostname: "www.example.com"},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		ResolveDone: &modelx.ResolveDoneEvent{Hostname: "www.example.com"},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		Connect: &modelx.ConnectEvent{ConnID: 1},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{ConnID: 1},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{ConnID: 1},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		Connect: &modelx.ConnectEvent{ConnID: 2},
+	})
+	connects := saver.Connects()
+	if len(connects) != 2 || connects[0].ConnID != 1 || connects[1].ConnID != 2 {
+		t.Fatal("unexpected connect events")
+	}
+	resolves := saver.Resolves()
+	if len(resolves) != 1 || resolves[0].Hostname != "www.example.com" {
+		t.Fatal("unexpected resolve events")
+	}
+	handshakes := saver.TLSHandshakes()
+	if len(handshakes) != 1 || handshakes[0].ConnID != 1 {
+		t.Fatal("unexpected TLS handshake events")
+	}
+	if len(saver.Read()) != 6 {
+		t.Fatal("getters should not drain the events")
+	}
+	if len(saver.Connects()) != 0 {
+		t.Fatal("Read should drain the events")
+	}
+}
+
+func TestUnitSavingHandlerTLSStates(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL: "http://www.example.com/",
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL: "https://www.example.com/",
+			ResponseTLS: &modelx.TLSConnectionState{
+				NegotiatedProtocol: "h2",
+			},
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			Error:      errors.New("mocked error"),
+			RequestURL: "https://www.example.org/",
+		},
+	})
+	states := saver.TLSStates()
+	if len(states) != 2 {
+		t.Fatal("unexpected number of states")
+	}
+	if state, found := states["http://www.example.com/"]; !found || state != nil {
+		t.Fatal("expected a nil state for plaintext HTTP")
+	}
+	if states["https://www.example.com/"].NegotiatedProtocol != "h2" {
+		t.Fatal("unexpected state for HTTPS")
+	}
+	if len(saver.Read()) != 3 || len(saver.TLSStates()) != 0 {
+		t.Fatal("expected Read to drain the saved states")
+	}
+}
+
+func TestUnitSavingHandlerRemoteAddresses(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL:            "http://www.example.com/",
+			ResponseRemoteAddress: "93.184.216.34:80",
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL:            "https://www.example.com/",
+			ResponseRemoteAddress: "[2606:2800:220:1:248:1893:25c8:1946]:443",
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			Error:      errors.New("mocked error"),
+			RequestURL: "https://www.example.org/",
+		},
+	})
+	addrs := saver.RemoteAddresses()
+	if len(addrs) != 2 {
+		t.Fatal("unexpected number of addresses")
+	}
+	if addrs["http://www.example.com/"] != "93.184.216.34:80" {
+		t.Fatal("unexpected address for HTTP")
+	}
+	if addrs["https://www.example.com/"] != "[2606:2800:220:1:248:1893:25c8:1946]:443" {
+		t.Fatal("unexpected address for HTTPS")
+	}
+	if len(saver.Read()) != 3 || len(saver.RemoteAddresses()) != 0 {
+		t.Fatal("expected Read to drain the saved addresses")
+	}
+}
+
+func TestUnitSavingHandlerCookies(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL: "http://www.example.com/",
+			ResponseHeaders: http.Header{
+				"Set-Cookie": []string{"a=1", "b=2"},
+			},
+			TransactionID: 1,
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestURL:    "http://www.example.com/nocookies",
+			TransactionID: 2,
+		},
+	})
+	saver.OnMeasurement(modelx.Measurement{
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			RequestHeaders: http.Header{
+				"Cookie": []string{"a=1; b=2"},
+			},
+			RequestURL:    "http://www.example.com/",
+			TransactionID: 3,
+		},
+	})
+	cookies := saver.Cookies()
+	if len(cookies) != 2 {
+		t.Fatal("unexpected number of entries")
+	}
+	if cookies[0].TransactionID != 1 || len(cookies[0].Received) != 2 ||
+		cookies[0].Received[1] != "b=2" || len(cookies[0].Sent) != 0 {
+		t.Fatalf("unexpected first entry: %+v", cookies[0])
+	}
+	if cookies[1].TransactionID != 3 || len(cookies[1].Received) != 0 ||
+		len(cookies[1].Sent) != 1 || cookies[1].Sent[0] != "a=1; b=2" {
+		t.Fatalf("unexpected second entry: %+v", cookies[1])
+	}
+	if len(saver.Read()) != 3 || len(saver.Cookies()) != 0 {
+		t.Fatal("expected Read to drain the saved cookies")
+	}
+}
+
+func TestUnitSavingHandlerDurations(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	for _, m := range []modelx.Measurement{{
+		HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			DurationSinceBeginning: 10, TransactionID: 1,
+		},
+	}, {
+		ResolveStart: &modelx.ResolveStartEvent{
+			DurationSinceBeginning: 11, TransactionID: 1,
+		},
+	}, {
+		ResolveDone: &modelx.ResolveDoneEvent{
+			DurationSinceBeginning: 15, TransactionID: 1,
+		},
+	}, {
+		Connect: &modelx.ConnectEvent{
+			DurationSinceBeginning: 18, SyscallDuration: 2, TransactionID: 1,
+		},
+	}, {
+		Connect: &modelx.ConnectEvent{
+			DurationSinceBeginning: 20, SyscallDuration: 2, TransactionID: 1,
+		},
+	}, {
+		TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{
+			DurationSinceBeginning: 21, TransactionID: 1,
+		},
+	}, {
+		TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{
+			DurationSinceBeginning: 30, TransactionID: 1,
+		},
+	}, {
+		HTTPResponseStart: &modelx.HTTPResponseStartEvent{
+			DurationSinceBeginning: 40, TransactionID: 1,
+		},
+	}, {
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: 41, TransactionID: 1,
+		},
+	}, {
+		HTTPResponseDone: &modelx.HTTPResponseDoneEvent{
+			DurationSinceBeginning: 50, TransactionID: 1,
+		},
+	}, {
+		HTTPRoundTripStart: &modelx.HTTPRoundTripStartEvent{
+			DurationSinceBeginning: 60, TransactionID: 2,
+		},
+	}, {
+		HTTPRoundTripDone: &modelx.HTTPRoundTripDoneEvent{
+			DurationSinceBeginning: 65, TransactionID: 2,
+		},
+	}} {
+		saver.OnMeasurement(m)
+	}
+	durations := saver.Durations()
+	if len(durations) != 2 {
+		t.Fatal("unexpected number of round trips")
+	}
+	first := durations[0]
+	if first.TransactionID != 1 {
+		t.Fatal("unexpected transaction ID")
+	}
+	if first.DNS != (handlers.PhaseDuration{Duration: 4}) {
+		t.Fatal("unexpected DNS duration")
+	}
+	if first.Connect != (handlers.PhaseDuration{Duration: 4}) {
+		t.Fatal("unexpected connect duration")
+	}
+	if first.TLS != (handlers.PhaseDuration{Duration: 9}) {
+		t.Fatal("unexpected TLS duration")
+	}
+	if first.TimeToFirstByte != (handlers.PhaseDuration{Duration: 30}) {
+		t.Fatal("unexpected time to first byte")
+	}
+	if first.Total != (handlers.PhaseDuration{Duration: 40}) {
+		t.Fatal("unexpected total duration")
+	}
+	second := durations[1]
+	skipped := handlers.PhaseDuration{Skipped: true}
+	if second.DNS != skipped || second.Connect != skipped ||
+		second.TLS != skipped || second.TimeToFirstByte != skipped {
+		t.Fatalf("expected skipped phases: %+v", second)
+	}
+	if second.Total != (handlers.PhaseDuration{Duration: 5}) {
+		t.Fatal("unexpected total duration")
+	}
+	if len(saver.Read()) != 12 {
+		t.Fatal("Durations should not drain the buffer")
+	}
+}
+
+func TestUnitMultiHandler(t *testing.T) {
+	first, second := &handlers.SavingHandler{}, &handlers.SavingHandler{}
+	handler := handlers.NewMultiHandler(first, nil, second)
+	handler.OnMeasurement(modelx.Measurement{
+		Close: &modelx.CloseEvent{ConnID: 1},
+	})
+	if len(first.Read()) != 1 || len(second.Read()) != 1 {
+		t.Fatal("expected both handlers to receive the measurement")
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"sync"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// SavingHandler is a Handler that saves the measurements it receives
+// so that they can later be read. The zero value is valid and saves
+// all the measurements without bounds. Set MaxEvents to a positive value
+// to only keep the most recent MaxEvents measurements, which is useful
+// to bound the memory used by long running programs.
+type SavingHandler struct {
+	// MaxEvents is the maximum number of measurements to keep. When
+	// positive, older measurements are discarded to make room for the
+	// new ones. Otherwise, we keep all the measurements.
+	MaxEvents int
+
+	dropped int64
+	mu      sync.Mutex
+	next    int
+	v       []modelx.Measurement
+}
+
+// OnMeasurement saves the measurement.
+func (h *SavingHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.MaxEvents <= 0 || len(h.v) < h.MaxEvents {
+		h.v = append(h.v, m)
+		return
+	}
+	// The buffer is full: overwrite the oldest measurement.
+	h.v[h.next] = m
+	h.next = (h.next + 1) % len(h.v)
+	h.dropped++
+}
+
+// Read returns the saved measurements in chronological order and
+// clears the internal buffer, so the next Read only returns the
+// measurements received afterwards.
+func (h *SavingHandler) Read() []modelx.Measurement {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v := h.snapshot()
+	h.v, h.next = nil, 0
+	return v
+}
+
+// snapshot returns a copy of the saved measurements in chronological
+// order. This function assumes we hold the mutex.
+func (h *SavingHandler) snapshot() []modelx.Measurement {
+	v := make([]modelx.Measurement, 0, len(h.v))
+	v = append(v, h.v[h.next:]...)
+	v = append(v, h.v[:h.next]...)
+	return v
+}
+
+// Connects returns the saved connect events in chronological order.
+// Unlike Read, this method does not clear the internal buffer.
+func (h *SavingHandler) Connects() (out []*modelx.ConnectEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.snapshot() {
+		if m.Connect != nil {
+			out = append(out, m.Connect)
+		}
+	}
+	return
+}
+
+// Resolves returns the saved resolve done events in chronological
+// order. Unlike Read, this method does not clear the internal buffer.
+func (h *SavingHandler) Resolves() (out []*modelx.ResolveDoneEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.snapshot() {
+		if m.ResolveDone != nil {
+			out = append(out, m.ResolveDone)
+		}
+	}
+	return
+}
+
+// TLSHandshakes returns the saved TLS handshake done events in chronological
+// order. Unlike Read, this method does not clear the internal buffer.
+func (h *SavingHandler) TLSHandshakes() (out []*modelx.TLSHandshakeDoneEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range h.snapshot() {
+		if m.TLSHandshakeDone != nil {
+			out = append(out, m.TLSHandshakeDone)
+		}
+	}
+	return
+}
+
+// TLSStates returns the TLS connection state of each saved round trip,
+// keyed by request URL. Plaintext requests map to a nil state. When
+// the same URL has been fetched more than once, the most recent state
+// wins. Unlike Read, this method does not clear the internal buffer.
+func (h *SavingHandler) TLSStates() map[string]*modelx.TLSConnectionState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]*modelx.TLSConnectionState)
+	for _, m := range h.snapshot() {
+		if m.HTTPRoundTripDone != nil && m.HTTPRoundTripDone.Error == nil {
+			out[m.HTTPRoundTripDone.RequestURL] = m.HTTPRoundTripDone.ResponseTLS
+		}
+	}
+	return out
+}
+
+// RemoteAddresses returns the remote address of the server that served
+// each saved round trip, keyed by request URL. With redirects, each hop
+// has its own URL, hence its own entry. When the same URL has been
+// fetched more than once, the most recent address wins. Unlike Read,
+// this method does not clear the internal buffer.
+func (h *SavingHandler) RemoteAddresses() map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]string)
+	for _, m := range h.snapshot() {
+		if m.HTTPRoundTripDone != nil && m.HTTPRoundTripDone.Error == nil {
+			out[m.HTTPRoundTripDone.RequestURL] = m.HTTPRoundTripDone.ResponseRemoteAddress
+		}
+	}
+	return out
+}
+
+// Dropped returns the number of measurements discarded so far
+// because the buffer was full.
+func (h *SavingHandler) Dropped() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
@@ -1,6 +1,7 @@
 package netx
 
 import (
+	"crypto/tls"
 	"net/http"
 	"net/url"
 	"time"
@@ -8,10 +9,24 @@ import (
 	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/internal/errwrapper"
 	"github.com/ooni/probe-engine/netx/internal/httptransport"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/alpnchecker"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/chaos"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/firstbyte"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/gzipbody"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/maxbody"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/ratelimiter"
 	"github.com/ooni/probe-engine/netx/modelx"
 	"golang.org/x/net/http2"
 )
 
+// GzipRequestBodyHeader is the request header with which a request
+// opts in to having its body compressed with gzip. Set it to "1" to
+// enable compression. It is never sent to the server. Bodies are only
+// compressed if they can be rewound, i.e., if the request has GetBody,
+// which http.NewRequest sets for bytes and strings readers. Requests
+// without this header are sent unmodified.
+const GzipRequestBodyHeader = gzipbody.OptInHeader
+
 // HTTPTransport performs single HTTP transactions and emits
 // measurement events as they happen.
 type HTTPTransport struct {
@@ -19,6 +34,11 @@ type HTTPTransport struct {
 	Dialer       *Dialer
 	Handler      modelx.Handler
 	Transport    *http.Transport
+	alpnChecker  *alpnchecker.Transport
+	chaos        *chaos.Transport
+	firstByte    *firstbyte.Transport
+	maxBody      *maxbody.Transport
+	rateLimiter  *ratelimiter.Transport
 	roundTripper http.RoundTripper
 }
 
@@ -39,7 +59,16 @@ func newHTTPTransport(
 		TLSHandshakeTimeout:   10 * time.Second,
 		DisableKeepAlives:     disableKeepAlives,
 	}
-	ooniTransport := httptransport.New(baseTransport)
+	// The chaos transport is below the OONI transport so that the
+	// injected failures are measured like real failures.
+	chaosTransport := chaos.New(baseTransport)
+	// The first byte transport is below the OONI transport so that the
+	// latter does not read the body to save a snapshot of it.
+	firstByte := firstbyte.New(chaosTransport)
+	// The ALPN checker is below the OONI transport so that the failure
+	// caused by a protocol mismatch is measured. See ForceHTTP2.
+	alpnChecker := alpnchecker.New(firstByte)
+	ooniTransport := httptransport.New(alpnChecker)
 	// Configure h2 and make sure that the custom TLSConfig we use for dialing
 	// is actually compatible with upgrading to h2. (This mainly means we
 	// need to make sure we include "h2" in the NextProtos array.) Because
@@ -55,19 +84,31 @@ func newHTTPTransport(
 	// cleartext connections. The net/http code will dial TLS connections.
 	baseTransport.DialContext = dialer.DialContext
 	// Better for Cloudflare DNS and also better because we have less
-	// noisy events and we can better understand what happened.
+	// noisy events and we can better understand what happened. Note that
+	// this means that requests to the same host reuse the same connection
+	// and HTTPConnectionReadyEvent.ConnReused will be true for them.
 	baseTransport.MaxConnsPerHost = 1
 	// The following (1) reduces the number of headers that Go will
 	// automatically send for us and (2) ensures that we always receive
 	// back the true headers, such as Content-Length. This change is
 	// functional to OONI's goal of observing the network.
 	baseTransport.DisableCompression = true
+	// By default there is no limit to the body size. See SetMaxBodySize.
+	maxBody := maxbody.New(ooniTransport, 0)
+	// The rate limiter is above the OONI transport so that the time
+	// we wait before sending a request is not part of the round trip.
+	rateLimiter := ratelimiter.New(maxBody)
 	return &HTTPTransport{
 		Beginning:    beginning,
 		Dialer:       dialer,
 		Handler:      handler,
 		Transport:    baseTransport,
-		roundTripper: ooniTransport,
+		alpnChecker:  alpnChecker,
+		chaos:        chaosTransport,
+		firstByte:    firstByte,
+		maxBody:      maxBody,
+		rateLimiter:  rateLimiter,
+		roundTripper: rateLimiter,
 	}
 }
 
@@ -123,6 +164,30 @@ func (t *HTTPTransport) SetResolver(r modelx.DNSResolver) {
 	t.Dialer.SetResolver(r)
 }
 
+// SetLocalAddr internally calls netx.Dialer.SetLocalAddr and
+// therefore it has the same caveats and limitations.
+func (t *HTTPTransport) SetLocalAddr(address string) error {
+	return t.Dialer.SetLocalAddr(address)
+}
+
+// SetKeepAlive internally calls netx.Dialer.SetKeepAlive and
+// therefore it has the same caveats and limitations.
+func (t *HTTPTransport) SetKeepAlive(period time.Duration) {
+	t.Dialer.SetKeepAlive(period)
+}
+
+// SetPinnedKeys internally calls netx.Dialer.SetPinnedKeys and
+// therefore it has the same caveats and limitations.
+func (t *HTTPTransport) SetPinnedKeys(pins []string) error {
+	return t.Dialer.SetPinnedKeys(pins)
+}
+
+// SetForceIPv6 internally calls netx.Dialer.SetForceIPv6 and
+// therefore it has the same caveats and limitations.
+func (t *HTTPTransport) SetForceIPv6(force bool) {
+	t.Dialer.SetForceIPv6(force)
+}
+
 // SetCABundle internally calls netx.Dialer.SetCABundle and
 // therefore it has the same caveats and limitations.
 func (t *HTTPTransport) SetCABundle(path string) error {
@@ -139,6 +204,123 @@ func (t *HTTPTransport) ForceSkipVerify() error {
 	return t.Dialer.ForceSkipVerify()
 }
 
+// ForceHTTP1 forces using HTTP/1.1 by disabling HTTP/2 and by not
+// advertising "h2" via ALPN. This is useful to check whether blocking
+// is specific to a protocol version. Like the other Force methods, you
+// should call this before starting to use the transport.
+func (t *HTTPTransport) ForceHTTP1() error {
+	t.Transport.ForceAttemptHTTP2 = false
+	t.Transport.TLSNextProto = make(map[string]func(
+		string, *tls.Conn) http.RoundTripper)
+	t.Transport.TLSClientConfig.NextProtos = nil
+	t.alpnChecker.RequiredProtocol = ""
+	return nil
+}
+
+// ErrUnexpectedProtocol is the error returned when we have forced
+// HTTP/2 using ForceHTTP2 and the server did not negotiate it.
+var ErrUnexpectedProtocol = alpnchecker.ErrUnexpectedProtocol
+
+// ForceHTTP2 forces using HTTP/2 by only advertising "h2" via ALPN and
+// by checking, after the TLS handshake, that the server negotiated "h2".
+// A server that supports ALPN but not h2 may fail the TLS handshake. A
+// server that does not support ALPN completes the TLS handshake without
+// negotiating any protocol, and net/http would then use HTTP/1.1. In
+// such case, we close the connection before sending the request and the
+// round trip fails with ErrUnexpectedProtocol. Note that this only
+// applies to HTTPS, since we never speak cleartext HTTP/2.
+func (t *HTTPTransport) ForceHTTP2() error {
+	t.Transport.TLSClientConfig.NextProtos = []string{"h2"}
+	t.alpnChecker.RequiredProtocol = "h2"
+	return nil
+}
+
+// ErrBodyTooLarge is the error returned when a response body is larger
+// than the limit configured using SetMaxBodySize.
+var ErrBodyTooLarge = maxbody.ErrBodyTooLarge
+
+// SetMaxBodySize configures the maximum number of response body bytes
+// that can be read. Reading beyond the limit fails with ErrBodyTooLarge,
+// and so does RoundTrip when the server advertises a Content-Length larger
+// than the limit, in which case we do not download the body. A zero or
+// negative value, which is the default, means that there is no limit.
+//
+// This functionality is not goroutine safe. You should only change
+// the limit before starting to use the HTTPTransport.
+func (t *HTTPTransport) SetMaxBodySize(limit int64) {
+	t.maxBody.MaxBodySize = limit
+}
+
+// ChaosConfig contains the settings for injecting chaos. See the
+// documentation of HTTPTransport.EnableChaos.
+type ChaosConfig = chaos.Config
+
+// The kinds of errors that EnableChaos can inject.
+const (
+	ChaosRefused = chaos.Refused
+	ChaosReset   = chaos.Reset
+	ChaosTimeout = chaos.Timeout
+)
+
+// EnableChaos starts injecting latency and failures into the round
+// trips, which is useful to test how experiments handle flaky networks.
+// Chaos is disabled by default. The injected failures are wrapped like
+// real failures, e.g., ChaosReset causes a connection_reset failure
+// of the read operation. The sequence of failures only depends on the
+// config's Seed, so that tests are reproducible.
+//
+// This functionality is not goroutine safe. You should only enable
+// chaos before starting to use the HTTPTransport.
+func (t *HTTPTransport) EnableChaos(config ChaosConfig) error {
+	return t.chaos.Enable(config)
+}
+
+// RateLimit is a rate limit. See the documentation of
+// HTTPTransport.SetRateLimit.
+type RateLimit = ratelimiter.Limit
+
+// SetRateLimit limits the rate of the requests sent to each host, which
+// allows us to be a polite scanner. Each host has a token bucket that
+// allows to send a burst of limit.Requests requests, after which we send
+// at most limit.Requests requests every limit.Interval. A request over
+// the limit blocks until we can send it or until its context is done,
+// in which case it fails without being sent. The hosts are identified
+// by the Host of the request URL, and the redirects count as requests. A
+// zero RateLimit, which is the default, means that there is no limit.
+//
+// This functionality is not goroutine safe. You should only change
+// the limits before starting to use the HTTPTransport.
+func (t *HTTPTransport) SetRateLimit(limit RateLimit) {
+	t.rateLimiter.Default = limit
+}
+
+// SetHostRateLimit is like SetRateLimit but only applies to the given
+// host, which must include the port if the URLs contain a port. This
+// limit overrides the one configured using SetRateLimit. A zero
+// RateLimit means that there is no limit for this host.
+//
+// This functionality is not goroutine safe. You should only change
+// the limits before starting to use the HTTPTransport.
+func (t *HTTPTransport) SetHostRateLimit(host string, limit RateLimit) {
+	if t.rateLimiter.Hosts == nil {
+		t.rateLimiter.Hosts = make(map[string]RateLimit)
+	}
+	t.rateLimiter.Hosts[host] = limit
+}
+
+// SetAbortAfterFirstByte configures the HTTPTransport to close the
+// response body as soon as it has received the response headers, which
+// saves bandwidth when we only need the status code and the headers. The
+// response body is then empty and the HTTPRoundTripDoneEvent has the
+// ResponseBodyAborted flag set. The timing events, e.g. the one emitted
+// when we receive the first response byte, are not affected.
+//
+// This functionality is not goroutine safe. You should only change
+// this setting before starting to use the HTTPTransport.
+func (t *HTTPTransport) SetAbortAfterFirstByte(abort bool) {
+	t.firstByte.Enabled = abort
+}
+
 // HTTPClient is a replacement for http.HTTPClient.
 type HTTPClient struct {
 	// HTTPClient is the underlying client. Pass this client to existing code
@@ -162,6 +344,16 @@ func NewHTTPClientWithProxyFunc(
 	}
 }
 
+// NewHTTPClientWithExplicitProxy creates a new client that routes all the
+// requests through proxyURL if explicitProxy is true and proxyURL is not
+// nil. Otherwise, the client always connects directly, regardless of the
+// HTTP_PROXY and HTTPS_PROXY environment variables. This is meant to be
+// used along with model.ExperimentSession's ExplicitProxy.
+func NewHTTPClientWithExplicitProxy(proxyURL *url.URL, explicitProxy bool) *HTTPClient {
+	return NewHTTPClientWithProxyFunc(
+		httptransport.NewProxyFunc(proxyURL, explicitProxy))
+}
+
 // NewHTTPClient creates a new client instance.
 func NewHTTPClient() *HTTPClient {
 	return NewHTTPClientWithProxyFunc(http.ProxyFromEnvironment)
@@ -184,6 +376,30 @@ func (c *HTTPClient) SetResolver(r modelx.DNSResolver) {
 	c.Transport.SetResolver(r)
 }
 
+// SetLocalAddr internally calls netx.Dialer.SetLocalAddr and
+// therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetLocalAddr(address string) error {
+	return c.Transport.SetLocalAddr(address)
+}
+
+// SetKeepAlive internally calls netx.Dialer.SetKeepAlive and
+// therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetKeepAlive(period time.Duration) {
+	c.Transport.SetKeepAlive(period)
+}
+
+// SetPinnedKeys internally calls netx.Dialer.SetPinnedKeys and
+// therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetPinnedKeys(pins []string) error {
+	return c.Transport.SetPinnedKeys(pins)
+}
+
+// SetForceIPv6 internally calls netx.Dialer.SetForceIPv6 and
+// therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetForceIPv6(force bool) {
+	c.Transport.SetForceIPv6(force)
+}
+
 // SetCABundle internally calls netx.Dialer.SetCABundle and
 // therefore it has the same caveats and limitations.
 func (c *HTTPClient) SetCABundle(path string) error {
@@ -200,6 +416,47 @@ func (c *HTTPClient) ForceSkipVerify() error {
 	return c.Transport.ForceSkipVerify()
 }
 
+// ForceHTTP1 internally calls netx.HTTPTransport.ForceHTTP1
+func (c *HTTPClient) ForceHTTP1() error {
+	return c.Transport.ForceHTTP1()
+}
+
+// ForceHTTP2 internally calls netx.HTTPTransport.ForceHTTP2
+func (c *HTTPClient) ForceHTTP2() error {
+	return c.Transport.ForceHTTP2()
+}
+
+// EnableChaos internally calls netx.HTTPTransport.EnableChaos
+// and therefore it has the same caveats and limitations.
+func (c *HTTPClient) EnableChaos(config ChaosConfig) error {
+	return c.Transport.EnableChaos(config)
+}
+
+// SetMaxBodySize internally calls netx.HTTPTransport.SetMaxBodySize
+// and therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetMaxBodySize(limit int64) {
+	c.Transport.SetMaxBodySize(limit)
+}
+
+// SetAbortAfterFirstByte internally calls
+// netx.HTTPTransport.SetAbortAfterFirstByte and therefore it has
+// the same caveats and limitations.
+func (c *HTTPClient) SetAbortAfterFirstByte(abort bool) {
+	c.Transport.SetAbortAfterFirstByte(abort)
+}
+
+// SetRateLimit internally calls netx.HTTPTransport.SetRateLimit
+// and therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetRateLimit(limit RateLimit) {
+	c.Transport.SetRateLimit(limit)
+}
+
+// SetHostRateLimit internally calls netx.HTTPTransport.SetHostRateLimit
+// and therefore it has the same caveats and limitations.
+func (c *HTTPClient) SetHostRateLimit(host string, limit RateLimit) {
+	c.Transport.SetHostRateLimit(host, limit)
+}
+
 // CloseIdleConnections closes the idle connections.
 func (c *HTTPClient) CloseIdleConnections() {
 	c.Transport.CloseIdleConnections()
@@ -2,18 +2,24 @@ package netx_test
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ooni/probe-engine/netx"
+	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -100,6 +106,151 @@ func TestIntegrationHTTPClientForceSkipVerify(t *testing.T) {
 	}
 }
 
+func TestIntegrationHTTPClientForceProtocol(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	var testcases = []struct {
+		name   string
+		force  func(*netx.HTTPClient) error
+		expect int
+	}{{
+		name:   "default",
+		force:  func(*netx.HTTPClient) error { return nil },
+		expect: 2,
+	}, {
+		name:   "http1",
+		force:  (*netx.HTTPClient).ForceHTTP1,
+		expect: 1,
+	}, {
+		name:   "http2",
+		force:  (*netx.HTTPClient).ForceHTTP2,
+		expect: 2,
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := netx.NewHTTPClientWithoutProxy()
+			defer client.CloseIdleConnections()
+			if err := client.ForceSkipVerify(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.force(client); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := client.HTTPClient.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != tc.expect {
+				t.Fatalf("expected HTTP/%d, got %s", tc.expect, resp.Proto)
+			}
+			if resp.TLS.NegotiatedProtocol == "h2" != (tc.expect == 2) {
+				t.Fatal("unexpected negotiated protocol")
+			}
+		})
+	}
+}
+
+func TestIntegrationHTTPClientForceHTTP2WithoutALPN(t *testing.T) {
+	var requests int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&requests, 1)
+			w.Write([]byte(r.Proto))
+		}))
+	// A non-nil empty NextProtos disables ALPN on the server side, so the
+	// handshake completes without negotiating any protocol.
+	server.TLS = &tls.Config{NextProtos: []string{}}
+	server.StartTLS()
+	defer server.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	saver := &handlers.SavingHandler{}
+	client.Transport.Handler = saver
+	if err := client.ForceSkipVerify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ForceHTTP2(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	if !errors.Is(err, netx.ErrUnexpectedProtocol) {
+		t.Fatal("not the error we expected", err)
+	}
+	if resp != nil {
+		t.Fatal("expected a nil response here")
+	}
+	if atomic.LoadInt64(&requests) != 0 {
+		t.Fatal("the request should not have reached the server")
+	}
+	var found bool
+	for _, ev := range saver.Read() {
+		if ev.HTTPRoundTripDone != nil {
+			found = true
+			if ev.HTTPRoundTripDone.Error == nil {
+				t.Fatal("expected the round trip failure to be measured")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no round trip done event")
+	}
+	// Forcing HTTP/1.1 afterwards disables the check.
+	if err := client.ForceHTTP1(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Fatal("expected HTTP/1.1")
+	}
+}
+
+func TestIntegrationHTTPClientWithExplicitProxy(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("direct"))
+		}))
+	defer target.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("proxy"))
+		}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, explicitProxy := range []bool{true, false} {
+		client := netx.NewHTTPClientWithExplicitProxy(proxyURL, explicitProxy)
+		resp, err := client.HTTPClient.Get(target.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect := "direct"
+		if explicitProxy {
+			expect = "proxy"
+		}
+		if string(data) != expect {
+			t.Fatalf("expected %s, got %s", expect, string(data))
+		}
+	}
+}
+
 func TestHTTPNewClientProxy(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
@@ -169,3 +320,323 @@ func TestIntegrationHTTPTransportFailure(t *testing.T) {
 	}
 	client.CloseIdleConnections()
 }
+
+func TestIntegrationHTTPTransportConnIDs(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("antani"))
+		}))
+	defer server.Close()
+	saver := &handlers.SavingHandler{}
+	client := netx.NewHTTPClientWithoutProxy()
+	client.Transport.Handler = saver
+	if err := client.ForceSkipVerify(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.HTTPClient.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		client.CloseIdleConnections() // so we dial again
+	}
+	connects := saver.Connects()
+	if len(connects) != 2 {
+		t.Fatal("unexpected number of connects")
+	}
+	first, second := connects[0].ConnID, connects[1].ConnID
+	if first <= 0 || second <= first {
+		t.Fatal("expected distinct and increasing ConnIDs")
+	}
+	counts := make(map[int64]int)
+	for _, ev := range saver.Read() {
+		switch {
+		case ev.DialDone != nil:
+			counts[ev.DialDone.ConnID]++
+		case ev.HTTPConnectionReady != nil:
+			counts[ev.HTTPConnectionReady.ConnID]++
+		case ev.Read != nil:
+			if ev.Read.ConnID != first && ev.Read.ConnID != second {
+				t.Fatal("read event with unexpected ConnID")
+			}
+		}
+	}
+	if len(counts) != 2 || counts[first] != 2 || counts[second] != 2 {
+		t.Fatal("expected dial and HTTP events to match the connects")
+	}
+}
+
+func TestIntegrationHTTPClientSetMaxBodySize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("A", 1024)))
+		}))
+	defer server.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	client.SetMaxBodySize(1023)
+	resp, err := client.HTTPClient.Get(server.URL)
+	if !errors.Is(err, netx.ErrBodyTooLarge) {
+		t.Fatal("not the error we expected")
+	}
+	if resp != nil {
+		t.Fatal("expected nil resp here")
+	}
+}
+
+func TestIntegrationHTTPClientSetRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+	defer server.Close()
+	URL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	client.SetRateLimit(netx.RateLimit{Interval: 100 * time.Millisecond, Requests: 1})
+	getAll := func() time.Duration {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			resp, err := client.HTTPClient.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+		return time.Since(start)
+	}
+	if elapsed := getAll(); elapsed < 190*time.Millisecond {
+		t.Fatal("the requests were not spaced", elapsed)
+	}
+	client.SetHostRateLimit(URL.Host, netx.RateLimit{})
+	if elapsed := getAll(); elapsed >= 100*time.Millisecond {
+		t.Fatal("the requests should not have been limited", elapsed)
+	}
+}
+
+func TestIntegrationHTTPClientEnableChaos(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+	defer server.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	err := client.EnableChaos(netx.ChaosConfig{
+		Errors:             []string{netx.ChaosReset},
+		FailureProbability: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Get(server.URL)
+	var errWrapper *modelx.ErrWrapper
+	if !errors.As(err, &errWrapper) {
+		t.Fatal("not the error we expected")
+	}
+	if errWrapper.Failure != modelx.FailureConnectionReset {
+		t.Fatal("unexpected failure")
+	}
+	if resp != nil {
+		t.Fatal("expected nil resp here")
+	}
+}
+
+func TestIntegrationHTTPClientSetPinnedKeys(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+	defer server.Close()
+	digest := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	good := base64.StdEncoding.EncodeToString(digest[:])
+	digest = sha256.Sum256([]byte("antani"))
+	bad := base64.StdEncoding.EncodeToString(digest[:])
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	for _, pin := range []string{good, bad} {
+		client := netx.NewHTTPClientWithoutProxy()
+		client.Transport.Transport.TLSClientConfig.RootCAs = pool
+		if err := client.SetPinnedKeys([]string{pin}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.HTTPClient.Get(server.URL)
+		client.CloseIdleConnections()
+		if pin == good {
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			continue
+		}
+		if err == nil || !strings.HasSuffix(err.Error(), modelx.FailureSSLPinMismatch) {
+			t.Fatal("not the error we expected")
+		}
+	}
+	if err := netx.NewHTTPClient().SetPinnedKeys([]string{"antani"}); !errors.Is(err, netx.ErrInvalidPin) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestIntegrationHTTPClientSetAbortAfterFirstByte(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("A", 1<<20)))
+		}))
+	defer server.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	client.SetAbortAfterFirstByte(true)
+	saver := &handlers.SavingHandler{}
+	client.Transport.Handler = saver
+	resp, err := client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || len(data) != 0 {
+		t.Fatal("expected the status code and an empty body")
+	}
+	var gotFirstByte, aborted bool
+	for _, ev := range saver.Read() {
+		if ev.HTTPResponseStart != nil {
+			gotFirstByte = true
+		}
+		if ev.HTTPRoundTripDone != nil {
+			aborted = ev.HTTPRoundTripDone.ResponseBodyAborted
+		}
+	}
+	if !gotFirstByte || !aborted {
+		t.Fatal("expected the first byte and the aborted body events")
+	}
+}
+
+type vantagePointResolver struct {
+	*net.Resolver
+	seen *modelx.VantagePoint
+}
+
+func (r *vantagePointResolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	r.seen = modelx.ContextVantagePoint(ctx)
+	return nil, errors.New("mocked error")
+}
+
+func TestIntegrationHTTPClientPropagatesVantagePoint(t *testing.T) {
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	resolver := &vantagePointResolver{Resolver: new(net.Resolver)}
+	client.SetResolver(resolver)
+	vp := &modelx.VantagePoint{ProbeASN: "AS30722", ProbeNetworkName: "Vodafone"}
+	ctx := modelx.WithVantagePoint(context.Background(), vp)
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://www.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.HTTPClient.Do(req)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resp != nil {
+		t.Fatal("expected nil resp here")
+	}
+	if resolver.seen != vp {
+		t.Fatal("the vantage point did not reach the resolver")
+	}
+}
+
+func TestIntegrationHTTPClientRemoteAddresses(t *testing.T) {
+	target := httptest.NewServer(http.NotFoundHandler())
+	defer target.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(
+		target.URL+"/", http.StatusFound))
+	defer redirector.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	saver := &handlers.SavingHandler{}
+	client.Transport.Handler = saver
+	for i := 0; i < 2; i++ {
+		resp, err := client.HTTPClient.Get(redirector.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	addrs := saver.RemoteAddresses()
+	if addrs[redirector.URL+"/"] != redirector.Listener.Addr().String() {
+		t.Fatal("unexpected address for the redirector")
+	}
+	if addrs[target.URL+"/"] != target.Listener.Addr().String() {
+		t.Fatal("unexpected address for the target")
+	}
+	var reused int
+	for _, ev := range saver.Read() {
+		if ev.HTTPConnectionReady == nil {
+			continue
+		}
+		if ev.HTTPConnectionReady.ConnReused {
+			reused++
+		}
+		addr := ev.HTTPConnectionReady.RemoteAddress
+		if addr != redirector.Listener.Addr().String() &&
+			addr != target.Listener.Addr().String() {
+			t.Fatal("unexpected remote address")
+		}
+	}
+	if reused != 2 {
+		t.Fatal("expected the second fetch to reuse the connections")
+	}
+}
+
+func TestIntegrationHTTPClientCookies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				http.SetCookie(w, &http.Cookie{Name: "antani", Value: "mascetti"})
+				http.Redirect(w, r, "/final", http.StatusFound)
+				return
+			}
+			if _, err := r.Cookie("antani"); err != nil {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		}))
+	defer server.Close()
+	client := netx.NewHTTPClientWithoutProxy()
+	defer client.CloseIdleConnections()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.HTTPClient.Jar = jar
+	saver := &handlers.SavingHandler{}
+	client.Transport.Handler = saver
+	resp, err := client.HTTPClient.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("the jar did not send the cookie")
+	}
+	cookies := saver.Cookies()
+	if len(cookies) != 2 {
+		t.Fatal("unexpected number of entries")
+	}
+	if cookies[0].URL != server.URL+"/" || len(cookies[0].Received) != 1 ||
+		cookies[0].Received[0] != "antani=mascetti" {
+		t.Fatalf("unexpected first entry: %+v", cookies[0])
+	}
+	if cookies[1].URL != server.URL+"/final" || len(cookies[1].Sent) != 1 ||
+		cookies[1].Sent[0] != "antani=mascetti" {
+		t.Fatalf("unexpected second entry: %+v", cookies[1])
+	}
+}
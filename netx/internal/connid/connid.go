@@ -5,10 +5,69 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/ooni/probe-engine/atomicx"
+)
+
+var (
+	counter  = atomicx.NewInt64()
+	mu       sync.Mutex
+	registry = make(map[string]int64)
 )
 
+// Next returns a new connectionID, which is assigned when dialing. The
+// absolute value of the returned IDs is monotonically increasing, so
+// that two connections never share the same ID. Like Compute, it returns
+// a negative value for UDP and zero for networks other than TCP and UDP.
+func Next(network string) int64 {
+	return sign(network) * counter.Add(1)
+}
+
+// Register binds id to conn, such that code that only sees conn, or a
+// wrapper of conn like a TLS connection, can find its ID using Lookup.
+func Register(conn net.Conn, id int64) {
+	if key := key(conn); key != "" && id != 0 {
+		mu.Lock()
+		registry[key] = id
+		mu.Unlock()
+	}
+}
+
+// Unregister removes the binding between conn and id, if any. It is
+// safe to call this function more than once.
+func Unregister(conn net.Conn, id int64) {
+	if key := key(conn); key != "" {
+		mu.Lock()
+		if registry[key] == id {
+			delete(registry, key)
+		}
+		mu.Unlock()
+	}
+}
+
+// Lookup returns the ID registered for conn, or zero if none.
+func Lookup(conn net.Conn) int64 {
+	if key := key(conn); key != "" {
+		mu.Lock()
+		defer mu.Unlock()
+		return registry[key]
+	}
+	return 0
+}
+
+// key identifies a connection using its local address, which is the
+// same for conn and for any wrapper of conn.
+func key(conn net.Conn) string {
+	if conn == nil || conn.LocalAddr() == nil {
+		return ""
+	}
+	return conn.LocalAddr().Network() + "/" + conn.LocalAddr().String()
+}
+
 // Compute computes the connectionID from the local socket address. The zero
-// value is conventionally returned to mean "unknown".
+// value is conventionally returned to mean "unknown". This is only useful
+// for connections not created by our dialers, which use Next instead.
 func Compute(network, address string) int64 {
 	_, portstring, err := net.SplitHostPort(address)
 	if err != nil {
@@ -21,11 +80,14 @@ func Compute(network, address string) int64 {
 	if portnum < 0 || portnum > 65535 {
 		return 0
 	}
-	result := int64(portnum)
+	return sign(network) * int64(portnum)
+}
+
+func sign(network string) int64 {
 	if strings.Contains(network, "udp") {
-		result *= -1
+		return -1
 	} else if !strings.Contains(network, "tcp") {
-		result = 0
+		return 0
 	}
-	return result
+	return 1
 }
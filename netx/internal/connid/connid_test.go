@@ -1,6 +1,9 @@
 package connid
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestIntegrationTCP(t *testing.T) {
 	num := Compute("tcp", "1.2.3.4:6789")
@@ -78,3 +81,47 @@ func TestIntegrationInvalidNetwork(t *testing.T) {
 		t.Fatal("unexpected result")
 	}
 }
+
+func TestUnitNext(t *testing.T) {
+	first, second := Next("tcp"), Next("tcp")
+	if first <= 0 || second <= first {
+		t.Fatal("expected increasing positive IDs for TCP")
+	}
+	if third := Next("udp"); third >= 0 || -third <= second {
+		t.Fatal("expected increasing negative IDs for UDP")
+	}
+	if Next("unix") != 0 {
+		t.Fatal("expected zero for other networks")
+	}
+}
+
+func TestUnitRegistry(t *testing.T) {
+	conn, _ := net.Pipe()
+	if Lookup(nil) != 0 || Lookup(conn) != 0 {
+		t.Fatal("expected zero for unknown connections")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id := Next("tcp")
+	Register(conn, id)
+	if Lookup(conn) != id {
+		t.Fatal("expected to find the registered ID")
+	}
+	Unregister(conn, id+1)
+	if Lookup(conn) != id {
+		t.Fatal("expected not to unregister a different ID")
+	}
+	Unregister(conn, id)
+	Unregister(conn, id)
+	if Lookup(conn) != 0 {
+		t.Fatal("expected the ID to be unregistered")
+	}
+}
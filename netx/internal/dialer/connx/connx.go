@@ -2,9 +2,12 @@
 package connx
 
 import (
+	"errors"
 	"net"
 	"time"
 
+	"github.com/ooni/probe-engine/atomicx"
+	"github.com/ooni/probe-engine/netx/internal/connid"
 	"github.com/ooni/probe-engine/netx/internal/errwrapper"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
@@ -15,12 +18,27 @@ type MeasuringConn struct {
 	Beginning time.Time
 	Handler   modelx.Handler
 	ID        int64
+
+	bytesRead    atomicx.Int64
+	bytesWritten atomicx.Int64
+}
+
+// BytesRead returns the number of bytes read so far.
+func (c *MeasuringConn) BytesRead() int64 {
+	return c.bytesRead.Load()
+}
+
+// BytesWritten returns the number of bytes written so far.
+func (c *MeasuringConn) BytesWritten() int64 {
+	return c.bytesWritten.Load()
 }
 
 // Read reads data from the connection.
 func (c *MeasuringConn) Read(b []byte) (n int, err error) {
 	start := time.Now()
 	n, err = c.Conn.Read(b)
+	c.bytesRead.Add(int64(n))
+	timedout := isTimeout(err)
 	err = errwrapper.SafeErrWrapperBuilder{
 		ConnID:    c.ID,
 		Error:     err,
@@ -36,6 +54,14 @@ func (c *MeasuringConn) Read(b []byte) (n int, err error) {
 			SyscallDuration:        stop.Sub(start),
 		},
 	})
+	if timedout {
+		c.Handler.OnMeasurement(modelx.Measurement{
+			ReadTimeout: &modelx.ReadTimeoutEvent{
+				ConnID:                 c.ID,
+				DurationSinceBeginning: stop.Sub(c.Beginning),
+			},
+		})
+	}
 	return
 }
 
@@ -43,6 +69,8 @@ func (c *MeasuringConn) Read(b []byte) (n int, err error) {
 func (c *MeasuringConn) Write(b []byte) (n int, err error) {
 	start := time.Now()
 	n, err = c.Conn.Write(b)
+	c.bytesWritten.Add(int64(n))
+	timedout := isTimeout(err)
 	err = errwrapper.SafeErrWrapperBuilder{
 		ConnID:    c.ID,
 		Error:     err,
@@ -58,6 +86,14 @@ func (c *MeasuringConn) Write(b []byte) (n int, err error) {
 			SyscallDuration:        stop.Sub(start),
 		},
 	})
+	if timedout {
+		c.Handler.OnMeasurement(modelx.Measurement{
+			WriteTimeout: &modelx.WriteTimeoutEvent{
+				ConnID:                 c.ID,
+				DurationSinceBeginning: stop.Sub(c.Beginning),
+			},
+		})
+	}
 	return
 }
 
@@ -65,6 +101,7 @@ func (c *MeasuringConn) Write(b []byte) (n int, err error) {
 func (c *MeasuringConn) Close() (err error) {
 	start := time.Now()
 	err = c.Conn.Close()
+	connid.Unregister(c.Conn, c.ID)
 	err = errwrapper.SafeErrWrapperBuilder{
 		ConnID:    c.ID,
 		Error:     err,
@@ -73,6 +110,8 @@ func (c *MeasuringConn) Close() (err error) {
 	stop := time.Now()
 	c.Handler.OnMeasurement(modelx.Measurement{
 		Close: &modelx.CloseEvent{
+			BytesRead:              c.BytesRead(),
+			BytesWritten:           c.BytesWritten(),
 			ConnID:                 c.ID,
 			DurationSinceBeginning: stop.Sub(c.Beginning),
 			Error:                  err,
@@ -81,3 +120,11 @@ func (c *MeasuringConn) Close() (err error) {
 	})
 	return
 }
+
+// isTimeout returns true if err is caused by an expired deadline. We
+// must call it before wrapping err, because the wrapped error does not
+// implement the net.Error interface anymore.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -2,6 +2,7 @@ package connx
 
 import (
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -31,6 +32,130 @@ func TestIntegrationMeasuringConn(t *testing.T) {
 	}
 }
 
+func TestUnitMeasuringConnByteCounters(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	conn := &MeasuringConn{
+		Conn:    fakeconn{},
+		Handler: saver,
+		ID:      11,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				conn.Read(make([]byte, 3))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				conn.Write(make([]byte, 5))
+			}
+		}()
+	}
+	wg.Wait()
+	if conn.BytesRead() != 8*100*3 {
+		t.Fatal("unexpected number of bytes read")
+	}
+	if conn.BytesWritten() != 8*100*5 {
+		t.Fatal("unexpected number of bytes written")
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, ev := range saver.Read() {
+		if ev.Close == nil {
+			continue
+		}
+		found = true
+		if ev.Close.BytesRead != 8*100*3 || ev.Close.BytesWritten != 8*100*5 {
+			t.Fatal("unexpected byte counters in close event")
+		}
+		if ev.Close.ConnID != 11 {
+			t.Fatal("unexpected ConnID")
+		}
+	}
+	if !found {
+		t.Fatal("close event not emitted")
+	}
+}
+
+func TestIntegrationMeasuringConnTimeouts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// Accept and never read or write, so the peer stalls.
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Second)
+	}()
+	tcpConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := &handlers.SavingHandler{}
+	conn := &MeasuringConn{
+		Beginning: time.Now(),
+		Conn:      tcpConn,
+		Handler:   saver,
+		ID:        17,
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 128)); err == nil {
+		t.Fatal("expected an error here")
+	}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Write(make([]byte, 128)); err == nil {
+		t.Fatal("expected an error here")
+	}
+	var readTimeout, writeTimeout bool
+	for _, ev := range saver.Read() {
+		if ev.ReadTimeout != nil {
+			readTimeout = true
+			if ev.ReadTimeout.ConnID != 17 {
+				t.Fatal("unexpected ConnID")
+			}
+			if ev.ReadTimeout.DurationSinceBeginning < 50*time.Millisecond {
+				t.Fatal("the deadline fired too early")
+			}
+		}
+		if ev.WriteTimeout != nil {
+			writeTimeout = true
+			if ev.WriteTimeout.ConnID != 17 {
+				t.Fatal("unexpected ConnID")
+			}
+		}
+	}
+	if !readTimeout || !writeTimeout {
+		t.Fatal("missing timeout events")
+	}
+}
+
+func TestUnitMeasuringConnNoTimeoutEvents(t *testing.T) {
+	saver := &handlers.SavingHandler{}
+	conn := &MeasuringConn{
+		Conn:    fakeconn{},
+		Handler: saver,
+	}
+	conn.Read(make([]byte, 4))
+	conn.Write(make([]byte, 4))
+	for _, ev := range saver.Read() {
+		if ev.ReadTimeout != nil || ev.WriteTimeout != nil {
+			t.Fatal("unexpected timeout event")
+		}
+	}
+}
+
 type fakeconn struct{}
 
 func (fakeconn) Read(b []byte) (n int, err error) {
@@ -4,8 +4,11 @@ package dialer
 
 import (
 	"crypto/tls"
+	"net/url"
 
 	"github.com/ooni/probe-engine/netx/internal/dialer/dnsdialer"
+	"github.com/ooni/probe-engine/netx/internal/dialer/proxydialer"
+	"github.com/ooni/probe-engine/netx/internal/dialer/throttledialer"
 	"github.com/ooni/probe-engine/netx/internal/dialer/tlsdialer"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
@@ -19,3 +22,14 @@ func New(resolver modelx.DNSResolver, dialer modelx.Dialer) *dnsdialer.Dialer {
 func NewTLS(dialer modelx.Dialer, config *tls.Config) *tlsdialer.TLSDialer {
 	return tlsdialer.New(dialer, config)
 }
+
+// NewProxy creates a new modelx.Dialer connecting through proxyURL
+func NewProxy(dialer modelx.Dialer, proxyURL *url.URL) (*proxydialer.Dialer, error) {
+	return proxydialer.New(dialer, proxyURL)
+}
+
+// NewThrottle creates a new modelx.Dialer whose connections read and
+// write at most rate bytes per second. Zero means no limit.
+func NewThrottle(dialer modelx.Dialer, rate int64) *throttledialer.Dialer {
+	return throttledialer.New(dialer, rate)
+}
@@ -31,3 +31,15 @@ func TestIntegrationNewTLS(t *testing.T) {
 	}
 	conn.Close()
 }
+
+func TestIntegrationNewThrottle(t *testing.T) {
+	var dialer modelx.Dialer = NewThrottle(new(net.Dialer), 1<<20)
+	conn, err := dialer.Dial("tcp", "www.kernel.org:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatal("expected non-nil conn")
+	}
+	conn.Close()
+}
@@ -60,7 +60,11 @@ func (d *Dialer) DialContext(
 		Error:     err,
 		Operation: "connect",
 	}.MaybeBuild()
-	connID := safeConnID(network, conn)
+	var connID int64
+	if err == nil {
+		connID = connid.Next(network)
+		connid.Register(conn, connID)
+	}
 	txID := transactionid.ContextTransactionID(ctx)
 	d.handler.OnMeasurement(modelx.Measurement{
 		Connect: &modelx.ConnectEvent{
@@ -68,10 +72,13 @@ func (d *Dialer) DialContext(
 			DialID:                 d.dialID,
 			DurationSinceBeginning: stop.Sub(d.beginning),
 			Error:                  err,
+			KeepAlive:              keepAlive(d.dialer),
+			LocalAddress:           safeLocalAddress(conn),
 			Network:                network,
 			RemoteAddress:          address,
 			SyscallDuration:        stop.Sub(start),
 			TransactionID:          txID,
+			VantagePoint:           modelx.ContextVantagePoint(ctx),
 		},
 	})
 	if err != nil {
@@ -91,7 +98,3 @@ func safeLocalAddress(conn net.Conn) (s string) {
 	}
 	return
 }
-
-func safeConnID(network string, conn net.Conn) int64 {
-	return connid.Compute(network, safeLocalAddress(conn))
-}
@@ -35,6 +35,27 @@ func TestIntegrationErrorNoConnect(t *testing.T) {
 	}
 }
 
+func TestUnitConnectEventHasVantagePoint(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	saver := &handlers.SavingHandler{}
+	dialer := New(time.Now(), saver, new(net.Dialer), 17)
+	vp := &modelx.VantagePoint{ProbeASN: "AS137", ProbeCC: "IT"}
+	ctx := modelx.WithVantagePoint(context.Background(), vp)
+	conn, err := dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	connects := saver.Connects()
+	if len(connects) != 1 || connects[0].VantagePoint != vp {
+		t.Fatal("expected the connect event to be tagged")
+	}
+}
+
 // see whether we implement the interface
 func newdialer() modelx.Dialer {
 	return New(
@@ -0,0 +1,112 @@
+package dialerbase
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// ErrLocalAddrNotAvailable indicates that the local address we should
+// bind to is not assigned to any of the interfaces of this host.
+var ErrLocalAddrNotAvailable = errors.New("dialerbase: local address not available")
+
+// LookupLocalIP returns the local IP address to bind to given either an
+// IP address or the name of a network interface. In the latter case, we
+// return the first IPv4 address of the interface or, if there is no such
+// address, its first IPv6 address. We fail if the address is not assigned
+// to any interface, so that we don't fail later when connecting.
+func LookupLocalIP(addressOrInterface string) (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if ip := net.ParseIP(addressOrInterface); ip != nil {
+		if ip.IsUnspecified() {
+			return ip, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return ip, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrLocalAddrNotAvailable, addressOrInterface)
+	}
+	iface, err := net.InterfaceByName(addressOrInterface)
+	if err != nil {
+		return nil, fmt.Errorf("dialerbase: no such interface: %s", addressOrInterface)
+	}
+	addrs, err = iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ipv6 net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+		if ipv6 == nil {
+			ipv6 = ipnet.IP
+		}
+	}
+	if ipv6 == nil {
+		return nil, fmt.Errorf("%w: %s has no address", ErrLocalAddrNotAvailable,
+			addressOrInterface)
+	}
+	return ipv6, nil
+}
+
+// NetDialer is a modelx.Dialer that uses net.Dialer to create
+// connections. The zero value behaves like new(net.Dialer).
+type NetDialer struct {
+	// KeepAlive is the TCP keep-alive period. Zero means that we use
+	// Go's default period, while a negative value disables keep-alives.
+	KeepAlive time.Duration
+
+	// LocalIP, when not nil, is the local IP to bind to.
+	LocalIP net.IP
+}
+
+// Dial creates a TCP or UDP connection. See net.Dial docs.
+func (d *NetDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but with context.
+func (d *NetDialer) DialContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	dialer := &net.Dialer{KeepAlive: d.KeepAlive}
+	if d.LocalIP != nil {
+		// The type of LocalAddr must match the network, otherwise
+		// net.Dialer fails with a mismatched address type error.
+		switch {
+		case strings.HasPrefix(network, "tcp"):
+			dialer.LocalAddr = &net.TCPAddr{IP: d.LocalIP}
+		case strings.HasPrefix(network, "udp"):
+			dialer.LocalAddr = &net.UDPAddr{IP: d.LocalIP}
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// keepAlive returns the keep-alive period configured in dialer, if
+// we know how to obtain it, and zero otherwise.
+func keepAlive(dialer modelx.Dialer) time.Duration {
+	switch d := dialer.(type) {
+	case *net.Dialer:
+		return d.KeepAlive
+	case *NetDialer:
+		return d.KeepAlive
+	default:
+		return 0
+	}
+}
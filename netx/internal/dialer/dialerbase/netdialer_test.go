@@ -0,0 +1,126 @@
+package dialerbase
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/handlers"
+)
+
+func loopbackInterface(t *testing.T) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+	t.Skip("no loopback interface")
+	return ""
+}
+
+func TestUnitLookupLocalIP(t *testing.T) {
+	ip, err := LookupLocalIP("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatal("unexpected IP")
+	}
+	ip, err = LookupLocalIP(loopbackInterface(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IsLoopback() {
+		t.Fatal("expected a loopback IP")
+	}
+	ip, err = LookupLocalIP("0.0.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.IsUnspecified() {
+		t.Fatal("expected the unspecified IP")
+	}
+}
+
+func TestUnitLookupLocalIPNotAvailable(t *testing.T) {
+	ip, err := LookupLocalIP("192.0.2.1") // TEST-NET-1
+	if !errors.Is(err, ErrLocalAddrNotAvailable) {
+		t.Fatal("not the error we expected", err)
+	}
+	if ip != nil {
+		t.Fatal("expected nil IP here")
+	}
+}
+
+func TestUnitLookupLocalIPNoSuchInterface(t *testing.T) {
+	ip, err := LookupLocalIP("antani0")
+	if err == nil || err.Error() != "dialerbase: no such interface: antani0" {
+		t.Fatal("not the error we expected", err)
+	}
+	if ip != nil {
+		t.Fatal("expected nil IP here")
+	}
+}
+
+func TestIntegrationDialWithLocalIP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	saver := &handlers.SavingHandler{}
+	dialer := New(time.Now(), saver, &NetDialer{LocalIP: net.IPv4(127, 0, 0, 1)}, 17)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	events := saver.Read()
+	if len(events) != 1 || events[0].Connect == nil {
+		t.Fatal("expected a single connect event")
+	}
+	if events[0].Connect.LocalAddress != conn.LocalAddr().String() {
+		t.Fatal("unexpected local address in connect event")
+	}
+	host, _, err := net.SplitHostPort(events[0].Connect.LocalAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" {
+		t.Fatal("unexpected local IP")
+	}
+}
+
+func TestIntegrationDialUDPWithLocalIP(t *testing.T) {
+	dialer := New(
+		time.Now(), handlers.NoHandler, &NetDialer{LocalIP: net.IPv4(127, 0, 0, 1)}, 17)
+	conn, err := dialer.Dial("udp", "127.0.0.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "127.0.0.1" {
+		t.Fatal("unexpected local IP")
+	}
+}
+
+func TestUnitKeepAlive(t *testing.T) {
+	if keepAlive(&net.Dialer{KeepAlive: 3 * time.Second}) != 3*time.Second {
+		t.Fatal("unexpected net.Dialer keep-alive")
+	}
+	if keepAlive(&NetDialer{KeepAlive: -1}) != -1 {
+		t.Fatal("unexpected NetDialer keep-alive")
+	}
+	if keepAlive(New(time.Now(), handlers.NoHandler, new(net.Dialer), 0)) != 0 {
+		t.Fatal("unexpected keep-alive for unknown dialer")
+	}
+}
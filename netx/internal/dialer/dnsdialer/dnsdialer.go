@@ -6,24 +6,54 @@ import (
 	"errors"
 	"net"
 	"strings"
+	"time"
 
+	"github.com/ooni/probe-engine/netx/internal/connid"
 	"github.com/ooni/probe-engine/netx/internal/dialer/dialerbase"
 	"github.com/ooni/probe-engine/netx/internal/dialid"
+	"github.com/ooni/probe-engine/netx/internal/transactionid"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 // Dialer defines the dialer API. We implement the most basic form
 // of DNS, but more advanced resolutions are possible.
 type Dialer struct {
-	dialer   modelx.Dialer
-	resolver modelx.DNSResolver
+	// ConnectTimeout is the maximum time we spend trying to connect to
+	// each resolved address, so that a slow address does not consume the
+	// time budget of the following ones. When zero, there is no timeout
+	// per address. The context deadline, if any, is always a hard cap.
+	ConnectTimeout time.Duration
+
+	// ForceIPv6 causes the dialer to try the IPv6 addresses in the
+	// order returned by the resolver even when this host does not seem
+	// to have IPv6 connectivity. By default, when we know that IPv6
+	// is not reachable, we try the IPv6 addresses after the IPv4 ones,
+	// to avoid wasting time. Measurements specifically testing IPv6
+	// should set ForceIPv6, so that the attempts are not reordered.
+	ForceIPv6 bool
+
+	// Port, when not empty, is the port we connect to, overriding the
+	// port in the address passed to Dial, which may then only contain
+	// the host. This allows to scan several ports of the same host.
+	Port string
+
+	// SkipResolution causes the dialer to pass the original address
+	// to the underlying dialer without resolving it. This is useful when
+	// the underlying dialer is a proxy capable of resolving domain names
+	// remotely (e.g. SOCKS5), so that we don't leak local DNS queries.
+	SkipResolution bool
+
+	dialer     modelx.Dialer
+	ipv6prober *ipv6Prober
+	resolver   modelx.DNSResolver
 }
 
 // New creates a new Dialer.
 func New(resolver modelx.DNSResolver, dialer modelx.Dialer) (d *Dialer) {
 	return &Dialer{
-		dialer:   dialer,
-		resolver: resolver,
+		dialer:     dialer,
+		ipv6prober: defaultIPv6Prober,
+		resolver:   resolver,
 	}
 }
 
@@ -37,34 +67,124 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 func (d *Dialer) DialContext(
 	ctx context.Context, network, address string,
 ) (conn net.Conn, err error) {
+	ctx, cancel := modelx.ContextWithMaxRuntime(ctx)
+	defer cancel()
 	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	address, err = OverridePort(address, d.Port)
+	if err != nil {
+		return nil, err
+	}
 	onlyhost, onlyport, err := net.SplitHostPort(address)
 	if err != nil {
 		return nil, err
 	}
 	ctx = dialid.WithDialID(ctx) // important to create before lookupHost
 	dialID := dialid.ContextDialID(ctx)
-	var addrs []string
-	addrs, err = d.lookupHost(ctx, onlyhost)
-	if err != nil {
-		return
+	var targets []string
+	if d.SkipResolution {
+		targets = append(targets, address)
+	} else {
+		var addrs []string
+		addrs, err = d.lookupHost(ctx, onlyhost)
+		if err != nil {
+			return
+		}
+		for _, addr := range d.sortAddresses(addrs) {
+			targets = append(targets, net.JoinHostPort(addr, onlyport))
+		}
 	}
-	var errorslist []error
-	for _, addr := range addrs {
+	var (
+		errorslist []error
+		failed     []string
+		remote     string
+	)
+	for _, target := range targets {
 		dialer := dialerbase.New(
 			root.Beginning, root.Handler, d.dialer, dialID,
 		)
-		target := net.JoinHostPort(addr, onlyport)
-		conn, err = dialer.DialContext(ctx, network, target)
+		conn, err = d.dialAddress(ctx, dialer, network, target)
 		if err == nil {
-			return
+			remote = target
+			break
 		}
 		errorslist = append(errorslist, err)
+		failed = append(failed, target)
+	}
+	attempts, reduced := reduceErrorsWithAddresses(failed, errorslist)
+	if conn == nil {
+		err = reduced
 	}
-	err = reduceErrors(errorslist)
+	root.Handler.OnMeasurement(modelx.Measurement{
+		DialDone: &modelx.DialDoneEvent{
+			Address:                address,
+			ConnID:                 connid.Lookup(conn),
+			DialID:                 dialID,
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Error:                  err,
+			FailedAddresses:        failed,
+			FailedAttempts:         attempts,
+			Network:                network,
+			RemoteAddress:          remote,
+			TransactionID:          transactionid.ContextTransactionID(ctx),
+		},
+	})
 	return
 }
 
+// ErrMissingPort indicates that the address passed to Dial does
+// not contain a port and there is no port override.
+var ErrMissingPort = errors.New("dnsdialer: missing port in address and no port override")
+
+// OverridePort returns address with its port replaced by port, unless
+// port is empty, in which case it returns address. The address may also
+// be a host without a port, including an IPv6 address with or without
+// brackets. It returns ErrMissingPort if both ports are missing.
+func OverridePort(address, port string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if port == "" {
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) && addrErr.Err == "missing port in address" {
+			return "", ErrMissingPort
+		}
+		return address, err
+	}
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// sortAddresses moves the IPv6 addresses after the IPv4 addresses
+// when we know that IPv6 is not reachable, unless d.ForceIPv6 is set.
+func (d *Dialer) sortAddresses(addrs []string) []string {
+	if d.ForceIPv6 {
+		return addrs
+	}
+	if reachable, known := d.ipv6prober.Reachable(); reachable || !known {
+		return addrs
+	}
+	var ipv4, ipv6 []string
+	for _, addr := range addrs {
+		if isIPv6(addr) {
+			ipv6 = append(ipv6, addr)
+			continue
+		}
+		ipv4 = append(ipv4, addr)
+	}
+	return append(ipv4, ipv6...)
+}
+
+func (d *Dialer) dialAddress(
+	ctx context.Context, dialer modelx.Dialer, network, address string,
+) (net.Conn, error) {
+	if d.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.ConnectTimeout)
+		defer cancel()
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
 func reduceErrors(errorslist []error) error {
 	if len(errorslist) == 0 {
 		return nil
@@ -77,9 +197,7 @@ func reduceErrors(errorslist []error) error {
 	// appear later in the list of errors.
 	for _, err := range errorslist {
 		var wrapper *modelx.ErrWrapper
-		if errors.As(err, &wrapper) && !strings.HasPrefix(
-			err.Error(), "unknown_error",
-		) {
+		if errors.As(err, &wrapper) && !isUnknownFailure(err.Error()) {
 			return err
 		}
 	}
@@ -87,6 +205,28 @@ func reduceErrors(errorslist []error) error {
 	return errorslist[0]
 }
 
+// reduceErrorsWithAddresses is like reduceErrors but also returns the
+// failure of each address, in order, before the reduced error, so that the caller does not lose
+// the errors that reduceErrors would discard. The addresses and the
+// errorslist must have the same length.
+func reduceErrorsWithAddresses(
+	addresses []string, errorslist []error,
+) ([]modelx.DialAttemptFailure, error) {
+	var attempts []modelx.DialAttemptFailure
+	for idx, err := range errorslist {
+		attempts = append(attempts, modelx.DialAttemptFailure{
+			Address: addresses[idx],
+			Error:   err,
+		})
+	}
+	return attempts, reduceErrors(errorslist)
+}
+
+func isUnknownFailure(failure string) bool {
+	return strings.HasPrefix(failure, "unknown_error") ||
+		strings.HasPrefix(failure, "unknown_failure")
+}
+
 func (d *Dialer) lookupHost(
 	ctx context.Context, hostname string,
 ) ([]string, error) {
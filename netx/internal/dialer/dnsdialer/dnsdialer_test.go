@@ -3,11 +3,17 @@ package dnsdialer
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/internal/dialer/dialerbase"
+	"github.com/ooni/probe-engine/netx/internal/errwrapper"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -32,14 +38,64 @@ func TestIntegrationDialAddress(t *testing.T) {
 func TestIntegrationNoPort(t *testing.T) {
 	dialer := newdialer()
 	conn, err := dialer.Dial("tcp", "antani.ooni.io")
-	if err == nil {
-		t.Fatal("expected an error here")
+	if !errors.Is(err, ErrMissingPort) {
+		t.Fatal("not the error we expected")
 	}
 	if conn != nil {
 		t.Fatal("expected a nil conn here")
 	}
 }
 
+func TestUnitPortOverride(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer := New(new(net.Resolver), new(net.Dialer))
+	dialer.Port = port
+	for _, address := range []string{"127.0.0.1", "127.0.0.1:1"} {
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != listener.Addr().String() {
+			t.Fatal("unexpected remote address")
+		}
+		conn.Close()
+	}
+}
+
+func TestUnitOverridePort(t *testing.T) {
+	var table = []struct {
+		address string
+		port    string
+		expect  string
+		err     error
+	}{
+		{"www.google.com:80", "", "www.google.com:80", nil},
+		{"www.google.com:80", "443", "www.google.com:443", nil},
+		{"www.google.com", "443", "www.google.com:443", nil},
+		{"www.google.com", "", "", ErrMissingPort},
+		{"[::1]:80", "443", "[::1]:443", nil},
+		{"[::1]", "443", "[::1]:443", nil},
+		{"::1", "443", "[::1]:443", nil},
+	}
+	for _, entry := range table {
+		out, err := OverridePort(entry.address, entry.port)
+		if out != entry.expect || !errors.Is(err, entry.err) {
+			t.Fatalf("unexpected result for %+v: %s %v", entry, out, err)
+		}
+	}
+	if _, err := OverridePort("::1", ""); err == nil || errors.Is(err, ErrMissingPort) {
+		t.Fatal("expected the original error here")
+	}
+}
+
 func TestIntegrationLookupFailure(t *testing.T) {
 	dialer := newdialer()
 	conn, err := dialer.Dial("tcp", "antani.ooni.io:443")
@@ -71,8 +127,32 @@ func newdialer() modelx.Dialer {
 }
 
 func TestReduceErrors(t *testing.T) {
+	// reduce calls both reduceErrors and reduceErrorsWithAddresses and
+	// checks that they agree and that the latter preserves all the
+	// per-address failures, in order.
+	reduce := func(t *testing.T, errorslist []error) error {
+		var addresses []string
+		for idx := range errorslist {
+			addresses = append(addresses, fmt.Sprintf("10.0.0.%d:443", idx+1))
+		}
+		result := reduceErrors(errorslist)
+		attempts, other := reduceErrorsWithAddresses(addresses, errorslist)
+		if other != result {
+			t.Fatal("the two functions disagree")
+		}
+		if len(attempts) != len(errorslist) {
+			t.Fatal("unexpected number of attempts")
+		}
+		for idx, attempt := range attempts {
+			if attempt.Address != addresses[idx] || attempt.Error != errorslist[idx] {
+				t.Fatal("unexpected attempt")
+			}
+		}
+		return result
+	}
+
 	t.Run("no errors", func(t *testing.T) {
-		result := reduceErrors(nil)
+		result := reduce(t, nil)
 		if result != nil {
 			t.Fatal("wrong result")
 		}
@@ -80,7 +160,7 @@ func TestReduceErrors(t *testing.T) {
 
 	t.Run("single error", func(t *testing.T) {
 		err := errors.New("mocked error")
-		result := reduceErrors([]error{err})
+		result := reduce(t, []error{err})
 		if result != err {
 			t.Fatal("wrong result")
 		}
@@ -89,7 +169,7 @@ func TestReduceErrors(t *testing.T) {
 	t.Run("multiple errors", func(t *testing.T) {
 		err1 := errors.New("mocked error #1")
 		err2 := errors.New("mocked error #2")
-		result := reduceErrors([]error{err1, err2})
+		result := reduce(t, []error{err1, err2})
 		if result.Error() != "mocked error #1" {
 			t.Fatal("wrong result")
 		}
@@ -104,11 +184,30 @@ func TestReduceErrors(t *testing.T) {
 			Failure: modelx.FailureConnectionRefused,
 		}
 		err4 := errors.New("mocked error #3")
-		result := reduceErrors([]error{err1, err2, err3, err4})
+		result := reduce(t, []error{err1, err2, err3, err4})
 		if result.Error() != modelx.FailureConnectionRefused {
 			t.Fatal("wrong result")
 		}
 	})
+
+	t.Run("unknown failures have lower precedence", func(t *testing.T) {
+		err1 := errwrapper.SafeErrWrapperBuilder{
+			Error:     errors.New("antani"),
+			Operation: "connect",
+		}.MaybeBuild()
+		err2 := errwrapper.SafeErrWrapperBuilder{
+			Error: &net.OpError{
+				Op:  "dial",
+				Net: "tcp",
+				Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNRESET},
+			},
+			Operation: "connect",
+		}.MaybeBuild()
+		result := reduce(t, []error{err1, err2})
+		if result.Error() != modelx.FailureConnectionReset {
+			t.Fatal("wrong result")
+		}
+	})
 }
 
 func TestIntegrationDivertLookupHost(t *testing.T) {
@@ -133,3 +232,305 @@ func TestIntegrationDivertLookupHost(t *testing.T) {
 		t.Fatal("expected a nil conn here")
 	}
 }
+
+// fakeconnector is a modelx.Dialer recording the address it
+// has been asked to dial and always failing.
+type fakeconnector struct {
+	address string
+}
+
+func (d *fakeconnector) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *fakeconnector) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	d.address = address
+	return nil, errors.New("mocked error")
+}
+
+func TestUnitSkipResolution(t *testing.T) {
+	connector := new(fakeconnector)
+	dialer := New(new(net.Resolver), connector)
+	dialer.SkipResolution = true
+	root := &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handlers.NoHandler,
+		LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+			t.Fatal("should not resolve the hostname")
+			return nil, nil
+		},
+	}
+	ctx := modelx.WithMeasurementRoot(context.Background(), root)
+	conn, err := dialer.DialContext(ctx, "tcp", "google.com:443")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected a nil conn here")
+	}
+	if connector.address != "google.com:443" {
+		t.Fatal("the connector did not receive the hostname")
+	}
+}
+
+// selectiveconnector is a modelx.Dialer that only succeeds
+// when dialing the configured address.
+type selectiveconnector struct {
+	good string
+}
+
+func (d *selectiveconnector) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *selectiveconnector) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	if address != d.good {
+		return nil, errors.New("mocked error")
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+type dialdonechecker struct {
+	events []*modelx.DialDoneEvent
+	mu     sync.Mutex
+}
+
+func (h *dialdonechecker) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.DialDone != nil {
+		h.events = append(h.events, m.DialDone)
+	}
+}
+
+func TestUnitDialDoneEvent(t *testing.T) {
+	t.Run("on success", func(t *testing.T) {
+		dialer := New(new(net.Resolver), &selectiveconnector{good: "10.0.0.3:443"})
+		handler := new(dialdonechecker)
+		root := &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+			LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+				return []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, nil
+			},
+		}
+		ctx := modelx.WithMeasurementRoot(context.Background(), root)
+		conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if len(handler.events) != 1 {
+			t.Fatal("unexpected number of events")
+		}
+		ev := handler.events[0]
+		if ev.Address != "www.example.com:443" || ev.Error != nil {
+			t.Fatal("unexpected event")
+		}
+		if ev.RemoteAddress != "10.0.0.3:443" {
+			t.Fatal("unexpected remote address")
+		}
+		if len(ev.FailedAddresses) != 2 || ev.FailedAddresses[0] != "10.0.0.1:443" ||
+			ev.FailedAddresses[1] != "10.0.0.2:443" {
+			t.Fatal("unexpected failed addresses")
+		}
+		if len(ev.FailedAttempts) != 2 || ev.FailedAttempts[0].Address != "10.0.0.1:443" ||
+			ev.FailedAttempts[1].Address != "10.0.0.2:443" || ev.FailedAttempts[0].Error == nil {
+			t.Fatal("unexpected failed attempts")
+		}
+	})
+	t.Run("on failure", func(t *testing.T) {
+		dialer := New(new(net.Resolver), &selectiveconnector{})
+		handler := new(dialdonechecker)
+		root := &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+			LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+				return []string{"10.0.0.1", "10.0.0.2"}, nil
+			},
+		}
+		ctx := modelx.WithMeasurementRoot(context.Background(), root)
+		conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:443")
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		if conn != nil {
+			t.Fatal("expected a nil conn here")
+		}
+		if len(handler.events) != 1 {
+			t.Fatal("unexpected number of events")
+		}
+		ev := handler.events[0]
+		if ev.Error != err || ev.RemoteAddress != "" || len(ev.FailedAddresses) != 2 {
+			t.Fatal("unexpected event")
+		}
+		if len(ev.FailedAttempts) != 2 || ev.FailedAttempts[0].Error != err {
+			t.Fatal("unexpected failed attempts")
+		}
+	})
+}
+
+// slowconnector is a modelx.Dialer that blocks until the context is
+// done when dialing the configured addresses and otherwise succeeds.
+type slowconnector struct {
+	slow map[string]bool
+}
+
+func (d *slowconnector) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *slowconnector) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	if d.slow[address] {
+		<-ctx.Done()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func TestUnitConnectTimeout(t *testing.T) {
+	newctx := func(handler modelx.Handler) context.Context {
+		return modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+			LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+				return []string{"10.0.0.1", "10.0.0.2"}, nil
+			},
+		})
+	}
+	t.Run("with unreachable first address", func(t *testing.T) {
+		dialer := New(new(net.Resolver), &slowconnector{
+			slow: map[string]bool{"10.0.0.1:443": true},
+		})
+		dialer.ConnectTimeout = 10 * time.Millisecond
+		handler := new(dialdonechecker)
+		conn, err := dialer.DialContext(newctx(handler), "tcp", "www.example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if len(handler.events) != 1 || handler.events[0].RemoteAddress != "10.0.0.2:443" {
+			t.Fatal("did not connect to the second address")
+		}
+	})
+	t.Run("with all addresses unreachable", func(t *testing.T) {
+		dialer := New(new(net.Resolver), &slowconnector{
+			slow: map[string]bool{"10.0.0.1:443": true, "10.0.0.2:443": true},
+		})
+		dialer.ConnectTimeout = 10 * time.Millisecond
+		handler := new(dialdonechecker)
+		_, err := dialer.DialContext(newctx(handler), "tcp", "www.example.com:443")
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		var wrapper *modelx.ErrWrapper
+		if !errors.As(err, &wrapper) || wrapper.Operation != "connect" {
+			t.Fatal("not the error we expected")
+		}
+		if wrapper.Failure != modelx.FailureGenericTimeoutError {
+			t.Fatal("unexpected failure")
+		}
+		if len(handler.events) != 1 || len(handler.events[0].FailedAddresses) != 2 {
+			t.Fatal("expected both addresses to be tried")
+		}
+	})
+	t.Run("with shorter context deadline", func(t *testing.T) {
+		dialer := New(new(net.Resolver), &slowconnector{
+			slow: map[string]bool{"10.0.0.1:443": true},
+		})
+		dialer.ConnectTimeout = time.Hour
+		ctx, cancel := context.WithTimeout(
+			newctx(handlers.NoHandler), 10*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:443")
+		if time.Since(start) > 10*time.Second {
+			t.Fatal("did not respect the context deadline")
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		if err.Error() != modelx.FailureGenericTimeoutError {
+			t.Fatal("not the error we expected")
+		}
+	})
+}
+
+func TestUnitMaxRuntime(t *testing.T) {
+	dialer := New(new(net.Resolver), &slowconnector{
+		slow: map[string]bool{"10.0.0.1:443": true, "10.0.0.2:443": true},
+	})
+	dialer.ConnectTimeout = time.Hour
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handlers.NoHandler,
+		LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+			return []string{"10.0.0.1", "10.0.0.2"}, nil
+		},
+		MaxRuntime: 10 * time.Millisecond,
+	})
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:443")
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("did not respect MaxRuntime")
+	}
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err.Error() != modelx.FailureGenericTimeoutError {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+}
+
+func TestUnitKeepAliveFlowsToConnectEvent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, period := range []time.Duration{-1, 0, 7 * time.Second} {
+		saver := &handlers.SavingHandler{}
+		ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   saver,
+			LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+				return []string{"127.0.0.1"}, nil
+			},
+		})
+		dialer := New(new(net.Resolver), &dialerbase.NetDialer{KeepAlive: period})
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		var found bool
+		for _, ev := range saver.Read() {
+			if ev.Connect != nil {
+				found = true
+				if ev.Connect.KeepAlive != period {
+					t.Fatal("unexpected keep-alive period")
+				}
+			}
+		}
+		if !found {
+			t.Fatal("no connect event")
+		}
+	}
+}
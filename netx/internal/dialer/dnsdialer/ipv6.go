@@ -0,0 +1,64 @@
+package dnsdialer
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ipv6ProbeAddress is a global IPv6 address that we use to check whether
+// this host has a route towards the IPv6 internet.
+const ipv6ProbeAddress = "[2001:4860:4860::8888]:53"
+
+const (
+	ipv6Unknown = int32(iota)
+	ipv6Reachable
+	ipv6Unreachable
+)
+
+// ipv6Prober checks once whether IPv6 is reachable and caches the result.
+type ipv6Prober struct {
+	once  sync.Once
+	probe func() bool
+	state int32
+}
+
+// defaultIPv6Prober is shared by all dialers, since IPv6 reachability
+// is a property of the host rather than of the dialer.
+var defaultIPv6Prober = &ipv6Prober{probe: probeIPv6}
+
+// Reachable returns whether IPv6 is reachable and whether we know that.
+// The first call starts the probe in a background goroutine and returns
+// immediately, so that we never delay the dial that triggered it. Until
+// the probe completes, we do not know whether IPv6 is reachable.
+func (p *ipv6Prober) Reachable() (reachable, known bool) {
+	p.once.Do(func() {
+		go func() {
+			state := ipv6Unreachable
+			if p.probe() {
+				state = ipv6Reachable
+			}
+			atomic.StoreInt32(&p.state, state)
+		}()
+	})
+	state := atomic.LoadInt32(&p.state)
+	return state == ipv6Reachable, state != ipv6Unknown
+}
+
+// probeIPv6 returns whether we have a route towards the IPv6 internet.
+// Connecting a UDP socket does not send any packet, so this is cheap
+// and does not depend on the remote address being up.
+func probeIPv6() bool {
+	conn, err := net.Dial("udp6", ipv6ProbeAddress)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// isIPv6 returns whether addr is an IPv6 address.
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
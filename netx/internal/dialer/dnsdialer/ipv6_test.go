@@ -0,0 +1,133 @@
+package dnsdialer
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// newprober returns an ipv6Prober that already knows the result.
+func newprober(reachable bool) *ipv6Prober {
+	p := &ipv6Prober{probe: func() bool { return reachable }}
+	p.once.Do(func() {})
+	p.state = ipv6Unreachable
+	if reachable {
+		p.state = ipv6Reachable
+	}
+	return p
+}
+
+// newunknownprober returns an ipv6Prober that never knows the result.
+func newunknownprober() *ipv6Prober {
+	p := new(ipv6Prober)
+	p.once.Do(func() {})
+	return p
+}
+
+func TestUnitIPv6ProberIsNonBlocking(t *testing.T) {
+	unblock := make(chan struct{})
+	p := &ipv6Prober{probe: func() bool {
+		<-unblock
+		return true
+	}}
+	if _, known := p.Reachable(); known {
+		t.Fatal("expected the result to be unknown")
+	}
+	close(unblock)
+	for {
+		reachable, known := p.Reachable()
+		if known {
+			if !reachable {
+				t.Fatal("expected IPv6 to be reachable")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnitIPv6ProberRunsOnce(t *testing.T) {
+	var count int
+	done := make(chan struct{})
+	p := &ipv6Prober{probe: func() bool {
+		count++
+		close(done)
+		return false
+	}}
+	for i := 0; i < 4; i++ {
+		p.Reachable()
+	}
+	<-done
+	for {
+		if _, known := p.Reachable(); known {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if count != 1 {
+		t.Fatal("expected a single probe")
+	}
+}
+
+func TestUnitSortAddresses(t *testing.T) {
+	addrs := []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2"}
+	var cases = []struct {
+		name     string
+		force    bool
+		prober   *ipv6Prober
+		expected []string
+	}{{
+		name:     "IPv6 is reachable",
+		prober:   newprober(true),
+		expected: addrs,
+	}, {
+		name:     "IPv6 reachability is unknown",
+		prober:   newunknownprober(),
+		expected: addrs,
+	}, {
+		name:     "IPv6 is not reachable",
+		prober:   newprober(false),
+		expected: []string{"10.0.0.1", "10.0.0.2", "2001:db8::1", "2001:db8::2"},
+	}, {
+		name:     "IPv6 is not reachable but we force it",
+		force:    true,
+		prober:   newprober(false),
+		expected: addrs,
+	}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dialer := New(new(net.Resolver), new(fakeconnector))
+			dialer.ForceIPv6 = c.force
+			dialer.ipv6prober = c.prober
+			if sorted := dialer.sortAddresses(addrs); !reflect.DeepEqual(sorted, c.expected) {
+				t.Fatalf("unexpected order: %+v", sorted)
+			}
+		})
+	}
+}
+
+func TestUnitDialWithUnreachableIPv6(t *testing.T) {
+	dialer := New(new(net.Resolver), &selectiveconnector{good: "10.0.0.1:443"})
+	dialer.ipv6prober = newprober(false)
+	handler := new(dialdonechecker)
+	root := &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   handler,
+		LookupHost: func(ctx context.Context, hostname string) ([]string, error) {
+			return []string{"2001:db8::1", "10.0.0.1"}, nil
+		},
+	}
+	ctx := modelx.WithMeasurementRoot(context.Background(), root)
+	conn, err := dialer.DialContext(ctx, "tcp", "www.example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(handler.events) != 1 || len(handler.events[0].FailedAddresses) != 0 {
+		t.Fatal("expected to connect without trying IPv6 first")
+	}
+}
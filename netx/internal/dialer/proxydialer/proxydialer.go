@@ -0,0 +1,224 @@
+// Package proxydialer contains a dialer that connects to the target
+// address through a SOCKS5 or an HTTP(S) proxy and emits events that
+// tell us how the proxy handshake went.
+package proxydialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/internal/connid"
+	"github.com/ooni/probe-engine/netx/internal/dialid"
+	"github.com/ooni/probe-engine/netx/internal/errwrapper"
+	"github.com/ooni/probe-engine/netx/internal/transactionid"
+	"github.com/ooni/probe-engine/netx/modelx"
+	"golang.org/x/net/proxy"
+)
+
+// ErrUnsupportedProxy indicates that the proxy URL scheme is not supported.
+var ErrUnsupportedProxy = errors.New("proxydialer: unsupported proxy scheme")
+
+// Dialer is a dialer that connects through a proxy.
+type Dialer struct {
+	// TLSConfig is the TLS config used to connect to an "https" proxy. If
+	// nil, we use the default config. In any case, if the ServerName is
+	// empty, we use the hostname of the proxy.
+	TLSConfig *tls.Config
+
+	dialer   modelx.Dialer
+	proxyURL *url.URL
+}
+
+// New creates a new Dialer connecting through proxyURL, whose scheme
+// must be "socks5", "http", or "https", using dialer to connect to the
+// proxy. With "https", we talk TLS with the proxy and then we use the
+// CONNECT method like with "http". The target address is not resolved
+// locally, so that the proxy resolves it and we do not leak DNS queries.
+func New(dialer modelx.Dialer, proxyURL *url.URL) (*Dialer, error) {
+	switch proxyURL.Scheme {
+	case "socks5", "http", "https":
+		return &Dialer{dialer: dialer, proxyURL: proxyURL}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedProxy, proxyURL.Scheme)
+}
+
+// Dial creates a TCP connection. See net.Dial docs.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but with context.
+func (d *Dialer) DialContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	ctx = dialid.WithDialID(ctx)
+	dialID := dialid.ContextDialID(ctx)
+	txID := transactionid.ContextTransactionID(ctx)
+	root.Handler.OnMeasurement(modelx.Measurement{
+		ProxyConnectStart: &modelx.ProxyConnectStartEvent{
+			DialID:                 dialID,
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Network:                network,
+			ProxyAddress:           d.proxyURL.Host,
+			ProxyType:              d.proxyURL.Scheme,
+			TargetAddress:          address,
+			TransactionID:          txID,
+		},
+	})
+	conn, statusCode, err := d.dial(ctx, network, address)
+	err = errwrapper.SafeErrWrapperBuilder{
+		DialID:        dialID,
+		Error:         err,
+		Operation:     "proxy_connect",
+		TransactionID: txID,
+	}.MaybeBuild()
+	var connID int64
+	if err == nil {
+		connID = connid.Lookup(conn)
+	}
+	root.Handler.OnMeasurement(modelx.Measurement{
+		ProxyConnectDone: &modelx.ProxyConnectDoneEvent{
+			ConnID:                 connID,
+			DialID:                 dialID,
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Error:                  err,
+			Network:                network,
+			ProxyAddress:           d.proxyURL.Host,
+			ProxyType:              d.proxyURL.Scheme,
+			StatusCode:             statusCode,
+			TargetAddress:          address,
+			TransactionID:          txID,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *Dialer) dial(
+	ctx context.Context, network, address string,
+) (net.Conn, int64, error) {
+	if d.proxyURL.Scheme == "http" || d.proxyURL.Scheme == "https" {
+		return d.dialHTTP(ctx, network, address)
+	}
+	var auth *proxy.Auth
+	if d.proxyURL.User != nil {
+		auth = &proxy.Auth{User: d.proxyURL.User.Username()}
+		auth.Password, _ = d.proxyURL.User.Password()
+	}
+	dialer, err := proxy.SOCKS5("tcp", d.proxyURL.Host, auth, d.dialer)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The SOCKS5 dialer returned by x/net/proxy implements DialContext
+	// and uses our dialer's DialContext to reach the proxy.
+	conn, err := dialer.(proxy.ContextDialer).DialContext(ctx, network, address)
+	return conn, 0, err
+}
+
+func (d *Dialer) dialHTTP(
+	ctx context.Context, network, address string,
+) (net.Conn, int64, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Make sure we don't block forever during the handshake.
+	// Closing the TCP connection also unblocks the TLS handshake.
+	done := make(chan interface{})
+	defer close(done)
+	tcpconn := conn
+	go func() {
+		select {
+		case <-ctx.Done():
+			tcpconn.Close()
+		case <-done:
+		}
+	}()
+	if d.proxyURL.Scheme == "https" {
+		tlsconn := tls.Client(tcpconn, d.tlsConfig())
+		if err := tlsconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, 0, errwrapper.SafeErrWrapperBuilder{
+				Error:     ctxErrOr(ctx, err),
+				Operation: "tls_handshake",
+			}.MaybeBuild()
+		}
+		conn = tlsconn
+	}
+	req := &http.Request{
+		Header: make(http.Header),
+		Host:   address,
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+	}
+	if d.proxyURL.User != nil {
+		password, _ := d.proxyURL.User.Password()
+		req.SetBasicAuth(d.proxyURL.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, 0, ctxErrOr(ctx, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, 0, ctxErrOr(ctx, err)
+	}
+	resp.Body.Close()
+	statusCode := int64(resp.StatusCode)
+	switch resp.StatusCode {
+	case 200:
+	case 407:
+		conn.Close()
+		return nil, statusCode, fmt.Errorf("%w: %s", modelx.ErrProxyAuthRequired, resp.Status)
+	default:
+		conn.Close()
+		return nil, statusCode, fmt.Errorf("%w: %s", modelx.ErrProxyConnectRefused, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		// The proxy has already sent us bytes from the target.
+		return &bufferedConn{Conn: conn, reader: reader}, statusCode, nil
+	}
+	return conn, statusCode, nil
+}
+
+// tlsConfig returns the TLS config for connecting to an "https" proxy.
+func (d *Dialer) tlsConfig() *tls.Config {
+	config := new(tls.Config)
+	if d.TLSConfig != nil {
+		config = d.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = d.proxyURL.Hostname()
+	}
+	return config
+}
+
+func ctxErrOr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
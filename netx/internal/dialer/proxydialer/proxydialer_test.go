@@ -0,0 +1,414 @@
+package proxydialer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// newEchoServer returns the address of a server echoing what it reads.
+func newEchoServer(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// newSOCKS5Server returns the address of a minimal SOCKS5 server
+// only supporting CONNECT without authentication.
+func newSOCKS5Server(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn)
+		}
+	}()
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		addr := make([]byte, map[byte]int{1: 4, 4: 16}[request[3]])
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		host = net.IP(addr).String()
+	case 3:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	target, err := net.Dial("tcp", net.JoinHostPort(
+		host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) // connection refused
+		return
+	}
+	defer target.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() {
+		io.Copy(target, conn)
+		target.Close()
+	}()
+	io.Copy(conn, target)
+}
+
+// newHTTPProxy returns the address of a minimal HTTP proxy only
+// supporting the CONNECT method.
+func newHTTPProxy() *httptest.Server {
+	return httptest.NewServer(newHTTPProxyHandler(""))
+}
+
+// newHTTPProxyHandler returns the handler of a minimal HTTP proxy
+// only supporting the CONNECT method. When auth is not empty, the
+// proxy requires the Proxy-Authorization header to be equal to it.
+func newHTTPProxyHandler(auth string) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "CONNECT" {
+				w.WriteHeader(405)
+				return
+			}
+			if auth != "" && r.Header.Get("Proxy-Authorization") != auth {
+				w.WriteHeader(407)
+				return
+			}
+			target, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(502)
+				return
+			}
+			defer target.Close()
+			conn, rw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+			rw.Flush()
+			go func() {
+				io.Copy(target, rw)
+				target.Close()
+			}()
+			io.Copy(conn, target)
+		})
+}
+
+func dialWithSaver(
+	t *testing.T, proxyURL *url.URL, address string,
+) (net.Conn, error, []modelx.Measurement) {
+	return dialWithSaverAndTLSConfig(t, proxyURL, address, nil)
+}
+
+func dialWithSaverAndTLSConfig(
+	t *testing.T, proxyURL *url.URL, address string, config *tls.Config,
+) (net.Conn, error, []modelx.Measurement) {
+	dialer, err := New(new(net.Dialer), proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer.TLSConfig = config
+	saver := &handlers.SavingHandler{}
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   saver,
+	})
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	return conn, err, saver.Read()
+}
+
+func checkEvents(
+	t *testing.T, events []modelx.Measurement, proxyURL *url.URL, address string,
+) *modelx.ProxyConnectDoneEvent {
+	if len(events) != 2 || events[0].ProxyConnectStart == nil ||
+		events[1].ProxyConnectDone == nil {
+		t.Fatal("unexpected events")
+	}
+	start, done := events[0].ProxyConnectStart, events[1].ProxyConnectDone
+	if start.ProxyAddress != proxyURL.Host || done.ProxyAddress != proxyURL.Host {
+		t.Fatal("unexpected proxy address")
+	}
+	if start.ProxyType != proxyURL.Scheme || done.ProxyType != proxyURL.Scheme {
+		t.Fatal("unexpected proxy type")
+	}
+	if start.TargetAddress != address || done.TargetAddress != address {
+		t.Fatal("unexpected target address")
+	}
+	if start.DialID == 0 || start.DialID != done.DialID {
+		t.Fatal("unexpected DialID")
+	}
+	return done
+}
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if _, err := conn.Write([]byte("antani")); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 6)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "antani" {
+		t.Fatal("unexpected data")
+	}
+}
+
+func TestUnitSOCKS5Success(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	defer closeEcho()
+	proxyAddr, closeProxy := newSOCKS5Server(t)
+	defer closeProxy()
+	proxyURL := &url.URL{Scheme: "socks5", Host: proxyAddr}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	if done := checkEvents(t, events, proxyURL, echo); done.Error != nil {
+		t.Fatal("unexpected error in done event")
+	}
+}
+
+func TestUnitSOCKS5TargetFailure(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	closeEcho() // so the proxy cannot connect to the target
+	proxyAddr, closeProxy := newSOCKS5Server(t)
+	defer closeProxy()
+	proxyURL := &url.URL{Scheme: "socks5", Host: proxyAddr}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	done := checkEvents(t, events, proxyURL, echo)
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(done.Error, &wrapper) || wrapper.Operation != "proxy_connect" {
+		t.Fatal("expected a proxy_connect failure")
+	}
+}
+
+func TestUnitProxyRefused(t *testing.T) {
+	for _, scheme := range []string{"http", "socks5"} {
+		proxyAddr, closeProxy := newSOCKS5Server(t)
+		closeProxy() // so the connection to the proxy is refused
+		proxyURL := &url.URL{Scheme: scheme, Host: proxyAddr}
+		conn, err, events := dialWithSaver(t, proxyURL, "www.example.com:443")
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn here")
+		}
+		if done := checkEvents(t, events, proxyURL, "www.example.com:443"); done.Error == nil {
+			t.Fatal("expected an error in done event")
+		}
+	}
+}
+
+func TestUnitHTTPSuccess(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	defer closeEcho()
+	proxy := newHTTPProxy()
+	defer proxy.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	if done := checkEvents(t, events, proxyURL, echo); done.Error != nil {
+		t.Fatal("unexpected error in done event")
+	}
+}
+
+func TestUnitHTTPTargetFailure(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	closeEcho() // so the proxy cannot connect to the target
+	proxy := newHTTPProxy()
+	defer proxy.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	done := checkEvents(t, events, proxyURL, echo)
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(done.Error, &wrapper) || wrapper.Operation != "proxy_connect" {
+		t.Fatal("expected a proxy_connect failure")
+	}
+}
+
+func TestUnitUnsupportedProxy(t *testing.T) {
+	dialer, err := New(new(net.Dialer), &url.URL{Scheme: "ftp", Host: "1.1.1.1:21"})
+	if !errors.Is(err, ErrUnsupportedProxy) {
+		t.Fatal("not the error we expected")
+	}
+	if dialer != nil {
+		t.Fatal("expected nil dialer here")
+	}
+}
+
+func TestUnitHTTPAuthSuccess(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	defer closeEcho()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("antani:mascetti"))
+	proxy := httptest.NewServer(newHTTPProxyHandler(auth))
+	defer proxy.Close()
+	proxyURL := &url.URL{
+		Scheme: "http",
+		Host:   proxy.Listener.Addr().String(),
+		User:   url.UserPassword("antani", "mascetti"),
+	}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	done := checkEvents(t, events, proxyURL, echo)
+	if done.Error != nil || done.StatusCode != 200 {
+		t.Fatal("unexpected done event")
+	}
+}
+
+func TestUnitHTTPAuthRequired(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	defer closeEcho()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("antani:mascetti"))
+	proxy := httptest.NewServer(newHTTPProxyHandler(auth))
+	defer proxy.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	conn, err, events := dialWithSaver(t, proxyURL, echo)
+	if !errors.Is(err, modelx.ErrProxyAuthRequired) {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	done := checkEvents(t, events, proxyURL, echo)
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(done.Error, &wrapper) || wrapper.Operation != "proxy_connect" ||
+		wrapper.Failure != modelx.FailureProxyAuthRequired {
+		t.Fatal("expected a proxy_auth_required failure")
+	}
+	if done.StatusCode != 407 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestUnitHTTPTargetFailureStatusCode(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	closeEcho() // so the proxy cannot connect to the target
+	proxy := newHTTPProxy()
+	defer proxy.Close()
+	proxyURL := &url.URL{Scheme: "http", Host: proxy.Listener.Addr().String()}
+	_, err, events := dialWithSaver(t, proxyURL, echo)
+	if !errors.Is(err, modelx.ErrProxyConnectRefused) {
+		t.Fatal("not the error we expected")
+	}
+	if done := checkEvents(t, events, proxyURL, echo); done.StatusCode != 502 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestUnitHTTPSSuccess(t *testing.T) {
+	echo, closeEcho := newEchoServer(t)
+	defer closeEcho()
+	proxy := httptest.NewTLSServer(newHTTPProxyHandler(""))
+	defer proxy.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(proxy.Certificate())
+	proxyURL := &url.URL{Scheme: "https", Host: proxy.Listener.Addr().String()}
+	conn, err, events := dialWithSaverAndTLSConfig(
+		t, proxyURL, echo, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	if done := checkEvents(t, events, proxyURL, echo); done.Error != nil {
+		t.Fatal("unexpected error in done event")
+	}
+}
+
+func TestUnitHTTPSUntrustedProxy(t *testing.T) {
+	proxy := httptest.NewTLSServer(newHTTPProxyHandler(""))
+	defer proxy.Close()
+	proxyURL := &url.URL{Scheme: "https", Host: proxy.Listener.Addr().String()}
+	conn, err, events := dialWithSaver(t, proxyURL, "www.example.com:443")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected nil conn here")
+	}
+	done := checkEvents(t, events, proxyURL, "www.example.com:443")
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(done.Error, &wrapper) || wrapper.Operation != "tls_handshake" ||
+		wrapper.Failure != modelx.FailureSSLUnknownAuthority {
+		t.Fatalf("expected a tls_handshake failure: %+v", done.Error)
+	}
+}
@@ -0,0 +1,225 @@
+// Package throttledialer contains a dialer whose connections limit the
+// bandwidth, i.e., the rate at which we read and write bytes, to simulate
+// slow links. It does not limit the rate at which we dial.
+package throttledialer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// Dialer is a dialer whose connections limit the rate at which we read
+// and write to Rate bytes per second in each direction. A zero or
+// negative Rate means that we do not limit the rate.
+type Dialer struct {
+	Rate   int64
+	dialer modelx.Dialer
+}
+
+// New creates a new Dialer limiting the rate of the connections created
+// by dialer to rate bytes per second in each direction.
+func New(dialer modelx.Dialer, rate int64) *Dialer {
+	return &Dialer{Rate: rate, dialer: dialer}
+}
+
+// Dial creates a TCP or UDP connection. See net.Dial docs.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is like Dial but with context.
+func (d *Dialer) DialContext(
+	ctx context.Context, network, address string,
+) (net.Conn, error) {
+	conn, err := d.dialer.DialContext(ctx, network, address)
+	if err != nil || d.Rate <= 0 {
+		return conn, err
+	}
+	return newConn(conn, d.Rate), nil
+}
+
+// bucket is a token bucket where each token is a byte. The bucket is
+// initially empty, so that transferring N bytes at rate R takes about
+// N/R seconds, and holds at most burst tokens.
+type bucket struct {
+	burst  float64
+	last   time.Time
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+}
+
+func newBucket(rate int64) *bucket {
+	return &bucket{
+		burst: float64(maxChunkSize(rate)),
+		last:  time.Now(),
+		rate:  float64(rate),
+	}
+}
+
+// maxChunkSize returns the maximum number of bytes that we transfer at
+// once, which is a tenth of a second worth of bytes, so that the rate
+// is smooth also when the application uses large buffers.
+func maxChunkSize(rate int64) int {
+	if size := rate / 10; size > 1 {
+		return int(size)
+	}
+	return 1
+}
+
+// wait consumes n tokens, waiting until they are available, until ctx is
+// done, or until deadline, if not zero. In the latter cases, the tokens
+// are consumed anyway and we return, respectively, the context error or
+// errTimeout. When the tokens would only be available after deadline,
+// we wait until deadline and then fail, like a blocking Read would do.
+func (b *bucket) wait(ctx context.Context, n int, deadline time.Time) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return nil
+	}
+	delay := time.Duration(deficit / b.rate * float64(time.Second))
+	var err error
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		delay, err = deadline.Sub(now), errTimeout
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return err
+	}
+}
+
+// errTimeout is the error returned when the deadline of a connection
+// expires while we are waiting for tokens. Like the error returned by
+// net.Conn in this case, it is a net.Error whose Timeout is true.
+var errTimeout net.Error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "throttledialer: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// conn is a rate limited connection. Closing the connection interrupts
+// any Read or Write waiting for tokens, and so do the deadlines.
+type conn struct {
+	net.Conn
+	cancel    context.CancelFunc
+	chunkSize int
+	ctx       context.Context
+	mu        sync.Mutex
+	readDL    time.Time
+	reads     *bucket
+	writeDL   time.Time
+	writes    *bucket
+}
+
+func newConn(c net.Conn, rate int64) *conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		Conn:      c,
+		cancel:    cancel,
+		chunkSize: maxChunkSize(rate),
+		ctx:       ctx,
+		reads:     newBucket(rate),
+		writes:    newBucket(rate),
+	}
+}
+
+// Read reads data from the connection and then waits for as many
+// tokens as the bytes read, which delays the following reads.
+func (c *conn) Read(b []byte) (int, error) {
+	if len(b) > c.chunkSize {
+		b = b[:c.chunkSize]
+	}
+	count, err := c.Conn.Read(b)
+	if count > 0 {
+		werr := c.reads.wait(c.ctx, count, c.readDeadline())
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return count, err
+}
+
+// Write waits for tokens and then writes data to the connection, one
+// chunk at a time, so that we don't send large bursts.
+func (c *conn) Write(b []byte) (int, error) {
+	var total int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > c.chunkSize {
+			chunk = chunk[:c.chunkSize]
+		}
+		if err := c.writes.wait(c.ctx, len(chunk), c.writeDeadline()); err != nil {
+			return total, err
+		}
+		count, err := c.Conn.Write(chunk)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		b = b[count:]
+	}
+	return total, nil
+}
+
+func (c *conn) readDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readDL
+}
+
+func (c *conn) writeDeadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeDL
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDL, c.writeDL = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, which also bounds the
+// time that Read spends waiting for tokens.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDL = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline, which also bounds the
+// time that Write spends waiting for tokens.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDL = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the connection.
+func (c *conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
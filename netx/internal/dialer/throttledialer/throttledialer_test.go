@@ -0,0 +1,200 @@
+package throttledialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newListener returns a listener that writes size bytes to each
+// connection and then closes it, and reads what the peer writes.
+func newListener(t *testing.T, size int64) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if size <= 0 {
+					io.Copy(ioutil.Discard, conn)
+					return
+				}
+				conn.Write(make([]byte, size))
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestUnitZeroRate(t *testing.T) {
+	listener := newListener(t, 1)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), 0).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*net.TCPConn); !ok {
+		t.Fatal("expected an unwrapped connection")
+	}
+}
+
+func TestUnitDialFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // fail immediately
+	conn, err := New(new(net.Dialer), 1024).DialContext(ctx, "tcp", "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected a nil conn here")
+	}
+}
+
+func checkElapsed(t *testing.T, elapsed, expected time.Duration) {
+	if elapsed < expected*7/10 || elapsed > expected*2 {
+		t.Fatalf("took %s, expected about %s", elapsed, expected)
+	}
+}
+
+func TestUnitRead(t *testing.T) {
+	const size, rate = 1 << 16, 1 << 17
+	listener := newListener(t, size)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), rate).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != size {
+		t.Fatal("unexpected number of bytes")
+	}
+	checkElapsed(t, time.Since(start), size*time.Second/rate)
+}
+
+func TestUnitWrite(t *testing.T) {
+	const size, rate = 1 << 16, 1 << 17
+	listener := newListener(t, 0)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), rate).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	count, err := conn.Write(make([]byte, size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != size {
+		t.Fatal("unexpected number of bytes")
+	}
+	checkElapsed(t, time.Since(start), size*time.Second/rate)
+}
+
+func TestUnitCloseInterruptsWrite(t *testing.T) {
+	listener := newListener(t, 0)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), 1).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+	start := time.Now()
+	count, err := conn.Write(make([]byte, 1<<10))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("not the error we expected")
+	}
+	if count >= 1<<10 {
+		t.Fatal("should not have written everything")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("Close did not interrupt Write")
+	}
+}
+
+func TestUnitBucketWaitCancelled(t *testing.T) {
+	b := newBucket(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.wait(ctx, 1<<20, time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitWriteDeadline(t *testing.T) {
+	listener := newListener(t, 0)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), 1).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	count, err := conn.Write(make([]byte, 1<<10))
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+	if count >= 1<<10 {
+		t.Fatal("should not have written everything")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatal("the deadline did not interrupt Write")
+	}
+}
+
+func TestUnitReadDeadline(t *testing.T) {
+	listener := newListener(t, 1<<10)
+	defer listener.Close()
+	conn, err := New(new(net.Dialer), 1).Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = ioutil.ReadAll(conn)
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatal("the deadline did not interrupt Read")
+	}
+}
+
+func TestUnitBucketWaitDeadline(t *testing.T) {
+	b := newBucket(1)
+	start := time.Now()
+	deadline := start.Add(50 * time.Millisecond)
+	if err := b.wait(context.Background(), 1<<20, deadline); err != errTimeout {
+		t.Fatal("not the error we expected")
+	}
+	if time.Now().Before(deadline) {
+		t.Fatal("returned before the deadline")
+	}
+}
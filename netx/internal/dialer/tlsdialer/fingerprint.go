@@ -0,0 +1,75 @@
+package tlsdialer
+
+import "crypto/tls"
+
+// Fingerprint describes how the ClientHello we send should look like. We
+// cannot fully mimic a browser using the standard library, but we can get
+// reasonably close by choosing the same cipher suites, curves and ALPN.
+type Fingerprint struct {
+	// Name is the name of the fingerprint (e.g. "chrome").
+	Name string
+
+	// CipherSuites contains the TLS <= 1.2 cipher suites in order.
+	CipherSuites []uint16
+
+	// CurvePreferences contains the supported groups in order.
+	CurvePreferences []tls.CurveID
+
+	// NextProtos contains the ALPN protocols in order.
+	NextProtos []string
+}
+
+// FingerprintChrome is a Chrome-like fingerprint.
+var FingerprintChrome = &Fingerprint{
+	Name: "chrome",
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	},
+	CurvePreferences: []tls.CurveID{
+		tls.X25519, tls.CurveP256, tls.CurveP384,
+	},
+	NextProtos: []string{"h2", "http/1.1"},
+}
+
+// FingerprintFirefox is a Firefox-like fingerprint.
+var FingerprintFirefox = &Fingerprint{
+	Name: "firefox",
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	},
+	CurvePreferences: []tls.CurveID{
+		tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521,
+	},
+	NextProtos: []string{"h2", "http/1.1"},
+}
+
+// apply modifies config to use the fingerprint.
+func (fp *Fingerprint) apply(config *tls.Config) {
+	config.CipherSuites = fp.CipherSuites
+	config.CurvePreferences = fp.CurvePreferences
+	config.NextProtos = fp.NextProtos
+}
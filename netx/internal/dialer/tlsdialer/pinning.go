@@ -0,0 +1,63 @@
+package tlsdialer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// ErrInvalidPin indicates that a pin is not the base64 encoding
+// of a SHA256 hash.
+var ErrInvalidPin = errors.New("tlsdialer: invalid pin")
+
+// SPKIHash returns the pin of cert, i.e., the base64 encoding of the
+// SHA256 hash of its SubjectPublicKeyInfo, as in HPKP (RFC7469).
+func SPKIHash(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+// NewPinVerifier returns a function for tls.Config.VerifyPeerCertificate
+// that fails with modelx.ErrSSLPinMismatch unless the pin of at least a
+// certificate in the chain is in pins. Like HPKP, we check the verified
+// chains, if any, and otherwise the certificates sent by the server. We
+// return a nil function if pins is empty, which disables pinning, and an
+// error wrapping ErrInvalidPin if any pin is not valid.
+func NewPinVerifier(
+	pins []string,
+) (func([][]byte, [][]*x509.Certificate) error, error) {
+	if len(pins) <= 0 {
+		return nil, nil
+	}
+	pinset := make(map[string]bool)
+	for _, pin := range pins {
+		data, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(data) != sha256.Size {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPin, pin)
+		}
+		pinset[pin] = true
+	}
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pinset[SPKIHash(cert)] {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) > 0 {
+			return modelx.ErrSSLPinMismatch
+		}
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err == nil && pinset[SPKIHash(cert)] {
+				return nil
+			}
+		}
+		return modelx.ErrSSLPinMismatch
+	}, nil
+}
@@ -0,0 +1,98 @@
+package tlsdialer
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// newPinnedDialer returns a dialer using pool as the root CAs and pinning pins.
+func newPinnedDialer(t *testing.T, pool *x509.CertPool, pins []string) *TLSDialer {
+	verifier, err := NewPinVerifier(pins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(new(net.Dialer), &tls.Config{
+		RootCAs:               pool,
+		ServerName:            "example.com",
+		VerifyPeerCertificate: verifier,
+	})
+}
+
+func TestUnitPinning(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(server.Certificate())
+	good := SPKIHash(server.Certificate())
+	digest := sha256.Sum256([]byte("antani"))
+	bad := base64.StdEncoding.EncodeToString(digest[:])
+	address := server.Listener.Addr().String()
+
+	t.Run("with a matching pin", func(t *testing.T) {
+		dialer := newPinnedDialer(t, pool, []string{bad, good})
+		_, conn, err := dialWithHandler(t, dialer, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("with a non-matching pin", func(t *testing.T) {
+		dialer := newPinnedDialer(t, pool, []string{bad})
+		handler, conn, err := dialWithHandler(t, dialer, address)
+		if !errors.Is(err, modelx.ErrSSLPinMismatch) {
+			t.Fatal("not the error we expected")
+		}
+		if err.Error() != modelx.FailureSSLPinMismatch {
+			t.Fatal("unexpected failure")
+		}
+		if conn != nil {
+			t.Fatal("expected nil conn here")
+		}
+		if handler.done[0].Error != err {
+			t.Fatal("the event does not contain the error")
+		}
+	})
+
+	t.Run("with a matching pin and skip verify", func(t *testing.T) {
+		dialer := newPinnedDialer(t, nil, []string{good})
+		dialer.config.InsecureSkipVerify = true
+		_, conn, err := dialWithHandler(t, dialer, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+
+	t.Run("with a non-matching pin and skip verify", func(t *testing.T) {
+		dialer := newPinnedDialer(t, nil, []string{bad})
+		dialer.config.InsecureSkipVerify = true
+		_, _, err := dialWithHandler(t, dialer, address)
+		if !errors.Is(err, modelx.ErrSSLPinMismatch) {
+			t.Fatal("not the error we expected")
+		}
+	})
+}
+
+func TestUnitNewPinVerifier(t *testing.T) {
+	verifier, err := NewPinVerifier(nil)
+	if err != nil || verifier != nil {
+		t.Fatal("expected no verifier and no error")
+	}
+	for _, pin := range []string{"antani", base64.StdEncoding.EncodeToString([]byte("antani"))} {
+		verifier, err = NewPinVerifier([]string{pin})
+		if !errors.Is(err, ErrInvalidPin) {
+			t.Fatal("not the error we expected")
+		}
+		if verifier != nil {
+			t.Fatal("expected nil verifier here")
+		}
+	}
+}
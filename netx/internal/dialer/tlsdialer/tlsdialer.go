@@ -4,7 +4,10 @@ package tlsdialer
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/ooni/probe-engine/netx/internal/dialer/connx"
@@ -14,10 +17,18 @@ import (
 
 // TLSDialer is the TLS dialer
 type TLSDialer struct {
-	ConnectTimeout      time.Duration // default: 30 second
-	TLSHandshakeTimeout time.Duration // default: 10 second
+	ClientSessionCache  tls.ClientSessionCache // default: use config's
+	ConnectTimeout      time.Duration          // default: 30 second
+	DisableResumption   bool                   // default: use config's
+	Fingerprint         *Fingerprint           // default: stdlib's ClientHello
+	MaxVersion          uint16                 // default: use config's
+	MinVersion          uint16                 // default: use config's
+	NextProtos          []string               // default: use config's
+	SkipVerifyHosts     []string               // default: use config's
+	TLSHandshakeTimeout time.Duration          // default: 10 second
 	config              *tls.Config
 	dialer              modelx.Dialer
+	explicitSNI         string
 	setDeadline         func(net.Conn, time.Time) error
 }
 
@@ -34,6 +45,15 @@ func New(dialer modelx.Dialer, config *tls.Config) *TLSDialer {
 	}
 }
 
+// NewWithSNI is like New but always uses the specified SNI, regardless
+// of the address we're dialing and of the config's ServerName. This is
+// useful to dial an IP address while presenting an arbitrary SNI.
+func NewWithSNI(dialer modelx.Dialer, config *tls.Config, sni string) *TLSDialer {
+	d := New(dialer, config)
+	d.explicitSNI = sni
+	return d
+}
+
 // DialTLS dials a new TLS connection
 func (d *TLSDialer) DialTLS(network, address string) (net.Conn, error) {
 	ctx := context.Background()
@@ -55,10 +75,44 @@ func (d *TLSDialer) DialTLSContext(
 		return nil, err
 	}
 	config := d.config.Clone() // avoid polluting original config
-	if config.ServerName == "" {
+	if d.explicitSNI != "" {
+		config.ServerName = d.explicitSNI
+	} else if config.ServerName == "" {
 		config.ServerName = host
 	}
-	err = d.setDeadline(conn, time.Now().Add(d.TLSHandshakeTimeout))
+	var fingerprint string
+	if d.Fingerprint != nil {
+		d.Fingerprint.apply(config)
+		fingerprint = d.Fingerprint.Name
+	}
+	// Allow experiments to force a specific TLS version range, e.g., to
+	// detect blocking that only targets some versions of the protocol.
+	if d.MinVersion != 0 {
+		config.MinVersion = d.MinVersion
+	}
+	if d.MaxVersion != 0 {
+		config.MaxVersion = d.MaxVersion
+	}
+	if len(d.NextProtos) > 0 {
+		config.NextProtos = d.NextProtos
+	}
+	// Allow experiments to measure session resumption. Note that, with
+	// TLS 1.3, the server sends session tickets after the handshake, so
+	// the cache is only filled once we read from the connection.
+	if d.ClientSessionCache != nil {
+		config.ClientSessionCache = d.ClientSessionCache
+	}
+	if d.DisableResumption {
+		config.ClientSessionCache = nil
+		config.SessionTicketsDisabled = true
+	}
+	// Allow experiments to accept, e.g., self-signed certificates only
+	// for specific test endpoints, while still verifying the others.
+	if d.shouldSkipVerify(config.ServerName) {
+		config.InsecureSkipVerify = true
+	}
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	err = d.setDeadline(conn, time.Now().Add(d.handshakeTimeout(root)))
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -68,7 +122,6 @@ func (d *TLSDialer) DialTLSContext(
 	if mconn, ok := conn.(*connx.MeasuringConn); ok {
 		connID = mconn.ID
 	}
-	root := modelx.ContextMeasurementRootOrDefault(ctx)
 	// Implementation note: when DialTLS is not set, the code in
 	// net/http will perform the handshake. Otherwise, if DialTLS
 	// is set, we will end up here. This code is still used when
@@ -77,10 +130,23 @@ func (d *TLSDialer) DialTLSContext(
 		TLSHandshakeStart: &modelx.TLSHandshakeStartEvent{
 			ConnID:                 connID,
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			Fingerprint:            fingerprint,
+			NextProtos:             config.NextProtos,
+			RemoteAddress:          safeRemoteAddress(conn),
 			SNI:                    config.ServerName,
 		},
 	})
 	err = tlsconn.Handshake()
+	// Go always asks the server to staple an OCSP response, so we do not
+	// need to configure anything and the state will contain the staple,
+	// if any, even when InsecureSkipVerify is set.
+	state := modelx.NewTLSConnectionState(tlsconn.ConnectionState())
+	if len(state.PeerCertificates) <= 0 {
+		// When certificate validation fails, the connection state does
+		// not contain any certificate. Yet, the offending certificate is
+		// what we most care about to detect MITM attempts.
+		state.PeerCertificates = modelx.SimplifyCerts(certsFromError(err))
+	}
 	err = errwrapper.SafeErrWrapperBuilder{
 		ConnID:    connID,
 		Error:     err,
@@ -89,9 +155,10 @@ func (d *TLSDialer) DialTLSContext(
 	root.Handler.OnMeasurement(modelx.Measurement{
 		TLSHandshakeDone: &modelx.TLSHandshakeDoneEvent{
 			ConnID:                 connID,
-			ConnectionState:        modelx.NewTLSConnectionState(tlsconn.ConnectionState()),
+			ConnectionState:        state,
 			Error:                  err,
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			InsecureSkipVerify:     config.InsecureSkipVerify,
 		},
 	})
 	conn.SetDeadline(time.Time{}) // clear deadline
@@ -101,3 +168,48 @@ func (d *TLSDialer) DialTLSContext(
 	}
 	return tlsconn, err
 }
+
+// handshakeTimeout returns the TLS handshake timeout, which is the one
+// in root, if any, and otherwise the one configured in the dialer.
+func (d *TLSDialer) handshakeTimeout(root *modelx.MeasurementRoot) time.Duration {
+	if root.TLSHandshakeTimeout > 0 {
+		return root.TLSHandshakeTimeout
+	}
+	return d.TLSHandshakeTimeout
+}
+
+// shouldSkipVerify returns true when serverName is one of the hosts
+// for which we should not verify the certificate.
+func (d *TLSDialer) shouldSkipVerify(serverName string) bool {
+	for _, host := range d.SkipVerifyHosts {
+		if strings.EqualFold(host, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+func safeRemoteAddress(conn net.Conn) (s string) {
+	if conn != nil && conn.RemoteAddr() != nil {
+		s = conn.RemoteAddr().String()
+	}
+	return
+}
+
+// certsFromError returns the certificate that caused the certificate
+// validation to fail, if err is a certificate validation error.
+func certsFromError(err error) []*x509.Certificate {
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) && hostnameErr.Certificate != nil {
+		return []*x509.Certificate{hostnameErr.Certificate}
+	}
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	if errors.As(err, &unknownAuthorityErr) && unknownAuthorityErr.Cert != nil {
+		return []*x509.Certificate{unknownAuthorityErr.Cert}
+	}
+	var certificateInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &certificateInvalidErr) && certificateInvalidErr.Cert != nil {
+		return []*x509.Certificate{certificateInvalidErr.Cert}
+	}
+	return nil
+}
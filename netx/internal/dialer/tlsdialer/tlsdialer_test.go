@@ -1,15 +1,23 @@
 package tlsdialer
 
 import (
+	"context"
+	"crypto"
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/internal/dialer/dialerbase"
 	"github.com/ooni/probe-engine/netx/modelx"
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestIntegrationSuccess(t *testing.T) {
@@ -88,6 +96,454 @@ func TestIntegrationFailureSetDeadline(t *testing.T) {
 	}
 }
 
+func TestUnitHandshakeTimeoutFromRoot(t *testing.T) {
+	// A server that accepts connections but never answers, so that
+	// the handshake only ends because of the timeout.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	dialer := New(new(net.Dialer), new(tls.Config))
+	dialer.TLSHandshakeTimeout = time.Hour
+	var deadline time.Time
+	dialer.setDeadline = func(conn net.Conn, t time.Time) error {
+		deadline = t
+		return conn.SetDeadline(t)
+	}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:           time.Now(),
+			Handler:             handlers.NoHandler,
+			TLSHandshakeTimeout: 10 * time.Millisecond,
+		},
+	)
+	start := time.Now()
+	conn, err := dialer.DialTLSContext(ctx, "tcp", listener.Addr().String())
+	if err == nil || err.Error() != modelx.FailureGenericTimeoutError {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+	if deadline.Sub(start) > time.Second {
+		t.Fatal("did not use the timeout in the measurement root")
+	}
+}
+
+func TestUnitHandshakeTimeoutDefault(t *testing.T) {
+	dialer := New(new(net.Dialer), new(tls.Config))
+	root := &modelx.MeasurementRoot{}
+	if dialer.handshakeTimeout(root) != 10*time.Second {
+		t.Fatal("unexpected default timeout")
+	}
+	dialer.TLSHandshakeTimeout = time.Second
+	if dialer.handshakeTimeout(root) != time.Second {
+		t.Fatal("did not use the timeout in the dialer")
+	}
+	root.TLSHandshakeTimeout = time.Millisecond
+	if dialer.handshakeTimeout(root) != time.Millisecond {
+		t.Fatal("did not use the timeout in the measurement root")
+	}
+}
+
+type tlsHandshakeHandler struct {
+	done  []*modelx.TLSHandshakeDoneEvent
+	mu    sync.Mutex
+	start []*modelx.TLSHandshakeStartEvent
+}
+
+func (h *tlsHandshakeHandler) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.TLSHandshakeStart != nil {
+		h.start = append(h.start, m.TLSHandshakeStart)
+	}
+	if m.TLSHandshakeDone != nil {
+		h.done = append(h.done, m.TLSHandshakeDone)
+	}
+}
+
+func dialWithHandler(
+	t *testing.T, dialer *TLSDialer, address string,
+) (*tlsHandshakeHandler, net.Conn, error) {
+	handler := new(tlsHandshakeHandler)
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	conn, err := dialer.DialTLSContext(ctx, "tcp", address)
+	if len(handler.done) != 1 {
+		t.Fatal("expected a single TLSHandshakeDone event")
+	}
+	return handler, conn, err
+}
+
+func newTLSServer(config *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {},
+	))
+	server.TLS = config
+	server.StartTLS()
+	return server
+}
+
+func TestUnitForceTLSVersion(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	dialer.MinVersion = tls.VersionTLS12
+	dialer.MaxVersion = tls.VersionTLS12
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if handler.done[0].ConnectionState.Version != tls.VersionTLS12 {
+		t.Fatal("unexpected TLS version")
+	}
+}
+
+func TestUnitForceTLSVersionMismatch(t *testing.T) {
+	server := newTLSServer(&tls.Config{MinVersion: tls.VersionTLS13})
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	dialer.MaxVersion = tls.VersionTLS12
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+	if handler.done[0].Error == nil {
+		t.Fatal("expected an error in the event")
+	}
+}
+
+func TestUnitPeerCertificatesWithSkipVerify(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	certs := handler.done[0].ConnectionState.PeerCertificates
+	if len(certs) < 1 {
+		t.Fatal("expected at least one certificate")
+	}
+	if len(certs[0].Data) <= 0 || certs[0].Subject == "" || certs[0].Issuer == "" {
+		t.Fatal("certificate not fully populated")
+	}
+	if !certs[0].NotBefore.Before(certs[0].NotAfter) {
+		t.Fatal("invalid certificate validity period")
+	}
+}
+
+func TestUnitPeerCertificatesOnVerifyFailure(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), new(tls.Config))
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err == nil || err.Error() != modelx.FailureSSLUnknownAuthority {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+	if len(handler.done[0].ConnectionState.PeerCertificates) != 1 {
+		t.Fatal("expected the offending certificate")
+	}
+}
+
+func TestUnitSkipVerifyHosts(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), new(tls.Config))
+	dialer.SkipVerifyHosts = []string{"www.example.com", "127.0.0.1"}
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if handler.done[0].InsecureSkipVerify != true {
+		t.Fatal("expected InsecureSkipVerify to be true")
+	}
+}
+
+func TestUnitSkipVerifyHostsOtherHost(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), new(tls.Config))
+	dialer.SkipVerifyHosts = []string{"www.example.com"}
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err == nil || err.Error() != modelx.FailureSSLUnknownAuthority {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("connection is not nil")
+	}
+	if handler.done[0].InsecureSkipVerify != false {
+		t.Fatal("expected InsecureSkipVerify to be false")
+	}
+}
+
+func TestUnitExplicitSNI(t *testing.T) {
+	var seenSNI string
+	server := newTLSServer(&tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			seenSNI = chi.ServerName
+			return nil, nil
+		},
+	})
+	defer server.Close()
+	dialer := NewWithSNI(
+		new(net.Dialer), &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "www.example.org",
+		}, "www.example.com",
+	)
+	address := server.Listener.Addr().String()
+	handler, conn, err := dialWithHandler(t, dialer, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if seenSNI != "www.example.com" {
+		t.Fatal("the server did not see the SNI we expected")
+	}
+	if len(handler.start) != 1 {
+		t.Fatal("expected a single TLSHandshakeStart event")
+	}
+	if handler.start[0].SNI != "www.example.com" {
+		t.Fatal("unexpected SNI in event")
+	}
+	if handler.start[0].RemoteAddress != address {
+		t.Fatal("unexpected RemoteAddress in event")
+	}
+}
+
+func TestUnitNextProtosNegotiated(t *testing.T) {
+	server := newTLSServer(&tls.Config{NextProtos: []string{"h2", "http/1.1"}})
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	})
+	dialer.NextProtos = []string{"h2"}
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if len(handler.start[0].NextProtos) != 1 || handler.start[0].NextProtos[0] != "h2" {
+		t.Fatal("unexpected NextProtos in start event")
+	}
+	if handler.done[0].ConnectionState.NegotiatedProtocol != "h2" {
+		t.Fatal("unexpected negotiated protocol")
+	}
+}
+
+func TestUnitNextProtosNotNegotiated(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	// httptest configures "http/1.1" by default and, when the server has
+	// ALPN configured, unknown protocols cause handshake failures.
+	server.TLS.NextProtos = nil
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	dialer.NextProtos = []string{"dot"}
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if handler.done[0].ConnectionState.NegotiatedProtocol != "" {
+		t.Fatal("unexpected negotiated protocol")
+	}
+}
+
+func TestUnitFingerprint(t *testing.T) {
+	hellos := make(chan *tls.ClientHelloInfo, 1)
+	server := newTLSServer(&tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hellos <- chi
+			return nil, nil
+		},
+	})
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	dialer.Fingerprint = FingerprintFirefox
+	dialer.MaxVersion = tls.VersionTLS12
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if handler.start[0].Fingerprint != "firefox" {
+		t.Fatal("unexpected fingerprint in start event")
+	}
+	var hello *tls.ClientHelloInfo
+	select {
+	case hello = <-hellos:
+	default:
+		t.Fatal("the server did not see the ClientHello")
+	}
+	// The standard library may reorder the cipher suites according to
+	// the hardware support for AES, hence we compare them as sets.
+	if !reflect.DeepEqual(sortedCiphers(hello.CipherSuites),
+		sortedCiphers(FingerprintFirefox.CipherSuites)) {
+		t.Fatalf("unexpected cipher suites: %+v", hello.CipherSuites)
+	}
+	if !reflect.DeepEqual(hello.SupportedCurves, FingerprintFirefox.CurvePreferences) {
+		t.Fatalf("unexpected curves: %+v", hello.SupportedCurves)
+	}
+	if !reflect.DeepEqual(hello.SupportedProtos, FingerprintFirefox.NextProtos) {
+		t.Fatalf("unexpected ALPN: %+v", hello.SupportedProtos)
+	}
+}
+
+func sortedCiphers(in []uint16) []uint16 {
+	out := append([]uint16{}, in...)
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+func TestUnitNoFingerprint(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if handler.start[0].Fingerprint != "" {
+		t.Fatal("unexpected fingerprint in start event")
+	}
+}
+
 func newdialer() modelx.TLSDialer {
 	return New(new(net.Dialer), new(tls.Config))
 }
+
+func dialTwiceWithHandler(
+	t *testing.T, dialer *TLSDialer, address string, maxVersion uint16,
+) (first, second *tlsHandshakeHandler) {
+	dialer.MaxVersion = maxVersion
+	first, conn, err := dialWithHandler(t, dialer, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With TLS 1.3 session tickets are sent after the handshake, hence
+	// we need to read from the connection for them to be processed.
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	conn.Read(make([]byte, 1))
+	conn.Close()
+	second, conn, err = dialWithHandler(t, dialer, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	return
+}
+
+func TestUnitSessionResumption(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+		dialer.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+		first, second := dialTwiceWithHandler(
+			t, dialer, server.Listener.Addr().String(), version)
+		if first.done[0].ConnectionState.DidResume {
+			t.Fatal("the first handshake should not resume")
+		}
+		if !second.done[0].ConnectionState.DidResume {
+			t.Fatal("the second handshake should resume")
+		}
+	}
+}
+
+func TestUnitNoSessionResumptionByDefault(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	_, second := dialTwiceWithHandler(
+		t, dialer, server.Listener.Addr().String(), tls.VersionTLS12)
+	if second.done[0].ConnectionState.DidResume {
+		t.Fatal("the second handshake should not resume")
+	}
+}
+
+func TestUnitDisableResumption(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		InsecureSkipVerify: true,
+	})
+	dialer.DisableResumption = true
+	_, second := dialTwiceWithHandler(
+		t, dialer, server.Listener.Addr().String(), tls.VersionTLS12)
+	if second.done[0].ConnectionState.DidResume {
+		t.Fatal("the second handshake should not resume")
+	}
+}
+
+func TestUnitOCSPStaple(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	cert := server.Certificate()
+	now := time.Now()
+	staple, err := ocsp.CreateResponse(cert, cert, ocsp.Response{
+		NextUpdate:   now.Add(time.Hour),
+		SerialNumber: cert.SerialNumber,
+		Status:       ocsp.Good,
+		ThisUpdate:   now,
+	}, server.TLS.Certificates[0].PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.Certificates[0].OCSPStaple = staple
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := handler.done[0].ConnectionState
+	if !state.OCSPStapled || state.OCSPResponse == nil {
+		t.Fatal("expected a stapled OCSP response")
+	}
+	if state.OCSPResponse.Status != "good" {
+		t.Fatal("unexpected OCSP status")
+	}
+}
+
+func TestUnitNoOCSPStaple(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+	dialer := New(new(net.Dialer), &tls.Config{InsecureSkipVerify: true})
+	handler, conn, err := dialWithHandler(t, dialer, server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	state := handler.done[0].ConnectionState
+	if state.OCSPStapled || state.OCSPResponse != nil {
+		t.Fatal("expected no stapled OCSP response")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"syscall"
 
 	"github.com/ooni/probe-engine/netx/modelx"
 )
@@ -57,6 +58,25 @@ func toFailureString(err error) string {
 	if errors.Is(err, modelx.ErrDNSBogon) {
 		return modelx.FailureDNSBogonError // not in MK
 	}
+	if errors.Is(err, modelx.ErrSSLPinMismatch) {
+		return modelx.FailureSSLPinMismatch // not in MK
+	}
+	if errors.Is(err, modelx.ErrProxyAuthRequired) {
+		return modelx.FailureProxyAuthRequired // not in MK
+	}
+	if errors.Is(err, modelx.ErrProxyConnectRefused) {
+		return modelx.FailureProxyConnectRefused // not in MK
+	}
+
+	// Inspect the underlying syscall error, if any, so that we never
+	// confuse RST-based tampering with a closed port. We also check the
+	// error strings below as a fallback for errors we cannot unwrap.
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return modelx.FailureConnectionRefused
+	}
+	if errors.Is(err, syscall.ECONNRESET) {
+		return modelx.FailureConnectionReset
+	}
 
 	var x509HostnameError x509.HostnameError
 	if errors.As(err, &x509HostnameError) {
@@ -121,6 +141,12 @@ func toOperationString(err error, operation string) string {
 		if errwrapper.Operation == "tls_handshake" {
 			return errwrapper.Operation
 		}
+		if errwrapper.Operation == "websocket_upgrade" {
+			return errwrapper.Operation
+		}
+		if errwrapper.Operation == "proxy_connect" {
+			return errwrapper.Operation
+		}
 		// FALLTHROUGH
 	}
 	return operation
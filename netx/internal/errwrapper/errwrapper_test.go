@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"os"
 	"syscall"
 	"testing"
 
@@ -52,6 +54,21 @@ func TestToFailureString(t *testing.T) {
 			t.Fatal("unexpected result")
 		}
 	})
+	t.Run("for modelx.ErrSSLPinMismatch", func(t *testing.T) {
+		if toFailureString(modelx.ErrSSLPinMismatch) != modelx.FailureSSLPinMismatch {
+			t.Fatal("unexpected result")
+		}
+	})
+	t.Run("for modelx.ErrProxyAuthRequired", func(t *testing.T) {
+		if toFailureString(modelx.ErrProxyAuthRequired) != modelx.FailureProxyAuthRequired {
+			t.Fatal("unexpected result")
+		}
+	})
+	t.Run("for modelx.ErrProxyConnectRefused", func(t *testing.T) {
+		if toFailureString(modelx.ErrProxyConnectRefused) != modelx.FailureProxyConnectRefused {
+			t.Fatal("unexpected result")
+		}
+	})
 	t.Run("for x509.HostnameError", func(t *testing.T) {
 		var err x509.HostnameError
 		if toFailureString(err) != modelx.FailureSSLInvalidHostname {
@@ -122,6 +139,125 @@ func TestToFailureString(t *testing.T) {
 	})
 }
 
+func TestUnitConnectionResetAndRefused(t *testing.T) {
+	newOpError := func(op string, errno syscall.Errno) error {
+		return &net.OpError{
+			Op:  op,
+			Net: "tcp",
+			Err: &os.SyscallError{Syscall: op, Err: errno},
+		}
+	}
+	var testcases = []struct {
+		name      string
+		err       error
+		operation string
+		failure   string
+	}{{
+		name:      "connect with ECONNREFUSED",
+		err:       newOpError("dial", syscall.ECONNREFUSED),
+		operation: "connect",
+		failure:   modelx.FailureConnectionRefused,
+	}, {
+		name:      "connect with ECONNRESET",
+		err:       newOpError("dial", syscall.ECONNRESET),
+		operation: "connect",
+		failure:   modelx.FailureConnectionReset,
+	}, {
+		name:      "http_round_trip with ECONNREFUSED",
+		err:       newOpError("read", syscall.ECONNREFUSED),
+		operation: "http_round_trip",
+		failure:   modelx.FailureConnectionRefused,
+	}, {
+		name:      "http_round_trip with ECONNRESET",
+		err:       newOpError("read", syscall.ECONNRESET),
+		operation: "http_round_trip",
+		failure:   modelx.FailureConnectionReset,
+	}, {
+		name: "wrapped ECONNRESET with custom message",
+		err: fmt.Errorf("antani: %w", &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: &customSyscallError{errno: syscall.ECONNRESET},
+		}),
+		operation: "http_round_trip",
+		failure:   modelx.FailureConnectionReset,
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := SafeErrWrapperBuilder{
+				Error:     tc.err,
+				Operation: tc.operation,
+			}.MaybeBuild()
+			var target *modelx.ErrWrapper
+			if errors.As(err, &target) == false {
+				t.Fatal("not the expected error type")
+			}
+			if target.Failure != tc.failure {
+				t.Fatal("unexpected failure", target.Failure)
+			}
+			if target.Operation != tc.operation {
+				t.Fatal("unexpected operation", target.Operation)
+			}
+		})
+	}
+}
+
+// customSyscallError wraps an errno using a message that does not
+// end with the standard errno description.
+type customSyscallError struct {
+	errno syscall.Errno
+}
+
+func (e *customSyscallError) Error() string {
+	return "mocked syscall error"
+}
+
+func (e *customSyscallError) Unwrap() error {
+	return e.errno
+}
+
+func TestUnitTLSCertificateFailures(t *testing.T) {
+	var testcases = []struct {
+		name    string
+		err     error
+		failure string
+	}{{
+		name:    "x509.CertificateInvalidError",
+		err:     x509.CertificateInvalidError{Reason: x509.Expired},
+		failure: modelx.FailureSSLInvalidCertificate,
+	}, {
+		name:    "x509.HostnameError",
+		err:     x509.HostnameError{Host: "www.example.com"},
+		failure: modelx.FailureSSLInvalidHostname,
+	}, {
+		name:    "x509.UnknownAuthorityError",
+		err:     x509.UnknownAuthorityError{},
+		failure: modelx.FailureSSLUnknownAuthority,
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Wrap the error like crypto/tls does for verification errors.
+			err := SafeErrWrapperBuilder{
+				Error:     fmt.Errorf("tls: failed to verify certificate: %w", tc.err),
+				Operation: "tls_handshake",
+			}.MaybeBuild()
+			var target *modelx.ErrWrapper
+			if errors.As(err, &target) == false {
+				t.Fatal("not the expected error type")
+			}
+			if target.Failure != tc.failure {
+				t.Fatal("unexpected failure", target.Failure)
+			}
+			if target.Operation != "tls_handshake" {
+				t.Fatal("unexpected operation", target.Operation)
+			}
+			if !errors.Is(target.WrappedErr, tc.err) {
+				t.Fatal("cannot unwrap the original error")
+			}
+		})
+	}
+}
+
 func TestUnitToOperationString(t *testing.T) {
 	t.Run("for connect", func(t *testing.T) {
 		// You're doing HTTP and connect fails. You want to know
@@ -155,6 +291,22 @@ func TestUnitToOperationString(t *testing.T) {
 			t.Fatal("unexpected result")
 		}
 	})
+	t.Run("for websocket_upgrade", func(t *testing.T) {
+		// You're dialing a WebSocket and the upgrade fails. You
+		// want to know about the upgrade error.
+		err := &modelx.ErrWrapper{Operation: "websocket_upgrade"}
+		if toOperationString(err, "http_round_trip") != "websocket_upgrade" {
+			t.Fatal("unexpected result")
+		}
+	})
+	t.Run("for proxy_connect", func(t *testing.T) {
+		// You're using a proxy and the proxy handshake fails. You
+		// want to know it's the proxy and not the target.
+		err := &modelx.ErrWrapper{Operation: "proxy_connect"}
+		if toOperationString(err, "http_round_trip") != "proxy_connect" {
+			t.Fatal("unexpected result")
+		}
+	})
 	t.Run("for minor operation", func(t *testing.T) {
 		// You just noticed that TLS handshake failed and you
 		// have a child error telling you that read failed. Here
@@ -0,0 +1,87 @@
+// Package alpnchecker contains a round tripper that fails when the TLS
+// handshake does not negotiate a specific protocol using ALPN. A server
+// that does not implement ALPN negotiates no protocol, which net/http
+// treats as HTTP/1.1, so we need to check after the handshake to be
+// sure that we are not silently falling back to HTTP/1.1.
+package alpnchecker
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// ErrUnexpectedProtocol indicates that the TLS handshake did not
+// negotiate the required protocol.
+var ErrUnexpectedProtocol = errors.New("alpnchecker: unexpected ALPN protocol")
+
+// Transport checks the protocol negotiated using ALPN.
+type Transport struct {
+	// RequiredProtocol is the protocol that the TLS handshake must
+	// negotiate (e.g. "h2"). When empty, we do not check.
+	RequiredProtocol string
+
+	roundTripper http.RoundTripper
+}
+
+// New creates a new Transport.
+func New(roundTripper http.RoundTripper) *Transport {
+	return &Transport{roundTripper: roundTripper}
+}
+
+// RoundTrip executes a single HTTP transaction, returning a Response
+// for the provided Request. As soon as we get a TLS connection that has
+// not negotiated RequiredProtocol, we close it, so that we don't send
+// the request, and we fail with ErrUnexpectedProtocol. We do not check
+// cleartext connections, since we never speak cleartext HTTP/2.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.RequiredProtocol == "" {
+		return t.roundTripper.RoundTrip(req)
+	}
+	var (
+		mu         sync.Mutex
+		mismatch   bool
+		negotiated string
+	)
+	tracer := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, ok := info.Conn.(*tls.Conn)
+			if !ok {
+				return
+			}
+			proto := conn.ConnectionState().NegotiatedProtocol
+			if proto == t.RequiredProtocol {
+				return
+			}
+			mu.Lock()
+			mismatch, negotiated = true, proto
+			mu.Unlock()
+			conn.Close()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), tracer))
+	resp, err := t.roundTripper.RoundTrip(req)
+	mu.Lock()
+	defer mu.Unlock()
+	if mismatch {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return nil, fmt.Errorf("%w: %q", ErrUnexpectedProtocol, negotiated)
+	}
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
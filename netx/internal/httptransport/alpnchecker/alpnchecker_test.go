@@ -0,0 +1,78 @@
+package alpnchecker
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newserver(enableHTTP2 bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {}))
+	server.EnableHTTP2 = enableHTTP2
+	server.StartTLS()
+	return server
+}
+
+func newtransport(required string) *Transport {
+	txp := New(&http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+	txp.RequiredProtocol = required
+	return txp
+}
+
+func get(txp *Transport, URL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return txp.RoundTrip(req)
+}
+
+func TestUnitRequiredProtocolNegotiated(t *testing.T) {
+	server := newserver(true)
+	defer server.Close()
+	txp := newtransport("h2")
+	defer txp.CloseIdleConnections()
+	resp, err := get(txp, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatal("expected HTTP/2")
+	}
+}
+
+func TestUnitRequiredProtocolNotNegotiated(t *testing.T) {
+	server := newserver(false)
+	defer server.Close()
+	txp := newtransport("h2")
+	defer txp.CloseIdleConnections()
+	resp, err := get(txp, server.URL)
+	if !errors.Is(err, ErrUnexpectedProtocol) {
+		t.Fatal("not the error we expected", err)
+	}
+	if resp != nil {
+		t.Fatal("expected a nil response here")
+	}
+}
+
+func TestUnitNoRequiredProtocol(t *testing.T) {
+	server := newserver(false)
+	defer server.Close()
+	txp := newtransport("")
+	defer txp.CloseIdleConnections()
+	resp, err := get(txp, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Fatal("expected HTTP/1.1")
+	}
+}
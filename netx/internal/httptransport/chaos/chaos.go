@@ -0,0 +1,175 @@
+// Package chaos contains a round tripper that injects failures and
+// latency, which is useful to test how experiments handle flaky
+// networks. The round tripper is disabled until explicitly enabled.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/internal/errwrapper"
+	"github.com/ooni/probe-engine/netx/internal/transactionid"
+)
+
+// The kinds of errors that we can inject.
+const (
+	// Refused simulates a connection refused while connecting.
+	Refused = "refused"
+
+	// Reset simulates a connection reset while reading.
+	Reset = "reset"
+
+	// Timeout simulates a timeout while reading.
+	Timeout = "timeout"
+)
+
+// ErrInvalidConfig indicates that the Config is not valid.
+var ErrInvalidConfig = errors.New("chaos: invalid config")
+
+// Config contains the chaos settings.
+type Config struct {
+	// Errors contains the kinds of errors to inject, e.g. Reset. When
+	// a round trip fails, we randomly choose one of them. If empty, we
+	// choose among all the kinds of errors.
+	Errors []string
+
+	// FailureProbability is the probability that a round trip fails,
+	// which must be between zero and one.
+	FailureProbability float64
+
+	// Latency is the latency added to each round trip.
+	Latency time.Duration
+
+	// Seed is the seed of the random number generator, so that a
+	// sequence of round trips is reproducible.
+	Seed int64
+}
+
+// Transport is a round tripper injecting chaos.
+type Transport struct {
+	config       *Config
+	mu           sync.Mutex
+	rng          *rand.Rand
+	roundTripper http.RoundTripper
+}
+
+// New creates a new Transport. The returned Transport just forwards
+// round trips to roundTripper until you call Enable.
+func New(roundTripper http.RoundTripper) *Transport {
+	return &Transport{roundTripper: roundTripper}
+}
+
+// Enable starts injecting chaos according to config. This function
+// is not goroutine safe. Make sure you call it before starting to use
+// the transport.
+func (t *Transport) Enable(config Config) error {
+	if config.FailureProbability < 0 || config.FailureProbability > 1 {
+		return fmt.Errorf("%w: FailureProbability out of range", ErrInvalidConfig)
+	}
+	if len(config.Errors) <= 0 {
+		config.Errors = []string{Refused, Reset, Timeout}
+	}
+	for _, kind := range config.Errors {
+		if _, found := injected[kind]; !found {
+			return fmt.Errorf("%w: unknown error kind: %s", ErrInvalidConfig, kind)
+		}
+	}
+	t.config = &config
+	t.rng = rand.New(rand.NewSource(config.Seed))
+	return nil
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.config == nil {
+		return t.roundTripper.RoundTrip(req)
+	}
+	if err := sleep(req.Context(), t.config.Latency); err != nil {
+		return nil, err
+	}
+	if kind := t.maybeFail(); kind != "" {
+		return nil, errwrapper.SafeErrWrapperBuilder{
+			Error:         injected[kind].err,
+			Operation:     injected[kind].operation,
+			TransactionID: transactionid.ContextTransactionID(req.Context()),
+		}.MaybeBuild()
+	}
+	return t.roundTripper.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// maybeFail returns the kind of error to inject, or an empty string
+// if this round trip should not fail.
+func (t *Transport) maybeFail() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rng.Float64() >= t.config.FailureProbability {
+		return ""
+	}
+	return t.config.Errors[t.rng.Intn(len(t.config.Errors))]
+}
+
+func sleep(ctx context.Context, latency time.Duration) error {
+	if latency <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(latency)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// timeoutError is a net.Error like the one returned by Go when
+// the deadline of a network operation expires.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// injected maps each kind of error to the error that we inject and to
+// the operation that would have failed when getting such an error.
+var injected = map[string]struct {
+	err       error
+	operation string
+}{
+	Refused: {
+		err: &net.OpError{
+			Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED),
+		},
+		operation: "connect",
+	},
+	Reset: {
+		err: &net.OpError{
+			Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET),
+		},
+		operation: "read",
+	},
+	Timeout: {
+		err:       &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+		operation: "read",
+	},
+}
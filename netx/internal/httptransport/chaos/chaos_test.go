@@ -0,0 +1,168 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+}
+
+func get(ctx context.Context, txp *Transport, URL string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := txp.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestUnitDisabledByDefault(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	txp := New(http.DefaultTransport)
+	defer txp.CloseIdleConnections()
+	for i := 0; i < 10; i++ {
+		if err := get(context.Background(), txp, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnitInjectedErrors(t *testing.T) {
+	var cases = []struct {
+		kind      string
+		failure   string
+		operation string
+	}{
+		{Refused, modelx.FailureConnectionRefused, "connect"},
+		{Reset, modelx.FailureConnectionReset, "read"},
+		{Timeout, modelx.FailureGenericTimeoutError, "read"},
+	}
+	server := newServer()
+	defer server.Close()
+	for _, c := range cases {
+		txp := New(http.DefaultTransport)
+		err := txp.Enable(Config{Errors: []string{c.kind}, FailureProbability: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = get(context.Background(), txp, server.URL)
+		var errWrapper *modelx.ErrWrapper
+		if !errors.As(err, &errWrapper) {
+			t.Fatal("not the error we expected")
+		}
+		if errWrapper.Failure != c.failure {
+			t.Fatalf("%s: unexpected failure: %s", c.kind, errWrapper.Failure)
+		}
+		if errWrapper.Operation != c.operation {
+			t.Fatalf("%s: unexpected operation: %s", c.kind, errWrapper.Operation)
+		}
+	}
+}
+
+func TestUnitZeroProbability(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	txp := New(http.DefaultTransport)
+	defer txp.CloseIdleConnections()
+	if err := txp.Enable(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := get(context.Background(), txp, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnitReproducible(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	sequence := func() (failures []bool) {
+		txp := New(http.DefaultTransport)
+		defer txp.CloseIdleConnections()
+		err := txp.Enable(Config{FailureProbability: 0.5, Seed: 17})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 32; i++ {
+			failures = append(failures, get(context.Background(), txp, server.URL) != nil)
+		}
+		return
+	}
+	first, second := sequence(), sequence()
+	var count int
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatal("the sequences of failures differ")
+		}
+		if first[i] {
+			count++
+		}
+	}
+	if count == 0 || count == len(first) {
+		t.Fatal("expected some round trips to fail and some to succeed")
+	}
+}
+
+func TestUnitLatency(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	txp := New(http.DefaultTransport)
+	defer txp.CloseIdleConnections()
+	const latency = 100 * time.Millisecond
+	if err := txp.Enable(Config{Latency: latency}); err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if err := get(context.Background(), txp, server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(begin) < latency {
+		t.Fatal("the latency has not been applied")
+	}
+}
+
+func TestUnitLatencyContextCanceled(t *testing.T) {
+	txp := New(http.DefaultTransport)
+	if err := txp.Enable(Config{Latency: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := get(ctx, txp, "http://www.example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitInvalidConfig(t *testing.T) {
+	var configs = []Config{
+		{FailureProbability: -0.1},
+		{FailureProbability: 1.1},
+		{Errors: []string{"antani"}},
+	}
+	for _, config := range configs {
+		txp := New(http.DefaultTransport)
+		if err := txp.Enable(config); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("%+v: not the error we expected", config)
+		}
+		if txp.config != nil {
+			t.Fatal("expected the transport to still be disabled")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package firstbyte contains a round tripper that closes the response
+// body as soon as we have received the response headers. This is useful
+// for censorship checks that only need the status and the headers and
+// want to save bandwidth by not downloading the body.
+package firstbyte
+
+import (
+	"io"
+	"net/http"
+)
+
+// Transport closes the response body after the first response byte.
+type Transport struct {
+	// Enabled indicates whether we should close the response body
+	// after the first response byte. It is false by default.
+	Enabled bool
+
+	roundTripper http.RoundTripper
+}
+
+// New creates a new Transport. The returned Transport is disabled.
+func New(roundTripper http.RoundTripper) *Transport {
+	return &Transport{roundTripper: roundTripper}
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request. When enabled, we close the
+// response body, which tears down the connection, or the stream in
+// case of HTTP/2, and we replace it with an empty body for which
+// Aborted returns true. Reading the empty body returns io.EOF.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTripper.RoundTrip(req)
+	if err != nil || !t.Enabled {
+		return resp, err
+	}
+	resp.Body.Close()
+	resp.Body = abortedBody{}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+// Aborted returns true if body is the empty body with which we have
+// replaced the body of a response after the first response byte.
+func Aborted(body io.ReadCloser) bool {
+	_, ok := body.(abortedBody)
+	return ok
+}
+
+type abortedBody struct{}
+
+func (abortedBody) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (abortedBody) Close() error {
+	return nil
+}
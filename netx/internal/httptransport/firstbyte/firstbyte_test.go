@@ -0,0 +1,78 @@
+package firstbyte
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Antani", "mascetti")
+			w.WriteHeader(403)
+			w.Write([]byte(strings.Repeat("A", 1<<20)))
+		}))
+}
+
+func TestUnitDisabled(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if Aborted(resp.Body) {
+		t.Fatal("did not expect the body to be aborted")
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<20 {
+		t.Fatal("unexpected body length")
+	}
+}
+
+func TestUnitEnabled(t *testing.T) {
+	server := newServer()
+	defer server.Close()
+	txp := New(http.DefaultTransport)
+	txp.Enabled = true
+	client := &http.Client{Transport: txp}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 403 || resp.Header.Get("X-Antani") != "mascetti" {
+		t.Fatal("unexpected status code or headers")
+	}
+	if !Aborted(resp.Body) {
+		t.Fatal("expected the body to be aborted")
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatal("expected an empty body")
+	}
+}
+
+func TestUnitEnabledWithError(t *testing.T) {
+	txp := New(http.DefaultTransport)
+	txp.Enabled = true
+	client := &http.Client{Transport: txp}
+	resp, err := client.Get("http://[::1]:0/")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resp != nil {
+		t.Fatal("expected nil resp here")
+	}
+}
@@ -0,0 +1,90 @@
+// Package gzipbody contains a round tripper that optionally compresses
+// request bodies using gzip. This is meant to reduce the amount of bytes
+// we send when uploading large bodies, e.g., measurement reports.
+package gzipbody
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// OptInHeader is the request header with which a request opts in to
+// having its body compressed. We only compress when its value is "1"
+// and we never send this header to the server. Requests that do not
+// opt in are passed through unmodified.
+const OptInHeader = "X-Gzip-Request-Body"
+
+// Transport compresses the body of requests that opt in.
+type Transport struct {
+	roundTripper http.RoundTripper
+}
+
+// New creates a new Transport.
+func New(roundTripper http.RoundTripper) *Transport {
+	return &Transport{roundTripper: roundTripper}
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, found := req.Header[OptInHeader]; !found {
+		return t.roundTripper.RoundTrip(req)
+	}
+	optIn := req.Header.Get(OptInHeader) == "1"
+	req = req.Clone(req.Context()) // don't modify the caller's request
+	req.Header.Del(OptInHeader)
+	if optIn && shouldCompress(req) {
+		data, err := compress(req)
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		req.Body.Close() // we've read a copy of it using GetBody
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		req.ContentLength = int64(len(data))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	return t.roundTripper.RoundTrip(req)
+}
+
+// shouldCompress returns true if the request has a body that we can
+// rewind, i.e., that we can read without consuming the original body,
+// and that is not already encoded.
+func shouldCompress(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody &&
+		req.GetBody != nil && req.Header.Get("Content-Encoding") == ""
+}
+
+func compress(req *http.Request) ([]byte, error) {
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := io.Copy(writer, body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
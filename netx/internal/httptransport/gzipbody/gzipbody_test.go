@@ -0,0 +1,138 @@
+package gzipbody
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type serverSeen struct {
+	body            []byte
+	contentEncoding string
+	contentLength   int64
+	optIn           bool
+}
+
+func newServer(t *testing.T, seen *serverSeen) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen.body = data
+			seen.contentEncoding = r.Header.Get("Content-Encoding")
+			seen.contentLength = r.ContentLength
+			_, seen.optIn = r.Header[OptInHeader]
+		}))
+}
+
+func TestUnitCompressed(t *testing.T) {
+	seen := &serverSeen{}
+	server := newServer(t, seen)
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	payload := strings.Repeat("antani mascetti ", 1024)
+	req, err := http.NewRequest("POST", server.URL, strings.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(OptInHeader, "1")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if seen.optIn {
+		t.Fatal("the opt-in header should not be sent")
+	}
+	if seen.contentEncoding != "gzip" {
+		t.Fatal("unexpected Content-Encoding")
+	}
+	if seen.contentLength != int64(len(seen.body)) {
+		t.Fatal("Content-Length does not match the body")
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(seen.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != payload {
+		t.Fatal("the server did not see the gzip of the original body")
+	}
+	if len(seen.body) >= len(payload) {
+		t.Fatal("expected the body to be smaller")
+	}
+	if req.Header.Get(OptInHeader) != "1" {
+		t.Fatal("the caller's request has been modified")
+	}
+}
+
+func TestUnitNotCompressed(t *testing.T) {
+	const payload = "antani mascetti"
+	var testcases = []struct {
+		name  string
+		body  func() io.Reader
+		setup func(*http.Request)
+	}{{
+		name:  "without opt in",
+		body:  func() io.Reader { return strings.NewReader(payload) },
+		setup: func(*http.Request) {},
+	}, {
+		name: "with opt in set to zero",
+		body: func() io.Reader { return strings.NewReader(payload) },
+		setup: func(req *http.Request) {
+			req.Header.Set(OptInHeader, "0")
+		},
+	}, {
+		name: "with a body that cannot be rewound",
+		body: func() io.Reader {
+			return ioutil.NopCloser(strings.NewReader(payload))
+		},
+		setup: func(req *http.Request) {
+			req.Header.Set(OptInHeader, "1")
+		},
+	}, {
+		name: "with an already encoded body",
+		body: func() io.Reader { return strings.NewReader(payload) },
+		setup: func(req *http.Request) {
+			req.Header.Set(OptInHeader, "1")
+			req.Header.Set("Content-Encoding", "identity")
+		},
+	}}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			seen := &serverSeen{}
+			server := newServer(t, seen)
+			defer server.Close()
+			client := &http.Client{Transport: New(http.DefaultTransport)}
+			req, err := http.NewRequest("POST", server.URL, tc.body())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.setup(req)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if seen.optIn {
+				t.Fatal("the opt-in header should not be sent")
+			}
+			if seen.contentEncoding == "gzip" {
+				t.Fatal("did not expect the body to be compressed")
+			}
+			if string(seen.body) != payload {
+				t.Fatal("the body has been modified")
+			}
+		})
+	}
+}
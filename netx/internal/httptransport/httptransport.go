@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/ooni/probe-engine/netx/internal/httptransport/bodytracer"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/gzipbody"
 	"github.com/ooni/probe-engine/netx/internal/httptransport/tracetripper"
 	"github.com/ooni/probe-engine/netx/internal/httptransport/transactioner"
 )
@@ -19,8 +20,8 @@ type Transport struct {
 // New creates a new Transport.
 func New(roundTripper http.RoundTripper) *Transport {
 	return &Transport{
-		roundTripper: transactioner.New(bodytracer.New(
-			tracetripper.New(roundTripper))),
+		roundTripper: gzipbody.New(transactioner.New(bodytracer.New(
+			tracetripper.New(roundTripper)))),
 	}
 }
 
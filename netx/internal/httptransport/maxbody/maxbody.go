@@ -0,0 +1,84 @@
+// Package maxbody contains a round tripper that enforces a maximum
+// response body size. This protects us from hostile endpoints sending
+// us huge bodies to make us run out of memory.
+package maxbody
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// ErrBodyTooLarge indicates that the response body is larger than
+// the configured maximum body size.
+var ErrBodyTooLarge = errors.New("maxbody: response body too large")
+
+// Transport enforces a maximum response body size.
+type Transport struct {
+	// MaxBodySize is the maximum number of body bytes that the client
+	// can read. Reading beyond this limit fails with ErrBodyTooLarge. A
+	// zero or negative value means that there is no limit.
+	MaxBodySize int64
+
+	roundTripper http.RoundTripper
+}
+
+// New creates a new Transport enforcing maxBodySize.
+func New(roundTripper http.RoundTripper, maxBodySize int64) *Transport {
+	return &Transport{MaxBodySize: maxBodySize, roundTripper: roundTripper}
+}
+
+// RoundTrip executes a single HTTP transaction, returning
+// a Response for the provided Request. When the server advertises a
+// Content-Length larger than MaxBodySize, we fail immediately with
+// ErrBodyTooLarge without reading the body.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.roundTripper.RoundTrip(req)
+	if err != nil || t.MaxBodySize <= 0 {
+		return resp, err
+	}
+	if resp.ContentLength > t.MaxBodySize {
+		resp.Body.Close()
+		return nil, ErrBodyTooLarge
+	}
+	resp.Body = &bodyWrapper{ReadCloser: resp.Body, remaining: t.MaxBodySize}
+	return resp, nil
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
+type bodyWrapper struct {
+	io.ReadCloser
+	remaining int64
+	tooLarge  bool
+}
+
+// Read is adapted from net/http's MaxBytesReader: we try to read one
+// byte more than allowed to know whether the body is too large.
+func (bw *bodyWrapper) Read(b []byte) (int, error) {
+	if bw.tooLarge {
+		return 0, ErrBodyTooLarge
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if int64(len(b)) > bw.remaining+1 {
+		b = b[:bw.remaining+1]
+	}
+	n, err := bw.ReadCloser.Read(b)
+	if int64(n) <= bw.remaining {
+		bw.remaining -= int64(n)
+		return n, err
+	}
+	n, bw.remaining, bw.tooLarge = int(bw.remaining), 0, true
+	return n, ErrBodyTooLarge
+}
@@ -0,0 +1,97 @@
+package maxbody
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newServer returns a server sending a body of size bytes. When chunked
+// is true, the server does not send the Content-Length header.
+func newServer(size int, chunked bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body := strings.Repeat("A", size)
+			if chunked {
+				w.(http.Flusher).Flush()
+			}
+			w.Write([]byte(body))
+		}))
+}
+
+func get(t *testing.T, server *httptest.Server, maxBodySize int64) ([]byte, error) {
+	client := &http.Client{Transport: New(http.DefaultTransport, maxBodySize)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func TestUnitWithinLimit(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		server := newServer(1024, chunked)
+		defer server.Close()
+		data, err := get(t, server, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != 1024 {
+			t.Fatal("unexpected body length")
+		}
+	}
+}
+
+func TestUnitContentLengthTooLarge(t *testing.T) {
+	server := newServer(1025, false)
+	defer server.Close()
+	data, err := get(t, server, 1024)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatal("not the error we expected")
+	}
+	if data != nil {
+		t.Fatal("expected nil data here")
+	}
+}
+
+func TestUnitChunkedTooLarge(t *testing.T) {
+	server := newServer(1<<20, true)
+	defer server.Close()
+	data, err := get(t, server, 1024)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatal("not the error we expected")
+	}
+	if len(data) != 1024 {
+		t.Fatal("expected to read up to the limit")
+	}
+}
+
+func TestUnitNoLimit(t *testing.T) {
+	server := newServer(1<<20, true)
+	defer server.Close()
+	data, err := get(t, server, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1<<20 {
+		t.Fatal("unexpected body length")
+	}
+}
+
+func TestUnitReadAfterTooLarge(t *testing.T) {
+	bw := &bodyWrapper{
+		ReadCloser: ioutil.NopCloser(strings.NewReader("antani")),
+		remaining:  2,
+	}
+	buf := make([]byte, 16)
+	if n, err := bw.Read(buf); n != 2 || !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatal("expected to read two bytes and fail")
+	}
+	if n, err := bw.Read(buf); n != 0 || !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatal("expected the error to be sticky")
+	}
+}
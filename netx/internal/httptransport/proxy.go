@@ -0,0 +1,28 @@
+package httptransport
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// NewProxyFunc returns the function to be used as the Proxy field of
+// the http.Transport wrapped by New. When explicitProxy is true and
+// proxyURL is not nil, every request is routed through proxyURL. In
+// all the other cases, the returned function forces a direct dial and
+// ignores the HTTP_PROXY and HTTPS_PROXY environment variables.
+//
+// Note that discovery services that geolocate the client, such as
+// locate.measurementlab.net used by ndt7, would see the proxy address
+// rather than ours when we're using a proxy. The caller should then
+// tell them our IP explicitly, e.g., with ndt7's `ip=` query parameter,
+// so that the answer is good for us and not for the proxy.
+func NewProxyFunc(
+	proxyURL *url.URL, explicitProxy bool,
+) func(*http.Request) (*url.URL, error) {
+	if explicitProxy && proxyURL != nil {
+		return http.ProxyURL(proxyURL)
+	}
+	return func(*http.Request) (*url.URL, error) {
+		return nil, nil
+	}
+}
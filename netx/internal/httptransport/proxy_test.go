@@ -0,0 +1,37 @@
+package httptransport
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestUnitNewProxyFunc(t *testing.T) {
+	os.Setenv("HTTPS_PROXY", "http://127.0.0.1:9999")
+	defer os.Unsetenv("HTTPS_PROXY")
+	proxyURL := &url.URL{Scheme: "socks5", Host: "127.0.0.1:9050"}
+	req, err := http.NewRequest("GET", "https://www.example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var testcases = []struct {
+		proxyURL      *url.URL
+		explicitProxy bool
+		expect        *url.URL
+	}{
+		{proxyURL: proxyURL, explicitProxy: true, expect: proxyURL},
+		{proxyURL: proxyURL, explicitProxy: false, expect: nil},
+		{proxyURL: nil, explicitProxy: true, expect: nil},
+		{proxyURL: nil, explicitProxy: false, expect: nil},
+	}
+	for _, tc := range testcases {
+		URL, err := NewProxyFunc(tc.proxyURL, tc.explicitProxy)(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if URL != tc.expect {
+			t.Fatalf("unexpected proxy URL for %+v", tc)
+		}
+	}
+}
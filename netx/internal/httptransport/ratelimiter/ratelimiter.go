@@ -0,0 +1,131 @@
+// Package ratelimiter contains a round tripper that limits the rate
+// of the requests sent to each host, which allows us to be a polite
+// scanner. The round tripper does not limit any host until configured.
+package ratelimiter
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limit is a rate limit. It allows to send at most Requests requests
+// every Interval. A Limit whose fields are not both positive means
+// that there is no limit.
+type Limit struct {
+	// Interval is the interval in which we can send Requests requests.
+	Interval time.Duration
+
+	// Requests is the number of requests we can send every Interval.
+	Requests int64
+}
+
+func (l Limit) enabled() bool {
+	return l.Interval > 0 && l.Requests > 0
+}
+
+// Transport limits the rate of the requests sent to each host using a
+// token bucket for each host. The bucket of a host initially contains
+// Limit.Requests tokens, hence we can send a burst of that many requests
+// to a host before we start spacing the requests. A request that exceeds
+// the limit blocks until there is a token or its context is done.
+type Transport struct {
+	// Default is the limit used for the hosts not in Hosts. By default
+	// there is no limit.
+	Default Limit
+
+	// Hosts contains the limits of specific hosts, overriding Default. The
+	// keys must be equal to the Host field of the URL of the requests,
+	// hence they include the port, if the URL contains a port.
+	Hosts map[string]Limit
+
+	buckets      map[string]*bucket
+	mu           sync.Mutex
+	roundTripper http.RoundTripper
+}
+
+type bucket struct {
+	last   time.Time
+	tokens float64
+}
+
+// New creates a new Transport that does not limit any host.
+func New(roundTripper http.RoundTripper) *Transport {
+	return &Transport{roundTripper: roundTripper}
+}
+
+// RoundTrip executes a single HTTP transaction, returning a Response
+// for the provided Request. When the request exceeds the limit of its
+// host, we wait until we can send it. If the request context is done
+// before that, we fail with the context error without sending it.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	limit := t.limit(host)
+	if !limit.enabled() {
+		return t.roundTripper.RoundTrip(req)
+	}
+	if delay := t.reserve(host, limit); delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			t.release(host)
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+	return t.roundTripper.RoundTrip(req)
+}
+
+func (t *Transport) limit(host string) Limit {
+	if limit, found := t.Hosts[host]; found {
+		return limit
+	}
+	return t.Default
+}
+
+// reserve takes a token from the bucket of host, possibly bringing the
+// number of tokens below zero, and returns how long the caller should
+// wait before the token it took is actually available.
+func (t *Transport) reserve(host string, limit Limit) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	burst := float64(limit.Requests)
+	if t.buckets == nil {
+		t.buckets = make(map[string]*bucket)
+	}
+	b := t.buckets[host]
+	if b == nil {
+		b = &bucket{last: now, tokens: burst}
+		t.buckets[host] = b
+	}
+	rate := burst / float64(limit.Interval) // tokens per nanosecond
+	b.tokens = math.Min(burst, b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate)
+}
+
+// release gives back the token taken by a request that has not
+// been sent because its context was done.
+func (t *Transport) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buckets[host].tokens++
+}
+
+// CloseIdleConnections closes the idle connections.
+func (t *Transport) CloseIdleConnections() {
+	// Adapted from net/http code
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if tr, ok := t.roundTripper.(closeIdler); ok {
+		tr.CloseIdleConnections()
+	}
+}
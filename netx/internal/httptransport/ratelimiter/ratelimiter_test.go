@@ -0,0 +1,141 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type timingRoundTripper struct {
+	mu    sync.Mutex
+	times map[string][]time.Time
+}
+
+func (rt *timingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.times == nil {
+		rt.times = make(map[string][]time.Time)
+	}
+	rt.times[req.URL.Host] = append(rt.times[req.URL.Host], time.Now())
+	return &http.Response{
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Header:     http.Header{},
+		Request:    req,
+		StatusCode: 200,
+	}, nil
+}
+
+func get(ctx context.Context, transport http.RoundTripper, URL string) error {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestUnitSpacing(t *testing.T) {
+	const (
+		interval = 100 * time.Millisecond
+		count    = 5
+	)
+	underlying := &timingRoundTripper{}
+	transport := New(underlying)
+	transport.Default = Limit{Interval: interval, Requests: 1}
+	// Run the requests in parallel to make sure that also concurrent
+	// requests to the same host are spaced according to the limit.
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := get(context.Background(), transport, "http://a.org/"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	times := underlying.times["a.org"]
+	if len(times) != count {
+		t.Fatal("unexpected number of requests")
+	}
+	const tolerance = 10 * time.Millisecond
+	for i := 1; i < len(times); i++ {
+		if gap := times[i].Sub(times[i-1]); gap < interval-tolerance {
+			t.Fatalf("requests %d and %d are too close: %s", i-1, i, gap)
+		}
+	}
+	if total := times[count-1].Sub(times[0]); total < (count-1)*interval-tolerance {
+		t.Fatal("the requests took less time than expected", total)
+	}
+}
+
+func TestUnitBurstAndPerHostLimits(t *testing.T) {
+	underlying := &timingRoundTripper{}
+	transport := New(underlying)
+	transport.Default = Limit{Interval: time.Hour, Requests: 1}
+	transport.Hosts = map[string]Limit{
+		"b.org":      {Interval: time.Hour, Requests: 3},
+		"c.org:8080": {},
+	}
+	start := time.Now()
+	for _, URL := range []string{
+		"http://a.org/",
+		"http://b.org/", "http://b.org/x", "http://b.org/y",
+		"http://c.org:8080/", "http://c.org:8080/", "http://c.org:8080/",
+		"http://d.org/",
+	} {
+		if err := get(context.Background(), transport, URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the requests within the limits should not block")
+	}
+	if len(underlying.times["b.org"]) != 3 || len(underlying.times["c.org:8080"]) != 3 {
+		t.Fatal("unexpected number of requests")
+	}
+}
+
+func TestUnitContextDone(t *testing.T) {
+	underlying := &timingRoundTripper{}
+	transport := New(underlying)
+	transport.Default = Limit{Interval: time.Hour, Requests: 1}
+	if err := get(context.Background(), transport, "http://a.org/"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := get(ctx, transport, "http://a.org/")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("not the error we expected", err)
+	}
+	if len(underlying.times["a.org"]) != 1 {
+		t.Fatal("the request should not have been sent")
+	}
+	if tokens := transport.buckets["a.org"].tokens; tokens < -0.01 || tokens > 0.01 {
+		t.Fatal("the token was not given back", tokens)
+	}
+}
+
+func TestUnitNoLimit(t *testing.T) {
+	underlying := &timingRoundTripper{}
+	transport := New(underlying)
+	for i := 0; i < 100; i++ {
+		if err := get(context.Background(), transport, "http://a.org/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if transport.buckets != nil {
+		t.Fatal("we should not have created any bucket")
+	}
+}
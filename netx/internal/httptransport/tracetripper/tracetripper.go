@@ -3,11 +3,17 @@ package tracetripper
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
 	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/http/httptrace"
+	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +21,7 @@ import (
 	"github.com/ooni/probe-engine/netx/internal/connid"
 	"github.com/ooni/probe-engine/netx/internal/dialid"
 	"github.com/ooni/probe-engine/netx/internal/errwrapper"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/firstbyte"
 	"github.com/ooni/probe-engine/netx/internal/transactionid"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
@@ -57,20 +64,94 @@ func (c *readCloseWrapper) Close() error {
 	return c.closer.Close()
 }
 
+// readSnap reads at most limit bytes from source and returns them. To
+// know whether the body is longer than limit, it attempts to read an
+// extra byte, which is not part of the returned data. All the bytes read
+// are then put back in front of source, so its consumer sees the body
+// in its entirety, regardless of the snapshot being truncated.
 func readSnap(
 	source *io.ReadCloser, limit int64,
 	readAll func(r io.Reader) ([]byte, error),
-) (data []byte, err error) {
-	data, err = readAll(io.LimitReader(*source, limit))
+) (data []byte, truncated bool, err error) {
+	readLimit := limit
+	if readLimit < math.MaxInt64 {
+		readLimit++
+	}
+	data, err = readAll(io.LimitReader(*source, readLimit))
 	if err == nil {
 		*source = newReadCloseWrapper(
 			io.MultiReader(bytes.NewReader(data), *source),
 			*source,
 		)
+		if int64(len(data)) > limit {
+			data, truncated = data[:limit], true
+		}
 	}
 	return
 }
 
+// readChunks reads source until EOF in chunks of chunkSize bytes and
+// appends to chunks the time at which we read each chunk.
+func readChunks(
+	source io.Reader, root *modelx.MeasurementRoot, chunkSize int64,
+	chunks *[]modelx.BodyChunk,
+) ([]byte, error) {
+	var data []byte
+	buffer := make([]byte, chunkSize)
+	for {
+		count, err := io.ReadFull(source, buffer)
+		if count > 0 {
+			data = append(data, buffer[:count]...)
+			*chunks = append(*chunks, modelx.BodyChunk{
+				DurationSinceBeginning: time.Now().Sub(root.Beginning),
+				NumBytes:               int64(count),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// computeChunkSize returns the size of the chunks in which we read a body
+// snapshot of at most snapSize bytes, or zero if we should not read it in
+// chunks. Chunks larger than the snapshot would not tell us anything more
+// than reading it at once, and we would allocate them anyway.
+func computeChunkSize(chunkSize, snapSize int64) int64 {
+	if chunkSize <= 0 {
+		return 0
+	}
+	if chunkSize > snapSize {
+		return snapSize
+	}
+	return chunkSize
+}
+
+// shouldSkipSnap returns true when the media type of the response
+// matches any of the patterns in skip, either as a prefix or as a glob.
+func shouldSkipSnap(resp *http.Response, skip []string) bool {
+	if len(skip) <= 0 {
+		return false
+	}
+	mediatype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, pattern := range skip {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(mediatype, pattern) {
+			return true
+		}
+		if matched, _ := path.Match(pattern, mediatype); matched {
+			return true
+		}
+	}
+	return false
+}
+
 // RoundTrip executes a single HTTP transaction, returning
 // a Response for the provided Request.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -91,15 +172,19 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		err              error
 		majorOp          = "http_round_trip"
 		majorOpMu        sync.Mutex
+		remoteAddr       string
+		remoteAddrMu     sync.Mutex
 		requestBody      []byte
+		requestBodyTrunc bool
 		requestHeaders   = http.Header{}
+		requestHeadersL  []modelx.HTTPHeaderField
 		requestHeadersMu sync.Mutex
 		snapSize         = modelx.ComputeBodySnapSize(root.MaxBodySnapSize)
 	)
 
 	// Save a snapshot of the request body
 	if req.Body != nil {
-		requestBody, err = readSnap(&req.Body, snapSize, t.readAll)
+		requestBody, requestBodyTrunc, err = readSnap(&req.Body, snapSize, t.readAll)
 		if err != nil {
 			return nil, err
 		}
@@ -144,13 +229,20 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			majorOpMu.Lock()
 			majorOp = "http_round_trip"
 			majorOpMu.Unlock()
+			// With connection reuse, this is the address of the
+			// pooled connection, which is what we want.
+			addr := remoteAddress(info.Conn)
+			remoteAddrMu.Lock()
+			remoteAddr = addr
+			remoteAddrMu.Unlock()
 			root.Handler.OnMeasurement(modelx.Measurement{
 				HTTPConnectionReady: &modelx.HTTPConnectionReadyEvent{
-					ConnID: connid.Compute(
-						info.Conn.LocalAddr().Network(),
-						info.Conn.LocalAddr().String(),
-					),
+					ConnID:                 connID(info.Conn),
+					ConnIdleTime:           info.IdleTime,
+					ConnReused:             info.Reused,
+					ConnWasIdle:            info.WasIdle,
 					DurationSinceBeginning: time.Now().Sub(root.Beginning),
+					RemoteAddress:          addr,
 					TransactionID:          tid,
 				},
 			})
@@ -162,6 +254,9 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			// perform normalization of header names!
 			for _, value := range values {
 				requestHeaders.Add(key, value)
+				requestHeadersL = append(requestHeadersL, modelx.HTTPHeaderField{
+					Key: key, Value: value,
+				})
 			}
 			requestHeadersMu.Unlock()
 			root.Handler.OnMeasurement(modelx.Measurement{
@@ -210,19 +305,22 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		},
 	}
 
-	// If we don't have already a tracer this is a toplevel request, so just
-	// set the tracer. Otherwise, we're doing DoH. We cannot set anothert trace
-	// because they'd be merged. Instead, replace the existing trace content
-	// with the new trace and then remember to reset it.
+	// If the context already contains one of our tracers, we're doing DoH
+	// within a toplevel request. We cannot set another trace because they'd
+	// be merged. Instead, replace the existing trace content with the new
+	// trace and then remember to reset it. Otherwise, this is a toplevel
+	// request, so just set the tracer, which is merged with the trace set
+	// by the caller, if any, so that the caller still sees its events.
 	origtracer := httptrace.ContextClientTrace(req.Context())
-	if origtracer != nil {
+	if origtracer != nil && origtracer == contextTracer(req.Context()) {
 		bkp := *origtracer
 		*origtracer = *tracer
 		defer func() {
 			*origtracer = bkp
 		}()
 	} else {
-		req = req.WithContext(httptrace.WithClientTrace(req.Context(), tracer))
+		ctx := httptrace.WithClientTrace(req.Context(), tracer)
+		req = req.WithContext(withTracer(ctx, httptrace.ContextClientTrace(ctx)))
 	}
 
 	resp, err := t.roundTripper.RoundTrip(req)
@@ -234,35 +332,110 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// [*] Require less event joining work by providing info that
 	// makes this event alone actionable for OONI
 	event := &modelx.HTTPRoundTripDoneEvent{
-		DurationSinceBeginning: time.Now().Sub(root.Beginning),
-		Error:                  err,
-		RequestBodySnap:        requestBody,
-		RequestHeaders:         requestHeaders,   // [*]
-		RequestMethod:          req.Method,       // [*]
-		RequestURL:             req.URL.String(), // [*]
-		MaxBodySnapSize:        snapSize,
-		TransactionID:          tid,
+		DurationSinceBeginning:   time.Now().Sub(root.Beginning),
+		Error:                    err,
+		RequestBodySnap:          requestBody,
+		RequestBodySnapTruncated: requestBodyTrunc,
+		RequestHeaders:           requestHeaders,   // [*]
+		RequestHeadersList:       requestHeadersL,  // [*]
+		RequestMethod:            req.Method,       // [*]
+		RequestURL:               req.URL.String(), // [*]
+		MaxBodySnapSize:          snapSize,
+		TransactionID:            tid,
 	}
 	if resp != nil {
 		event.ResponseHeaders = resp.Header
 		event.ResponseStatusCode = int64(resp.StatusCode)
 		event.ResponseProto = resp.Proto
+		remoteAddrMu.Lock()
+		event.ResponseRemoteAddress = remoteAddr
+		remoteAddrMu.Unlock()
+		if resp.TLS != nil {
+			state := modelx.NewTLSConnectionState(*resp.TLS)
+			event.ResponseTLS = &state
+		}
 		// Save a snapshot of the response body
-		var data []byte
-		data, err = readSnap(&resp.Body, snapSize, t.readAll)
+		var (
+			data      []byte
+			truncated bool
+		)
+		if firstbyte.Aborted(resp.Body) {
+			event.ResponseBodyAborted = true
+		} else if shouldSkipSnap(resp, root.SkipBodySnapContentTypes) {
+			event.ResponseBodySnapSkipped = true
+		} else if chunkSize := computeChunkSize(
+			root.BodySnapChunkSize, snapSize); chunkSize > 0 {
+			data, truncated, err = readSnap(&resp.Body, snapSize,
+				func(r io.Reader) ([]byte, error) {
+					return readChunks(r, root, chunkSize, &event.ResponseBodySnapChunks)
+				})
+		} else {
+			data, truncated, err = readSnap(&resp.Body, snapSize, t.readAll)
+		}
 		if err != nil {
 			t.readAllErrs.Add(1)
 			resp = nil // this is how net/http likes it
 		} else {
 			event.ResponseBodySnap = data
+			event.ResponseBodySnapTruncated = truncated
 		}
 	}
 	root.Handler.OnMeasurement(modelx.Measurement{
 		HTTPRoundTripDone: event,
 	})
+	if redirect := newRedirectEvent(req, resp, root, tid); redirect != nil {
+		root.Handler.OnMeasurement(modelx.Measurement{
+			HTTPRedirect: redirect,
+		})
+	}
 	return resp, err
 }
 
+// newRedirectEvent returns the event describing the redirect of req, or
+// nil if resp is nil or is not a redirect response.
+func newRedirectEvent(
+	req *http.Request, resp *http.Response, root *modelx.MeasurementRoot,
+	tid int64,
+) *modelx.HTTPRedirectEvent {
+	if resp == nil {
+		return nil
+	}
+	switch resp.StatusCode {
+	case 301, 302, 303, 307, 308:
+	default:
+		return nil
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+	to, err := req.URL.Parse(location)
+	if err != nil {
+		return nil
+	}
+	return &modelx.HTTPRedirectEvent{
+		DurationSinceBeginning: time.Now().Sub(root.Beginning),
+		From:                   req.URL.String(),
+		StatusCode:             int64(resp.StatusCode),
+		To:                     to.String(),
+		TransactionID:          tid,
+	}
+}
+
+type tracerKey struct{}
+
+// withTracer returns a copy of ctx remembering that tracer is the
+// trace that we have added to ctx.
+func withTracer(ctx context.Context, tracer *httptrace.ClientTrace) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// contextTracer returns the trace we have added to ctx, if any.
+func contextTracer(ctx context.Context) *httptrace.ClientTrace {
+	tracer, _ := ctx.Value(tracerKey{}).(*httptrace.ClientTrace)
+	return tracer
+}
+
 // CloseIdleConnections closes the idle connections.
 func (t *Transport) CloseIdleConnections() {
 	// Adapted from net/http code
@@ -273,3 +446,20 @@ func (t *Transport) CloseIdleConnections() {
 		tr.CloseIdleConnections()
 	}
 }
+
+// remoteAddress returns the remote address of conn, if any.
+func remoteAddress(conn net.Conn) (s string) {
+	if conn != nil && conn.RemoteAddr() != nil {
+		s = conn.RemoteAddr().String()
+	}
+	return
+}
+
+// connID returns the ID assigned to conn by our dialers. When conn was
+// created by some other dialer, we compute the ID from the local address.
+func connID(conn net.Conn) int64 {
+	if id := connid.Lookup(conn); id != 0 {
+		return id
+	}
+	return connid.Compute(conn.LocalAddr().Network(), conn.LocalAddr().String())
+}
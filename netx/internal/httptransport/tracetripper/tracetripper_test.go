@@ -6,13 +6,17 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httptrace"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/httptransport/firstbyte"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -270,3 +274,615 @@ func TestIntegrationWithReadAllFailingForBody(t *testing.T) {
 		t.Fatal("more round trips than expected")
 	}
 }
+
+func TestUnitReadSnap(t *testing.T) {
+	var testcases = []struct {
+		body      string
+		limit     int64
+		snap      string
+		truncated bool
+	}{
+		{body: "antani", limit: 4, snap: "anta", truncated: true},
+		{body: "antani", limit: 5, snap: "antan", truncated: true},
+		{body: "antani", limit: 6, snap: "antani", truncated: false},
+		{body: "antani", limit: 7, snap: "antani", truncated: false},
+		{body: "antani", limit: math.MaxInt64, snap: "antani", truncated: false},
+	}
+	for _, tc := range testcases {
+		body := ioutil.NopCloser(strings.NewReader(tc.body))
+		snap, truncated, err := readSnap(&body, tc.limit, ioutil.ReadAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(snap) != tc.snap || truncated != tc.truncated {
+			t.Fatalf("unexpected snap for %+v", tc)
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != tc.body {
+			t.Fatalf("the body is not complete for %+v", tc)
+		}
+	}
+}
+
+func TestUnitTruncatedSnaps(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			w.Write([]byte(body))
+		}))
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	for _, snapSize := range []int64{10, 20} {
+		handler := &roundTripHandler{}
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning:       time.Now(),
+				Handler:         handler,
+				MaxBodySnapSize: snapSize,
+			},
+		)
+		req, err := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != body {
+			t.Fatal("the client did not receive the whole body")
+		}
+		if len(handler.roundTrips) != 1 {
+			t.Fatal("unexpected number of round trips")
+		}
+		roundTrip := handler.roundTrips[0]
+		expectTruncated := snapSize < int64(len(body))
+		if roundTrip.RequestBodySnapTruncated != expectTruncated {
+			t.Fatal("unexpected RequestBodySnapTruncated")
+		}
+		if roundTrip.ResponseBodySnapTruncated != expectTruncated {
+			t.Fatal("unexpected ResponseBodySnapTruncated")
+		}
+		if string(roundTrip.ResponseBodySnap) != body[:snapSize] {
+			t.Fatal("unexpected response body snap")
+		}
+	}
+}
+
+func TestUnitShouldSkipSnap(t *testing.T) {
+	var testcases = []struct {
+		contentType string
+		skip        []string
+		expect      bool
+	}{
+		{contentType: "image/png", skip: nil, expect: false},
+		{contentType: "image/png", skip: []string{"image/"}, expect: true},
+		{contentType: "image/png", skip: []string{"image/*"}, expect: true},
+		{contentType: "IMAGE/PNG", skip: []string{"image/*"}, expect: true},
+		{contentType: "image/png", skip: []string{"Image/*"}, expect: true},
+		{contentType: "video/mp4; codecs=avc1", skip: []string{"video/mp4"}, expect: true},
+		{contentType: "text/html; charset=utf-8", skip: []string{"image/*", "video/"}, expect: false},
+		{contentType: "", skip: []string{"image/*"}, expect: false},
+	}
+	for _, tc := range testcases {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set("Content-Type", tc.contentType)
+		if shouldSkipSnap(resp, tc.skip) != tc.expect {
+			t.Fatalf("unexpected result for %+v", tc)
+		}
+	}
+}
+
+func TestUnitSkipSnapByContentType(t *testing.T) {
+	const body = "\x89PNG antani mascetti"
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(body))
+		}))
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:                time.Now(),
+			Handler:                  handler,
+			SkipBodySnapContentTypes: []string{"image/*"},
+		},
+	)
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != body {
+		t.Fatal("the client did not receive the whole body")
+	}
+	if len(handler.roundTrips) != 1 {
+		t.Fatal("unexpected number of round trips")
+	}
+	roundTrip := handler.roundTrips[0]
+	if !roundTrip.ResponseBodySnapSkipped {
+		t.Fatal("expected the snapshot to be skipped")
+	}
+	if len(roundTrip.ResponseBodySnap) != 0 {
+		t.Fatal("expected an empty snapshot")
+	}
+	if roundTrip.ResponseStatusCode != 200 || roundTrip.ResponseHeaders == nil {
+		t.Fatal("expected metadata to be recorded")
+	}
+}
+
+func TestUnitResponseTLSState(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("antani"))
+		}))
+	defer server.Close()
+	plainServer := httptest.NewServer(server.Config.Handler)
+	defer plainServer.Close()
+	client := &http.Client{Transport: New(server.Client().Transport)}
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	for _, URL := range []string{server.URL, plainServer.URL} {
+		req, err := http.NewRequest("GET", URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if len(handler.roundTrips) != 2 {
+		t.Fatal("unexpected number of round trips")
+	}
+	state := handler.roundTrips[0].ResponseTLS
+	if state == nil {
+		t.Fatal("expected a TLS state")
+	}
+	if state.Version == 0 || state.CipherSuite == 0 {
+		t.Fatal("expected version and cipher suite to be set")
+	}
+	if len(state.PeerCertificates) < 1 {
+		t.Fatal("expected peer certificates")
+	}
+	if handler.roundTrips[1].ResponseTLS != nil {
+		t.Fatal("expected no TLS state for plaintext HTTP")
+	}
+}
+
+type connReadyHandler struct {
+	events []*modelx.HTTPConnectionReadyEvent
+	mu     sync.Mutex
+}
+
+func (h *connReadyHandler) OnMeasurement(m modelx.Measurement) {
+	if m.HTTPConnectionReady != nil {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.events = append(h.events, m.HTTPConnectionReady)
+	}
+}
+
+func TestUnitConnectionReuse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("antani"))
+		}))
+	defer server.Close()
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: New(transport)}
+	handler := &connReadyHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(handler.events) != 2 {
+		t.Fatal("unexpected number of events")
+	}
+	first, second := handler.events[0], handler.events[1]
+	if first.ConnReused || first.ConnWasIdle || first.ConnIdleTime != 0 {
+		t.Fatal("expected a fresh connection")
+	}
+	if !second.ConnReused || !second.ConnWasIdle || second.ConnIdleTime <= 0 {
+		t.Fatal("expected a reused connection")
+	}
+	if first.ConnID != second.ConnID {
+		t.Fatal("expected the same connection")
+	}
+}
+
+func TestUnitAbortedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("A", 1<<20)))
+		}))
+	defer server.Close()
+	firstByte := firstbyte.New(http.DefaultTransport)
+	firstByte.Enabled = true
+	client := &http.Client{Transport: New(firstByte)}
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(handler.roundTrips) != 1 {
+		t.Fatal("unexpected number of round trips")
+	}
+	roundTrip := handler.roundTrips[0]
+	if !roundTrip.ResponseBodyAborted || roundTrip.Error != nil {
+		t.Fatal("expected the body to be cleanly aborted")
+	}
+	if len(roundTrip.ResponseBodySnap) != 0 {
+		t.Fatal("expected an empty snapshot")
+	}
+	if roundTrip.ResponseStatusCode != 200 || roundTrip.ResponseHeaders == nil {
+		t.Fatal("expected metadata to be recorded")
+	}
+}
+
+func TestUnitHeadersList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("X-Antani", "2")
+	req.Header.Add("X-Antani", "1")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(handler.roundTrips) != 1 {
+		t.Fatal("unexpected number of round trips")
+	}
+	roundTrip := handler.roundTrips[0]
+	var antani []string
+	for _, field := range roundTrip.RequestHeadersList {
+		if field.Key == "X-Antani" {
+			antani = append(antani, field.Value)
+		}
+	}
+	if len(antani) != 2 || antani[0] != "2" || antani[1] != "1" {
+		t.Fatalf("unexpected request headers: %+v", roundTrip.RequestHeadersList)
+	}
+}
+
+func TestUnitBodySnapChunks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+			w.Write([]byte("abcdefghij"))
+		}))
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	for _, chunkSize := range []int64{0, 10} {
+		handler := &roundTripHandler{}
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning:         time.Now(),
+				BodySnapChunkSize: chunkSize,
+				Handler:           handler,
+			},
+		)
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "0123456789abcdefghij" {
+			t.Fatal("the client did not receive the whole body")
+		}
+		roundTrip := handler.roundTrips[0]
+		if string(roundTrip.ResponseBodySnap) != "0123456789abcdefghij" {
+			t.Fatal("unexpected snapshot")
+		}
+		chunks := roundTrip.ResponseBodySnapChunks
+		if chunkSize == 0 {
+			if len(chunks) != 0 {
+				t.Fatal("expected no chunks by default")
+			}
+			continue
+		}
+		if len(chunks) != 2 || chunks[0].NumBytes != 10 || chunks[1].NumBytes != 10 {
+			t.Fatalf("unexpected chunks: %+v", chunks)
+		}
+		if chunks[1].DurationSinceBeginning-chunks[0].DurationSinceBeginning < 50*time.Millisecond {
+			t.Fatal("the chunks timeline does not show the stall")
+		}
+	}
+}
+
+type failingAfterReader struct {
+	reader io.Reader
+}
+
+func (r *failingAfterReader) Read(b []byte) (int, error) {
+	count, err := r.reader.Read(b)
+	if err == io.EOF {
+		err = io.ErrClosedPipe
+	}
+	return count, err
+}
+
+func TestUnitReadChunksFailure(t *testing.T) {
+	root := &modelx.MeasurementRoot{Beginning: time.Now()}
+	var chunks []modelx.BodyChunk
+	data, err := readChunks(&failingAfterReader{
+		reader: strings.NewReader("0123456789"),
+	}, root, 4, &chunks)
+	if !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatal("not the error we expected")
+	}
+	if string(data) != "0123456789" {
+		t.Fatal("unexpected data")
+	}
+	if len(chunks) != 3 || chunks[2].NumBytes != 2 {
+		t.Fatalf("unexpected chunks: %+v", chunks)
+	}
+}
+
+func TestUnitComputeChunkSize(t *testing.T) {
+	var table = []struct {
+		chunkSize int64
+		snapSize  int64
+		expected  int64
+	}{
+		{-1, 1 << 17, 0},
+		{0, 1 << 17, 0},
+		{1, 1 << 17, 1},
+		{1 << 17, 1 << 17, 1 << 17},
+		{1<<17 + 1, 1 << 17, 1 << 17},
+		{math.MaxInt64, 8, 8},
+	}
+	for _, entry := range table {
+		out := computeChunkSize(entry.chunkSize, entry.snapSize)
+		if out != entry.expected {
+			t.Fatalf("unexpected chunk size for %+v: %d", entry, out)
+		}
+	}
+}
+
+func TestUnitBodySnapChunkSizeLargerThanSnap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("0123456789"))
+		}))
+	defer server.Close()
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:         time.Now(),
+			BodySnapChunkSize: math.MaxInt64,
+			Handler:           handler,
+			MaxBodySnapSize:   8,
+		},
+	)
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	roundTrip := handler.roundTrips[0]
+	if string(roundTrip.ResponseBodySnap) != "01234567" {
+		t.Fatalf("unexpected snapshot: %s", string(roundTrip.ResponseBodySnap))
+	}
+	chunks := roundTrip.ResponseBodySnapChunks
+	if len(chunks) != 2 || chunks[0].NumBytes != 8 || chunks[1].NumBytes != 1 {
+		t.Fatalf("unexpected chunks: %+v", chunks)
+	}
+}
+
+type redirectHandler struct {
+	redirects []*modelx.HTTPRedirectEvent
+	roundTrip *modelx.HTTPRoundTripDoneEvent
+}
+
+func (h *redirectHandler) OnMeasurement(m modelx.Measurement) {
+	if m.HTTPRoundTripDone != nil {
+		h.roundTrip = m.HTTPRoundTripDone
+	}
+	if m.HTTPRedirect != nil {
+		if h.roundTrip == nil {
+			panic("redirect event emitted before round trip done")
+		}
+		h.redirects = append(h.redirects, m.HTTPRedirect)
+	}
+}
+
+type cannedRoundTripper struct {
+	header     http.Header
+	statusCode int
+}
+
+func (rt *cannedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Header:     rt.header,
+		Request:    req,
+		StatusCode: rt.statusCode,
+	}, nil
+}
+
+func TestUnitRedirectEvent(t *testing.T) {
+	for _, tc := range []struct {
+		statusCode int
+		location   string
+		expectTo   string
+	}{
+		{302, "/next?x=1", "http://www.example.com/next?x=1"},
+		{301, "https://www.example.org/", "https://www.example.org/"},
+		{308, "other", "http://www.example.com/dir/other"},
+		{302, "", ""},
+		{200, "/next", ""},
+		{304, "/next", ""},
+	} {
+		header := http.Header{}
+		if tc.location != "" {
+			header.Set("Location", tc.location)
+		}
+		transport := New(&cannedRoundTripper{
+			header:     header,
+			statusCode: tc.statusCode,
+		})
+		handler := &redirectHandler{}
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning: time.Now(),
+				Handler:   handler,
+			},
+		)
+		req, err := http.NewRequest("GET", "http://www.example.com/dir/page", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if tc.expectTo == "" {
+			if len(handler.redirects) != 0 {
+				t.Fatalf("unexpected redirect event for %+v", tc)
+			}
+			continue
+		}
+		if len(handler.redirects) != 1 {
+			t.Fatalf("expected a redirect event for %+v", tc)
+		}
+		redirect := handler.redirects[0]
+		if redirect.From != "http://www.example.com/dir/page" || redirect.To != tc.expectTo {
+			t.Fatalf("unexpected redirect URLs: %+v", redirect)
+		}
+		if redirect.StatusCode != int64(tc.statusCode) {
+			t.Fatal("unexpected status code")
+		}
+		if redirect.DurationSinceBeginning <= 0 {
+			t.Fatal("unexpected elapsed time")
+		}
+		if redirect.TransactionID != handler.roundTrip.TransactionID {
+			t.Fatal("unexpected transaction ID")
+		}
+	}
+}
+
+func TestUnitCallerClientTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(204)
+		}))
+	defer server.Close()
+	client := &http.Client{Transport: New(http.DefaultTransport)}
+	defer client.CloseIdleConnections()
+	handler := &roundTripHandler{}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	var remoteAddr string
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remoteAddr = info.Conn.RemoteAddr().String()
+		},
+	})
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if remoteAddr != server.Listener.Addr().String() {
+		t.Fatal("the trace of the caller did not see the connection")
+	}
+	if len(handler.roundTrips) != 1 {
+		t.Fatal("unexpected number of round trips")
+	}
+	if handler.roundTrips[0].ResponseRemoteAddress != remoteAddr {
+		t.Fatal("we did not see the connection")
+	}
+}
@@ -53,3 +53,8 @@ func (c *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error)
 	c.NumErrors.Add(1)
 	return nil, errNotFound
 }
+
+// Close does nothing, since this resolver does not own any resource.
+func (c *Resolver) Close() error {
+	return nil
+}
@@ -3,8 +3,10 @@ package chainresolver
 
 import (
 	"context"
+	"errors"
 	"net"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -49,6 +51,66 @@ func (c *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 	return addrs, err
 }
 
+// LookupHostWithCNAME returns the IP addresses of a host along with
+// the CNAMEs encountered while resolving it.
+func (c *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	addrs, cnames, err := lookupHostWithCNAME(ctx, c.primary, hostname)
+	if err != nil {
+		addrs, cnames, err = lookupHostWithCNAME(ctx, c.secondary, hostname)
+	}
+	return addrs, cnames, err
+}
+
+func lookupHostWithCNAME(ctx context.Context, r modelx.DNSResolver,
+	hostname string) ([]string, []string, error) {
+	if rc, ok := r.(modelx.DNSResolverWithCNAME); ok {
+		return rc.LookupHostWithCNAME(ctx, hostname)
+	}
+	addrs, err := r.LookupHost(ctx, hostname)
+	return addrs, nil, err
+}
+
+// LookupType queries for records of a specific type
+func (c *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	records, err := lookupType(ctx, c.primary, name, qtype)
+	if err != nil {
+		records, err = lookupType(ctx, c.secondary, name, qtype)
+	}
+	return records, err
+}
+
+func lookupType(ctx context.Context, r modelx.DNSResolver,
+	name string, qtype uint16) ([]dns.RR, error) {
+	if rt, ok := r.(modelx.DNSResolverWithType); ok {
+		return rt.LookupType(ctx, name, qtype)
+	}
+	return nil, errLookupTypeNotSupported
+}
+
+var errLookupTypeNotSupported = errors.New("chainresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name
+func (c *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	records, err := lookupHTTPS(ctx, c.primary, name)
+	if err != nil {
+		records, err = lookupHTTPS(ctx, c.secondary, name)
+	}
+	return records, err
+}
+
+func lookupHTTPS(ctx context.Context, r modelx.DNSResolver,
+	name string) ([]modelx.HTTPSRecord, error) {
+	if rh, ok := r.(modelx.DNSResolverWithHTTPS); ok {
+		return rh.LookupHTTPS(ctx, name)
+	}
+	return nil, errLookupHTTPSNotSupported
+}
+
+var errLookupHTTPSNotSupported = errors.New("chainresolver: LookupHTTPS not supported")
+
 // LookupMX returns the MX records of a specific name
 func (c *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
 	records, err := c.primary.LookupMX(ctx, name)
@@ -66,3 +128,13 @@ func (c *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error)
 	}
 	return records, err
 }
+
+// Close closes the primary and the secondary resolvers and returns
+// the first error that occurred, if any.
+func (c *Resolver) Close() error {
+	err := modelx.CloseDNSResolver(c.primary)
+	if err2 := modelx.CloseDNSResolver(c.secondary); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -2,10 +2,13 @@ package chainresolver
 
 import (
 	"context"
+	"errors"
 	"net"
 	"testing"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 func TestLookupAddr(t *testing.T) {
@@ -62,3 +65,141 @@ func TestLookupNS(t *testing.T) {
 		t.Fatal("expect non nil return value here")
 	}
 }
+
+type cnameresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (cnameresolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	return []string{"8.8.8.8"}, []string{"dns.example.net."}, nil
+}
+
+type fixedresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (fixedresolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	return []string{"8.8.4.4"}, nil
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	client := New(brokenresolver.New(), cnameresolver{brokenresolver.New()})
+	addrs, cnames, err := client.LookupHostWithCNAME(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addrs")
+	}
+	if len(cnames) != 1 || cnames[0] != "dns.example.net." {
+		t.Fatal("unexpected cnames")
+	}
+}
+
+func TestUnitLookupHostWithCNAMEWithoutSupport(t *testing.T) {
+	client := New(brokenresolver.New(), fixedresolver{brokenresolver.New()})
+	addrs, cnames, err := client.LookupHostWithCNAME(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.4.4" {
+		t.Fatal("unexpected addrs")
+	}
+	if len(cnames) != 0 {
+		t.Fatal("unexpected cnames")
+	}
+}
+
+type typeresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeresolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"antani"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	client := New(brokenresolver.New(), typeresolver{brokenresolver.New()})
+	records, err := client.LookupType(context.Background(), "dns.google", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	client := New(brokenresolver.New(), brokenresolver.New())
+	records, err := client.LookupType(context.Background(), "dns.google", dns.TypeTXT)
+	if err != errLookupTypeNotSupported {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type httpsresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsresolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, ALPN: []string{"h3"}}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	client := New(brokenresolver.New(), httpsresolver{brokenresolver.New()})
+	records, err := client.LookupHTTPS(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	client := New(brokenresolver.New(), brokenresolver.New())
+	records, err := client.LookupHTTPS(context.Background(), "dns.google")
+	if err != errLookupHTTPSNotSupported {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type closeresolver struct {
+	*brokenresolver.Resolver
+	closed bool
+	err    error
+}
+
+func (r *closeresolver) Close() error {
+	r.closed = true
+	return r.err
+}
+
+func TestUnitClose(t *testing.T) {
+	expected := errors.New("mocked error")
+	primary := &closeresolver{Resolver: brokenresolver.New(), err: expected}
+	secondary := &closeresolver{Resolver: brokenresolver.New()}
+	client := New(primary, secondary)
+	if err := client.Close(); !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+	if !primary.closed || !secondary.closed {
+		t.Fatal("expected to close both resolvers")
+	}
+}
+
+func TestUnitCloseWithoutSupport(t *testing.T) {
+	client := New(brokenresolver.New(), new(net.Resolver))
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
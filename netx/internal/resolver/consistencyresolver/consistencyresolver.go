@@ -0,0 +1,181 @@
+// Package consistencyresolver contains a resolver that queries both a
+// trusted resolver and the system resolver and compares their answers,
+// which is useful to detect DNS tampering.
+package consistencyresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// SystemServer is the Server of the answers of the system resolver.
+const SystemServer = "system"
+
+// Resolver is a consistency resolver.
+type Resolver struct {
+	system        modelx.DNSResolver
+	trusted       modelx.DNSResolver
+	trustedServer string
+}
+
+// New creates a new consistency Resolver. The trustedServer string
+// identifies the trusted resolver in the results, e.g., the URL of a
+// DoH server, while the system resolver is always identified by
+// SystemServer. Since both resolvers are just DNSResolvers, you can
+// pass resolvers that already emit measurement events.
+func New(trustedServer string, trusted, system modelx.DNSResolver) *Resolver {
+	return &Resolver{
+		system:        system,
+		trusted:       trusted,
+		trustedServer: trustedServer,
+	}
+}
+
+// LookupHostConsistency resolves hostname using both the trusted and
+// the system resolver in parallel and compares their answers. Both
+// answers are returned even when one of the lookups fails. The error
+// is non-nil only when both lookups fail, in which case it is the
+// error returned by the trusted resolver.
+func (c *Resolver) LookupHostConsistency(
+	ctx context.Context, hostname string) (modelx.DNSConsistencyResult, error) {
+	var (
+		result modelx.DNSConsistencyResult
+		wg     sync.WaitGroup
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		result.Trusted = lookup(ctx, c.trusted, c.trustedServer, hostname)
+	}()
+	go func() {
+		defer wg.Done()
+		result.System = lookup(ctx, c.system, SystemServer, hostname)
+	}()
+	wg.Wait()
+	if result.Trusted.Error != nil && result.System.Error != nil {
+		return result, result.Trusted.Error
+	}
+	result.Consistent = intersects(result.Trusted.Addresses, result.System.Addresses)
+	return result, nil
+}
+
+func lookup(ctx context.Context, r modelx.DNSResolver,
+	server, hostname string) modelx.DNSConsistencyAnswer {
+	addrs, err := r.LookupHost(ctx, hostname)
+	return modelx.DNSConsistencyAnswer{
+		Addresses: addrs,
+		Error:     err,
+		Server:    server,
+	}
+}
+
+func intersects(left, right []string) bool {
+	set := make(map[string]bool)
+	for _, addr := range left {
+		set[addr] = true
+	}
+	for _, addr := range right {
+		if set[addr] {
+			return true
+		}
+	}
+	return false
+}
+
+// LookupAddr returns the name of the provided IP address
+func (c *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return c.trusted.LookupAddr(ctx, addr)
+}
+
+// LookupCNAME returns the canonical name of a host
+func (c *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return c.trusted.LookupCNAME(ctx, host)
+}
+
+// LookupHost returns the IP addresses of a host. It performs the same
+// lookups of LookupHostConsistency and returns the addresses of the
+// trusted resolver, or the ones of the system resolver if the trusted
+// resolver failed, so that the Resolver can be used for dialing.
+func (c *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	result, err := c.LookupHostConsistency(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if result.Trusted.Error != nil {
+		return result.System.Addresses, nil
+	}
+	return result.Trusted.Addresses, nil
+}
+
+// LookupHostWithCNAME returns the IP addresses of a host along with the
+// CNAMEs encountered while resolving it, using the trusted resolver or,
+// if it fails, the system resolver. Unlike LookupHost, it does not query
+// both resolvers, since we would only return the answer of one of them.
+func (c *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	addrs, cnames, err := lookupHostWithCNAME(ctx, c.trusted, hostname)
+	if err != nil {
+		addrs, cnames, err = lookupHostWithCNAME(ctx, c.system, hostname)
+	}
+	return addrs, cnames, err
+}
+
+func lookupHostWithCNAME(ctx context.Context, r modelx.DNSResolver,
+	hostname string) ([]string, []string, error) {
+	if rc, ok := r.(modelx.DNSResolverWithCNAME); ok {
+		return rc.LookupHostWithCNAME(ctx, hostname)
+	}
+	addrs, err := r.LookupHost(ctx, hostname)
+	return addrs, []string{}, err
+}
+
+// LookupType queries for records of a specific type using the trusted
+// resolver, which must support this functionality.
+func (c *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reso, ok := c.trusted.(modelx.DNSResolverWithType)
+	if !ok {
+		return nil, errLookupTypeNotSupported
+	}
+	return reso.LookupType(ctx, name, qtype)
+}
+
+var errLookupTypeNotSupported = errors.New("consistencyresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name using the trusted
+// resolver, which must support this functionality.
+func (c *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := c.trusted.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	return reso.LookupHTTPS(ctx, name)
+}
+
+var errLookupHTTPSNotSupported = errors.New("consistencyresolver: LookupHTTPS not supported")
+
+// LookupMX returns the MX records of a specific name
+func (c *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return c.trusted.LookupMX(ctx, name)
+}
+
+// LookupNS returns the NS records of a specific name
+func (c *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return c.trusted.LookupNS(ctx, name)
+}
+
+// Close closes the trusted and the system resolvers and returns
+// the first error that occurred, if any.
+func (c *Resolver) Close() error {
+	err := modelx.CloseDNSResolver(c.trusted)
+	if err2 := modelx.CloseDNSResolver(c.system); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package consistencyresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/staticresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newFakeResolver(addrs ...string) modelx.DNSResolver {
+	return staticresolver.New(map[string][]string{
+		"example.com": addrs,
+	}, brokenresolver.New())
+}
+
+func TestUnitConsistent(t *testing.T) {
+	reso := New(
+		"https://dns.example/dns-query",
+		newFakeResolver("1.2.3.4", "5.6.7.8"),
+		newFakeResolver("5.6.7.8"),
+	)
+	result, err := reso.LookupHostConsistency(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Consistent {
+		t.Fatal("expected consistent result")
+	}
+	if result.Trusted.Server != "https://dns.example/dns-query" {
+		t.Fatal("unexpected trusted server")
+	}
+	if result.System.Server != SystemServer {
+		t.Fatal("unexpected system server")
+	}
+	if len(result.Trusted.Addresses) != 2 || len(result.System.Addresses) != 1 {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitInconsistent(t *testing.T) {
+	reso := New("trusted", newFakeResolver("1.2.3.4"), newFakeResolver("10.0.0.1"))
+	result, err := reso.LookupHostConsistency(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Consistent {
+		t.Fatal("expected inconsistent result")
+	}
+	if result.System.Addresses[0] != "10.0.0.1" {
+		t.Fatal("unexpected system addresses")
+	}
+}
+
+func TestUnitSystemFailure(t *testing.T) {
+	reso := New("trusted", newFakeResolver("1.2.3.4"), brokenresolver.New())
+	result, err := reso.LookupHostConsistency(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Consistent {
+		t.Fatal("expected inconsistent result")
+	}
+	if result.System.Error == nil {
+		t.Fatal("expected system error here")
+	}
+	if len(result.Trusted.Addresses) != 1 || result.Trusted.Error != nil {
+		t.Fatal("unexpected trusted answer")
+	}
+	addrs, err := reso.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitTrustedFailure(t *testing.T) {
+	reso := New("trusted", brokenresolver.New(), newFakeResolver("10.0.0.1"))
+	result, err := reso.LookupHostConsistency(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Trusted.Error == nil {
+		t.Fatal("expected trusted error here")
+	}
+	addrs, err := reso.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitBothFailure(t *testing.T) {
+	reso := New("trusted", brokenresolver.New(), brokenresolver.New())
+	result, err := reso.LookupHostConsistency(context.Background(), "example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result.Trusted.Error == nil || result.System.Error == nil {
+		t.Fatal("expected both answers to contain errors")
+	}
+	addrs, err := reso.LookupHost(context.Background(), "example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+}
+
+func TestUnitOtherLookupsUseTrusted(t *testing.T) {
+	trusted := brokenresolver.New()
+	reso := New("trusted", trusted, newFakeResolver("10.0.0.1"))
+	ctx := context.Background()
+	reso.LookupAddr(ctx, "1.2.3.4")
+	reso.LookupCNAME(ctx, "example.com")
+	reso.LookupMX(ctx, "example.com")
+	reso.LookupNS(ctx, "example.com")
+	if trusted.NumErrors.Load() != 4 {
+		t.Fatal("expected the trusted resolver to be used")
+	}
+}
+
+func TestUnitImplementsInterface(t *testing.T) {
+	var _ modelx.DNSResolverWithConsistency = New("", nil, nil)
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	reso := New("https://dns.example/dns-query",
+		newFakeResolver("1.1.1.1"), newFakeResolver("2.2.2.2"))
+	addrs, cnames, err := reso.LookupHostWithCNAME(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.1.1.1" {
+		t.Fatal("expected the addresses of the trusted resolver")
+	}
+	if cnames == nil || len(cnames) != 0 {
+		t.Fatal("expected empty cnames")
+	}
+}
+
+func TestUnitLookupHostWithCNAMETrustedFailure(t *testing.T) {
+	reso := New("https://dns.example/dns-query",
+		brokenresolver.New(), newFakeResolver("2.2.2.2"))
+	addrs, _, err := reso.LookupHostWithCNAME(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "2.2.2.2" {
+		t.Fatal("expected the addresses of the system resolver")
+	}
+}
+
+type typeResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeResolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"hello"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	r := New("https://dns.example/dns-query", typeResolver{brokenresolver.New()}, brokenresolver.New())
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	r := New("https://dns.example/dns-query", brokenresolver.New(), typeResolver{brokenresolver.New()})
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if !errors.Is(err, errLookupTypeNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type httpsResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsResolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, Target: "."}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	r := New("https://dns.example/dns-query", httpsResolver{brokenresolver.New()}, brokenresolver.New())
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	r := New("https://dns.example/dns-query", brokenresolver.New(), httpsResolver{brokenresolver.New()})
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if !errors.Is(err, errLookupHTTPSNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
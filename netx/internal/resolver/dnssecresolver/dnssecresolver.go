@@ -0,0 +1,534 @@
+// Package dnssecresolver contains a resolver that validates DNSSEC. It
+// is meant to be used on top of a resolver that returns DNSSEC records,
+// e.g., an ooniresolver using DoH or DoT with DNSSEC enabled.
+package dnssecresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+var (
+	// errInsecure indicates that the answer is not signed and that the
+	// parent of its zone proved that the zone is not signed.
+	errInsecure = errors.New("dnssecresolver: insecure answer")
+
+	errMissingSignatures = errors.New("dnssecresolver: missing signatures")
+	errNoDenial          = errors.New("dnssecresolver: no authenticated denial of DS")
+	errNoAddresses       = errors.New("dnssecresolver: no addresses")
+	errNoKeys            = errors.New("dnssecresolver: no DNSKEY records")
+	errNoTrustedKey      = errors.New("dnssecresolver: no trusted DNSKEY")
+	errInvalidSignature  = errors.New("dnssecresolver: invalid signature")
+	errInvalidSigner     = errors.New("dnssecresolver: invalid signer name")
+)
+
+// defaultAnchors contains the DS records of the IANA root zone KSKs
+// (KSK-2017 and KSK-2024), as published at https://data.iana.org/root-anchors/.
+var defaultAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+func newDefaultAnchors() (out []*dns.DS) {
+	for _, s := range defaultAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(err) // the anchors above are hardcoded and valid
+		}
+		out = append(out, rr.(*dns.DS))
+	}
+	return
+}
+
+// Resolver is a resolver that validates DNSSEC.
+type Resolver struct {
+	// Anchors contains the trust anchors, i.e., the DS records of the
+	// root zone keys. New initializes them to the IANA root KSKs.
+	Anchors []*dns.DS
+
+	resolver modelx.DNSResolverWithType
+	timeNow  func() time.Time
+}
+
+// New creates a new Resolver using the specified resolver to query
+// for records. Such resolver must return the DNSSEC records along with
+// the answers, otherwise all signed answers will look bogus.
+func New(resolver modelx.DNSResolverWithType) *Resolver {
+	return &Resolver{
+		Anchors:  newDefaultAnchors(),
+		resolver: resolver,
+		timeNow:  time.Now,
+	}
+}
+
+// LookupAddr returns the name of the provided IP address
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+// LookupCNAME returns the canonical name of a host
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return r.resolver.LookupCNAME(ctx, host)
+}
+
+// LookupHost returns the IP addresses of a host. Like LookupHostDNSSEC,
+// it returns the addresses even if validation fails.
+func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	result, err := r.LookupHostDNSSEC(ctx, hostname)
+	return result.Addresses, err
+}
+
+// LookupHostDNSSEC returns the IP addresses of a host and validates
+// the chain of trust from the root zone down to the A and AAAA answers.
+// When validation fails, we still return the addresses but we mark them
+// as bogus, so that the caller can record the tampering.
+func (r *Resolver) LookupHostDNSSEC(
+	ctx context.Context, hostname string) (modelx.DNSSECResult, error) {
+	var (
+		addrs   []string
+		answers [][]dns.RR
+		errs    []error
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		answer, err := r.resolver.LookupType(ctx, hostname, qtype)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+		}
+		answers = append(answers, answer)
+	}
+	if len(addrs) <= 0 {
+		if len(errs) > 0 {
+			return modelx.DNSSECResult{}, errs[0]
+		}
+		return modelx.DNSSECResult{}, errNoAddresses
+	}
+	result := modelx.DNSSECResult{Addresses: addrs}
+	v := &validator{
+		ctx:      ctx,
+		anchors:  r.Anchors,
+		now:      r.timeNow(),
+		resolver: r.resolver,
+		zones:    make(map[string]zoneEntry),
+	}
+	err := v.validateAnswers(answers)
+	switch {
+	case err == nil:
+		result.Validated = true
+	case errors.Is(err, errInsecure):
+		// nothing to flag
+	default:
+		result.Bogus = true
+	}
+	return result, nil
+}
+
+// LookupType queries for records of type qtype without validation.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return r.resolver.LookupType(ctx, name, qtype)
+}
+
+// errLookupHTTPSNotSupported indicates that the underlying resolver
+// is not able to query for HTTPS records.
+var errLookupHTTPSNotSupported = errors.New("dnssecresolver: LookupHTTPS not supported")
+
+// LookupHTTPS queries for the HTTPS records of name without validation.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	return reso.LookupHTTPS(ctx, name)
+}
+
+// LookupMX returns the MX records of a specific name
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver.LookupMX(ctx, name)
+}
+
+// LookupNS returns the NS records of a specific name
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return r.resolver.LookupNS(ctx, name)
+}
+
+// Close closes the underlying resolver.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
+
+type zoneEntry struct {
+	keys []*dns.DNSKEY
+	err  error
+}
+
+// validator validates the answers of a single lookup. It caches
+// the validated keys of each zone for the duration of the lookup.
+type validator struct {
+	ctx      context.Context
+	anchors  []*dns.DS
+	now      time.Time
+	resolver modelx.DNSResolverWithType
+	zones    map[string]zoneEntry
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// validateAnswers validates every RRset in the answers. It returns nil
+// if all of them are secure, errInsecure if at least one is insecure and
+// none is bogus, and another error if at least one is bogus.
+func (v *validator) validateAnswers(answers [][]dns.RR) error {
+	var insecure bool
+	for _, answer := range answers {
+		rrsets, sigs := splitAnswer(answer)
+		for _, rrset := range rrsets {
+			err := v.validateRRSet(rrset, sigs)
+			if errors.Is(err, errInsecure) {
+				insecure = true
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if insecure {
+		return errInsecure
+	}
+	return nil
+}
+
+// splitAnswer groups the records by owner name and type and separates
+// the signatures from the records they cover.
+func splitAnswer(answer []dns.RR) (rrsets [][]dns.RR, sigs []*dns.RRSIG) {
+	index := make(map[string]int)
+	for _, rr := range answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+		key := canonicalName(rr.Header().Name) + "/" + dns.TypeToString[rr.Header().Rrtype]
+		if idx, found := index[key]; found {
+			rrsets[idx] = append(rrsets[idx], rr)
+			continue
+		}
+		index[key] = len(rrsets)
+		rrsets = append(rrsets, []dns.RR{rr})
+	}
+	return
+}
+
+func coveringSigs(rrset []dns.RR, sigs []*dns.RRSIG) (out []*dns.RRSIG) {
+	header := rrset[0].Header()
+	for _, sig := range sigs {
+		if sig.TypeCovered == header.Rrtype &&
+			canonicalName(sig.Header().Name) == canonicalName(header.Name) {
+			out = append(out, sig)
+		}
+	}
+	return
+}
+
+func (v *validator) validateRRSet(rrset []dns.RR, sigs []*dns.RRSIG) error {
+	owner := canonicalName(rrset[0].Header().Name)
+	covering := coveringSigs(rrset, sigs)
+	if len(covering) <= 0 {
+		return v.unsignedError(owner)
+	}
+	err := errInvalidSignature
+	for _, sig := range covering {
+		signer := canonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, owner) {
+			err = errInvalidSigner
+			continue
+		}
+		keys, kerr := v.zoneKeys(signer)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		if v.verify(sig, keys, rrset) {
+			return nil
+		}
+	}
+	return err
+}
+
+// unsignedError returns errInsecure if name provably belongs to an
+// unsigned zone and another error otherwise. We walk down the chain of
+// trust from the root: a zone is unsigned only if its parent publishes
+// an authenticated denial of its DS records, i.e., validated NSEC or
+// NSEC3 records. Otherwise, an attacker could strip the signatures and
+// the DS records and have the answers accepted as insecure.
+func (v *validator) unsignedError(name string) error {
+	zone := "."
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.Join(labels[i:], "."))
+		answer, authority, err := v.lookupWithAuthority(child, dns.TypeDS)
+		if err != nil {
+			return err
+		}
+		if hasDS(answer) {
+			// We validate these DS records when we need the child's keys.
+			zone = child
+			continue
+		}
+		keys, err := v.zoneKeys(zone)
+		if err != nil {
+			return err
+		}
+		delegation, err := v.deniedDS(zone, keys, child, authority)
+		if err != nil {
+			return err
+		}
+		if delegation {
+			return errInsecure
+		}
+		// The child is not a zone cut, so it still belongs to zone.
+	}
+	return errMissingSignatures
+}
+
+// lookupWithAuthority queries for the records of type qtype and
+// also returns the authority section, if the resolver supports it.
+func (v *validator) lookupWithAuthority(
+	name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	if reso, ok := v.resolver.(modelx.DNSResolverWithAuthority); ok {
+		return reso.LookupTypeWithAuthority(v.ctx, name, qtype)
+	}
+	answer, err := v.resolver.LookupType(v.ctx, name, qtype)
+	return answer, nil, err
+}
+
+func hasDS(answer []dns.RR) bool {
+	for _, rr := range answer {
+		if _, ok := rr.(*dns.DS); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedDS checks whether the authority section contains NSEC or NSEC3
+// records signed by zone proving that child has no DS records. It returns
+// whether child is a delegation, i.e., an unsigned zone, or errNoDenial
+// if there is no such proof. A NSEC3 record with the opt-out flag set
+// covering child also proves that child may be an unsigned delegation.
+func (v *validator) deniedDS(
+	zone string, keys []*dns.DNSKEY, child string, authority []dns.RR) (bool, error) {
+	var (
+		nsecs  []*dns.NSEC
+		nsec3s []*dns.NSEC3
+	)
+	rrsets, sigs := splitAnswer(authority)
+	for _, rrset := range rrsets {
+		if !v.signedBy(zone, keys, rrset, sigs) {
+			continue
+		}
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				nsecs = append(nsecs, rr)
+			case *dns.NSEC3:
+				nsec3s = append(nsec3s, rr)
+			}
+		}
+	}
+	for _, rr := range nsecs {
+		if canonicalName(rr.Header().Name) == child {
+			return delegationWithoutDS(rr.TypeBitMap)
+		}
+	}
+	for _, rr := range nsec3s {
+		if rr.Match(child) {
+			return delegationWithoutDS(rr.TypeBitMap)
+		}
+	}
+	// Since we walk down one label at a time, the closest encloser of
+	// child is its parent and child itself is the next closer name.
+	labels := dns.SplitDomainName(child)
+	parent := dns.Fqdn(strings.Join(labels[1:], "."))
+	for _, encloser := range nsec3s {
+		if !encloser.Match(parent) {
+			continue
+		}
+		for _, rr := range nsec3s {
+			if rr.Flags&nsec3OptOut != 0 && rr.Cover(child) {
+				return true, nil
+			}
+		}
+	}
+	return false, errNoDenial
+}
+
+// nsec3OptOut is the NSEC3 opt-out flag (see RFC 5155).
+const nsec3OptOut = 1
+
+// delegationWithoutDS interprets the type bitmap of the NSEC or NSEC3
+// record matching a name for which we have queried DS records.
+func delegationWithoutDS(bitmap []uint16) (bool, error) {
+	var delegation bool
+	for _, qtype := range bitmap {
+		switch qtype {
+		case dns.TypeDS:
+			return false, errNoDenial
+		case dns.TypeNS:
+			delegation = true
+		}
+	}
+	return delegation, nil
+}
+
+// signedBy returns true if rrset is validly signed by zone using keys.
+func (v *validator) signedBy(
+	zone string, keys []*dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG) bool {
+	for _, sig := range coveringSigs(rrset, sigs) {
+		if canonicalName(sig.SignerName) == zone && v.verify(sig, keys, rrset) {
+			return true
+		}
+	}
+	return false
+}
+
+// zoneKeys returns the validated DNSKEY records of zone.
+func (v *validator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	if entry, found := v.zones[zone]; found {
+		return entry.keys, entry.err
+	}
+	keys, err := v.validateZoneKeys(zone)
+	v.zones[zone] = zoneEntry{keys: keys, err: err}
+	return keys, err
+}
+
+func (v *validator) validateZoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	answer, err := v.resolver.LookupType(v.ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dns.DNSKEY
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+		}
+	}
+	if len(keys) <= 0 {
+		return nil, errNoKeys
+	}
+	trusted, err := v.trustedDS(zone)
+	if err != nil {
+		return nil, err
+	}
+	// The DNSKEY RRset must be signed by a key matching a trusted DS.
+	for _, key := range keys {
+		if !matchesDS(key, trusted) {
+			continue
+		}
+		for _, sig := range coveringSigs(rrset, sigs) {
+			if v.verify(sig, []*dns.DNSKEY{key}, rrset) {
+				return keys, nil
+			}
+		}
+	}
+	return nil, errNoTrustedKey
+}
+
+// trustedDS returns the validated DS records for zone. For the root
+// zone, these are the trust anchors. Otherwise, they are the DS records
+// published by the parent zone, validated using the parent's keys.
+func (v *validator) trustedDS(zone string) ([]*dns.DS, error) {
+	if zone == "." {
+		return v.anchors, nil
+	}
+	answer, err := v.resolver.LookupType(v.ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+	var records []*dns.DS
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range answer {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			records = append(records, rr)
+			rrset = append(rrset, rr)
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+		}
+	}
+	if len(records) <= 0 {
+		// The zone is signed but its parent may not vouch for it, in
+		// which case this is an island of security that we cannot
+		// validate. We accept that only with an authenticated denial.
+		return nil, v.unsignedError(zone)
+	}
+	err = errInvalidSignature
+	for _, sig := range coveringSigs(rrset, sigs) {
+		signer := canonicalName(sig.SignerName)
+		// The DS RRset is signed by the parent zone, which must be a
+		// strict ancestor of the zone. This also bounds the recursion.
+		if signer == zone || !dns.IsSubDomain(signer, zone) {
+			err = errInvalidSigner
+			continue
+		}
+		keys, kerr := v.zoneKeys(signer)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		if v.verify(sig, keys, rrset) {
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+func matchesDS(key *dns.DNSKEY, trusted []*dns.DS) bool {
+	for _, ds := range trusted {
+		if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+			continue
+		}
+		computed := key.ToDS(ds.DigestType)
+		if computed != nil && strings.EqualFold(computed.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// verify returns true if sig is currently valid and any of the keys
+// with the same key tag verifies it over rrset.
+func (v *validator) verify(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) bool {
+	if !sig.ValidityPeriod(v.now) {
+		return false
+	}
+	for _, key := range keys {
+		if key.KeyTag() == sig.KeyTag && sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+	return false
+}
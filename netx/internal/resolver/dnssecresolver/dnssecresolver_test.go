@@ -0,0 +1,348 @@
+package dnssecresolver
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/systemresolver"
+)
+
+// fakeresolver serves records from maps indexed by name and type.
+type fakeresolver struct {
+	*systemresolver.Resolver
+	authority map[string][]dns.RR
+	records   map[string][]dns.RR
+	err       error
+}
+
+func newfakeresolver() *fakeresolver {
+	return &fakeresolver{
+		Resolver:  systemresolver.New(new(net.Resolver)),
+		authority: make(map[string][]dns.RR),
+		records:   make(map[string][]dns.RR),
+	}
+}
+
+func fakekey(name string, qtype uint16) string {
+	return canonicalName(name) + "/" + dns.TypeToString[qtype]
+}
+
+func (r *fakeresolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.records[fakekey(name, qtype)], nil
+}
+
+func (r *fakeresolver) LookupTypeWithAuthority(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	key := fakekey(name, qtype)
+	return r.records[key], r.authority[key], nil
+}
+
+func (r *fakeresolver) add(name string, qtype uint16, rrs ...dns.RR) {
+	r.records[fakekey(name, qtype)] = append(r.records[fakekey(name, qtype)], rrs...)
+}
+
+func (r *fakeresolver) addAuthority(name string, qtype uint16, rrs ...dns.RR) {
+	r.authority[fakekey(name, qtype)] = append(r.authority[fakekey(name, qtype)], rrs...)
+}
+
+type zone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	name string
+}
+
+func newzone(t *testing.T, name string) *zone {
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600,
+		},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &zone{key: key, priv: priv.(crypto.Signer), name: name}
+}
+
+func (z *zone) sign(t *testing.T, rrset ...dns.RR) *dns.RRSIG {
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		Expiration: uint32(now.Add(24 * time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newNSEC(name, next string, bitmap ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600,
+		},
+		NextDomain: next,
+		TypeBitMap: bitmap,
+	}
+}
+
+// newNSEC3 returns a NSEC3 record of zone matching name, using no salt
+// and no additional iterations. When next is equal to name, the record
+// covers all the other names in the zone.
+func newNSEC3(zone, name, next string, flags uint8, bitmap ...uint16) *dns.NSEC3 {
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   dns.HashName(name, dns.SHA1, 0, "") + "." + zone,
+			Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600,
+		},
+		Hash:       dns.SHA1,
+		Flags:      flags,
+		HashLength: 20,
+		NextDomain: dns.HashName(next, dns.SHA1, 0, ""),
+		TypeBitMap: bitmap,
+	}
+}
+
+func newA(name, address string) *dns.A {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300,
+		},
+		A: net.ParseIP(address),
+	}
+}
+
+// newfixture creates a signed hierarchy consisting of the root zone,
+// com. and example.com., where www.example.com. has a signed A record
+// and example.com. proves that www.example.com. has no DS records. The
+// parent zones also prove that org., insecure.com. and optout.com. are
+// unsigned delegations, the latter two using NSEC3.
+func newfixture(t *testing.T) (*Resolver, *fakeresolver, *zone) {
+	reso := newfakeresolver()
+	root, com, example := newzone(t, "."), newzone(t, "com."), newzone(t, "example.com.")
+	for _, z := range []*zone{root, com, example} {
+		reso.add(z.name, dns.TypeDNSKEY, z.key, z.sign(t, z.key))
+	}
+	comDS := com.key.ToDS(dns.SHA256)
+	reso.add("com.", dns.TypeDS, comDS, root.sign(t, comDS))
+	exampleDS := example.key.ToDS(dns.SHA256)
+	reso.add("example.com.", dns.TypeDS, exampleDS, com.sign(t, exampleDS))
+	record := newA("www.example.com.", "93.184.216.34")
+	reso.add("www.example.com.", dns.TypeA, record, example.sign(t, record))
+	nsec := newNSEC("www.example.com.", "example.com.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)
+	reso.addAuthority("www.example.com.", dns.TypeDS, nsec, example.sign(t, nsec))
+	nsec = newNSEC("org.", "zz.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)
+	reso.addAuthority("org.", dns.TypeDS, nsec, root.sign(t, nsec))
+	nsec3 := newNSEC3("com.", "insecure.com.", "zz.com.", 0, dns.TypeNS)
+	reso.addAuthority("insecure.com.", dns.TypeDS, nsec3, com.sign(t, nsec3))
+	nsec3 = newNSEC3("com.", "com.", "com.", nsec3OptOut, dns.TypeNS, dns.TypeSOA)
+	reso.addAuthority("optout.com.", dns.TypeDS, nsec3, com.sign(t, nsec3))
+	r := New(reso)
+	r.Anchors = []*dns.DS{root.key.ToDS(dns.SHA256)}
+	return r, reso, example
+}
+
+func TestUnitValidated(t *testing.T) {
+	r, _, _ := newfixture(t)
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Validated || result.Bogus || result.Unsupported {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if len(result.Addresses) != 1 || result.Addresses[0] != "93.184.216.34" {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitTamperedAnswer(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	key := fakekey("www.example.com.", dns.TypeA)
+	reso.records[key][0].(*dns.A).A = net.ParseIP("10.10.34.35")
+	addrs, err := r.LookupHost(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.10.34.35" {
+		t.Fatal("expected the tampered address to be returned")
+	}
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitStrippedSignatures(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	key := fakekey("www.example.com.", dns.TypeA)
+	reso.records[key] = reso.records[key][:1]
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitUnsignedZone(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	reso.add("www.example.org.", dns.TypeA, newA("www.example.org.", "10.0.0.1"))
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitUnsignedZoneNSEC3(t *testing.T) {
+	for _, domain := range []string{"insecure.com", "optout.com"} {
+		r, reso, _ := newfixture(t)
+		reso.add("www."+domain+".", dns.TypeA, newA("www."+domain+".", "10.0.0.1"))
+		result, err := r.LookupHostDNSSEC(context.Background(), "www."+domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Validated || result.Bogus {
+			t.Fatalf("%s: unexpected result: %+v", domain, result)
+		}
+	}
+}
+
+func TestUnitStrippedSignaturesAndDS(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	key := fakekey("www.example.com.", dns.TypeA)
+	reso.records[key] = reso.records[key][:1]
+	delete(reso.records, fakekey("example.com.", dns.TypeDS))
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitForgedDenial(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	key := fakekey("www.example.com.", dns.TypeA)
+	reso.records[key] = reso.records[key][:1]
+	delete(reso.records, fakekey("example.com.", dns.TypeDS))
+	forged := newzone(t, "com.")
+	nsec := newNSEC("example.com.", "zz.com.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)
+	reso.addAuthority("example.com.", dns.TypeDS, nsec, forged.sign(t, nsec))
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitDeniedDSWithDSInBitmap(t *testing.T) {
+	delegation, err := delegationWithoutDS([]uint16{dns.TypeNS, dns.TypeDS})
+	if !errors.Is(err, errNoDenial) {
+		t.Fatal("not the error we expected")
+	}
+	if delegation {
+		t.Fatal("expected no delegation here")
+	}
+}
+
+func TestUnitUntrustedAnchor(t *testing.T) {
+	r, _, example := newfixture(t)
+	r.Anchors = []*dns.DS{example.key.ToDS(dns.SHA256)}
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitExpiredSignatures(t *testing.T) {
+	r, _, _ := newfixture(t)
+	r.timeNow = func() time.Time {
+		return time.Now().Add(48 * time.Hour)
+	}
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Validated || !result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitLookupFailure(t *testing.T) {
+	r, reso, _ := newfixture(t)
+	expected := errors.New("mocked error")
+	reso.err = expected
+	result, err := r.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+	if result.Addresses != nil {
+		t.Fatal("expected nil addresses")
+	}
+}
+
+func TestUnitNoAddresses(t *testing.T) {
+	r, _, _ := newfixture(t)
+	_, err := r.LookupHostDNSSEC(context.Background(), "nonexistent.example.com")
+	if !errors.Is(err, errNoAddresses) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitDefaultAnchors(t *testing.T) {
+	anchors := newDefaultAnchors()
+	if len(anchors) != len(defaultAnchors) {
+		t.Fatal("unexpected number of anchors")
+	}
+	for _, anchor := range anchors {
+		if anchor.Header().Name != "." || anchor.DigestType != dns.SHA256 {
+			t.Fatal("unexpected anchor")
+		}
+	}
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	// The fake resolver is based on the system resolver, which does
+	// not support HTTPS records, hence we expect its error.
+	r := New(newfakeresolver())
+	records, err := r.LookupHTTPS(context.Background(), "www.example.com")
+	if !errors.Is(err, systemresolver.ErrUnsupportedType) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
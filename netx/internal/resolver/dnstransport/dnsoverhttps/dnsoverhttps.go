@@ -4,35 +4,64 @@ package dnsoverhttps
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
+// urlTemplateSuffix is the suffix of the URI template of a DoH
+// server that accepts GET requests (RFC8484 Sect. 3).
+const urlTemplateSuffix = "{?dns}"
+
+// ErrUnsupportedMethod indicates that the HTTP method is neither
+// GET nor POST, which are the methods defined by RFC8484.
+var ErrUnsupportedMethod = errors.New("doh: unsupported HTTP method")
+
 // Transport is a DNS over HTTPS modelx.DNSRoundTripper.
 //
 // As a known bug, this implementation does not cache the domain
 // name in the URL for reuse, but this should be easy to fix.
 type Transport struct {
 	clientDo func(req *http.Request) (*http.Response, error)
+	method   string
 	url      string
 }
 
-// NewTransport creates a new Transport
+// NewTransport creates a new Transport using the POST method.
 func NewTransport(client *http.Client, URL string) *Transport {
 	return &Transport{
 		clientDo: client.Do,
+		method:   "POST",
 		url:      URL,
 	}
 }
 
+// NewTransportWithMethod creates a new Transport using the specified
+// HTTP method, which must be either "GET" or "POST". We recommend using
+// POST, because the queries are not cached and they do not appear in
+// the URL, but some servers only support GET. Also, some censors may
+// treat the two methods differently. The URL may be a URI template
+// ending with "{?dns}", as specified by RFC8484.
+func NewTransportWithMethod(
+	client *http.Client, URL, method string) (*Transport, error) {
+	if method != "GET" && method != "POST" {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, method)
+	}
+	txp := NewTransport(client, URL)
+	txp.method = method
+	return txp, nil
+}
+
 // RoundTrip sends a request and receives a response.
 func (t *Transport) RoundTrip(ctx context.Context, query []byte) (reply []byte, err error) {
-	req, err := http.NewRequest("POST", t.url, bytes.NewReader(query))
+	req, err := t.newRequest(query)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("content-type", "application/dns-message")
 	var resp *http.Response
 	resp, err = t.clientDo(req.WithContext(ctx))
 	if err != nil {
@@ -53,6 +82,31 @@ func (t *Transport) RoundTrip(ctx context.Context, query []byte) (reply []byte,
 	return
 }
 
+func (t *Transport) newRequest(query []byte) (*http.Request, error) {
+	URL := strings.TrimSuffix(t.url, urlTemplateSuffix)
+	if t.method == "GET" {
+		parsed, err := url.Parse(URL)
+		if err != nil {
+			return nil, err
+		}
+		values := parsed.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		parsed.RawQuery = values.Encode()
+		req, err := http.NewRequest("GET", parsed.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("accept", "application/dns-message")
+		return req, nil
+	}
+	req, err := http.NewRequest("POST", URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/dns-message")
+	return req, nil
+}
+
 // RequiresPadding returns true for DoH according to RFC8467
 func (t *Transport) RequiresPadding() bool {
 	return true
@@ -63,7 +117,13 @@ func (t *Transport) Network() string {
 	return "doh"
 }
 
-// Address returns the upstream server address.
+// Address returns the upstream server address, i.e., the URL or
+// the URI template that was used to create the transport.
 func (t *Transport) Address() string {
 	return t.url
 }
+
+// Method returns the HTTP method, i.e., either "GET" or "POST".
+func (t *Transport) Method() string {
+	return t.method
+}
@@ -2,9 +2,12 @@ package dnsoverhttps
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
@@ -112,3 +115,101 @@ func roundTrip(transport *Transport, domain string) error {
 	}
 	return query.Unpack(data)
 }
+
+// newServer returns a DoH server that replies to A queries with
+// 1.2.3.4 and saves the method used by the client.
+func newServer(t *testing.T, method *string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			*method = r.Method
+			var (
+				data []byte
+				err  error
+			)
+			switch r.Method {
+			case "GET":
+				if r.Header.Get("accept") != "application/dns-message" {
+					w.WriteHeader(400)
+					return
+				}
+				data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			case "POST":
+				if r.Header.Get("content-type") != "application/dns-message" {
+					w.WriteHeader(400)
+					return
+				}
+				data, err = ioutil.ReadAll(r.Body)
+			}
+			query := new(dns.Msg)
+			if err != nil || query.Unpack(data) != nil {
+				w.WriteHeader(400)
+				return
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(query)
+			reply.Answer = append(reply.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name: query.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET,
+				},
+				A: net.IPv4(1, 2, 3, 4),
+			})
+			data, err = reply.Pack()
+			if err != nil {
+				w.WriteHeader(500)
+				return
+			}
+			w.Header().Set("content-type", "application/dns-message")
+			w.Write(data)
+		}))
+}
+
+func TestUnitMethods(t *testing.T) {
+	for _, method := range []string{"GET", "POST"} {
+		var seen string
+		server := newServer(t, &seen)
+		defer server.Close()
+		for _, URL := range []string{server.URL, server.URL + "/dns-query{?dns}"} {
+			transport, err := NewTransportWithMethod(http.DefaultClient, URL, method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transport.Method() != method || transport.Address() != URL {
+				t.Fatal("unexpected method or address")
+			}
+			if err := roundTrip(transport, "ooni.io."); err != nil {
+				t.Fatal(err)
+			}
+			if seen != method {
+				t.Fatal("the server saw an unexpected method")
+			}
+		}
+	}
+}
+
+func TestUnitDefaultMethod(t *testing.T) {
+	transport := NewTransport(http.DefaultClient, "https://dns.google/dns-query")
+	if transport.Method() != "POST" {
+		t.Fatal("expected POST to be the default")
+	}
+}
+
+func TestUnitUnsupportedMethod(t *testing.T) {
+	transport, err := NewTransportWithMethod(
+		http.DefaultClient, "https://dns.google/dns-query", "PUT")
+	if !errors.Is(err, ErrUnsupportedMethod) {
+		t.Fatal("not the error we expected")
+	}
+	if transport != nil {
+		t.Fatal("expected nil transport here")
+	}
+}
+
+func TestUnitGETInvalidURL(t *testing.T) {
+	transport, err := NewTransportWithMethod(http.DefaultClient, "\t", "GET")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(transport, "ooni.io."); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
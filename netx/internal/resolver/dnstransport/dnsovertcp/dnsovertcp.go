@@ -7,6 +7,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/ooni/probe-engine/internal/runtimex"
@@ -15,14 +16,29 @@ import (
 
 // Transport is a DNS over TCP/TLS modelx.DNSRoundTripper.
 //
-// As a known bug, this implementation always creates a new connection
-// for each incoming query, thus increasing the response delay.
+// By default, this implementation creates a new connection for each
+// incoming query, thus increasing the response delay. Set IdleTimeout
+// to reuse connections. Each connection serves a query at a time, so
+// concurrent queries use distinct connections.
 type Transport struct {
+	// IdleTimeout is the time after which we close a connection that we
+	// are not using. When zero, we do not reuse connections.
+	IdleTimeout time.Duration
+
 	dialer          dialerAdapter
 	address         string
+	closed          bool
+	idle            []idleConn
+	mu              sync.Mutex
+	reaper          *time.Timer
 	requiresPadding bool
 }
 
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
 type dialerAdapter interface {
 	modelx.Dialer
 	Network() string
@@ -48,12 +64,96 @@ func NewTransportTLS(dialer modelx.TLSDialer, address string) *Transport {
 
 // RoundTrip sends a request and receives a response.
 func (t *Transport) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	if conn := t.getIdle(); conn != nil {
+		reply, err := t.doWithConn(conn, query)
+		if err == nil {
+			t.putIdle(conn)
+			return reply, nil
+		}
+		// The server may have closed the connection while it was
+		// idle, so let us retry using a new connection.
+		conn.Close()
+	}
 	conn, err := t.dialer.DialContext(ctx, "tcp", t.address)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	return t.doWithConn(conn, query)
+	reply, err := t.doWithConn(conn, query)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.putIdle(conn)
+	return reply, nil
+}
+
+// Close closes the idle connections. The connections in use are closed
+// when the corresponding queries complete, because we do not reuse
+// connections after Close. It is safe to call Close more than once.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.reaper != nil {
+		t.reaper.Stop()
+		t.reaper = nil
+	}
+	for _, c := range t.idle {
+		c.Close()
+	}
+	t.idle = nil
+	return nil
+}
+
+// getIdle returns the most recently used idle connection, if any.
+func (t *Transport) getIdle() net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.idle) <= 0 {
+		return nil
+	}
+	c := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+	return c.Conn
+}
+
+// putIdle adds conn to the idle connections, if we reuse connections,
+// and otherwise closes it. The reaper closes the idle connections once
+// they have been idle for IdleTimeout.
+func (t *Transport) putIdle(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.IdleTimeout <= 0 || t.closed {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, idleConn{Conn: conn, since: time.Now()})
+	if t.reaper == nil {
+		t.reaper = time.AfterFunc(t.IdleTimeout, t.reap)
+	}
+}
+
+// reap closes the expired idle connections and, if there are still idle
+// connections, schedules itself to run when the oldest one expires.
+func (t *Transport) reap() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reaper = nil
+	now := time.Now()
+	var idle []idleConn
+	for _, c := range t.idle {
+		if now.Sub(c.since) >= t.IdleTimeout {
+			c.Close()
+			continue
+		}
+		idle = append(idle, c)
+	}
+	t.idle = idle
+	if len(t.idle) > 0 && !t.closed {
+		// The oldest connection is the first, since we append.
+		t.reaper = time.AfterFunc(
+			t.IdleTimeout-now.Sub(t.idle[0].since), t.reap)
+	}
 }
 
 // RequiresPadding returns true for DoT and false for TCP
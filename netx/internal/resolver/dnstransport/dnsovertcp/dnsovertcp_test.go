@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -190,3 +192,142 @@ func (d *fakeTLSDialer) DialTLSContext(
 	d.calledDialTLSContext = true
 	return nil, errors.New("mocked error")
 }
+
+// echoServer is a DNS over TCP server replying with the query. It
+// records the number of accepted connections and signals on closed
+// each time a client closes a connection.
+type echoServer struct {
+	accepted int
+	closed   chan struct{}
+	listener net.Listener
+	mu       sync.Mutex
+	oneReply bool // close the connection after the first reply
+}
+
+func newEchoServer(t *testing.T, oneReply bool) *echoServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &echoServer{
+		closed: make(chan struct{}, 16), listener: listener, oneReply: oneReply,
+	}
+	go srv.serve()
+	return srv
+}
+
+func (srv *echoServer) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		srv.accepted++
+		srv.mu.Unlock()
+		go srv.handle(conn)
+	}
+}
+
+func (srv *echoServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			srv.closed <- struct{}{}
+			return
+		}
+		query := make([]byte, int(header[0])<<8|int(header[1]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if _, err := conn.Write(append(header, query...)); err != nil {
+			return
+		}
+		if srv.oneReply {
+			return
+		}
+	}
+}
+
+func (srv *echoServer) numAccepted() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.accepted
+}
+
+func (srv *echoServer) waitClosed(t *testing.T) {
+	select {
+	case <-srv.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client did not close the connection")
+	}
+}
+
+func TestUnitNoReuseByDefault(t *testing.T) {
+	srv := newEchoServer(t, false)
+	defer srv.listener.Close()
+	transport := NewTransportTCP(&net.Dialer{}, srv.listener.Addr().String())
+	if err := threeRounds(transport); err != nil {
+		t.Fatal(err)
+	}
+	if srv.numAccepted() != 3 {
+		t.Fatal("expected a connection for each query")
+	}
+}
+
+func TestUnitReuseAndClose(t *testing.T) {
+	srv := newEchoServer(t, false)
+	defer srv.listener.Close()
+	transport := NewTransportTCP(&net.Dialer{}, srv.listener.Addr().String())
+	transport.IdleTimeout = time.Hour
+	if err := threeRounds(transport); err != nil {
+		t.Fatal(err)
+	}
+	if srv.numAccepted() != 1 {
+		t.Fatal("expected to reuse the connection")
+	}
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.waitClosed(t)
+	if err := transport.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(transport, "ooni.io."); err != nil {
+		t.Fatal(err)
+	}
+	srv.waitClosed(t) // we don't reuse connections after Close
+}
+
+func TestUnitReaperClosesIdleConnections(t *testing.T) {
+	srv := newEchoServer(t, false)
+	defer srv.listener.Close()
+	transport := NewTransportTCP(&net.Dialer{}, srv.listener.Addr().String())
+	transport.IdleTimeout = 50 * time.Millisecond
+	if err := roundTrip(transport, "ooni.io."); err != nil {
+		t.Fatal(err)
+	}
+	srv.waitClosed(t)
+	if err := roundTrip(transport, "ooni.io."); err != nil {
+		t.Fatal(err)
+	}
+	if srv.numAccepted() != 2 {
+		t.Fatal("expected a new connection after the idle timeout")
+	}
+	transport.Close()
+}
+
+func TestUnitRetryWhenIdleConnectionWasClosed(t *testing.T) {
+	srv := newEchoServer(t, true)
+	defer srv.listener.Close()
+	transport := NewTransportTCP(&net.Dialer{}, srv.listener.Addr().String())
+	transport.IdleTimeout = time.Hour
+	defer transport.Close()
+	if err := threeRounds(transport); err != nil {
+		t.Fatal(err)
+	}
+	if srv.numAccepted() != 3 {
+		t.Fatal("expected a new connection for each query")
+	}
+}
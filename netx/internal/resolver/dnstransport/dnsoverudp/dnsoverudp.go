@@ -5,6 +5,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/ooni/probe-engine/netx/internal/resolver/dnstransport/dnsovertcp"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -22,8 +23,22 @@ func NewTransport(dialer modelx.Dialer, address string) *Transport {
 	}
 }
 
-// RoundTrip sends a request and receives a response.
-func (t *Transport) RoundTrip(ctx context.Context, query []byte) (reply []byte, err error) {
+// RoundTrip sends a request and receives a response. When the response
+// is truncated, we retry the query using TCP, as mandated by RFC7766.
+func (t *Transport) RoundTrip(ctx context.Context, query []byte) ([]byte, error) {
+	reply, err := t.roundTripUDP(ctx, query)
+	if err == nil && truncated(reply) {
+		return dnsovertcp.NewTransportTCP(t.dialer, t.address).RoundTrip(ctx, query)
+	}
+	return reply, err
+}
+
+// truncated returns whether the TC bit of the reply is set.
+func truncated(reply []byte) bool {
+	return len(reply) > 2 && (reply[2]&0x02) != 0
+}
+
+func (t *Transport) roundTripUDP(ctx context.Context, query []byte) (reply []byte, err error) {
 	conn, err := t.dialer.DialContext(ctx, "udp", t.address)
 	if err != nil {
 		return
@@ -1,8 +1,11 @@
 package dnsoverudp
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 	"testing"
 	"time"
@@ -75,6 +78,106 @@ func TestIntegrationWriteError(t *testing.T) {
 	}
 }
 
+func TestUnitTruncatedFallsBackToTCP(t *testing.T) {
+	// Header with ID 0x1234, QR|TC, and no records.
+	truncatedReply := []byte{
+		0x12, 0x34, 0x82, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	// Header with ID 0x1234, QR, one question, and one answer, followed
+	// by the question and by an A record for example.com.
+	fullReply := []byte{
+		0x12, 0x34, 0x80, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x0e, 0x10,
+		0x00, 0x04, 93, 184, 216, 34,
+	}
+	address, tcpQueries := startServers(t, truncatedReply, fullReply)
+	transport := NewTransport(&net.Dialer{}, address)
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := transport.RoundTrip(context.Background(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, fullReply) {
+		t.Fatal("not the reply we expected")
+	}
+	if !bytes.Equal(<-tcpQueries, data) {
+		t.Fatal("not the query we expected")
+	}
+	var msg dns.Msg
+	if err := msg.Unpack(reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Fatal("unexpected answer")
+	}
+}
+
+func TestUnitTruncated(t *testing.T) {
+	if truncated(nil) {
+		t.Fatal("an empty reply cannot be truncated")
+	}
+	if truncated([]byte{0x12, 0x34, 0x80}) {
+		t.Fatal("expected the reply not to be truncated")
+	}
+	if !truncated([]byte{0x12, 0x34, 0x82}) {
+		t.Fatal("expected the reply to be truncated")
+	}
+}
+
+// startServers starts UDP and TCP DNS servers listening on the same
+// local port, which reply to any query with udpReply and tcpReply,
+// respectively. It returns the servers address and a channel where we
+// post the queries received using TCP.
+func startServers(t *testing.T, udpReply, tcpReply []byte) (string, <-chan []byte) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	pconn, err := net.ListenPacket("udp", listener.Addr().String())
+	if err != nil {
+		t.Skip("cannot listen for UDP on the same port: ", err)
+	}
+	t.Cleanup(func() { pconn.Close() })
+	go func() {
+		buffer := make([]byte, 1<<10)
+		for {
+			_, addr, err := pconn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			pconn.WriteTo(udpReply, addr)
+		}
+	}()
+	queries := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		queries <- query
+		binary.Write(conn, binary.BigEndian, uint16(len(tcpReply)))
+		conn.Write(tcpReply)
+	}()
+	return listener.Addr().String(), queries
+}
+
 func threeRounds(transport *Transport) error {
 	err := roundTrip(transport, "ooni.io.")
 	if err != nil {
@@ -0,0 +1,136 @@
+package ooniresolver
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// typeHTTPS is the HTTPS record type. We define it here because the
+// version of miekg/dns we're using does not know about this type, so
+// that HTTPS records are returned as unknown records (RFC3597).
+const typeHTTPS = 65
+
+// The SvcParamKeys we know how to parse.
+const (
+	svcParamALPN     = 1
+	svcParamPort     = 3
+	svcParamIPv4Hint = 4
+	svcParamECH      = 5
+	svcParamIPv6Hint = 6
+)
+
+// errInvalidHTTPS indicates that a HTTPS record is malformed.
+var errInvalidHTTPS = errors.New("ooniresolver: invalid HTTPS record")
+
+// LookupHTTPS queries for the HTTPS records of name.
+func (c *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reply, err := c.roundTripWithRetry(ctx, name, typeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	return httpsRecords(reply.Answer)
+}
+
+// httpsRecords parses the HTTPS records in answers, skipping the
+// records of other types, e.g., CNAMEs.
+func httpsRecords(answers []dns.RR) ([]modelx.HTTPSRecord, error) {
+	var records []modelx.HTTPSRecord
+	for _, answer := range answers {
+		unknown, ok := answer.(*dns.RFC3597)
+		if !ok || unknown.Hdr.Rrtype != typeHTTPS {
+			continue
+		}
+		rdata, err := hex.DecodeString(unknown.Rdata)
+		if err != nil {
+			return nil, err
+		}
+		record, err := parseHTTPS(rdata)
+		if err != nil {
+			return nil, err
+		}
+		raw := make([]byte, dns.Len(answer))
+		off, err := dns.PackRR(answer, raw, 0, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		record.Raw = raw[:off]
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// parseHTTPS parses the rdata of a HTTPS record.
+func parseHTTPS(rdata []byte) (record modelx.HTTPSRecord, err error) {
+	if len(rdata) < 2 {
+		return record, errInvalidHTTPS
+	}
+	record.Priority = binary.BigEndian.Uint16(rdata)
+	// The target name MUST NOT be compressed, hence we can unpack
+	// it without having access to the whole message.
+	var off int
+	record.Target, off, err = dns.UnpackDomainName(rdata, 2)
+	if err != nil {
+		return record, errInvalidHTTPS
+	}
+	for off < len(rdata) {
+		if len(rdata)-off < 4 {
+			return record, errInvalidHTTPS
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if len(rdata)-off < length {
+			return record, errInvalidHTTPS
+		}
+		if err = parseSvcParam(&record, key, rdata[off:off+length]); err != nil {
+			return record, err
+		}
+		off += length
+	}
+	return record, nil
+}
+
+// parseSvcParam parses a SvcParam value and stores it into record. We
+// ignore the keys we don't know, as mandated by the specification.
+func parseSvcParam(record *modelx.HTTPSRecord, key uint16, value []byte) error {
+	switch key {
+	case svcParamALPN:
+		for len(value) > 0 {
+			length := int(value[0])
+			if len(value)-1 < length || length == 0 {
+				return errInvalidHTTPS
+			}
+			record.ALPN = append(record.ALPN, string(value[1:1+length]))
+			value = value[1+length:]
+		}
+	case svcParamPort:
+		if len(value) != 2 {
+			return errInvalidHTTPS
+		}
+		record.Port = binary.BigEndian.Uint16(value)
+	case svcParamIPv4Hint:
+		if len(value) == 0 || len(value)%net.IPv4len != 0 {
+			return errInvalidHTTPS
+		}
+		for ; len(value) > 0; value = value[net.IPv4len:] {
+			record.IPv4Hint = append(record.IPv4Hint, net.IP(value[:net.IPv4len]).String())
+		}
+	case svcParamECH:
+		record.ECHConfig = append([]byte{}, value...)
+	case svcParamIPv6Hint:
+		if len(value) == 0 || len(value)%net.IPv6len != 0 {
+			return errInvalidHTTPS
+		}
+		for ; len(value) > 0; value = value[net.IPv6len:] {
+			record.IPv6Hint = append(record.IPv6Hint, net.IP(value[:net.IPv6len]).String())
+		}
+	}
+	return nil
+}
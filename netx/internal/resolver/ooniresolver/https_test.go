@@ -0,0 +1,154 @@
+package ooniresolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// httpsRdata is the wire format of a HTTPS record with priority 1, the
+// root target, and all the SvcParamKeys that we know how to parse plus
+// an unknown key, which we should ignore.
+var httpsRdata = []byte{
+	0, 1, // priority
+	0,                                    // target
+	0, 1, 0, 6, 2, 'h', '3', 2, 'h', '2', // alpn
+	0, 3, 0, 2, 1, 187, // port
+	0, 4, 0, 8, 1, 2, 3, 4, 5, 6, 7, 8, // ipv4hint
+	0, 5, 0, 3, 0xaa, 0xbb, 0xcc, // ech
+	0, 6, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, // ipv6hint
+	0, 99, 0, 1, 0, // unknown
+}
+
+func TestUnitParseHTTPS(t *testing.T) {
+	record, err := parseHTTPS(httpsRdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Priority != 1 || record.Target != "." || record.Port != 443 {
+		t.Fatal("unexpected priority, target or port")
+	}
+	if len(record.ALPN) != 2 || record.ALPN[0] != "h3" || record.ALPN[1] != "h2" {
+		t.Fatal("unexpected ALPN")
+	}
+	if len(record.IPv4Hint) != 2 || record.IPv4Hint[1] != "5.6.7.8" {
+		t.Fatal("unexpected IPv4Hint")
+	}
+	if len(record.IPv6Hint) != 1 || record.IPv6Hint[0] != "::1" {
+		t.Fatal("unexpected IPv6Hint")
+	}
+	if !bytes.Equal(record.ECHConfig, []byte{0xaa, 0xbb, 0xcc}) {
+		t.Fatal("unexpected ECHConfig")
+	}
+}
+
+func TestUnitParseHTTPSAlias(t *testing.T) {
+	rdata := []byte{0, 0, 3, 'c', 'd', 'n', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0}
+	record, err := parseHTTPS(rdata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Priority != 0 || record.Target != "cdn.example." {
+		t.Fatal("unexpected alias record")
+	}
+}
+
+func TestUnitParseHTTPSInvalid(t *testing.T) {
+	for _, rdata := range [][]byte{
+		{0},                               // too short for the priority
+		{0, 1, 5, 'a'},                    // truncated target
+		{0, 1, 0, 0, 1},                   // truncated key
+		{0, 1, 0, 0, 1, 0, 4, 'h'},        // truncated value
+		{0, 1, 0, 0, 1, 0, 2, 2, 'h'},     // truncated alpn
+		{0, 1, 0, 0, 1, 0, 1, 0},          // empty alpn
+		{0, 1, 0, 0, 3, 0, 1, 1},          // invalid port
+		{0, 1, 0, 0, 4, 0, 3, 1, 2, 3},    // invalid ipv4hint
+		{0, 1, 0, 0, 6, 0, 4, 0, 0, 0, 1}, // invalid ipv6hint
+	} {
+		if _, err := parseHTTPS(rdata); err != errInvalidHTTPS {
+			t.Fatalf("not the error we expected for %v: %+v", rdata, err)
+		}
+	}
+}
+
+// httpstransport replies to HTTPS queries with a CNAME followed by
+// an HTTPS record using the wire format in rdata.
+type httpstransport struct {
+	rdata []byte
+}
+
+func (t *httpstransport) RoundTrip(
+	ctx context.Context, query []byte,
+) (reply []byte, err error) {
+	qmsg := new(dns.Msg)
+	if err := qmsg.Unpack(query); err != nil {
+		return nil, err
+	}
+	rmsg := new(dns.Msg)
+	rmsg.SetReply(qmsg)
+	rmsg.Answer = append(rmsg.Answer, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET,
+		},
+		Target: "edge.example.org.",
+	}, &dns.RFC3597{
+		Hdr: dns.RR_Header{
+			Name: "edge.example.org.", Rrtype: typeHTTPS, Class: dns.ClassINET, Ttl: 300,
+		},
+		Rdata: hex.EncodeToString(t.rdata),
+	})
+	return rmsg.Pack()
+}
+
+func (t *httpstransport) RequiresPadding() bool {
+	return false
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	client := New(&httpstransport{rdata: httpsRdata})
+	records, err := client.LookupHTTPS(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+	if len(records[0].ALPN) != 2 || records[0].Port != 443 {
+		t.Fatal("unexpected record")
+	}
+	rr, _, err := dns.UnpackRR(records[0].Raw, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Header().Name != "edge.example.org." || rr.Header().Rrtype != typeHTTPS {
+		t.Fatal("unexpected raw record")
+	}
+	if !bytes.HasSuffix(records[0].Raw, httpsRdata) {
+		t.Fatal("the raw record should contain the rdata")
+	}
+}
+
+func TestUnitLookupHTTPSInvalid(t *testing.T) {
+	client := New(&httpstransport{rdata: []byte{0, 1, 0, 0, 3, 0, 1, 1}})
+	records, err := client.LookupHTTPS(context.Background(), "www.example.com")
+	if err != errInvalidHTTPS {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+func TestUnitLookupHTTPSFailure(t *testing.T) {
+	client := New(&faketransport{})
+	records, err := client.LookupHTTPS(context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
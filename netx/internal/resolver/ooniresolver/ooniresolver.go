@@ -4,6 +4,7 @@ package ooniresolver
 import (
 	"context"
 	"errors"
+	"io"
 	"net"
 	"time"
 
@@ -17,6 +18,23 @@ import (
 // manually create and submit queries. It can use all the transports
 // for DNS supported by this library, however.
 type Resolver struct {
+	// DNSSEC indicates that we should always send the EDNS0 OPT record
+	// with the DO bit set, so that replies include DNSSEC records. By
+	// default, we only send EDNS0 with ECS or when padding is required.
+	DNSSEC bool
+
+	// ECSPrefix is the optional EDNS Client Subnet (RFC7871) prefix
+	// to send along with queries. When nil, we don't send ECS, unless
+	// ECSFromVantagePoint is set.
+	ECSPrefix *net.IPNet
+
+	// ECSFromVantagePoint causes us to send, when ECSPrefix is nil, the
+	// /24 (IPv4) or /56 (IPv6) network of the probe IP in the vantage
+	// point configured in the context (see modelx.WithVantagePoint), if
+	// any. Since the DNSQuery events record the prefix, only set this
+	// when the privacy settings allow sharing the probe network.
+	ECSFromVantagePoint bool
+
 	ntimeouts *atomicx.Int64
 	transport modelx.DNSRoundTripper
 }
@@ -50,7 +68,15 @@ func (c *Resolver) LookupCNAME(ctx context.Context, host string) (cname string,
 
 // LookupHost returns the IP addresses of a host
 func (c *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
-	var addrs []string
+	addrs, _, err := c.LookupHostWithCNAME(ctx, hostname)
+	return addrs, err
+}
+
+// LookupHostWithCNAME returns the IP addresses of a host along with
+// the ordered list of CNAMEs encountered while resolving it.
+func (c *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	var addrs, cnames []string
 	var reply *dns.Msg
 	reply, errA := c.roundTripWithRetry(ctx, hostname, dns.TypeA)
 	if errA == nil {
@@ -60,6 +86,7 @@ func (c *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 				addrs = append(addrs, ip.String())
 			}
 		}
+		cnames = cnameChain(reply)
 	}
 	reply, errAAAA := c.roundTripWithRetry(ctx, hostname, dns.TypeAAAA)
 	if errAAAA == nil {
@@ -69,8 +96,26 @@ func (c *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 				addrs = append(addrs, ip.String())
 			}
 		}
+		if len(cnames) <= 0 {
+			cnames = cnameChain(reply)
+		}
 	}
-	return lookupHostResult(addrs, errA, errAAAA)
+	addrs, err := lookupHostResult(addrs, errA, errAAAA)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addrs, cnames, nil
+}
+
+// cnameChain returns the CNAME targets in reply in the order in
+// which they appear in the answer section.
+func cnameChain(reply *dns.Msg) (cnames []string) {
+	for _, answer := range reply.Answer {
+		if rrcname, ok := answer.(*dns.CNAME); ok {
+			cnames = append(cnames, rrcname.Target)
+		}
+	}
+	return
 }
 
 func lookupHostResult(addrs []string, errA, errAAAA error) ([]string, error) {
@@ -86,6 +131,28 @@ func lookupHostResult(addrs []string, errA, errAAAA error) ([]string, error) {
 	return nil, errors.New("ooniresolver: no response returned")
 }
 
+// LookupType queries for records of type qtype and returns the
+// resource records contained in the answer section of the reply.
+func (c *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reply, err := c.roundTripWithRetry(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Answer, nil
+}
+
+// LookupTypeWithAuthority is like LookupType but also returns the
+// resource records contained in the authority section of the reply.
+func (c *Resolver) LookupTypeWithAuthority(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	reply, err := c.roundTripWithRetry(ctx, name, qtype)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Answer, reply.Ns, nil
+}
+
 // LookupMX returns the MX records of a specific name
 func (c *Resolver) LookupMX(ctx context.Context, name string) (mx []*net.MX, err error) {
 	err = errNotImpl
@@ -98,6 +165,15 @@ func (c *Resolver) LookupNS(ctx context.Context, name string) (ns []*net.NS, err
 	return
 }
 
+// Close closes the transport, if it owns resources, e.g., the
+// persistent connections of DNS over TCP and TLS.
+func (c *Resolver) Close() error {
+	if closer, ok := c.transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 const (
 	// desiredBlockSize is the size that the padded query should be multiple of
 	desiredBlockSize = 128
@@ -109,14 +185,27 @@ const (
 	dnssecEnabled = true
 )
 
-func (c *Resolver) newQueryWithQuestion(q dns.Question, needspadding bool) (query *dns.Msg) {
+func (c *Resolver) newQueryWithQuestion(q dns.Question, needspadding bool) *dns.Msg {
+	return c.newQueryWithQuestionAndECS(q, c.ECSPrefix, needspadding)
+}
+
+func (c *Resolver) newQueryWithQuestionAndECS(
+	q dns.Question, ecs *net.IPNet, needspadding bool) (query *dns.Msg) {
 	query = new(dns.Msg)
 	query.Id = dns.Id()
 	query.RecursionDesired = true
 	query.Question = make([]dns.Question, 1)
 	query.Question[0] = q
-	if needspadding {
+	if c.DNSSEC || ecs != nil {
 		query.SetEdns0(maxResponseSize, dnssecEnabled)
+	}
+	if ecs != nil {
+		query.IsEdns0().Option = append(query.IsEdns0().Option, newECSOption(ecs))
+	}
+	if needspadding {
+		if query.IsEdns0() == nil {
+			query.SetEdns0(maxResponseSize, dnssecEnabled)
+		}
 		// Clients SHOULD pad queries to the closest multiple of
 		// 128 octets RFC8467#section-4.1. We inflate the query
 		// length by the size of the option (i.e. 4 octets). The
@@ -131,16 +220,77 @@ func (c *Resolver) newQueryWithQuestion(q dns.Question, needspadding bool) (quer
 	return
 }
 
+func newECSOption(prefix *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := prefix.Mask.Size()
+	opt := new(dns.EDNS0_SUBNET)
+	opt.Code = dns.EDNS0SUBNET
+	opt.SourceNetmask = uint8(ones)
+	address := prefix.IP.Mask(prefix.Mask)
+	if ip4 := address.To4(); ip4 != nil {
+		opt.Family = 1 // IPv4, see RFC7871 Sect. 6
+		opt.Address = ip4
+	} else {
+		opt.Family = 2 // IPv6, see RFC7871 Sect. 6
+		opt.Address = address
+	}
+	return opt
+}
+
+// ecsPrefixFor returns the ECS prefix to send along with the
+// queries using ctx, or nil if we should not send ECS.
+func (c *Resolver) ecsPrefixFor(ctx context.Context) *net.IPNet {
+	if c.ECSPrefix != nil || !c.ECSFromVantagePoint {
+		return c.ECSPrefix
+	}
+	vp := modelx.ContextVantagePoint(ctx)
+	if vp == nil {
+		return nil
+	}
+	return newVantagePointECSPrefix(vp.ProbeIP)
+}
+
+func newVantagePointECSPrefix(probeIP string) *net.IPNet {
+	ip := net.ParseIP(probeIP)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+		return nil // e.g., we could not discover the probe IP
+	}
+	mask := net.CIDRMask(56, 128)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(24, 32)
+	}
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+// queryECSPrefix returns the ECS prefix in query, if any.
+func queryECSPrefix(query *dns.Msg) string {
+	if query == nil {
+		return ""
+	}
+	if opt := query.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				bits := 8 * len(subnet.Address)
+				return (&net.IPNet{
+					IP:   subnet.Address,
+					Mask: net.CIDRMask(int(subnet.SourceNetmask), bits),
+				}).String()
+			}
+		}
+	}
+	return ""
+}
+
 func (c *Resolver) roundTripWithRetry(
 	ctx context.Context, hostname string, qtype uint16,
 ) (*dns.Msg, error) {
 	var errorslist []error
+	ecs := c.ecsPrefixFor(ctx)
 	for i := 0; i < 3; i++ {
-		reply, err := c.roundTrip(ctx, c.newQueryWithQuestion(dns.Question{
+		reply, err := c.roundTrip(ctx, c.newQueryWithQuestionAndECS(dns.Question{
 			Name:   dns.Fqdn(hostname),
 			Qtype:  qtype,
 			Qclass: dns.ClassINET,
-		}, c.Transport().RequiresPadding()))
+		}, ecs, c.Transport().RequiresPadding()))
 		if err == nil {
 			return reply, nil
 		}
@@ -199,6 +349,7 @@ func (c *Resolver) mockableRoundTrip(
 			Data:                   querydata,
 			DialID:                 dialid.ContextDialID(ctx),
 			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			ECSPrefix:              queryECSPrefix(query),
 			Msg:                    query,
 		},
 	})
@@ -6,6 +6,7 @@ import (
 	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/internal/resolver/dnstransport/dnsovertcp"
@@ -276,3 +277,326 @@ func TestUnitPadding(t *testing.T) {
 		}
 	}
 }
+
+// cnametransport replies to queries with a CNAME chain followed
+// by an A or AAAA record, as a recursive resolver would do.
+type cnametransport struct{}
+
+func (t *cnametransport) RoundTrip(
+	ctx context.Context, query []byte,
+) (reply []byte, err error) {
+	qmsg := new(dns.Msg)
+	if err := qmsg.Unpack(query); err != nil {
+		return nil, err
+	}
+	rmsg := new(dns.Msg)
+	rmsg.SetReply(qmsg)
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET}
+	}
+	rmsg.Answer = append(rmsg.Answer, &dns.CNAME{
+		Hdr:    header("www.example.com.", dns.TypeCNAME),
+		Target: "www.example.net.",
+	}, &dns.CNAME{
+		Hdr:    header("www.example.net.", dns.TypeCNAME),
+		Target: "edge.example.org.",
+	})
+	if qmsg.Question[0].Qtype == dns.TypeA {
+		rmsg.Answer = append(rmsg.Answer, &dns.A{
+			Hdr: header("edge.example.org.", dns.TypeA),
+			A:   net.IPv4(10, 0, 0, 1),
+		})
+	}
+	if qmsg.Question[0].Qtype == dns.TypeDS {
+		rmsg.Ns = append(rmsg.Ns, &dns.NSEC{
+			Hdr:        header("www.example.com.", dns.TypeNSEC),
+			NextDomain: "zzz.example.com.",
+			TypeBitMap: []uint16{dns.TypeCNAME, dns.TypeRRSIG, dns.TypeNSEC},
+		})
+	}
+	return rmsg.Pack()
+}
+
+func (t *cnametransport) RequiresPadding() bool {
+	return false
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	client := New(&cnametransport{})
+	addrs, cnames, err := client.LookupHostWithCNAME(
+		context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatal("unexpected addrs")
+	}
+	if len(cnames) != 2 || cnames[0] != "www.example.net." ||
+		cnames[1] != "edge.example.org." {
+		t.Fatal("unexpected cnames")
+	}
+}
+
+func TestUnitLookupHostWithCNAMEFailure(t *testing.T) {
+	client := New(&faketransport{})
+	addrs, cnames, err := client.LookupHostWithCNAME(
+		context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+}
+
+func TestUnitNoECSQueryIsUnchanged(t *testing.T) {
+	question := dns.Question{
+		Name:   dns.Fqdn("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+	query := new(Resolver).newQueryWithQuestion(question, false)
+	if query.IsEdns0() != nil {
+		t.Fatal("unexpected OPT record")
+	}
+	query = new(Resolver).newQueryWithQuestion(question, true)
+	options := query.IsEdns0().Option
+	if len(options) != 1 || options[0].Option() != dns.EDNS0PADDING {
+		t.Fatal("expected just the padding option")
+	}
+}
+
+func TestUnitECS(t *testing.T) {
+	for _, cidr := range []string{"130.192.91.211/24", "2001:db8:1234::1/48"} {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, padding := range []bool{false, true} {
+			reso := &Resolver{ECSPrefix: prefix}
+			query := reso.newQueryWithQuestion(dns.Question{
+				Name:   dns.Fqdn("www.example.com"),
+				Qtype:  dns.TypeA,
+				Qclass: dns.ClassINET,
+			}, padding)
+			data, err := query.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if padding && len(data)%desiredBlockSize != 0 {
+				t.Fatal("query is not padded correctly")
+			}
+			parsed := new(dns.Msg)
+			if err := parsed.Unpack(data); err != nil {
+				t.Fatal(err)
+			}
+			var subnet *dns.EDNS0_SUBNET
+			for _, option := range parsed.IsEdns0().Option {
+				if opt, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnet = opt
+				}
+			}
+			if subnet == nil {
+				t.Fatal("ECS option not found")
+			}
+			ones, _ := prefix.Mask.Size()
+			if int(subnet.SourceNetmask) != ones {
+				t.Fatal("unexpected source netmask")
+			}
+			if !prefix.IP.Equal(subnet.Address) {
+				t.Fatal("unexpected address")
+			}
+		}
+	}
+}
+
+type queryrecorder struct {
+	queries []*modelx.DNSQueryEvent
+}
+
+func (h *queryrecorder) OnMeasurement(m modelx.Measurement) {
+	if m.DNSQuery != nil {
+		h.queries = append(h.queries, m.DNSQuery)
+	}
+}
+
+func TestUnitECSIsRecorded(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("130.192.91.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ecs := range []*net.IPNet{nil, prefix} {
+		handler := new(queryrecorder)
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning: time.Now(),
+				Handler:   handler,
+			},
+		)
+		client := New(&cnametransport{})
+		client.ECSPrefix = ecs
+		if _, err := client.LookupHost(ctx, "www.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if len(handler.queries) != 2 {
+			t.Fatal("unexpected number of queries")
+		}
+		expected := ""
+		if ecs != nil {
+			expected = "130.192.91.0/24"
+		}
+		for _, query := range handler.queries {
+			if query.ECSPrefix != expected {
+				t.Fatal("unexpected ECSPrefix")
+			}
+		}
+	}
+}
+
+func TestUnitECSFromVantagePoint(t *testing.T) {
+	var expectations = []struct {
+		vp       *modelx.VantagePoint
+		expected string
+	}{{
+		vp:       nil,
+		expected: "",
+	}, {
+		vp:       &modelx.VantagePoint{ProbeIP: "130.192.91.211"},
+		expected: "130.192.91.0/24",
+	}, {
+		vp:       &modelx.VantagePoint{ProbeIP: "2001:db8:1:2ff::1"},
+		expected: "2001:db8:1:200::/56",
+	}, {
+		vp:       &modelx.VantagePoint{ProbeIP: "127.0.0.1"},
+		expected: "",
+	}, {
+		vp:       &modelx.VantagePoint{ProbeIP: ""},
+		expected: "",
+	}}
+	for _, e := range expectations {
+		handler := new(queryrecorder)
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning: time.Now(),
+				Handler:   handler,
+			},
+		)
+		if e.vp != nil {
+			ctx = modelx.WithVantagePoint(ctx, e.vp)
+		}
+		client := New(&cnametransport{})
+		client.ECSFromVantagePoint = true
+		if _, err := client.LookupHost(ctx, "www.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if len(handler.queries) != 2 {
+			t.Fatal("unexpected number of queries")
+		}
+		for _, query := range handler.queries {
+			if query.ECSPrefix != e.expected {
+				t.Fatalf("unexpected ECSPrefix: %s", query.ECSPrefix)
+			}
+			if (e.expected != "") != (query.Msg.IsEdns0() != nil) {
+				t.Fatal("unexpected EDNS0 state")
+			}
+		}
+	}
+}
+
+func TestUnitECSPrefixOverridesVantagePoint(t *testing.T) {
+	_, prefix, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := modelx.WithVantagePoint(context.Background(), &modelx.VantagePoint{
+		ProbeIP: "130.192.91.211",
+	})
+	client := New(&cnametransport{})
+	client.ECSPrefix = prefix
+	client.ECSFromVantagePoint = true
+	if got := client.ecsPrefixFor(ctx); got != prefix {
+		t.Fatal("expected ECSPrefix to take precedence")
+	}
+	client.ECSFromVantagePoint = false
+	client.ECSPrefix = nil
+	if got := client.ecsPrefixFor(ctx); got != nil {
+		t.Fatal("expected no ECS prefix")
+	}
+}
+
+func TestUnitLookupType(t *testing.T) {
+	client := New(&cnametransport{})
+	records, err := client.LookupType(context.Background(), "www.example.com", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatal("unexpected number of records")
+	}
+	if _, ok := records[2].(*dns.A); !ok {
+		t.Fatal("expected an A record here")
+	}
+}
+
+func TestUnitLookupTypeFailure(t *testing.T) {
+	client := New(&faketransport{})
+	records, err := client.LookupType(context.Background(), "www.example.com", dns.TypeTXT)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+func TestUnitLookupTypeWithAuthority(t *testing.T) {
+	client := New(&cnametransport{})
+	answer, authority, err := client.LookupTypeWithAuthority(
+		context.Background(), "www.example.com", dns.TypeDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(answer) != 2 {
+		t.Fatal("unexpected number of answer records")
+	}
+	if len(authority) != 1 {
+		t.Fatal("unexpected number of authority records")
+	}
+	if _, ok := authority[0].(*dns.NSEC); !ok {
+		t.Fatal("expected a NSEC record here")
+	}
+}
+
+func TestUnitLookupTypeWithAuthorityFailure(t *testing.T) {
+	client := New(&faketransport{})
+	answer, authority, err := client.LookupTypeWithAuthority(
+		context.Background(), "www.example.com", dns.TypeDS)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if answer != nil || authority != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+func TestUnitDNSSECQuery(t *testing.T) {
+	question := dns.Question{
+		Name:   dns.Fqdn("www.example.com"),
+		Qtype:  dns.TypeA,
+		Qclass: dns.ClassINET,
+	}
+	reso := &Resolver{DNSSEC: true}
+	query := reso.newQueryWithQuestion(question, false)
+	opt := query.IsEdns0()
+	if opt == nil || !opt.Do() {
+		t.Fatal("expected an OPT record with the DO bit set")
+	}
+	if len(opt.Option) != 0 {
+		t.Fatal("expected no options")
+	}
+	query = reso.newQueryWithQuestion(question, true)
+	options := query.IsEdns0().Option
+	if len(options) != 1 || options[0].Option() != dns.EDNS0PADDING {
+		t.Fatal("expected just the padding option")
+	}
+}
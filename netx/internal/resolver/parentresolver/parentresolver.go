@@ -7,6 +7,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/atomicx"
 	"github.com/ooni/probe-engine/netx/internal/dialid"
 	"github.com/ooni/probe-engine/netx/internal/errwrapper"
@@ -17,6 +18,12 @@ import (
 
 // Resolver is the emitter resolver
 type Resolver struct {
+	// DivertLookupHost, when not nil, is used to lookup hosts instead
+	// of the wrapped resolver, like MeasurementRoot.LookupHost for the
+	// dialer. We still emit events and check for bogons. This is useful
+	// to inject a custom lookup without writing a fake resolver.
+	DivertLookupHost func(ctx context.Context, hostname string) ([]string, error)
+
 	bogonsCount *atomicx.Int64
 	resolver    modelx.DNSResolver
 }
@@ -44,25 +51,44 @@ type queryableTransport interface {
 	Address() string
 }
 
+type methodTransport interface {
+	Method() string
+}
+
 type queryableResolver interface {
 	Transport() modelx.DNSRoundTripper
 }
 
-func (r *Resolver) queryTransport() (network string, address string) {
+func (r *Resolver) queryTransport() (network, address, method string) {
 	if reso, okay := r.resolver.(queryableResolver); okay {
 		if transport, okay := reso.Transport().(queryableTransport); okay {
 			network, address = transport.Network(), transport.Address()
 		}
+		if transport, okay := reso.Transport().(methodTransport); okay {
+			method = transport.Method()
+		}
 	}
 	return
 }
 
 // LookupHost returns the IP addresses of a host
 func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
-	network, address := r.queryTransport()
+	addrs, _, err := r.LookupHostWithCNAME(ctx, hostname)
+	return addrs, err
+}
+
+// LookupHostWithCNAME returns the IP addresses of a host along with the
+// CNAMEs encountered while resolving it. If the underlying resolver is
+// not able to return CNAMEs, the returned list of CNAMEs is empty.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	ctx, cancel := modelx.ContextWithMaxRuntime(ctx)
+	defer cancel()
+	network, address, method := r.queryTransport()
 	dialID := dialid.ContextDialID(ctx)
 	txID := transactionid.ContextTransactionID(ctx)
 	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	vp := modelx.ContextVantagePoint(ctx)
 	root.Handler.OnMeasurement(modelx.Measurement{
 		ResolveStart: &modelx.ResolveStartEvent{
 			DialID:                 dialID,
@@ -70,10 +96,14 @@ func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 			Hostname:               hostname,
 			TransactionID:          txID,
 			TransportAddress:       address,
+			TransportMethod:        method,
 			TransportNetwork:       network,
+			VantagePoint:           vp,
 		},
 	})
-	addrs, err := r.lookupHost(ctx, hostname)
+	start := time.Now()
+	addrs, cnames, err := r.lookupHost(ctx, hostname)
+	stop := time.Now()
 	containsBogons := errors.Is(err, modelx.ErrDNSBogon)
 	if containsBogons {
 		// By default root.ErrDNSBogon is nil. Treating bogons as
@@ -95,32 +125,51 @@ func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 	root.Handler.OnMeasurement(modelx.Measurement{
 		ResolveDone: &modelx.ResolveDoneEvent{
 			Addresses:              addrs,
+			CNAMEs:                 cnames,
 			ContainsBogons:         containsBogons,
 			DialID:                 dialID,
-			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			DurationSinceBeginning: stop.Sub(root.Beginning),
 			Error:                  err,
 			Hostname:               hostname,
+			LookupDuration:         stop.Sub(start),
 			TransactionID:          txID,
 			TransportAddress:       address,
+			TransportMethod:        method,
 			TransportNetwork:       network,
+			VantagePoint:           vp,
 		},
 	})
 	// Respect general Go expectation that one doesn't return
 	// both a value and a non-nil error
 	if errors.Is(err, modelx.ErrDNSBogon) {
-		addrs = nil
+		addrs, cnames = nil, nil
 	}
-	return addrs, err
+	return addrs, cnames, err
 }
 
-func (r *Resolver) lookupHost(ctx context.Context, hostname string) ([]string, error) {
-	addrs, err := r.resolver.LookupHost(ctx, hostname)
+func (r *Resolver) lookupHost(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	addrs, cnames, err := r.lookupHostWithCNAME(ctx, hostname)
 	for _, addr := range addrs {
 		if bogondetector.Check(addr) == true {
-			return r.detectedBogon(ctx, hostname, addrs)
+			addrs, err = r.detectedBogon(ctx, hostname, addrs)
+			return addrs, cnames, err
 		}
 	}
-	return addrs, err
+	return addrs, cnames, err
+}
+
+func (r *Resolver) lookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	if r.DivertLookupHost != nil {
+		addrs, err := r.DivertLookupHost(ctx, hostname)
+		return addrs, nil, err
+	}
+	if reso, okay := r.resolver.(modelx.DNSResolverWithCNAME); okay {
+		return reso.LookupHostWithCNAME(ctx, hostname)
+	}
+	addrs, err := r.resolver.LookupHost(ctx, hostname)
+	return addrs, nil, err
 }
 
 func (r *Resolver) detectedBogon(
@@ -130,6 +179,44 @@ func (r *Resolver) detectedBogon(
 	return addrs, modelx.ErrDNSBogon
 }
 
+// LookupType queries for records of a specific type
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reso, okay := r.resolver.(modelx.DNSResolverWithType)
+	if !okay {
+		return nil, errLookupTypeNotSupported
+	}
+	return reso.LookupType(ctx, name, qtype)
+}
+
+var errLookupTypeNotSupported = errors.New("parentresolver: LookupType not supported")
+
+// LookupTypeWithAuthority queries for records of a specific type
+// and also returns the records in the authority section
+func (r *Resolver) LookupTypeWithAuthority(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	reso, okay := r.resolver.(modelx.DNSResolverWithAuthority)
+	if !okay {
+		return nil, nil, errLookupTypeWithAuthorityNotSupported
+	}
+	return reso.LookupTypeWithAuthority(ctx, name, qtype)
+}
+
+var errLookupTypeWithAuthorityNotSupported = errors.New(
+	"parentresolver: LookupTypeWithAuthority not supported")
+
+// LookupHTTPS queries for the HTTPS records of name
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, okay := r.resolver.(modelx.DNSResolverWithHTTPS)
+	if !okay {
+		return nil, errLookupHTTPSNotSupported
+	}
+	return reso.LookupHTTPS(ctx, name)
+}
+
+var errLookupHTTPSNotSupported = errors.New("parentresolver: LookupHTTPS not supported")
+
 // LookupMX returns the MX records of a specific name
 func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
 	return r.resolver.LookupMX(ctx, name)
@@ -139,3 +226,8 @@ func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error)
 func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
 	return r.resolver.LookupNS(ctx, name)
 }
+
+// Close closes the underlying resolver.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
@@ -2,11 +2,15 @@ package parentresolver
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
 	"github.com/ooni/probe-engine/netx/internal/resolver/systemresolver"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
@@ -151,3 +155,325 @@ func TestLookupNS(t *testing.T) {
 		t.Fatal("expected non-nil result here")
 	}
 }
+
+type cnameresolver struct {
+	*brokenresolver.Resolver
+	addrs []string
+}
+
+func (r cnameresolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	return r.addrs, []string{"www.example.net."}, nil
+}
+
+type cnamechecker struct {
+	cnames []string
+	mu     sync.Mutex
+}
+
+func (h *cnamechecker) OnMeasurement(m modelx.Measurement) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m.ResolveDone != nil {
+		h.cnames = m.ResolveDone.CNAMEs
+	}
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	client := New(cnameresolver{
+		Resolver: brokenresolver.New(),
+		addrs:    []string{"8.8.8.8"},
+	})
+	handler := new(cnamechecker)
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   handler,
+		},
+	)
+	addrs, cnames, err := client.LookupHostWithCNAME(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addrs")
+	}
+	if len(cnames) != 1 || cnames[0] != "www.example.net." {
+		t.Fatal("unexpected cnames")
+	}
+	if len(handler.cnames) != 1 || handler.cnames[0] != "www.example.net." {
+		t.Fatal("cnames not included in the event")
+	}
+}
+
+func TestUnitLookupHostWithCNAMEBogon(t *testing.T) {
+	client := New(cnameresolver{
+		Resolver: brokenresolver.New(),
+		addrs:    []string{"127.0.0.1"},
+	})
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:   time.Now(),
+			ErrDNSBogon: modelx.ErrDNSBogon,
+			Handler:     new(cnamechecker),
+		},
+	)
+	addrs, cnames, err := client.LookupHostWithCNAME(ctx, "www.example.com")
+	if !errors.Is(err, modelx.ErrDNSBogon) {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+}
+
+func TestUnitLookupHostWithCNAMEWithoutSupport(t *testing.T) {
+	client := New(brokenresolver.New())
+	addrs, cnames, err := client.LookupHostWithCNAME(
+		context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+}
+
+func TestUnitDivertLookupHost(t *testing.T) {
+	client := New(cnameresolver{
+		Resolver: brokenresolver.New(),
+		addrs:    []string{"8.8.8.8"},
+	})
+	expected := errors.New("mocked error")
+	client.DivertLookupHost = func(ctx context.Context, hostname string) ([]string, error) {
+		return nil, expected
+	}
+	saver := new(handlers.SavingHandler)
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning: time.Now(),
+			Handler:   saver,
+		},
+	)
+	addrs, err := client.LookupHost(ctx, "www.example.com")
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	resolves := saver.Resolves()
+	if len(resolves) != 1 || !errors.Is(resolves[0].Error, expected) {
+		t.Fatal("the error is not in the resolve done event")
+	}
+}
+
+func TestUnitDivertLookupHostBogon(t *testing.T) {
+	client := New(brokenresolver.New())
+	client.DivertLookupHost = func(ctx context.Context, hostname string) ([]string, error) {
+		return []string{"127.0.0.1"}, nil
+	}
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:   time.Now(),
+			ErrDNSBogon: modelx.ErrDNSBogon,
+			Handler:     handlers.NoHandler,
+		},
+	)
+	addrs, err := client.LookupHost(ctx, "www.example.com")
+	if !errors.Is(err, modelx.ErrDNSBogon) {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+}
+
+type typeresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeresolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"antani"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	client := New(typeresolver{brokenresolver.New()})
+	records, err := client.LookupType(context.Background(), "dns.google", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	client := New(brokenresolver.New())
+	records, err := client.LookupType(context.Background(), "dns.google", dns.TypeTXT)
+	if err != errLookupTypeNotSupported {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type authorityresolver struct {
+	typeresolver
+}
+
+func (authorityresolver) LookupTypeWithAuthority(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, []dns.RR, error) {
+	return nil, []dns.RR{&dns.NSEC{NextDomain: "antani."}}, nil
+}
+
+func TestUnitLookupTypeWithAuthority(t *testing.T) {
+	client := New(authorityresolver{typeresolver{brokenresolver.New()}})
+	answer, authority, err := client.LookupTypeWithAuthority(
+		context.Background(), "dns.google", dns.TypeDS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer != nil || len(authority) != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupTypeWithAuthorityNotSupported(t *testing.T) {
+	client := New(typeresolver{brokenresolver.New()})
+	answer, authority, err := client.LookupTypeWithAuthority(
+		context.Background(), "dns.google", dns.TypeDS)
+	if err != errLookupTypeWithAuthorityNotSupported {
+		t.Fatal("not the error we expected")
+	}
+	if answer != nil || authority != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type hangingresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (hangingresolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestUnitLookupHostMaxRuntime(t *testing.T) {
+	client := New(hangingresolver{brokenresolver.New()})
+	ctx := modelx.WithMeasurementRoot(
+		context.Background(), &modelx.MeasurementRoot{
+			Beginning:  time.Now(),
+			Handler:    new(cnamechecker),
+			MaxRuntime: 10 * time.Millisecond,
+		},
+	)
+	start := time.Now()
+	addrs, err := client.LookupHost(ctx, "www.example.com")
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("did not respect MaxRuntime")
+	}
+	if err == nil || err.Error() != modelx.FailureGenericTimeoutError {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+}
+
+type nxdomainresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (nxdomainresolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: hostname, IsNotFound: true}
+}
+
+func TestUnitLookupHostDuration(t *testing.T) {
+	var tests = []struct {
+		resolver modelx.DNSResolver
+		failure  string
+		minimum  time.Duration
+	}{{
+		resolver: cnameresolver{
+			Resolver: brokenresolver.New(),
+			addrs:    []string{"8.8.8.8", "8.8.4.4"},
+		},
+	}, {
+		resolver: nxdomainresolver{brokenresolver.New()},
+		failure:  modelx.FailureDNSNXDOMAINError,
+	}, {
+		resolver: hangingresolver{brokenresolver.New()},
+		failure:  modelx.FailureGenericTimeoutError,
+		minimum:  10 * time.Millisecond,
+	}}
+	for _, tt := range tests {
+		saver := new(handlers.SavingHandler)
+		ctx := modelx.WithMeasurementRoot(
+			context.Background(), &modelx.MeasurementRoot{
+				Beginning:  time.Now(),
+				Handler:    saver,
+				MaxRuntime: 10 * time.Millisecond,
+			},
+		)
+		New(tt.resolver).LookupHost(ctx, "www.example.com")
+		events := saver.Read()
+		if len(events) != 2 || events[0].ResolveStart == nil || events[1].ResolveDone == nil {
+			t.Fatal("unexpected events")
+		}
+		ev := events[1].ResolveDone
+		if ev.LookupDuration < tt.minimum {
+			t.Fatal("LookupDuration is too short")
+		}
+		if ev.DurationSinceBeginning-ev.LookupDuration < events[0].ResolveStart.DurationSinceBeginning {
+			t.Fatal("the lookup started before the start event")
+		}
+		var failure string
+		if ev.Error != nil {
+			failure = ev.Error.Error()
+		}
+		if failure != tt.failure {
+			t.Fatalf("unexpected failure: %s", failure)
+		}
+		if tt.failure == "" && len(ev.Addresses) != 2 {
+			t.Fatal("unexpected number of addresses")
+		}
+		if len(saver.Read()) != 0 {
+			t.Fatal("Read did not drain the events")
+		}
+	}
+}
+
+type httpsresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsresolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, ALPN: []string{"h3"}}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	client := New(httpsresolver{brokenresolver.New()})
+	records, err := client.LookupHTTPS(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ALPN[0] != "h3" {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	client := New(brokenresolver.New())
+	records, err := client.LookupHTTPS(context.Background(), "dns.google")
+	if err != errLookupHTTPSNotSupported {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
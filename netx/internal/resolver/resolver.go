@@ -4,6 +4,7 @@ package resolver
 import (
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/ooni/probe-engine/netx/internal/resolver/dnstransport/dnsoverhttps"
 	"github.com/ooni/probe-engine/netx/internal/resolver/dnstransport/dnsovertcp"
@@ -42,9 +43,83 @@ func NewResolverTLS(dialer modelx.TLSDialer, address string) *parentresolver.Res
 	)
 }
 
-// NewResolverHTTPS creates a new DoH resolver.
+// Options contains optional settings for the resolvers using our
+// own DNS client, i.e., all the resolvers except the system one.
+type Options struct {
+	// DNSSEC causes the resolver to request DNSSEC records by setting
+	// the DO bit, which is what dnssecresolver needs to validate.
+	DNSSEC bool
+
+	// ECSPrefix, when not nil, is the EDNS Client Subnet prefix we
+	// include in the queries. See ooniresolver.Resolver.ECSPrefix.
+	ECSPrefix *net.IPNet
+
+	// ECSFromVantagePoint causes the resolver to derive the EDNS Client
+	// Subnet prefix from the context. See ooniresolver.Resolver.
+	ECSFromVantagePoint bool
+
+	// IdleTimeout, when positive, causes the TCP and TLS resolvers to
+	// reuse connections, closing them after they have been idle for
+	// IdleTimeout. It has no effect on the UDP and HTTPS resolvers.
+	IdleTimeout time.Duration
+}
+
+func newResolverWithOptions(
+	transport modelx.DNSRoundTripper, options Options) *parentresolver.Resolver {
+	reso := ooniresolver.New(transport)
+	reso.DNSSEC = options.DNSSEC
+	reso.ECSPrefix = options.ECSPrefix
+	reso.ECSFromVantagePoint = options.ECSFromVantagePoint
+	return parentresolver.New(reso)
+}
+
+// NewResolverUDPWithOptions is like NewResolverUDP but with options.
+func NewResolverUDPWithOptions(
+	dialer modelx.Dialer, address string, options Options,
+) *parentresolver.Resolver {
+	return newResolverWithOptions(dnsoverudp.NewTransport(dialer, address), options)
+}
+
+// NewResolverTCPWithOptions is like NewResolverTCP but with options.
+func NewResolverTCPWithOptions(
+	dialer modelx.Dialer, address string, options Options,
+) *parentresolver.Resolver {
+	transport := dnsovertcp.NewTransportTCP(dialer, address)
+	transport.IdleTimeout = options.IdleTimeout
+	return newResolverWithOptions(transport, options)
+}
+
+// NewResolverTLSWithOptions is like NewResolverTLS but with options.
+func NewResolverTLSWithOptions(
+	dialer modelx.TLSDialer, address string, options Options,
+) *parentresolver.Resolver {
+	transport := dnsovertcp.NewTransportTLS(dialer, address)
+	transport.IdleTimeout = options.IdleTimeout
+	return newResolverWithOptions(transport, options)
+}
+
+// NewResolverHTTPS creates a new DoH resolver using the POST method.
 func NewResolverHTTPS(client *http.Client, address string) *parentresolver.Resolver {
 	return parentresolver.New(
 		ooniresolver.New(dnsoverhttps.NewTransport(client, address)),
 	)
 }
+
+// NewResolverHTTPSWithMethod is like NewResolverHTTPS but allows to
+// choose the HTTP method, which must be either "GET" or "POST".
+func NewResolverHTTPSWithMethod(
+	client *http.Client, address, method string) (*parentresolver.Resolver, error) {
+	return NewResolverHTTPSWithOptions(client, address, method, Options{})
+}
+
+// NewResolverHTTPSWithOptions is like NewResolverHTTPSWithMethod but
+// with options.
+func NewResolverHTTPSWithOptions(
+	client *http.Client, address, method string, options Options,
+) (*parentresolver.Resolver, error) {
+	transport, err := dnsoverhttps.NewTransportWithMethod(client, address, method)
+	if err != nil {
+		return nil, err
+	}
+	return newResolverWithOptions(transport, options), nil
+}
@@ -5,10 +5,14 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/internal/resolver/chainresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/sortingresolver"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -101,3 +105,128 @@ func (*tlsdialer) DialTLSContext(
 ) (net.Conn, error) {
 	return tls.Dial(network, address, new(tls.Config))
 }
+
+// newLocalDNSServer starts a DNS over TCP server resolving every name
+// to 127.0.0.1 and returns its address along with a stop function.
+func newLocalDNSServer(t *testing.T) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			if req.Question[0].Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   req.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IPv4(127, 0, 0, 1),
+				})
+			}
+			w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	return listener.Addr().String(), func() { server.Shutdown() }
+}
+
+type trackedConn struct {
+	net.Conn
+	closed bool
+	mu     sync.Mutex
+}
+
+func (c *trackedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *trackedConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+type trackingDialer struct {
+	conns []*trackedConn
+	mu    sync.Mutex
+}
+
+func (d *trackingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *trackingDialer) DialContext(
+	ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := new(net.Dialer).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	tc := &trackedConn{Conn: conn}
+	d.mu.Lock()
+	d.conns = append(d.conns, tc)
+	d.mu.Unlock()
+	return tc, nil
+}
+
+func TestUnitNewResolverTCPWithOptionsClose(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	dialer := new(trackingDialer)
+	// Wrap the pooled resolver to check that Close is forwarded.
+	reso := chainresolver.New(
+		sortingresolver.New(NewResolverTCPWithOptions(
+			dialer, address, Options{IdleTimeout: time.Hour})),
+		NewResolverSystem(),
+	)
+	for i := 0; i < 2; i++ {
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatal("unexpected addresses")
+		}
+	}
+	if len(dialer.conns) != 1 {
+		t.Fatal("expected to reuse the connection")
+	}
+	if dialer.conns[0].isClosed() {
+		t.Fatal("expected the connection to be open")
+	}
+	if err := modelx.CloseDNSResolver(reso); err != nil {
+		t.Fatal(err)
+	}
+	if !dialer.conns[0].isClosed() {
+		t.Fatal("expected Close to close the connection")
+	}
+	if err := reso.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnitNewResolverTCPDoesNotReuse(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	dialer := new(trackingDialer)
+	reso := NewResolverTCP(dialer, address)
+	if _, err := reso.LookupHost(context.Background(), "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(dialer.conns) != 2 {
+		t.Fatal("expected a connection for each query")
+	}
+	for _, conn := range dialer.conns {
+		if !conn.isClosed() {
+			t.Fatal("expected the connection to be closed")
+		}
+	}
+}
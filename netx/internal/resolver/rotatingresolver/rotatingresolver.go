@@ -0,0 +1,247 @@
+// Package rotatingresolver contains a resolver that rotates among a
+// list of resolvers, e.g., public DoH providers, so that a single
+// resolver does not become a source of measurement bias.
+package rotatingresolver
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/atomicx"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+const (
+	// PerLookup means that each lookup starts from the provider that
+	// follows the one where the previous lookup started.
+	PerLookup = "per-lookup"
+
+	// PerSession means that all lookups start from the same provider,
+	// which we choose at random when creating the resolver.
+	PerSession = "per-session"
+)
+
+var (
+	// ErrInvalidMode indicates that the rotation mode is not valid.
+	ErrInvalidMode = errors.New("rotatingresolver: invalid mode")
+
+	// ErrNoProviders indicates that the list of providers is empty.
+	ErrNoProviders = errors.New("rotatingresolver: no providers")
+)
+
+// Provider is a named resolver.
+type Provider struct {
+	// Name identifies the provider, e.g., the URL of a DoH server.
+	Name string
+
+	// Resolver is the resolver to use.
+	Resolver modelx.DNSResolver
+}
+
+// Usage contains the usage counters of a provider.
+type Usage struct {
+	// Failures is the number of lookups that failed.
+	Failures int64
+
+	// Lookups is the number of lookups, including failed ones.
+	Lookups int64
+
+	// Name is the name of the provider.
+	Name string
+}
+
+type provider struct {
+	Provider
+	failures *atomicx.Int64
+	lookups  *atomicx.Int64
+}
+
+// Resolver is a resolver rotating among providers. Each lookup starts
+// from a provider that depends on the rotation mode and, on failure,
+// falls back to the following providers, until one succeeds. Since the
+// providers emit their own events, the events tell you which provider
+// served each lookup. For DoH, this is the TransportAddress field.
+type Resolver struct {
+	mode      string
+	mu        sync.Mutex
+	next      int
+	providers []*provider
+}
+
+// New creates a new Resolver using the given rotation mode, which
+// must be either PerLookup or PerSession.
+func New(mode string, providers ...Provider) (*Resolver, error) {
+	if mode != PerLookup && mode != PerSession {
+		return nil, ErrInvalidMode
+	}
+	if len(providers) <= 0 {
+		return nil, ErrNoProviders
+	}
+	r := &Resolver{mode: mode}
+	for _, p := range providers {
+		r.providers = append(r.providers, &provider{
+			Provider: p,
+			failures: atomicx.NewInt64(),
+			lookups:  atomicx.NewInt64(),
+		})
+	}
+	r.next = rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(providers))
+	return r, nil
+}
+
+// Usage returns the usage counters of each provider, in the order
+// in which the providers have been passed to New.
+func (r *Resolver) Usage() []Usage {
+	var out []Usage
+	for _, p := range r.providers {
+		out = append(out, Usage{
+			Failures: p.failures.Load(),
+			Lookups:  p.lookups.Load(),
+			Name:     p.Name,
+		})
+	}
+	return out
+}
+
+// start returns the index of the provider to try first.
+func (r *Resolver) start() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := r.next
+	if r.mode == PerLookup {
+		r.next = (r.next + 1) % len(r.providers)
+	}
+	return start
+}
+
+// do calls lookup with each provider until lookup succeeds and returns
+// the error returned by the last provider, if all of them failed. We stop
+// as soon as ctx is done, since the next providers would fail as well,
+// and we should not count them as failing.
+func (r *Resolver) do(
+	ctx context.Context, lookup func(reso modelx.DNSResolver) error) (err error) {
+	start := r.start()
+	for idx := 0; idx < len(r.providers); idx++ {
+		p := r.providers[(start+idx)%len(r.providers)]
+		p.lookups.Add(1)
+		if err = lookup(p.Resolver); err == nil {
+			return
+		}
+		p.failures.Add(1)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
+
+// LookupAddr returns the name of the provided IP address
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		names, err = reso.LookupAddr(ctx, addr)
+		return
+	})
+	return
+}
+
+// LookupCNAME returns the canonical name of a host
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		cname, err = reso.LookupCNAME(ctx, host)
+		return
+	})
+	return
+}
+
+// LookupHost returns the IP addresses of a host
+func (r *Resolver) LookupHost(ctx context.Context, hostname string) (addrs []string, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		addrs, err = reso.LookupHost(ctx, hostname)
+		return
+	})
+	return
+}
+
+// LookupHostWithCNAME is like LookupHost but also returns the CNAMEs
+// encountered while resolving, if the provider supports them.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) (addrs, cnames []string, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		if rc, ok := reso.(modelx.DNSResolverWithCNAME); ok {
+			addrs, cnames, err = rc.LookupHostWithCNAME(ctx, hostname)
+			return
+		}
+		addrs, err = reso.LookupHost(ctx, hostname)
+		cnames = []string{}
+		return
+	})
+	return
+}
+
+// LookupType queries for records of a specific type. The providers not
+// supporting this functionality count as failing.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) (records []dns.RR, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		rt, ok := reso.(modelx.DNSResolverWithType)
+		if !ok {
+			return errLookupTypeNotSupported
+		}
+		records, err = rt.LookupType(ctx, name, qtype)
+		return
+	})
+	return
+}
+
+var errLookupTypeNotSupported = errors.New("rotatingresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name. The providers not
+// supporting this functionality count as failing.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) (records []modelx.HTTPSRecord, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		rh, ok := reso.(modelx.DNSResolverWithHTTPS)
+		if !ok {
+			return errLookupHTTPSNotSupported
+		}
+		records, err = rh.LookupHTTPS(ctx, name)
+		return
+	})
+	return
+}
+
+var errLookupHTTPSNotSupported = errors.New("rotatingresolver: LookupHTTPS not supported")
+
+// LookupMX returns the MX records of a specific name
+func (r *Resolver) LookupMX(ctx context.Context, name string) (mx []*net.MX, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		mx, err = reso.LookupMX(ctx, name)
+		return
+	})
+	return
+}
+
+// LookupNS returns the NS records of a specific name
+func (r *Resolver) LookupNS(ctx context.Context, name string) (ns []*net.NS, err error) {
+	err = r.do(ctx, func(reso modelx.DNSResolver) (err error) {
+		ns, err = reso.LookupNS(ctx, name)
+		return
+	})
+	return
+}
+
+// Close closes the resolvers of all the providers and returns the
+// first error that occurred, if any.
+func (r *Resolver) Close() (err error) {
+	for _, p := range r.providers {
+		if err2 := modelx.CloseDNSResolver(p.Resolver); err == nil {
+			err = err2
+		}
+	}
+	return
+}
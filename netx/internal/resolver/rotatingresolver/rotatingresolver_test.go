@@ -0,0 +1,274 @@
+package rotatingresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/staticresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newprovider(name, addr string) Provider {
+	return Provider{
+		Name: name,
+		Resolver: staticresolver.New(map[string][]string{
+			"www.example.com": {addr},
+		}, brokenresolver.New()),
+	}
+}
+
+func TestUnitNewErrors(t *testing.T) {
+	if _, err := New("antani", newprovider("a", "10.0.0.1")); !errors.Is(err, ErrInvalidMode) {
+		t.Fatal("not the error we expected")
+	}
+	if _, err := New(PerLookup); !errors.Is(err, ErrNoProviders) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitPerLookup(t *testing.T) {
+	reso, err := New(PerLookup,
+		newprovider("a", "10.0.0.1"), newprovider("b", "10.0.0.2"),
+		newprovider("c", "10.0.0.3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addrs[0]]++
+	}
+	if len(seen) != 3 || seen["10.0.0.1"] != 2 || seen["10.0.0.2"] != 2 {
+		t.Fatalf("unexpected rotation: %+v", seen)
+	}
+	for _, usage := range reso.Usage() {
+		if usage.Lookups != 2 || usage.Failures != 0 {
+			t.Fatalf("unexpected usage: %+v", usage)
+		}
+	}
+}
+
+func TestUnitPerSession(t *testing.T) {
+	reso, err := New(PerSession,
+		newprovider("a", "10.0.0.1"), newprovider("b", "10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[addrs[0]]++
+	}
+	if len(seen) != 1 {
+		t.Fatalf("expected to always use the same provider: %+v", seen)
+	}
+}
+
+func TestUnitFallback(t *testing.T) {
+	broken := Provider{Name: "broken", Resolver: brokenresolver.New()}
+	reso, err := New(PerLookup, broken, newprovider("good", "10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			t.Fatal("unexpected addresses")
+		}
+	}
+	usage := reso.Usage()
+	if usage[0].Name != "broken" || usage[0].Lookups != 2 || usage[0].Failures != 2 {
+		t.Fatalf("unexpected usage: %+v", usage[0])
+	}
+	if usage[1].Name != "good" || usage[1].Lookups != 4 || usage[1].Failures != 0 {
+		t.Fatalf("unexpected usage: %+v", usage[1])
+	}
+}
+
+func TestUnitAllFailing(t *testing.T) {
+	reso, err := New(PerLookup,
+		Provider{Name: "a", Resolver: brokenresolver.New()},
+		Provider{Name: "b", Resolver: brokenresolver.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	for _, usage := range reso.Usage() {
+		if usage.Lookups != 1 || usage.Failures != 1 {
+			t.Fatalf("unexpected usage: %+v", usage)
+		}
+	}
+}
+
+func TestUnitOtherLookups(t *testing.T) {
+	reso, err := New(PerLookup, Provider{Name: "a", Resolver: brokenresolver.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := reso.LookupAddr(ctx, "10.0.0.1"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := reso.LookupCNAME(ctx, "www.example.com"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := reso.LookupMX(ctx, "example.com"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := reso.LookupNS(ctx, "example.com"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if usage := reso.Usage(); usage[0].Lookups != 4 || usage[0].Failures != 4 {
+		t.Fatalf("unexpected usage: %+v", usage[0])
+	}
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	r, err := New(PerSession,
+		Provider{Name: "broken", Resolver: brokenresolver.New()},
+		newprovider("static", "1.1.1.1"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, cnames, err := r.LookupHostWithCNAME(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.1.1.1" {
+		t.Fatal("unexpected addresses")
+	}
+	if cnames == nil || len(cnames) != 0 {
+		t.Fatal("expected empty cnames")
+	}
+}
+
+type typeResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeResolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"hello"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	r, err := New(PerSession,
+		Provider{Name: "broken", Resolver: brokenresolver.New()},
+		Provider{Name: "type", Resolver: typeResolver{brokenresolver.New()}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	r, err := New(PerSession, Provider{Name: "broken", Resolver: brokenresolver.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if !errors.Is(err, errLookupTypeNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if r.Usage()[0].Failures != 1 {
+		t.Fatal("expected the provider to count as failing")
+	}
+}
+
+type httpsResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsResolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, Target: "."}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	r, err := New(PerSession,
+		Provider{Name: "broken", Resolver: brokenresolver.New()},
+		Provider{Name: "https", Resolver: httpsResolver{brokenresolver.New()}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	r, err := New(PerSession, Provider{Name: "broken", Resolver: brokenresolver.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.LookupHTTPS(context.Background(), "example.com")
+	if !errors.Is(err, errLookupHTTPSNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+type cancelingResolver struct {
+	*brokenresolver.Resolver
+	cancel context.CancelFunc
+}
+
+func (r cancelingResolver) LookupHost(
+	ctx context.Context, hostname string) ([]string, error) {
+	r.cancel()
+	return nil, ctx.Err()
+}
+
+func TestUnitStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reso, err := New(PerSession,
+		Provider{Name: "canceling", Resolver: cancelingResolver{
+			Resolver: brokenresolver.New(), cancel: cancel,
+		}},
+		newprovider("good", "10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reso.next = 0 // New starts from a random provider
+	addrs, err := reso.LookupHost(ctx, "www.example.com")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	if usage := reso.Usage(); usage[1].Lookups != 0 {
+		t.Fatalf("expected not to try the next provider: %+v", usage[1])
+	}
+}
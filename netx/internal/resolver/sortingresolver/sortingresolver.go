@@ -0,0 +1,146 @@
+// Package sortingresolver contains a resolver that returns addresses
+// in a deterministic order, so that measurements are reproducible.
+package sortingresolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// Resolver is a resolver that sorts the addresses returned by the
+// wrapped resolver. IPv4 addresses come before IPv6 addresses, and
+// addresses of the same family are sorted by their bytes. Strings that
+// are not IP addresses, if any, come last in lexicographic order.
+type Resolver struct {
+	resolver modelx.DNSResolver
+}
+
+// New creates a new Resolver wrapping resolver.
+func New(resolver modelx.DNSResolver) *Resolver {
+	return &Resolver{resolver: resolver}
+}
+
+// LookupAddr returns the name of the provided IP address
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+// LookupCNAME returns the canonical name of a host
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return r.resolver.LookupCNAME(ctx, host)
+}
+
+// LookupHost returns the sorted IP addresses of a host
+func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	addrs, err := r.resolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+	return Sort(addrs), nil
+}
+
+// LookupHostWithCNAME returns the sorted IP addresses of a host along
+// with the CNAMEs encountered while resolving it, whose order we do not
+// change, since it is meaningful. If the wrapped resolver does not
+// support CNAMEs, the returned list of CNAMEs is always empty.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithCNAME)
+	if !ok {
+		addrs, err := r.LookupHost(ctx, hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+		return addrs, []string{}, nil
+	}
+	addrs, cnames, err := reso.LookupHostWithCNAME(ctx, hostname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Sort(addrs), cnames, nil
+}
+
+// LookupType queries for records of a specific type. We do not sort
+// the records, since their order may be meaningful, e.g., for CNAMEs.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithType)
+	if !ok {
+		return nil, errLookupTypeNotSupported
+	}
+	return reso.LookupType(ctx, name, qtype)
+}
+
+var errLookupTypeNotSupported = errors.New("sortingresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name. We do not sort
+// the records, since the priority defines their order.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	return reso.LookupHTTPS(ctx, name)
+}
+
+var errLookupHTTPSNotSupported = errors.New("sortingresolver: LookupHTTPS not supported")
+
+// LookupMX returns the MX records of a specific name
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver.LookupMX(ctx, name)
+}
+
+// LookupNS returns the NS records of a specific name
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return r.resolver.LookupNS(ctx, name)
+}
+
+// Close closes the underlying resolver.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
+
+// Sort returns a sorted copy of addrs. See the documentation of
+// Resolver for the ordering that we use.
+func Sort(addrs []string) []string {
+	if addrs == nil {
+		return nil
+	}
+	sorted := append([]string{}, addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	return sorted
+}
+
+// rank returns 0 for IPv4, 1 for IPv6, and 2 for other strings, along
+// with the address bytes, if addr is an IP address.
+func rank(addr string) (int, net.IP) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return 2, nil
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return 0, ipv4
+	}
+	return 1, ip
+}
+
+func less(left, right string) bool {
+	leftRank, leftIP := rank(left)
+	rightRank, rightIP := rank(right)
+	if leftRank != rightRank {
+		return leftRank < rightRank
+	}
+	if leftIP == nil {
+		return left < right
+	}
+	return bytes.Compare(leftIP, rightIP) < 0
+}
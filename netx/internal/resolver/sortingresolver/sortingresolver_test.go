@@ -0,0 +1,140 @@
+package sortingresolver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/staticresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func TestUnitSort(t *testing.T) {
+	addrs := []string{
+		"2001:db8::1", "10.0.0.10", "antani", "::1", "10.0.0.2", "1.1.1.1",
+	}
+	sorted := Sort(addrs)
+	expected := []string{
+		"1.1.1.1", "10.0.0.2", "10.0.0.10", "::1", "2001:db8::1", "antani",
+	}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Fatalf("unexpected order: %+v", sorted)
+	}
+	if addrs[0] != "2001:db8::1" {
+		t.Fatal("the original slice has been modified")
+	}
+	if Sort(nil) != nil {
+		t.Fatal("expected nil here")
+	}
+}
+
+func TestUnitLookupHostStableOrder(t *testing.T) {
+	expected := []string{"8.8.4.4", "8.8.8.8", "2001:4860:4860::8844", "2001:4860:4860::8888"}
+	permutations := [][]string{
+		{"2001:4860:4860::8888", "8.8.8.8", "2001:4860:4860::8844", "8.8.4.4"},
+		{"8.8.4.4", "2001:4860:4860::8844", "8.8.8.8", "2001:4860:4860::8888"},
+		{"2001:4860:4860::8844", "2001:4860:4860::8888", "8.8.8.8", "8.8.4.4"},
+	}
+	for _, addrs := range permutations {
+		reso := New(staticresolver.New(map[string][]string{
+			"dns.google": addrs,
+		}, brokenresolver.New()))
+		sorted, err := reso.LookupHost(context.Background(), "dns.google")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sorted, expected) {
+			t.Fatalf("unexpected order: %+v", sorted)
+		}
+		sorted, cnames, err := reso.LookupHostWithCNAME(context.Background(), "dns.google")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sorted, expected) || cnames == nil || len(cnames) != 0 {
+			t.Fatalf("unexpected result: %+v %+v", sorted, cnames)
+		}
+	}
+}
+
+func TestUnitLookupHostFailure(t *testing.T) {
+	reso := New(brokenresolver.New())
+	addrs, err := reso.LookupHost(context.Background(), "dns.google")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	addrs, cnames, err := reso.LookupHostWithCNAME(context.Background(), "dns.google")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+}
+
+type typeResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeResolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"hello"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	r := New(typeResolver{brokenresolver.New()})
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	r := New(brokenresolver.New())
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if !errors.Is(err, errLookupTypeNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type httpsResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsResolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, Target: "."}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	r := New(httpsResolver{brokenresolver.New()})
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	r := New(brokenresolver.New())
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if !errors.Is(err, errLookupHTTPSNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
@@ -0,0 +1,123 @@
+// Package staticresolver contains a resolver that returns statically
+// configured addresses for some hostnames, like /etc/hosts does, and
+// otherwise falls back to another resolver.
+package staticresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// Resolver is a resolver with a static hostname to addresses mapping.
+type Resolver struct {
+	fallback modelx.DNSResolver
+	mapping  map[string][]string
+}
+
+// New creates a new Resolver. The mapping keys are hostnames, which
+// are matched case insensitively and regardless of the trailing dot,
+// and the values are the addresses to return. Hostnames that are not
+// in the mapping are resolved using fallback.
+func New(mapping map[string][]string, fallback modelx.DNSResolver) *Resolver {
+	r := &Resolver{fallback: fallback, mapping: make(map[string][]string)}
+	for hostname, addrs := range mapping {
+		r.mapping[normalize(hostname)] = append([]string{}, addrs...)
+	}
+	return r
+}
+
+func normalize(hostname string) string {
+	return strings.ToLower(strings.TrimSuffix(hostname, "."))
+}
+
+func (r *Resolver) lookup(hostname string) ([]string, bool) {
+	addrs, found := r.mapping[normalize(hostname)]
+	if !found {
+		return nil, false
+	}
+	return append([]string{}, addrs...), true
+}
+
+// LookupAddr returns the name of the provided IP address
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.fallback.LookupAddr(ctx, addr)
+}
+
+// LookupCNAME returns the canonical name of a host
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return r.fallback.LookupCNAME(ctx, host)
+}
+
+// LookupHost returns the IP addresses of a host
+func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	if addrs, found := r.lookup(hostname); found {
+		return addrs, nil
+	}
+	return r.fallback.LookupHost(ctx, hostname)
+}
+
+// LookupHostWithCNAME returns the IP addresses of a host along with the
+// CNAMEs encountered while resolving it. There are no CNAMEs for mapped
+// hostnames. If the fallback does not support CNAMEs, the returned list
+// of CNAMEs is always empty.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	if addrs, found := r.lookup(hostname); found {
+		return addrs, []string{}, nil
+	}
+	if fallback, ok := r.fallback.(modelx.DNSResolverWithCNAME); ok {
+		return fallback.LookupHostWithCNAME(ctx, hostname)
+	}
+	addrs, err := r.fallback.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addrs, []string{}, nil
+}
+
+// LookupType queries for records of a specific type using the fallback,
+// which must support this functionality. The mapping only contains
+// addresses, hence we do not use it here.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	fallback, ok := r.fallback.(modelx.DNSResolverWithType)
+	if !ok {
+		return nil, errLookupTypeNotSupported
+	}
+	return fallback.LookupType(ctx, name, qtype)
+}
+
+var errLookupTypeNotSupported = errors.New("staticresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name using the fallback,
+// which must support this functionality.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := r.fallback.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	return reso.LookupHTTPS(ctx, name)
+}
+
+var errLookupHTTPSNotSupported = errors.New("staticresolver: LookupHTTPS not supported")
+
+// LookupMX returns the MX records of a specific name
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.fallback.LookupMX(ctx, name)
+}
+
+// LookupNS returns the NS records of a specific name
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return r.fallback.LookupNS(ctx, name)
+}
+
+// Close closes the fallback resolver.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.fallback)
+}
@@ -0,0 +1,141 @@
+package staticresolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func TestUnitMappedName(t *testing.T) {
+	fallback := brokenresolver.New()
+	reso := New(map[string][]string{
+		"example.com": {"1.2.3.4", "::1"},
+	}, fallback)
+	for _, hostname := range []string{"example.com", "EXAMPLE.com."} {
+		addrs, err := reso.LookupHost(context.Background(), hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 || addrs[0] != "1.2.3.4" || addrs[1] != "::1" {
+			t.Fatal("unexpected addresses")
+		}
+		addrs, cnames, err := reso.LookupHostWithCNAME(context.Background(), hostname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 2 || cnames == nil || len(cnames) != 0 {
+			t.Fatal("unexpected result")
+		}
+	}
+	if fallback.NumErrors.Load() != 0 {
+		t.Fatal("the fallback should not have been used")
+	}
+}
+
+func TestUnitUnmappedName(t *testing.T) {
+	fallback := brokenresolver.New()
+	reso := New(map[string][]string{
+		"example.com": {"1.2.3.4"},
+	}, fallback)
+	addrs, err := reso.LookupHost(context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	addrs, cnames, err := reso.LookupHostWithCNAME(context.Background(), "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+	if fallback.NumErrors.Load() != 2 {
+		t.Fatal("the fallback should have been used")
+	}
+}
+
+func TestUnitMappingIsCopied(t *testing.T) {
+	mapping := map[string][]string{"example.com": {"1.2.3.4"}}
+	reso := New(mapping, brokenresolver.New())
+	mapping["example.com"][0] = "5.6.7.8"
+	addrs, err := reso.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs[0] = "9.10.11.12"
+	addrs, err = reso.LookupHost(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs[0] != "1.2.3.4" {
+		t.Fatal("the mapping has been modified")
+	}
+}
+
+type typeResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeResolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"hello"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	r := New(nil, typeResolver{brokenresolver.New()})
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	r := New(nil, brokenresolver.New())
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if !errors.Is(err, errLookupTypeNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type httpsResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsResolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, Target: "."}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	r := New(nil, httpsResolver{brokenresolver.New()})
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	r := New(nil, brokenresolver.New())
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if !errors.Is(err, errLookupHTTPSNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -59,6 +60,98 @@ func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, e
 	return r.resolver.LookupHost(ctx, hostname)
 }
 
+// LookupHostWithCNAME returns the IP addresses of a host. Because the
+// system resolver does not tell us about CNAMEs, the returned list of
+// CNAMEs is always empty.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	addrs, err := r.LookupHost(ctx, hostname)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addrs, []string{}, nil
+}
+
+// LookupHostDNSSEC returns the IP addresses of a host. Because the
+// system resolver does not give us access to DNSSEC records, the result
+// always reports that DNSSEC validation is unsupported.
+func (r *Resolver) LookupHostDNSSEC(
+	ctx context.Context, hostname string) (modelx.DNSSECResult, error) {
+	addrs, err := r.LookupHost(ctx, hostname)
+	if err != nil {
+		return modelx.DNSSECResult{}, err
+	}
+	return modelx.DNSSECResult{Addresses: addrs, Unsupported: true}, nil
+}
+
+// ErrUnsupportedType indicates that LookupType cannot query for the
+// requested record type, because the stdlib does not expose it.
+var ErrUnsupportedType = errors.New("systemresolver: unsupported record type")
+
+type ipAddrResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+type txtResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// LookupType queries for records of a specific type. We only support
+// the types that the stdlib exposes, i.e., A, AAAA, and TXT, and return
+// ErrUnsupportedType for other types. Since the stdlib does not return
+// the raw resource records, we construct them without TTL.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	header := dns.RR_Header{
+		Name: dns.Fqdn(name), Rrtype: qtype, Class: dns.ClassINET,
+	}
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		reso, ok := r.resolver.(ipAddrResolver)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		addrs, err := reso.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var records []dns.RR
+		for _, addr := range addrs {
+			ipv4 := addr.IP.To4()
+			if qtype == dns.TypeA && ipv4 != nil {
+				records = append(records, &dns.A{Hdr: header, A: ipv4})
+			}
+			if qtype == dns.TypeAAAA && ipv4 == nil {
+				records = append(records, &dns.AAAA{Hdr: header, AAAA: addr.IP})
+			}
+		}
+		return records, nil
+	case dns.TypeTXT:
+		reso, ok := r.resolver.(txtResolver)
+		if !ok {
+			return nil, ErrUnsupportedType
+		}
+		txts, err := reso.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		var records []dns.RR
+		for _, txt := range txts {
+			records = append(records, &dns.TXT{Hdr: header, Txt: []string{txt}})
+		}
+		return records, nil
+	default:
+		return nil, ErrUnsupportedType
+	}
+}
+
+// LookupHTTPS queries for the HTTPS records of name. Because the stdlib
+// does not expose HTTPS records, this always fails with ErrUnsupportedType.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return nil, ErrUnsupportedType
+}
+
 // LookupMX returns the MX records of a specific name
 func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
 	return r.resolver.LookupMX(ctx, name)
@@ -68,3 +161,9 @@ func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error)
 func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
 	return r.resolver.LookupNS(ctx, name)
 }
+
+// Close closes the underlying resolver, which usually is a
+// *net.Resolver, hence Close usually does nothing.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
@@ -5,6 +5,8 @@ import (
 	"net"
 	"testing"
 
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -97,3 +99,139 @@ func TestLookupNS(t *testing.T) {
 		t.Fatal("expected non-nil result here")
 	}
 }
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	client := New(brokenresolver.New())
+	addrs, cnames, err := client.LookupHostWithCNAME(context.Background(), "localhost")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+}
+
+func TestIntegrationLookupHostWithCNAME(t *testing.T) {
+	client := New(new(net.Resolver))
+	addrs, cnames, err := client.LookupHostWithCNAME(context.Background(), "www.google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs == nil {
+		t.Fatal("expected non-nil addrs here")
+	}
+	if cnames == nil || len(cnames) != 0 {
+		t.Fatal("expected empty cnames here")
+	}
+}
+
+type fakestdlibresolver struct {
+	*brokenresolver.Resolver
+}
+
+func (fakestdlibresolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return []net.IPAddr{
+		{IP: net.ParseIP("8.8.8.8")},
+		{IP: net.ParseIP("2001:4860:4860::8888")},
+	}, nil
+}
+
+func (fakestdlibresolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return []string{"v=spf1 -all"}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	client := New(fakestdlibresolver{brokenresolver.New()})
+	ctx := context.Background()
+	records, err := client.LookupType(ctx, "dns.google", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].(*dns.A).A.String() != "8.8.8.8" {
+		t.Fatal("unexpected A records")
+	}
+	records, err = client.LookupType(ctx, "dns.google", dns.TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].(*dns.AAAA).AAAA.String() != "2001:4860:4860::8888" {
+		t.Fatal("unexpected AAAA records")
+	}
+	records, err = client.LookupType(ctx, "dns.google", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].(*dns.TXT).Txt[0] != "v=spf1 -all" {
+		t.Fatal("unexpected TXT records")
+	}
+	if records[0].Header().Name != "dns.google." {
+		t.Fatal("unexpected record name")
+	}
+	if _, err := client.LookupType(ctx, "dns.google", 65); err != ErrUnsupportedType {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestUnitLookupTypeWithoutStdlibMethods(t *testing.T) {
+	client := New(brokenresolver.New())
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+		records, err := client.LookupType(context.Background(), "dns.google", qtype)
+		if err != ErrUnsupportedType {
+			t.Fatal("not the error we expected")
+		}
+		if records != nil {
+			t.Fatal("expected nil records here")
+		}
+	}
+}
+
+func TestUnitLookupTypeFailure(t *testing.T) {
+	client := New(new(net.Resolver))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeTXT} {
+		records, err := client.LookupType(ctx, "dns.google", qtype)
+		if err == nil {
+			t.Fatal("expected an error here")
+		}
+		if records != nil {
+			t.Fatal("expected nil records here")
+		}
+	}
+}
+
+func TestUnitLookupHostDNSSEC(t *testing.T) {
+	client := New(new(net.Resolver))
+	result, err := client.LookupHostDNSSEC(context.Background(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Addresses) < 1 {
+		t.Fatal("expected some addresses here")
+	}
+	if !result.Unsupported || result.Validated || result.Bogus {
+		t.Fatal("expected DNSSEC to be reported as unsupported")
+	}
+}
+
+func TestUnitLookupHostDNSSECFailure(t *testing.T) {
+	client := New(brokenresolver.New())
+	result, err := client.LookupHostDNSSEC(context.Background(), "localhost")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if result.Addresses != nil {
+		t.Fatal("expected nil addresses here")
+	}
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	client := New(new(net.Resolver))
+	records, err := client.LookupHTTPS(context.Background(), "dns.google")
+	if err != ErrUnsupportedType {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
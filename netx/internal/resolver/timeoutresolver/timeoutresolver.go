@@ -0,0 +1,184 @@
+// Package timeoutresolver contains a resolver that bounds the time
+// spent in LookupHost, LookupHostWithCNAME, LookupType and LookupHTTPS,
+// regardless of the parent context.
+package timeoutresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// ErrTimeout is the error returned by LookupHost when the lookup
+// did not complete within the configured timeout. It wraps the
+// context.DeadlineExceeded error, so errwrapper classifies it as a
+// generic timeout, and callers can use errors.Is to check for it.
+var ErrTimeout = &timeoutError{}
+
+type timeoutError struct{}
+
+func (*timeoutError) Error() string {
+	return "timeoutresolver: lookup timed out: " + context.DeadlineExceeded.Error()
+}
+
+func (*timeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Resolver is a resolver with a LookupHost timeout
+type Resolver struct {
+	// Timeout is the maximum time LookupHost, LookupHostWithCNAME,
+	// LookupType and LookupHTTPS may take. A shorter deadline in the
+	// parent context still takes precedence. When zero or negative, we
+	// do not bound the time spent in lookups.
+	Timeout time.Duration
+
+	resolver modelx.DNSResolver
+}
+
+// New creates a new Resolver
+func New(resolver modelx.DNSResolver, timeout time.Duration) *Resolver {
+	return &Resolver{Timeout: timeout, resolver: resolver}
+}
+
+// LookupAddr returns the name of the provided IP address
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+// LookupCNAME returns the canonical name of a host
+func (r *Resolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	return r.resolver.LookupCNAME(ctx, host)
+}
+
+// LookupHost returns the IP addresses of a host. If the lookup does
+// not complete within Timeout, it returns ErrTimeout.
+func (r *Resolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	var addrs []string
+	done, err := r.do(ctx, func(ctx context.Context) (err error) {
+		addrs, err = r.resolver.LookupHost(ctx, hostname)
+		return
+	})
+	if !done {
+		return nil, err
+	}
+	return addrs, err
+}
+
+// LookupHostWithCNAME is like LookupHost but also returns the CNAMEs
+// encountered while resolving, if the wrapped resolver supports them.
+func (r *Resolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	var addrs, cnames []string
+	done, err := r.do(ctx, func(ctx context.Context) (err error) {
+		if reso, ok := r.resolver.(modelx.DNSResolverWithCNAME); ok {
+			addrs, cnames, err = reso.LookupHostWithCNAME(ctx, hostname)
+			return
+		}
+		addrs, err = r.resolver.LookupHost(ctx, hostname)
+		cnames = []string{}
+		return
+	})
+	if !done {
+		return nil, nil, err
+	}
+	return addrs, cnames, err
+}
+
+// LookupType queries for records of a specific type. It fails if the
+// wrapped resolver does not support this functionality.
+func (r *Resolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithType)
+	if !ok {
+		return nil, errLookupTypeNotSupported
+	}
+	var records []dns.RR
+	done, err := r.do(ctx, func(ctx context.Context) (err error) {
+		records, err = reso.LookupType(ctx, name, qtype)
+		return
+	})
+	if !done {
+		return nil, err
+	}
+	return records, err
+}
+
+var errLookupTypeNotSupported = errors.New("timeoutresolver: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name. It fails if the
+// wrapped resolver does not support this functionality.
+func (r *Resolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	var records []modelx.HTTPSRecord
+	done, err := r.do(ctx, func(ctx context.Context) (err error) {
+		records, err = reso.LookupHTTPS(ctx, name)
+		return
+	})
+	if !done {
+		return nil, err
+	}
+	return records, err
+}
+
+var errLookupHTTPSNotSupported = errors.New("timeoutresolver: LookupHTTPS not supported")
+
+// do runs lookup in a background goroutine and waits for it to complete
+// or for Timeout to expire, in which case it returns ErrTimeout. The
+// goroutine does not outlive lookup, which sees a context canceled when
+// we return. We return done equal to true when lookup has completed, so
+// that its results are valid even when it returned an error; otherwise,
+// lookup may still be running and callers must ignore its results.
+func (r *Resolver) do(
+	ctx context.Context, lookup func(ctx context.Context) error) (done bool, err error) {
+	if r.Timeout <= 0 {
+		return true, lookup(ctx)
+	}
+	childctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	ch := make(chan error, 1) // buffered so the goroutine never blocks
+	go func() {
+		ch <- lookup(childctx)
+	}()
+	select {
+	case err := <-ch:
+		if err != nil && r.timedOut(ctx, childctx) {
+			return false, ErrTimeout
+		}
+		return true, err
+	case <-childctx.Done():
+		if r.timedOut(ctx, childctx) {
+			return false, ErrTimeout
+		}
+		return false, ctx.Err()
+	}
+}
+
+// timedOut returns true when our own timeout expired, as opposed to
+// the parent context being canceled or reaching its own deadline.
+func (r *Resolver) timedOut(ctx, childctx context.Context) bool {
+	return ctx.Err() == nil && errors.Is(childctx.Err(), context.DeadlineExceeded)
+}
+
+// LookupMX returns the MX records of a specific name
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return r.resolver.LookupMX(ctx, name)
+}
+
+// LookupNS returns the NS records of a specific name
+func (r *Resolver) LookupNS(ctx context.Context, name string) ([]*net.NS, error) {
+	return r.resolver.LookupNS(ctx, name)
+}
+
+// Close closes the underlying resolver.
+func (r *Resolver) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
@@ -0,0 +1,294 @@
+package timeoutresolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// hangingResolver is a resolver whose LookupHost blocks until the
+// context is done, and then signals that it has returned.
+type hangingResolver struct {
+	*brokenresolver.Resolver
+	returned chan struct{}
+}
+
+func newHangingResolver() *hangingResolver {
+	return &hangingResolver{
+		Resolver: brokenresolver.New(),
+		returned: make(chan struct{}),
+	}
+}
+
+func (r *hangingResolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	defer close(r.returned)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+type fixedResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (fixedResolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	return []string{"8.8.8.8"}, nil
+}
+
+func TestUnitLookupHostSuccess(t *testing.T) {
+	r := New(fixedResolver{brokenresolver.New()}, time.Second)
+	addrs, err := r.LookupHost(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitLookupHostOtherFailure(t *testing.T) {
+	r := New(brokenresolver.New(), time.Second)
+	addrs, err := r.LookupHost(context.Background(), "dns.google")
+	var dnsError *net.DNSError
+	if !errors.As(err, &dnsError) {
+		t.Fatal("not the error we expected")
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Fatal("should not be a timeout error")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+}
+
+func TestUnitLookupHostTimeout(t *testing.T) {
+	child := newHangingResolver()
+	r := New(child, 10*time.Millisecond)
+	addrs, err := r.LookupHost(context.Background(), "dns.google")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("not the error we expected")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("should also be a deadline exceeded error")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	select {
+	case <-child.returned:
+	case <-time.After(time.Second):
+		t.Fatal("the lookup goroutine is leaking")
+	}
+}
+
+func TestUnitLookupHostShorterParentDeadline(t *testing.T) {
+	child := newHangingResolver()
+	r := New(child, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := r.LookupHost(ctx, "dns.google")
+	if time.Since(start) > 10*time.Second {
+		t.Fatal("did not respect the parent deadline")
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Fatal("should not be our own timeout error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("not the error we expected")
+	}
+	<-child.returned
+}
+
+func TestUnitLookupHostParentCanceled(t *testing.T) {
+	child := newHangingResolver()
+	r := New(child, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.LookupHost(ctx, "dns.google")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("not the error we expected")
+	}
+	<-child.returned
+}
+
+func TestUnitOtherMethods(t *testing.T) {
+	r := New(brokenresolver.New(), time.Second)
+	ctx := context.Background()
+	if _, err := r.LookupAddr(ctx, "8.8.8.8"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := r.LookupCNAME(ctx, "dns.google"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := r.LookupMX(ctx, "dns.google"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if _, err := r.LookupNS(ctx, "dns.google"); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+type cnameResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (cnameResolver) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	return []string{"8.8.8.8"}, []string{"dns.example.net."}, nil
+}
+
+func TestUnitLookupHostWithCNAME(t *testing.T) {
+	r := New(cnameResolver{brokenresolver.New()}, time.Second)
+	addrs, cnames, err := r.LookupHostWithCNAME(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addresses")
+	}
+	if len(cnames) != 1 || cnames[0] != "dns.example.net." {
+		t.Fatal("unexpected cnames")
+	}
+}
+
+func TestUnitLookupHostWithCNAMEWithoutSupport(t *testing.T) {
+	r := New(fixedResolver{brokenresolver.New()}, time.Second)
+	addrs, cnames, err := r.LookupHostWithCNAME(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addresses")
+	}
+	if cnames == nil || len(cnames) != 0 {
+		t.Fatal("expected empty cnames")
+	}
+}
+
+func TestUnitLookupHostWithCNAMETimeout(t *testing.T) {
+	child := newHangingResolver()
+	r := New(child, 10*time.Millisecond)
+	addrs, cnames, err := r.LookupHostWithCNAME(context.Background(), "dns.google")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("not the error we expected")
+	}
+	if addrs != nil || cnames != nil {
+		t.Fatal("expected nil results here")
+	}
+	<-child.returned
+}
+
+type bogonResolver struct {
+	*brokenresolver.Resolver
+}
+
+var errBogon = errors.New("mocked bogon error")
+
+func (bogonResolver) LookupHost(ctx context.Context, hostname string) ([]string, error) {
+	return []string{"10.0.0.1"}, errBogon
+}
+
+func TestUnitLookupHostKeepsAddressesOnError(t *testing.T) {
+	r := New(bogonResolver{brokenresolver.New()}, time.Second)
+	addrs, err := r.LookupHost(context.Background(), "dns.google")
+	if !errors.Is(err, errBogon) {
+		t.Fatal("not the error we expected")
+	}
+	if len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+		t.Fatal("expected the addresses returned along with the error")
+	}
+}
+
+type typeResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (typeResolver) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	return []dns.RR{&dns.TXT{Txt: []string{"hello"}}}, nil
+}
+
+func TestUnitLookupType(t *testing.T) {
+	r := New(typeResolver{brokenresolver.New()}, time.Second)
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+}
+
+func TestUnitLookupTypeNotSupported(t *testing.T) {
+	r := New(brokenresolver.New(), time.Second)
+	records, err := r.LookupType(context.Background(), "example.com", dns.TypeTXT)
+	if !errors.Is(err, errLookupTypeNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+type httpsResolver struct {
+	*brokenresolver.Resolver
+}
+
+func (httpsResolver) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	return []modelx.HTTPSRecord{{Priority: 1, Target: "."}}, nil
+}
+
+func TestUnitLookupHTTPS(t *testing.T) {
+	r := New(httpsResolver{brokenresolver.New()}, time.Second)
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 {
+		t.Fatal("unexpected records")
+	}
+}
+
+func TestUnitLookupHTTPSNotSupported(t *testing.T) {
+	r := New(brokenresolver.New(), time.Second)
+	records, err := r.LookupHTTPS(context.Background(), "example.com")
+	if !errors.Is(err, errLookupHTTPSNotSupported) {
+		t.Fatal("not the error we expected")
+	}
+	if records != nil {
+		t.Fatal("expected nil records here")
+	}
+}
+
+func TestUnitZeroTimeout(t *testing.T) {
+	r := &Resolver{resolver: fixedResolver{brokenresolver.New()}}
+	addrs, err := r.LookupHost(context.Background(), "dns.google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "8.8.8.8" {
+		t.Fatal("unexpected addresses")
+	}
+}
+
+func TestUnitNegativeTimeoutRespectsParentContext(t *testing.T) {
+	child := newHangingResolver()
+	r := New(child, -1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := r.LookupHost(ctx, "dns.google")
+	if errors.Is(err, ErrTimeout) {
+		t.Fatal("should not be our own timeout error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("not the error we expected")
+	}
+	<-child.returned
+}
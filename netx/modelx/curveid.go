@@ -0,0 +1,16 @@
+//go:build go1.25
+// +build go1.25
+
+package modelx
+
+import "crypto/tls"
+
+// curveID returns the key exchange group selected by the server, or
+// nil if we don't know it, e.g., because we used RSA key exchange.
+func curveID(s tls.ConnectionState) *uint16 {
+	if s.CurveID == 0 {
+		return nil
+	}
+	id := uint16(s.CurveID)
+	return &id
+}
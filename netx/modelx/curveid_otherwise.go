@@ -0,0 +1,12 @@
+//go:build !go1.25
+// +build !go1.25
+
+package modelx
+
+import "crypto/tls"
+
+// curveID returns nil because before Go 1.25 the standard library
+// does not tell us the key exchange group selected by the server.
+func curveID(s tls.ConnectionState) *uint16 {
+	return nil
+}
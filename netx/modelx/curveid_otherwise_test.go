@@ -0,0 +1,19 @@
+//go:build !go1.25
+// +build !go1.25
+
+package modelx
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestUnitNewTLSConnectionStateCurveID(t *testing.T) {
+	state := NewTLSConnectionState(tls.ConnectionState{})
+	if state.CurveID != nil {
+		t.Fatal("expected nil CurveID")
+	}
+	if state.SignatureScheme != nil {
+		t.Fatal("expected nil SignatureScheme")
+	}
+}
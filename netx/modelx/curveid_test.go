@@ -0,0 +1,26 @@
+//go:build go1.25
+// +build go1.25
+
+package modelx
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestUnitNewTLSConnectionStateCurveID(t *testing.T) {
+	state := NewTLSConnectionState(tls.ConnectionState{CurveID: tls.X25519})
+	if state.CurveID == nil || *state.CurveID != uint16(tls.X25519) {
+		t.Fatal("unexpected CurveID")
+	}
+	if state.SignatureScheme != nil {
+		t.Fatal("expected nil SignatureScheme")
+	}
+}
+
+func TestUnitNewTLSConnectionStateCurveIDUnknown(t *testing.T) {
+	state := NewTLSConnectionState(tls.ConnectionState{})
+	if state.CurveID != nil {
+		t.Fatal("expected nil CurveID")
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/crypto/ocsp"
 )
 
 // Measurement contains zero or more events. Do not assume that at any
@@ -43,6 +44,29 @@ type Measurement struct {
 	Write   *WriteEvent   `json:",omitempty"`
 	Close   *CloseEvent   `json:",omitempty"`
 
+	// Deadline events
+	//
+	// Identified by a ConnID. They are emitted right after the Read
+	// or Write event when the operation failed because the deadline set
+	// using SetDeadline, SetReadDeadline or SetWriteDeadline expired.
+	ReadTimeout  *ReadTimeoutEvent  `json:",omitempty"`
+	WriteTimeout *WriteTimeoutEvent `json:",omitempty"`
+
+	// Dial events
+	//
+	// Identified by a DialID. A dial may consist of several CONNECT
+	// attempts, one for each resolved address, and DialDone tells us
+	// which address, if any, was successfully used in the end.
+	DialDone *DialDoneEvent `json:",omitempty"`
+
+	// Proxy events
+	//
+	// Identified by a DialID. They wrap the dial towards the proxy, which
+	// has its own DialID, and the proxy handshake, so that we can tell
+	// proxy failures apart from failures of the target.
+	ProxyConnectStart *ProxyConnectStartEvent `json:",omitempty"`
+	ProxyConnectDone  *ProxyConnectDoneEvent  `json:",omitempty"`
+
 	// TLS events
 	//
 	// Identified by either ConnID or TransactionID. In the former case
@@ -68,6 +92,13 @@ type Measurement struct {
 	HTTPResponseStart      *HTTPResponseStartEvent      `json:",omitempty"`
 	HTTPRoundTripDone      *HTTPRoundTripDoneEvent      `json:",omitempty"`
 
+	// HTTP redirect events
+	//
+	// Identified by the TransactionID of the round trip that received
+	// the redirect response and emitted right after its HTTPRoundTripDone
+	// event, so that one can reconstruct the redirect chain.
+	HTTPRedirect *HTTPRedirectEvent `json:",omitempty"`
+
 	// HTTP body events
 	//
 	// They are identified by the TransactionID. You are not going to see
@@ -76,6 +107,14 @@ type Measurement struct {
 	HTTPResponseBodyPart *HTTPResponseBodyPartEvent `json:",omitempty"`
 	HTTPResponseDone     *HTTPResponseDoneEvent     `json:",omitempty"`
 
+	// WebSocket events
+	//
+	// Identified by TransactionID. The upgrade starts before we dial
+	// and ends when we've got the response to the upgrade request or
+	// an error. The dial and TLS events in between use the same ID.
+	WebSocketUpgradeStart *WebSocketUpgradeStartEvent `json:",omitempty"`
+	WebSocketUpgradeDone  *WebSocketUpgradeDoneEvent  `json:",omitempty"`
+
 	// Extension events.
 	//
 	// The purpose of these events is to give us some flexibility to
@@ -104,6 +143,18 @@ const (
 	// FailureGenericTimeoutError means we got some timer has expired.
 	FailureGenericTimeoutError = "generic_timeout_error"
 
+	// FailureProxyAuthRequired means that the HTTP proxy answered to
+	// the CONNECT request with 407 Proxy Authentication Required.
+	FailureProxyAuthRequired = "proxy_auth_required"
+
+	// FailureProxyConnectRefused means that the HTTP proxy answered to
+	// the CONNECT request with a status code other than 200 and 407.
+	FailureProxyConnectRefused = "proxy_connect_refused"
+
+	// FailureSSLPinMismatch means that no certificate in the chain
+	// matches the public keys that we have pinned.
+	FailureSSLPinMismatch = "ssl_pin_mismatch"
+
 	// FailureSSLInvalidHostname means we got certificate is not valid for SNI.
 	FailureSSLInvalidHostname = "ssl_invalid_hostname"
 
@@ -140,6 +191,8 @@ type ErrWrapper struct {
 	// - `connect`: connecting to an IP failed
 	// - `tls_handshake`: TLS handshaking failed
 	// - `http_round_trip`: other errors during round trip
+	// - `websocket_upgrade`: other errors during the WebSocket upgrade
+	// - `proxy_connect`: the proxy handshake failed
 	//
 	// Because a network connection doesn't necessarily know
 	// what is the current major operation we also have the
@@ -176,6 +229,13 @@ func (e *ErrWrapper) Unwrap() error {
 
 // CloseEvent is emitted when the CLOSE syscall returns.
 type CloseEvent struct {
+	// BytesRead is the total number of bytes read from this
+	// connection over its whole lifetime.
+	BytesRead int64
+
+	// BytesWritten is like BytesRead but for bytes written.
+	BytesWritten int64
+
 	// ConnID is the identifier of this connection.
 	ConnID int64
 
@@ -207,6 +267,14 @@ type ConnectEvent struct {
 	// Error is the error returned by CONNECT.
 	Error error
 
+	// KeepAlive is the configured TCP keep-alive period. Zero means
+	// Go's default period and a negative value means disabled.
+	KeepAlive time.Duration `json:",omitempty"`
+
+	// LocalAddress is the local address of the connection, which
+	// is empty if we could not connect.
+	LocalAddress string `json:",omitempty"`
+
 	// Network is the network we're dialing for, e.g. "tcp"
 	Network string
 
@@ -220,6 +288,62 @@ type ConnectEvent struct {
 	// TransactionID is the ID of the HTTP transaction that caused the
 	// current dial to run, or zero if there's no such transaction.
 	TransactionID int64 `json:",omitempty"`
+
+	// VantagePoint is the vantage point configured in the context
+	// using WithVantagePoint, if any. We do not serialize it, since
+	// it contains the probe IP.
+	VantagePoint *VantagePoint `json:"-"`
+}
+
+// DialDoneEvent is emitted when a dial operation terminates after
+// having tried to connect to one or more remote addresses.
+type DialDoneEvent struct {
+	// Address is the address we were asked to dial.
+	Address string
+
+	// ConnID is the identifier of the connection we have established,
+	// or zero if we could not connect to any remote address. Knowing
+	// this ID allows you to bind dial events to net and HTTP events.
+	ConnID int64
+
+	// DialID is the identifier of this dial operation.
+	DialID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the error returned by the dial operation.
+	Error error
+
+	// FailedAddresses contains the remote addresses that we tried
+	// before RemoteAddress, in order, and that we could not connect to.
+	FailedAddresses []string
+
+	// FailedAttempts is like FailedAddresses but also contains the
+	// error that occurred when connecting to each address.
+	FailedAttempts []DialAttemptFailure `json:",omitempty"`
+
+	// Network is the network we're dialing for, e.g. "tcp"
+	Network string
+
+	// RemoteAddress is the remote address we're connected to, or
+	// empty if we could not connect to any remote address.
+	RemoteAddress string
+
+	// TransactionID is the ID of the HTTP transaction that caused the
+	// current dial to run, or zero if there's no such transaction.
+	TransactionID int64 `json:",omitempty"`
+}
+
+// DialAttemptFailure describes why we could not connect to one of
+// the remote addresses tried by a dial operation.
+type DialAttemptFailure struct {
+	// Address is the remote address we could not connect to.
+	Address string
+
+	// Error is the error that occurred.
+	Error error
 }
 
 // DNSQueryEvent is emitted when we send a DNS query.
@@ -235,6 +359,10 @@ type DNSQueryEvent struct {
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
+	// ECSPrefix is the EDNS Client Subnet prefix we've sent along
+	// with the query. It is empty when we did not send ECS.
+	ECSPrefix string `json:",omitempty"`
+
 	// Msg is the parsed message we're sending to the server.
 	Msg *dns.Msg `json:"-"`
 }
@@ -313,10 +441,31 @@ type HTTPConnectionReadyEvent struct {
 	// this ID allows you to bind HTTP events to net events.
 	ConnID int64
 
+	// ConnIdleTime is the time for which the connection was idle
+	// before being used for this request, if ConnWasIdle is true.
+	ConnIdleTime time.Duration
+
+	// ConnReused indicates whether the connection has been used for
+	// previous requests, rather than being freshly dialed. Note that
+	// netx's HTTP transport sets MaxConnsPerHost to one, hence requests
+	// to the same host are serialized on a single connection and most
+	// requests but the first one will see a reused connection. Keep
+	// this in mind when interpreting latencies.
+	ConnReused bool
+
+	// ConnWasIdle indicates whether the connection was obtained from
+	// the pool of idle connections.
+	ConnWasIdle bool
+
 	// DurationSinceBeginning is the number of nanoseconds since
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
+	// RemoteAddress is the remote address of the connection, i.e.,
+	// the IP address and port of the server, also when the connection
+	// has been reused rather than freshly dialed.
+	RemoteAddress string
+
 	// TransactionID is the identifier of this transaction
 	TransactionID int64
 }
@@ -428,11 +577,21 @@ type HTTPRoundTripDoneEvent struct {
 	// about saving them using other means.
 	RequestBodySnap []byte
 
+	// RequestBodySnapTruncated indicates whether the request body was
+	// longer than MaxBodySnapSize, and hence RequestBodySnap is truncated.
+	RequestBodySnapTruncated bool
+
 	// RequestHeaders contain the original request headers. This is
 	// included here to make this event actionable without needing to
 	// join it with other events, as it's too important.
 	RequestHeaders http.Header
 
+	// RequestHeadersList contains the request headers in the order in
+	// which we have written them, including duplicates, which instead
+	// are merged by RequestHeaders. This allows to detect headers that
+	// have been reordered or injected by a middlebox.
+	RequestHeadersList []HTTPHeaderField
+
 	// RequestMethod is the original request method. This is here
 	// for the same reason of RequestHeaders.
 	RequestMethod string
@@ -447,15 +606,49 @@ type HTTPRoundTripDoneEvent struct {
 	// mainly to log small stuff like DoH and redirects.
 	ResponseBodySnap []byte
 
-	// ResponseHeaders contains the response headers if error is nil.
+	// ResponseBodySnapTruncated is like RequestBodySnapTruncated
+	// but for the response body.
+	ResponseBodySnapTruncated bool
+
+	// ResponseBodySnapChunks contains the chunks in which we read the
+	// response body snapshot, if MeasurementRoot.BodySnapChunkSize is
+	// positive, and is empty otherwise. We also fill it when reading
+	// the snapshot fails, so that we know when the body stalled.
+	ResponseBodySnapChunks []BodyChunk `json:",omitempty"`
+
+	// ResponseBodySnapSkipped indicates that we did not save a snapshot
+	// of the response body because of its content type. In such case,
+	// ResponseBodySnap is empty.
+	ResponseBodySnapSkipped bool
+
+	// ResponseBodyAborted indicates that we closed the response body
+	// right after receiving the response headers, as requested, so that
+	// we did not download it. In such case, ResponseBodySnap is empty.
+	ResponseBodyAborted bool
+
+	// ResponseHeaders contains the response headers if error is nil. Since
+	// net/http does not tell us the order in which we received the response
+	// headers, there is no response equivalent of RequestHeadersList.
 	ResponseHeaders http.Header
 
 	// ResponseProto contains the response protocol
 	ResponseProto string
 
+	// ResponseRemoteAddress is the remote address of the connection
+	// used to receive the response, i.e., the IP address and port of
+	// the server that served it, or empty if error is not nil. With
+	// redirects, each hop is a distinct transaction, so each hop has
+	// its own address, which may differ from the others.
+	ResponseRemoteAddress string
+
 	// ResponseStatusCode contains the HTTP status code if error is nil.
 	ResponseStatusCode int64
 
+	// ResponseTLS is the state of the TLS connection used to receive
+	// the response, or nil if error is not nil or the request was sent
+	// using plaintext HTTP.
+	ResponseTLS *TLSConnectionState
+
 	// MaxBodySnapSize is the maximum size of the bodies snapshot.
 	MaxBodySnapSize int64
 
@@ -463,6 +656,50 @@ type HTTPRoundTripDoneEvent struct {
 	TransactionID int64
 }
 
+// HTTPRedirectEvent is emitted when a round trip receives a redirect
+// response, i.e., a response with status code 301, 302, 303, 307, or 308
+// and a valid Location header. We emit this event regardless of whether
+// the client will follow the redirect.
+type HTTPRedirectEvent struct {
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// From is the URL of the request that was redirected.
+	From string
+
+	// StatusCode is the status code of the redirect response.
+	StatusCode int64
+
+	// To is the URL in the Location header, resolved relative
+	// to the URL of the request that was redirected.
+	To string
+
+	// TransactionID is the identifier of this transaction
+	TransactionID int64
+}
+
+// BodyChunk is a chunk of a body that we have read.
+type BodyChunk struct {
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// NumBytes is the size of the chunk, which is less than the
+	// configured chunk size only for the last chunk.
+	NumBytes int64
+}
+
+// HTTPHeaderField is a single header field, i.e., a key and
+// one of its values.
+type HTTPHeaderField struct {
+	// Key is the header key.
+	Key string
+
+	// Value is the header value.
+	Value string
+}
+
 // HTTPResponseBodyPartEvent is emitted after we have received
 // a part of the response body, or an error reading it. Note that
 // bytes read here does not necessarily match bytes returned by
@@ -502,6 +739,75 @@ type HTTPResponseDoneEvent struct {
 	TransactionID int64
 }
 
+// ProxyConnectStartEvent is emitted when we start connecting to a
+// target address through a proxy.
+type ProxyConnectStartEvent struct {
+	// DialID is the identifier of this dial operation.
+	DialID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Network is the network we're dialing for, e.g. "tcp"
+	Network string
+
+	// ProxyAddress is the address of the proxy.
+	ProxyAddress string
+
+	// ProxyType is the type of proxy, i.e., "http", "https", or "socks5".
+	ProxyType string
+
+	// TargetAddress is the address we asked the proxy to connect to.
+	TargetAddress string
+
+	// TransactionID is the ID of the HTTP transaction that caused the
+	// current dial to run, or zero if there's no such transaction.
+	TransactionID int64 `json:",omitempty"`
+}
+
+// ProxyConnectDoneEvent is emitted when we have connected to a
+// target address through a proxy or failed to do so. A failure
+// whose Operation is `connect` means we could not connect to the
+// proxy, while `proxy_connect` means that the proxy handshake failed,
+// e.g., because the proxy could not connect to the target.
+type ProxyConnectDoneEvent struct {
+	// ConnID is the identifier of the connection towards the proxy,
+	// or zero if we could not connect through the proxy.
+	ConnID int64
+
+	// DialID is the identifier of this dial operation.
+	DialID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the result of connecting through the proxy.
+	Error error
+
+	// Network is the network we're dialing for, e.g. "tcp"
+	Network string
+
+	// ProxyAddress is the address of the proxy.
+	ProxyAddress string
+
+	// ProxyType is the type of proxy, i.e., "http", "https", or "socks5".
+	ProxyType string
+
+	// StatusCode is the status code of the response to the CONNECT
+	// request, or zero if the proxy is not an HTTP proxy or we did not
+	// receive any response.
+	StatusCode int64 `json:",omitempty"`
+
+	// TargetAddress is the address we asked the proxy to connect to.
+	TargetAddress string
+
+	// TransactionID is the ID of the HTTP transaction that caused the
+	// current dial to run, or zero if there's no such transaction.
+	TransactionID int64 `json:",omitempty"`
+}
+
 // ReadEvent is emitted when the READ/RECV syscall returns.
 type ReadEvent struct {
 	// ConnID is the identifier of this connection.
@@ -523,6 +829,17 @@ type ReadEvent struct {
 	SyscallDuration time.Duration
 }
 
+// ReadTimeoutEvent is emitted when READ/RECV fails because the
+// read deadline of the connection expired.
+type ReadTimeoutEvent struct {
+	// ConnID is the identifier of this connection.
+	ConnID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+}
+
 // ResolveStartEvent is emitted when we start resolving a domain name.
 type ResolveStartEvent struct {
 	// DialID is the identifier of the dial operation as
@@ -545,8 +862,18 @@ type ResolveStartEvent struct {
 	TransportNetwork string
 
 	// TransportAddress is the address used by the DNS transport, which
-	// is of course relative to the TransportNetwork.
+	// is of course relative to the TransportNetwork. For DoH, this is
+	// the URL, or the URI template, of the server.
 	TransportAddress string
+
+	// TransportMethod is the HTTP method used by the DNS transport when
+	// the TransportNetwork is "doh", and is empty otherwise.
+	TransportMethod string `json:",omitempty"`
+
+	// VantagePoint is the vantage point configured in the context
+	// using WithVantagePoint, if any. We do not serialize it, since
+	// it contains the probe IP.
+	VantagePoint *VantagePoint `json:"-"`
 }
 
 // ResolveDoneEvent is emitted when we know the IP addresses of a
@@ -555,6 +882,10 @@ type ResolveDoneEvent struct {
 	// Addresses is the list of returned addresses (empty on error).
 	Addresses []string
 
+	// CNAMEs is the ordered list of CNAMEs encountered while resolving
+	// Hostname, if the underlying resolver is able to return it.
+	CNAMEs []string `json:",omitempty"`
+
 	// ContainsBogons indicates whether Addresses contains one
 	// or more IP addresses that classify as bogons.
 	ContainsBogons bool
@@ -573,6 +904,12 @@ type ResolveDoneEvent struct {
 	// Hostname is the domain name to resolve.
 	Hostname string
 
+	// LookupDuration is the number of nanoseconds we were blocked
+	// waiting for the lookup to complete. It is also set on failure,
+	// where Error tells a timeout apart from, e.g., NXDOMAIN. The
+	// lookup started at DurationSinceBeginning - LookupDuration.
+	LookupDuration time.Duration
+
 	// TransactionID is the ID of the HTTP transaction that caused the
 	// current dial to run, or zero if there's no such transaction.
 	TransactionID int64 `json:",omitempty"`
@@ -582,39 +919,138 @@ type ResolveDoneEvent struct {
 	TransportNetwork string
 
 	// TransportAddress is the address used by the DNS transport, which
-	// is of course relative to the TransportNetwork.
+	// is of course relative to the TransportNetwork. For DoH, this is
+	// the URL, or the URI template, of the server.
 	TransportAddress string
+
+	// TransportMethod is the HTTP method used by the DNS transport when
+	// the TransportNetwork is "doh", and is empty otherwise.
+	TransportMethod string `json:",omitempty"`
+
+	// VantagePoint is the vantage point configured in the context
+	// using WithVantagePoint, if any. We do not serialize it, since
+	// it contains the probe IP.
+	VantagePoint *VantagePoint `json:"-"`
 }
 
 // X509Certificate is an x.509 certificate.
 type X509Certificate struct {
 	// Data contains the certificate bytes in DER format.
 	Data []byte
+
+	// Issuer is the distinguished name of the certificate issuer.
+	Issuer string
+
+	// NotAfter is the end of the certificate validity period.
+	NotAfter time.Time
+
+	// NotBefore is the beginning of the certificate validity period.
+	NotBefore time.Time
+
+	// Subject is the distinguished name of the certificate subject.
+	Subject string
 }
 
 // TLSConnectionState contains the TLS connection state.
 type TLSConnectionState struct {
 	CipherSuite        uint16
+	CurveID            *uint16 // nil when unavailable
+	DidResume          bool
 	NegotiatedProtocol string
+	OCSPResponse       *OCSPResponse // nil when OCSPStapled is false
+	OCSPStapled        bool
 	PeerCertificates   []X509Certificate
+	SignatureScheme    *uint16 // nil when unavailable
 	Version            uint16
 }
 
-// NewTLSConnectionState creates a new TLSConnectionState.
+// NewTLSConnectionState creates a new TLSConnectionState. The CurveID
+// field, i.e., the key exchange group selected by the server, is only
+// available when building with Go >= 1.25. The SignatureScheme field,
+// i.e., the scheme used by the server to sign the handshake, is always
+// unavailable, because the standard library does not expose it. We
+// leave unavailable fields nil rather than guessing their value.
 func NewTLSConnectionState(s tls.ConnectionState) TLSConnectionState {
 	return TLSConnectionState{
 		CipherSuite:        s.CipherSuite,
+		CurveID:            curveID(s),
+		DidResume:          s.DidResume,
 		NegotiatedProtocol: s.NegotiatedProtocol,
+		OCSPResponse:       NewOCSPResponse(s.OCSPResponse, s.PeerCertificates),
+		OCSPStapled:        len(s.OCSPResponse) > 0,
 		PeerCertificates:   SimplifyCerts(s.PeerCertificates),
 		Version:            s.Version,
 	}
 }
 
-// SimplifyCerts simplifies a certificate chain for archival
+// OCSPResponse is the OCSP response stapled by the server during
+// the TLS handshake.
+type OCSPResponse struct {
+	// Data contains the raw OCSP response in DER format.
+	Data []byte
+
+	// NextUpdate is the time by which newer information will be
+	// available. It is zero if the responder did not set it.
+	NextUpdate time.Time
+
+	// ParseError is the error that occurred parsing Data, if any, in
+	// which case the other fields besides Data are not meaningful.
+	ParseError string `json:",omitempty"`
+
+	// ProducedAt is the time when the response was signed.
+	ProducedAt time.Time
+
+	// Status is one of "good", "revoked", and "unknown".
+	Status string
+
+	// ThisUpdate is the time when the status was known to be correct.
+	ThisUpdate time.Time
+}
+
+// NewOCSPResponse parses the stapled OCSP response data. It returns nil
+// when data is empty, i.e., the server did not staple any response.
+// The chain is the one sent by the peer, with the leaf first, and we
+// use the certificate following the leaf as the issuer, if available,
+// to check the signature of the response.
+func NewOCSPResponse(data []byte, chain []*x509.Certificate) *OCSPResponse {
+	if len(data) <= 0 {
+		return nil
+	}
+	out := &OCSPResponse{Data: data}
+	var issuer *x509.Certificate
+	if len(chain) > 1 {
+		issuer = chain[1]
+	}
+	resp, err := ocsp.ParseResponse(data, issuer)
+	if err != nil {
+		out.ParseError = err.Error()
+		return out
+	}
+	out.NextUpdate = resp.NextUpdate
+	out.ProducedAt = resp.ProducedAt
+	out.ThisUpdate = resp.ThisUpdate
+	switch resp.Status {
+	case ocsp.Good:
+		out.Status = "good"
+	case ocsp.Revoked:
+		out.Status = "revoked"
+	default:
+		out.Status = "unknown"
+	}
+	return out
+}
+
+// SimplifyCerts simplifies a certificate chain for archival. We keep
+// the whole chain in the same order in which the peer sent it, that
+// is, the leaf certificate comes first.
 func SimplifyCerts(in []*x509.Certificate) (out []X509Certificate) {
 	for _, cert := range in {
 		out = append(out, X509Certificate{
-			Data: cert.Raw,
+			Data:      cert.Raw,
+			Issuer:    cert.Issuer.String(),
+			NotAfter:  cert.NotAfter,
+			NotBefore: cert.NotBefore,
+			Subject:   cert.Subject.String(),
 		})
 	}
 	return
@@ -632,6 +1068,20 @@ type TLSHandshakeStartEvent struct {
 	// the time configured as the "zero" time.
 	DurationSinceBeginning time.Duration
 
+	// Fingerprint is the name of the ClientHello fingerprint we're
+	// using, or empty if we're using Go's default ClientHello.
+	Fingerprint string `json:",omitempty"`
+
+	// NextProtos contains the ALPN protocols we're offering. The
+	// protocol that has been negotiated, if any, is instead part of
+	// the TLSHandshakeDoneEvent's ConnectionState.
+	NextProtos []string `json:",omitempty"`
+
+	// RemoteAddress is the address of the endpoint we're handshaking
+	// with, if known. Comparing it with SNI allows to spot cases where
+	// we presented a SNI unrelated to the address we dialed.
+	RemoteAddress string `json:",omitempty"`
+
 	// SNI is the SNI used when we force a specific SNI.
 	SNI string
 
@@ -661,6 +1111,13 @@ type TLSHandshakeDoneEvent struct {
 	// Error is the result of the TLS handshake.
 	Error error
 
+	// InsecureSkipVerify indicates whether we did not verify the
+	// certificate of this connection. We verify certificates unless
+	// configured otherwise, either for all hosts or for this host. This
+	// is only set for handshakes performed by explicit TLS dials, since
+	// we don't know the TLS config used by net/http.
+	InsecureSkipVerify bool
+
 	// TransactionID is the ID of the transaction that started
 	// this TLS handshake, or zero if we don't know it. Typically,
 	// it is zero for explicit dials, and it's nonzero instead
@@ -689,6 +1146,63 @@ type WriteEvent struct {
 	SyscallDuration time.Duration
 }
 
+// WriteTimeoutEvent is like ReadTimeoutEvent but for WRITE/SEND.
+type WriteTimeoutEvent struct {
+	// ConnID is the identifier of this connection.
+	ConnID int64
+
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+}
+
+// WebSocketUpgradeStartEvent is emitted when we start dialing
+// a WebSocket connection.
+type WebSocketUpgradeStartEvent struct {
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// RequestHeaders contains the headers of the upgrade request
+	// that have been configured by the user.
+	RequestHeaders http.Header
+
+	// TransactionID is the identifier of this upgrade.
+	TransactionID int64
+
+	// URL is the WebSocket URL we're dialing.
+	URL string
+}
+
+// WebSocketUpgradeDoneEvent is emitted when the WebSocket upgrade
+// is complete. Either we have an error, or a valid connection.
+type WebSocketUpgradeDoneEvent struct {
+	// DurationSinceBeginning is the number of nanoseconds since
+	// the time configured as the "zero" time.
+	DurationSinceBeginning time.Duration
+
+	// Error is the result of the upgrade.
+	Error error
+
+	// ResponseHeaders contains the headers of the response to the
+	// upgrade request, if we received such response.
+	ResponseHeaders http.Header
+
+	// ResponseStatusCode is the status code of the response to the
+	// upgrade request, or zero if we did not receive it.
+	ResponseStatusCode int64
+
+	// Subprotocol is the subprotocol negotiated with the server, or
+	// empty if the server did not choose any subprotocol.
+	Subprotocol string
+
+	// TransactionID is the identifier of this upgrade.
+	TransactionID int64
+
+	// URL is the WebSocket URL we're dialing.
+	URL string
+}
+
 // Handler handles measurement events.
 type Handler interface {
 	// OnMeasurement is called when an event occurs. There will be no
@@ -717,6 +1231,169 @@ type DNSResolver interface {
 	LookupNS(ctx context.Context, name string) ([]*net.NS, error)
 }
 
+// DNSResolverWithCNAME is a DNSResolver that is also able to return
+// the CNAME chain encountered while resolving a hostname.
+type DNSResolverWithCNAME interface {
+	DNSResolver
+
+	// LookupHostWithCNAME is like LookupHost but also returns the
+	// ordered list of CNAMEs encountered while resolving.
+	LookupHostWithCNAME(ctx context.Context, hostname string) (
+		addrs []string, cnames []string, err error)
+}
+
+// DNSResolverWithType is a DNSResolver that is also able to query
+// for a specific record type and return the raw resource records.
+type DNSResolverWithType interface {
+	DNSResolver
+
+	// LookupType queries for records of type qtype (e.g. dns.TypeTXT)
+	// and returns the resource records in the answer section.
+	LookupType(ctx context.Context, name string, qtype uint16) ([]dns.RR, error)
+}
+
+// DNSResolverWithAuthority is a DNSResolverWithType that is also able
+// to return the authority section, which contains, e.g., the NSEC and
+// NSEC3 records proving that the queried records do not exist.
+type DNSResolverWithAuthority interface {
+	DNSResolverWithType
+
+	// LookupTypeWithAuthority is like LookupType but also returns
+	// the resource records in the authority section.
+	LookupTypeWithAuthority(ctx context.Context, name string, qtype uint16) (
+		answer []dns.RR, authority []dns.RR, err error)
+}
+
+// HTTPSRecord is a parsed HTTPS resource record, which tells us how to
+// connect to a service, e.g., whether it supports HTTP/3. The HTTPS
+// record is a SVCB record specific to HTTPS. See
+// https://tools.ietf.org/html/draft-ietf-dnsop-svcb-https.
+type HTTPSRecord struct {
+	// ALPN contains the protocols supported by the service, if any.
+	ALPN []string
+
+	// ECHConfig is the encrypted ClientHello config, if any.
+	ECHConfig []byte
+
+	// IPv4Hint contains the IPv4 address hints, if any.
+	IPv4Hint []string
+
+	// IPv6Hint contains the IPv6 address hints, if any.
+	IPv6Hint []string
+
+	// Port is the alternative port, or zero if not set.
+	Port uint16
+
+	// Priority is the record priority. Zero means that this is an
+	// alias for Target rather than a service description.
+	Priority uint16
+
+	// Raw contains the wire format of the resource record, so that
+	// the measurement can store it as received.
+	Raw []byte
+
+	// Target is the target domain name. The root domain, i.e. ".",
+	// means that the target is the owner name of the record.
+	Target string
+}
+
+// DNSResolverWithHTTPS is a DNSResolver that is also able to query
+// for HTTPS records.
+type DNSResolverWithHTTPS interface {
+	DNSResolver
+
+	// LookupHTTPS queries for the HTTPS records of name.
+	LookupHTTPS(ctx context.Context, name string) ([]HTTPSRecord, error)
+}
+
+// DNSSECResult is the result of a lookup with DNSSEC validation. When
+// the answer could not be validated because the zone is not signed, both
+// Validated and Bogus are false.
+type DNSSECResult struct {
+	// Addresses contains the resolved addresses. We also return them
+	// when validation fails, such that we can record the tampering.
+	Addresses []string
+
+	// Bogus indicates that the answer should have been signed and that
+	// validation failed, which is a strong signal of tampering.
+	Bogus bool
+
+	// Unsupported indicates that the resolver cannot validate DNSSEC
+	// at all, e.g., because it's the system resolver.
+	Unsupported bool
+
+	// Validated indicates that we validated the whole chain of trust
+	// from the root trust anchor down to the answer.
+	Validated bool
+}
+
+// DNSResolverWithDNSSEC is a DNSResolver that is also able to validate
+// DNSSEC while resolving a hostname.
+type DNSResolverWithDNSSEC interface {
+	DNSResolver
+
+	// LookupHostDNSSEC is like LookupHost but also validates DNSSEC.
+	LookupHostDNSSEC(ctx context.Context, hostname string) (DNSSECResult, error)
+}
+
+// DNSConsistencyAnswer is the answer returned by one of the resolvers
+// used when checking for DNS consistency.
+type DNSConsistencyAnswer struct {
+	// Addresses contains the resolved addresses.
+	Addresses []string
+
+	// Error is the error that occurred, if any.
+	Error error
+
+	// Server identifies the resolver that returned this answer.
+	Server string
+}
+
+// DNSConsistencyResult is the result of resolving a hostname using both
+// a trusted resolver and the system resolver.
+type DNSConsistencyResult struct {
+	// Consistent indicates that both lookups succeeded and that the
+	// two sets of addresses have at least one address in common.
+	Consistent bool
+
+	// System is the answer of the system resolver.
+	System DNSConsistencyAnswer
+
+	// Trusted is the answer of the trusted resolver.
+	Trusted DNSConsistencyAnswer
+}
+
+// DNSResolverWithConsistency is a DNSResolver that is also able to
+// check whether the system resolver agrees with a trusted resolver.
+type DNSResolverWithConsistency interface {
+	DNSResolver
+
+	// LookupHostConsistency resolves hostname using both resolvers
+	// in parallel. It returns an error only when both lookups fail.
+	LookupHostConsistency(ctx context.Context, hostname string) (
+		DNSConsistencyResult, error)
+}
+
+// DNSResolverWithClose is a DNSResolver that owns resources, e.g., the
+// persistent connections used by DNS over TCP and TLS. Resolvers wrapping
+// other resolvers forward Close to them. Close is idempotent. Close is
+// not part of DNSResolver because *net.Resolver does not implement it.
+type DNSResolverWithClose interface {
+	DNSResolver
+
+	// Close releases the resources owned by the resolver.
+	Close() error
+}
+
+// CloseDNSResolver closes r if it is a DNSResolverWithClose and
+// otherwise does nothing, since r does not own any resource.
+func CloseDNSResolver(r DNSResolver) error {
+	if rc, ok := r.(DNSResolverWithClose); ok {
+		return rc.Close()
+	}
+	return nil
+}
+
 // DNSRoundTripper represents an abstract DNS transport.
 type DNSRoundTripper interface {
 	// RoundTrip sends a DNS query and receives the reply.
@@ -749,6 +1426,18 @@ type TLSDialer interface {
 // to tell this library to return an error when a bogon is found.
 var ErrDNSBogon = errors.New("dns: detected bogon address")
 
+// ErrSSLPinMismatch indicates that no certificate in the chain sent
+// by the server matches the public keys that we have pinned.
+var ErrSSLPinMismatch = errors.New("tls: no certificate matches the pinned public keys")
+
+// ErrProxyAuthRequired indicates that the HTTP proxy requires us
+// to authenticate, or that the credentials we sent are not valid.
+var ErrProxyAuthRequired = errors.New("proxy: authentication required")
+
+// ErrProxyConnectRefused indicates that the HTTP proxy refused to
+// connect us to the target, e.g., because it cannot reach it.
+var ErrProxyConnectRefused = errors.New("proxy: CONNECT refused")
+
 // MeasurementRoot is the measurement root.
 //
 // If you attach this to a context, we'll use it rather than using
@@ -779,9 +1468,33 @@ type MeasurementRoot struct {
 	// reasonable large value. Otherwise, we'll use this value.
 	MaxBodySnapSize int64
 
+	// BodySnapChunkSize, if positive, causes us to read the response
+	// body snapshot in chunks of BodySnapChunkSize bytes, recording
+	// when we received each chunk, so to detect stalls and resets in
+	// the middle of the body. Otherwise, we read the snapshot at once.
+	// We use at most the snapshot size as the chunk size.
+	BodySnapChunkSize int64
+
+	// SkipBodySnapContentTypes contains the media types of the response
+	// bodies for which we don't want to save a snapshot, e.g. "video/mp4".
+	// We match each entry against the response media type, ignoring case,
+	// either as a prefix (e.g. "image/") or as a glob (e.g. "image/*").
+	SkipBodySnapContentTypes []string
+
 	// LookupHost allows to override the host lookup for all the request
 	// and dials that use this measurement root.
 	LookupHost func(ctx context.Context, hostname string) ([]string, error)
+
+	// MaxRuntime is the maximum amount of time, measured since Beginning,
+	// that dials and lookups using this measurement root may run. If this
+	// value is zero or negative, there is no maximum runtime.
+	MaxRuntime time.Duration
+
+	// TLSHandshakeTimeout, if positive, overrides the TLS handshake
+	// timeout of the TLS dialers used with this measurement root, e.g.
+	// to shorten it for a specific measurement. Otherwise, we use the
+	// timeout configured in each TLS dialer.
+	TLSHandshakeTimeout time.Duration
 }
 
 type measurementRootContextKey struct{}
@@ -810,6 +1523,19 @@ func ContextMeasurementRootOrDefault(ctx context.Context) *MeasurementRoot {
 	return root
 }
 
+// ContextWithMaxRuntime returns a copy of the context that expires
+// when the MaxRuntime of the MeasurementRoot configured in the context,
+// if any, has elapsed since the root's Beginning. If there is no root or
+// no MaxRuntime, the returned context does not have a new deadline. The
+// caller should always call the returned cancel function.
+func ContextWithMaxRuntime(ctx context.Context) (context.Context, context.CancelFunc) {
+	root := ContextMeasurementRoot(ctx)
+	if root == nil || root.MaxRuntime <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, root.Beginning.Add(root.MaxRuntime))
+}
+
 // WithMeasurementRoot returns a copy of the context with the
 // configured MeasurementRoot set. Panics if the provided root
 // is a nil pointer, like httptrace.WithClientTrace.
@@ -826,3 +1552,42 @@ func WithMeasurementRoot(
 		ctx, measurementRootContextKey{}, root,
 	)
 }
+
+// VantagePoint describes the network from which we are measuring. We
+// propagate it using the context, so that dialers and resolvers deep
+// in the stack can use it, e.g., to tag events or to configure EDNS0
+// client subnet. Note that ProbeIP is sensitive information: do not
+// save it unless the privacy settings allow that.
+type VantagePoint struct {
+	// ProbeASN is the ASN of the probe (e.g. "AS30722").
+	ProbeASN string
+
+	// ProbeCC is the country code of the probe (e.g. "IT").
+	ProbeCC string
+
+	// ProbeIP is the IP address of the probe.
+	ProbeIP string
+
+	// ProbeNetworkName is the name of the probe network.
+	ProbeNetworkName string
+}
+
+type vantagePointContextKey struct{}
+
+// ContextVantagePoint returns the VantagePoint configured in the
+// provided context, or a nil pointer, if not set.
+func ContextVantagePoint(ctx context.Context) *VantagePoint {
+	vp, _ := ctx.Value(vantagePointContextKey{}).(*VantagePoint)
+	return vp
+}
+
+// WithVantagePoint returns a copy of the context with the configured
+// VantagePoint set. Panics if the provided vantage point is a nil
+// pointer, like WithMeasurementRoot. Setting again the vantage point
+// replaces the original one.
+func WithVantagePoint(ctx context.Context, vp *VantagePoint) context.Context {
+	if vp == nil {
+		panic("nil vantage point")
+	}
+	return context.WithValue(ctx, vantagePointContextKey{}, vp)
+}
@@ -2,11 +2,20 @@ package modelx
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"math"
+	"math/big"
+	"net"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestNewTLSConnectionState(t *testing.T) {
@@ -57,6 +66,27 @@ func TestMeasurementRootWithMeasurementRootPanic(t *testing.T) {
 	ctx = WithMeasurementRoot(ctx, nil)
 }
 
+func TestUnitVantagePoint(t *testing.T) {
+	ctx := context.Background()
+	if ContextVantagePoint(ctx) != nil {
+		t.Fatal("unexpected value for ContextVantagePoint")
+	}
+	vp := &VantagePoint{ProbeASN: "AS30722", ProbeNetworkName: "Vodafone"}
+	ctx = WithVantagePoint(ctx, vp)
+	if ContextVantagePoint(ctx) != vp {
+		t.Fatal("unexpected ContextVantagePoint value")
+	}
+}
+
+func TestUnitWithVantagePointPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic")
+		}
+	}()
+	WithVantagePoint(context.Background(), nil)
+}
+
 func TestErrWrapperPublicAPI(t *testing.T) {
 	child := errors.New("mocked error")
 	wrapper := &ErrWrapper{
@@ -82,3 +112,161 @@ func TestUnitComputeBodySnapSize(t *testing.T) {
 		t.Fatal("unexpected result")
 	}
 }
+
+func TestUnitContextWithMaxRuntime(t *testing.T) {
+	t.Run("without root", func(t *testing.T) {
+		ctx, cancel := ContextWithMaxRuntime(context.Background())
+		defer cancel()
+		if _, ok := ctx.Deadline(); ok {
+			t.Fatal("expected no deadline here")
+		}
+	})
+	t.Run("without MaxRuntime", func(t *testing.T) {
+		ctx := WithMeasurementRoot(context.Background(), &MeasurementRoot{
+			Beginning: time.Now(),
+		})
+		ctx, cancel := ContextWithMaxRuntime(ctx)
+		defer cancel()
+		if _, ok := ctx.Deadline(); ok {
+			t.Fatal("expected no deadline here")
+		}
+	})
+	t.Run("with MaxRuntime", func(t *testing.T) {
+		beginning := time.Now().Add(-time.Second)
+		ctx := WithMeasurementRoot(context.Background(), &MeasurementRoot{
+			Beginning:  beginning,
+			MaxRuntime: time.Minute,
+		})
+		ctx, cancel := ContextWithMaxRuntime(ctx)
+		defer cancel()
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			t.Fatal("expected a deadline here")
+		}
+		if !deadline.Equal(beginning.Add(time.Minute)) {
+			t.Fatal("unexpected deadline")
+		}
+	})
+}
+
+func newOCSPChain(t *testing.T, status int) ([]*x509.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		NotAfter:              now.Add(time.Hour),
+		NotBefore:             now.Add(-time.Hour),
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+	}
+	caData, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		NotAfter:     now.Add(time.Hour),
+		NotBefore:    now.Add(-time.Hour),
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "leaf"},
+	}
+	leafData, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+		NextUpdate:   now.Add(time.Hour),
+		RevokedAt:    now.Add(-time.Minute),
+		SerialNumber: leaf.SerialNumber,
+		Status:       status,
+		ThisUpdate:   now.Add(-time.Minute),
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{leaf, ca}, data
+}
+
+func TestUnitNewOCSPResponse(t *testing.T) {
+	t.Run("without staple", func(t *testing.T) {
+		if NewOCSPResponse(nil, nil) != nil {
+			t.Fatal("expected nil response here")
+		}
+		state := NewTLSConnectionState(tls.ConnectionState{})
+		if state.OCSPStapled || state.OCSPResponse != nil {
+			t.Fatal("unexpected OCSP information")
+		}
+	})
+	t.Run("with invalid staple", func(t *testing.T) {
+		resp := NewOCSPResponse([]byte("antani"), nil)
+		if resp == nil || resp.ParseError == "" {
+			t.Fatal("expected a parse error here")
+		}
+		if string(resp.Data) != "antani" {
+			t.Fatal("unexpected raw data")
+		}
+	})
+	for _, tc := range []struct {
+		status   int
+		expected string
+	}{
+		{ocsp.Good, "good"},
+		{ocsp.Revoked, "revoked"},
+		{ocsp.Unknown, "unknown"},
+	} {
+		t.Run("with "+tc.expected+" staple", func(t *testing.T) {
+			chain, data := newOCSPChain(t, tc.status)
+			state := NewTLSConnectionState(tls.ConnectionState{
+				OCSPResponse:     data,
+				PeerCertificates: chain,
+			})
+			if !state.OCSPStapled || state.OCSPResponse == nil {
+				t.Fatal("expected OCSP information")
+			}
+			if state.OCSPResponse.ParseError != "" {
+				t.Fatal(state.OCSPResponse.ParseError)
+			}
+			if state.OCSPResponse.Status != tc.expected {
+				t.Fatal("unexpected status")
+			}
+			if state.OCSPResponse.NextUpdate.IsZero() || state.OCSPResponse.ThisUpdate.IsZero() {
+				t.Fatal("unexpected times")
+			}
+		})
+	}
+}
+
+type closingResolver struct {
+	*net.Resolver
+	closed bool
+}
+
+func (r *closingResolver) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestUnitCloseDNSResolver(t *testing.T) {
+	reso := &closingResolver{Resolver: new(net.Resolver)}
+	if err := CloseDNSResolver(reso); err != nil {
+		t.Fatal(err)
+	}
+	if !reso.closed {
+		t.Fatal("expected the resolver to be closed")
+	}
+	if err := CloseDNSResolver(new(net.Resolver)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,103 @@
+package netx
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// Config contains the settings of a measurement Pipeline. The zero
+// value is valid and gives you a pipeline using the system resolver,
+// not using any proxy, and only saving the events.
+type Config struct {
+	// Beginning is the zero time of the events. If zero, we use
+	// the time when the Pipeline is created.
+	Beginning time.Time
+
+	// DNSNetwork and DNSAddress configure the resolver exactly like
+	// the arguments of Dialer.ConfigureDNS.
+	DNSNetwork string
+	DNSAddress string
+
+	// Handler is an optional handler that receives the events along
+	// with the saver of the Pipeline. Experiments typically use this
+	// field to log the events using a netxlogger.Handler.
+	Handler modelx.Handler
+
+	// MaxBodySnapSize is the MaxBodySnapSize of the MeasurementRoot.
+	MaxBodySnapSize int64
+
+	// ProxyURL is the optional URL of the proxy to use. If nil, we
+	// always connect directly, regardless of the environment.
+	ProxyURL *url.URL
+}
+
+// Pipeline is a ready to use measurement pipeline, where all the
+// dialers, resolvers, and transports emit events towards the same
+// MeasurementRoot, whose handler saves them.
+type Pipeline struct {
+	// Client is the HTTP client. Its HTTPClient field uses Root for
+	// all the requests that do not already have a MeasurementRoot.
+	Client *HTTPClient
+
+	// Root is the MeasurementRoot shared by the whole pipeline.
+	Root *modelx.MeasurementRoot
+
+	// Saver saves all the events, which you can then read to fill
+	// the experiment test keys.
+	Saver *handlers.SavingHandler
+}
+
+// NewPipeline creates a new Pipeline using the specified config. This
+// is meant to give experiments consistent instrumentation with a single
+// call, rather than assembling dialers, resolvers, and transports.
+func NewPipeline(config Config) (*Pipeline, error) {
+	if config.Beginning.IsZero() {
+		config.Beginning = time.Now()
+	}
+	saver := &handlers.SavingHandler{}
+	root := &modelx.MeasurementRoot{
+		Beginning:       config.Beginning,
+		Handler:         handlers.NewMultiHandler(saver, config.Handler),
+		MaxBodySnapSize: config.MaxBodySnapSize,
+	}
+	client := NewHTTPClientWithExplicitProxy(config.ProxyURL, config.ProxyURL != nil)
+	client.Transport.Beginning = root.Beginning
+	client.Transport.Handler = root.Handler
+	client.Transport.Dialer.Beginning = root.Beginning
+	client.Transport.Dialer.Handler = root.Handler
+	// Configure DNS after setting the handler, because the resolver
+	// we create uses the dialer's beginning and handler.
+	if err := client.ConfigureDNS(config.DNSNetwork, config.DNSAddress); err != nil {
+		return nil, err
+	}
+	client.HTTPClient.Transport = &rootTransport{
+		HTTPTransport: client.Transport,
+		root:          root,
+	}
+	return &Pipeline{Client: client, Root: root, Saver: saver}, nil
+}
+
+// NewContext returns a copy of ctx using the pipeline's Root, which
+// is useful to measure operations not performed using Client, e.g.,
+// dialing with Client.Transport.Dialer.
+func (p *Pipeline) NewContext(ctx context.Context) context.Context {
+	return modelx.WithMeasurementRoot(ctx, p.Root)
+}
+
+// rootTransport makes sure requests use the pipeline's root.
+type rootTransport struct {
+	*HTTPTransport
+	root *modelx.MeasurementRoot
+}
+
+func (t *rootTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if modelx.ContextMeasurementRoot(req.Context()) == nil {
+		req = req.WithContext(modelx.WithMeasurementRoot(req.Context(), t.root))
+	}
+	return t.HTTPTransport.RoundTrip(req)
+}
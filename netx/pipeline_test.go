@@ -0,0 +1,74 @@
+package netx_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ooni/probe-engine/netx"
+	"github.com/ooni/probe-engine/netx/handlers"
+)
+
+func TestIntegrationPipeline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("antani mascetti"))
+		}))
+	defer server.Close()
+	other := &handlers.SavingHandler{}
+	beginning := time.Now().Add(-time.Hour)
+	pipeline, err := netx.NewPipeline(netx.Config{
+		Beginning:       beginning,
+		Handler:         other,
+		MaxBodySnapSize: 6,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Client.CloseIdleConnections()
+	resp, err := pipeline.Client.HTTPClient.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !pipeline.Root.Beginning.Equal(beginning) {
+		t.Fatal("unexpected beginning")
+	}
+	if len(pipeline.Saver.Connects()) != 1 {
+		t.Fatal("expected to see the connect event")
+	}
+	events := pipeline.Saver.Read()
+	if len(events) == 0 || len(events) != len(other.Read()) {
+		t.Fatal("expected both handlers to see the same events")
+	}
+	var found bool
+	for _, ev := range events {
+		if ev.HTTPRoundTripDone == nil {
+			continue
+		}
+		found = true
+		if string(ev.HTTPRoundTripDone.ResponseBodySnap) != "antani" ||
+			!ev.HTTPRoundTripDone.ResponseBodySnapTruncated {
+			t.Fatal("expected the root's MaxBodySnapSize to be used")
+		}
+		if ev.HTTPRoundTripDone.DurationSinceBeginning < time.Hour {
+			t.Fatal("expected the root's Beginning to be used")
+		}
+	}
+	if !found {
+		t.Fatal("expected to see the round trip event")
+	}
+}
+
+func TestIntegrationPipelineInvalidDNS(t *testing.T) {
+	pipeline, err := netx.NewPipeline(netx.Config{DNSNetwork: "antani"})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if pipeline != nil {
+		t.Fatal("expected nil pipeline here")
+	}
+}
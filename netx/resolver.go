@@ -9,9 +9,16 @@ import (
 	"sync"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/internal/resolver"
 	"github.com/ooni/probe-engine/netx/internal/resolver/chainresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/consistencyresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/dnssecresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/rotatingresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/sortingresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/staticresolver"
+	"github.com/ooni/probe-engine/netx/internal/resolver/timeoutresolver"
 	"github.com/ooni/probe-engine/netx/modelx"
 )
 
@@ -98,6 +105,44 @@ func (r *resolverWrapper) LookupHost(ctx context.Context, hostname string) ([]st
 	return r.resolver.LookupHost(ctx, hostname)
 }
 
+// LookupHostWithCNAME returns the IP addresses of a host along with
+// the CNAMEs encountered while resolving it
+func (r *resolverWrapper) LookupHostWithCNAME(
+	ctx context.Context, hostname string) ([]string, []string, error) {
+	ctx = maybeWithMeasurementRoot(ctx, r.beginning, r.handler)
+	if reso, ok := r.resolver.(modelx.DNSResolverWithCNAME); ok {
+		return reso.LookupHostWithCNAME(ctx, hostname)
+	}
+	addrs, err := r.resolver.LookupHost(ctx, hostname)
+	return addrs, []string{}, err
+}
+
+// LookupType queries for records of a specific type
+func (r *resolverWrapper) LookupType(
+	ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithType)
+	if !ok {
+		return nil, errLookupTypeNotSupported
+	}
+	ctx = maybeWithMeasurementRoot(ctx, r.beginning, r.handler)
+	return reso.LookupType(ctx, name, qtype)
+}
+
+var errLookupTypeNotSupported = errors.New("netx: LookupType not supported")
+
+// LookupHTTPS queries for the HTTPS records of name
+func (r *resolverWrapper) LookupHTTPS(
+	ctx context.Context, name string) ([]modelx.HTTPSRecord, error) {
+	reso, ok := r.resolver.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		return nil, errLookupHTTPSNotSupported
+	}
+	ctx = maybeWithMeasurementRoot(ctx, r.beginning, r.handler)
+	return reso.LookupHTTPS(ctx, name)
+}
+
+var errLookupHTTPSNotSupported = errors.New("netx: LookupHTTPS not supported")
+
 // LookupMX returns the MX records of a specific name
 func (r *resolverWrapper) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
 	ctx = maybeWithMeasurementRoot(ctx, r.beginning, r.handler)
@@ -110,46 +155,137 @@ func (r *resolverWrapper) LookupNS(ctx context.Context, name string) ([]*net.NS,
 	return r.resolver.LookupNS(ctx, name)
 }
 
+// LookupHostDNSSEC is like LookupHost but also validates DNSSEC. If
+// the wrapped resolver cannot validate, the result is unsupported.
+func (r *resolverWrapper) LookupHostDNSSEC(
+	ctx context.Context, hostname string) (modelx.DNSSECResult, error) {
+	ctx = maybeWithMeasurementRoot(ctx, r.beginning, r.handler)
+	if reso, ok := r.resolver.(modelx.DNSResolverWithDNSSEC); ok {
+		return reso.LookupHostDNSSEC(ctx, hostname)
+	}
+	addrs, err := r.resolver.LookupHost(ctx, hostname)
+	return modelx.DNSSECResult{Addresses: addrs, Unsupported: true}, err
+}
+
+// Close closes the wrapped resolver
+func (r *resolverWrapper) Close() error {
+	return modelx.CloseDNSResolver(r.resolver)
+}
+
+// newResolver creates a new resolver using the specified options.
 func newResolver(
 	beginning time.Time, handler modelx.Handler, network, address string,
-) (modelx.DNSResolver, error) {
+	options ResolverOptions,
+) (*resolverWrapper, error) {
 	// Implementation note: system need to be dealt with
 	// separately because it doesn't have any transport.
 	if network == "system" || network == "" {
 		return newResolverWrapper(
 			beginning, handler, resolver.NewResolverSystem()), nil
 	}
-	if network == "doh" {
-		return newResolverWrapper(beginning, handler, resolver.NewResolverHTTPS(
-			newHTTPClientForDoH(beginning, handler), address,
-		)), nil
+	roptions := resolver.Options{
+		DNSSEC:              options.DNSSEC,
+		ECSPrefix:           options.ECSPrefix,
+		ECSFromVantagePoint: options.ECSFromVantagePoint,
+		IdleTimeout:         options.IdleTimeout,
 	}
-	if network == "dot" {
+	var reso modelx.DNSResolverWithType
+	switch network {
+	case "doh", "doh-get":
+		method := "POST"
+		if network == "doh-get" {
+			method = "GET"
+		}
+		var err error
+		reso, err = resolver.NewResolverHTTPSWithOptions(
+			newHTTPClientForDoH(beginning, handler), address, method, roptions,
+		)
+		if err != nil {
+			return nil, err
+		}
+	case "dot":
 		// We need a child dialer here to avoid an endless loop where the
 		// dialer will ask us to resolve, we'll tell the dialer to dial, it
 		// will ask us to resolve, ...
-		return newResolverWrapper(beginning, handler, resolver.NewResolverTLS(
-			newDialer(beginning, handler), withPort(address, "853"),
-		)), nil
-	}
-	if network == "tcp" {
+		reso = resolver.NewResolverTLSWithOptions(
+			newDialer(beginning, handler), withPort(address, "853"), roptions,
+		)
+	case "tcp":
 		// Same rationale as above: avoid possible endless loop
-		return newResolverWrapper(beginning, handler, resolver.NewResolverTCP(
-			newDialer(beginning, handler), withPort(address, "53"),
-		)), nil
-	}
-	if network == "udp" {
+		reso = resolver.NewResolverTCPWithOptions(
+			newDialer(beginning, handler), withPort(address, "53"), roptions,
+		)
+	case "udp":
 		// Same rationale as above: avoid possible endless loop
-		return newResolverWrapper(beginning, handler, resolver.NewResolverUDP(
-			newDialer(beginning, handler), withPort(address, "53"),
-		)), nil
+		reso = resolver.NewResolverUDPWithOptions(
+			newDialer(beginning, handler), withPort(address, "53"), roptions,
+		)
+	default:
+		return nil, errors.New("resolver.New: unsupported network value")
 	}
-	return nil, errors.New("resolver.New: unsupported network value")
+	if options.DNSSEC {
+		reso = dnssecresolver.New(reso)
+	}
+	return newResolverWrapper(beginning, handler, reso), nil
 }
 
 // NewResolver creates a standalone Resolver
 func NewResolver(network, address string) (modelx.DNSResolver, error) {
-	return newResolver(time.Now(), handlers.NoHandler, network, address)
+	return NewResolverWithOptions(network, address, ResolverOptions{})
+}
+
+// ResolverOptions contains optional settings for NewResolverWithOptions.
+type ResolverOptions struct {
+	// DNSSEC causes the resolver to request DNSSEC records and to validate
+	// the answers of LookupHost from the root trust anchor down. Use the
+	// LookupHostDNSSEC method of modelx.DNSResolverWithDNSSEC to know
+	// the outcome of the validation. We cannot validate when using the
+	// "system" resolver, so LookupHostDNSSEC marks its results as
+	// unsupported, regardless of this setting.
+	DNSSEC bool
+
+	// ECSPrefix, when not nil, causes the resolver to include an EDNS
+	// Client Subnet option with this prefix in the queries, to study
+	// geo-based responses. The DNSQuery events record the prefix. It
+	// has no effect on the "system" resolver.
+	ECSPrefix *net.IPNet
+
+	// ECSFromVantagePoint causes the resolver to use, when ECSPrefix is
+	// nil, the /24 (IPv4) or /56 (IPv6) network of the probe IP in the
+	// modelx.VantagePoint of the context, which Experiment sets when
+	// measuring. Because the DNSQuery events record the prefix, only use
+	// this when the privacy settings allow sharing the probe network.
+	ECSFromVantagePoint bool
+
+	// IdleTimeout, when positive, causes the "tcp" and "dot" resolvers
+	// to reuse connections, closing them after they have been idle for
+	// IdleTimeout. Otherwise, they use a connection per query.
+	IdleTimeout time.Duration
+}
+
+// NewResolverWithOptions is like NewResolver but allows to specify
+// options. The returned resolver also implements the optional resolver
+// interfaces of modelx, e.g., modelx.DNSResolverWithDNSSEC. Call Close
+// when done to close the idle connections.
+func NewResolverWithOptions(
+	network, address string, options ResolverOptions,
+) (modelx.DNSResolverWithClose, error) {
+	reso, err := newResolver(time.Now(), handlers.NoHandler, network, address, options)
+	if err != nil {
+		return nil, err
+	}
+	return reso, nil
+}
+
+// NewPooledResolver is like NewResolver except that the "tcp" and "dot"
+// resolvers reuse connections, closing them after they have been idle for
+// idleTimeout. The other resolvers behave like the ones returned by
+// NewResolver. Call Close when done to close the idle connections.
+func NewPooledResolver(
+	network, address string, idleTimeout time.Duration,
+) (modelx.DNSResolverWithClose, error) {
+	return NewResolverWithOptions(
+		network, address, ResolverOptions{IdleTimeout: idleTimeout})
 }
 
 // ChainResolvers chains a primary and a secondary resolver such that
@@ -157,3 +293,80 @@ func NewResolver(network, address string) (modelx.DNSResolver, error) {
 func ChainResolvers(primary, secondary modelx.DNSResolver) modelx.DNSResolver {
 	return chainresolver.New(primary, secondary)
 }
+
+// RotatingResolver is a resolver rotating among DoH providers. Its
+// Usage method returns the usage counters of each provider.
+type RotatingResolver = rotatingresolver.Resolver
+
+// RotatingResolverUsage contains the usage counters of a provider.
+type RotatingResolverUsage = rotatingresolver.Usage
+
+// The rotation modes supported by NewRotatingResolver.
+const (
+	RotatePerLookup  = rotatingresolver.PerLookup
+	RotatePerSession = rotatingresolver.PerSession
+)
+
+// NewRotatingResolver creates a resolver rotating among the DoH servers
+// at URLs, so that a single provider does not bias measurements. With
+// RotatePerLookup, each lookup starts from the next provider. With
+// RotatePerSession, all lookups start from the same provider, chosen at
+// random. On failure, we try the following providers. The lookups emit
+// the usual DoH events, whose TransportAddress field tells you which
+// provider served each lookup.
+func NewRotatingResolver(mode string, URLs []string) (*RotatingResolver, error) {
+	var providers []rotatingresolver.Provider
+	for _, URL := range URLs {
+		reso, err := NewResolver("doh", URL)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, rotatingresolver.Provider{
+			Name: URL, Resolver: reso,
+		})
+	}
+	return rotatingresolver.New(mode, providers...)
+}
+
+// NewStaticResolver creates a resolver that returns the configured
+// addresses for the hostnames in mapping and otherwise uses fallback. This
+// allows to pin, e.g., example.com to 1.2.3.4 without touching the OS
+// configuration. Use it with Dialer.SetResolver or ChainResolvers.
+func NewStaticResolver(
+	mapping map[string][]string, fallback modelx.DNSResolver,
+) modelx.DNSResolver {
+	return staticresolver.New(mapping, fallback)
+}
+
+// NewSortingResolver creates a resolver that sorts the addresses
+// returned by resolver, putting IPv4 addresses before IPv6 addresses and
+// sorting addresses of the same family. Because the system resolver
+// returns addresses in arbitrary order, sorting them reduces the noise
+// when diffing measurements across runs. Resolvers do not sort unless
+// you wrap them, e.g., use d.SetResolver(NewSortingResolver(reso)).
+func NewSortingResolver(resolver modelx.DNSResolver) modelx.DNSResolver {
+	return sortingresolver.New(resolver)
+}
+
+// NewTimeoutResolver creates a resolver that bounds the time spent by
+// resolver in LookupHost and its variants, e.g., LookupHostWithCNAME,
+// such that a slow resolver does not consume all the time budget of the
+// measurement. When the timeout expires, the lookups fail with an error
+// that wraps context.DeadlineExceeded. A zero or negative timeout means
+// that we do not bound the time spent in lookups.
+func NewTimeoutResolver(
+	resolver modelx.DNSResolver, timeout time.Duration) modelx.DNSResolver {
+	return timeoutresolver.New(resolver, timeout)
+}
+
+// NewConsistencyResolver creates a resolver that resolves hostnames using
+// both trusted and system in parallel, so that the LookupHostConsistency
+// method can tell whether the system resolver agrees with the trusted one
+// and report which resolver returned what. The trustedServer string is
+// used to identify trusted in the results. Because both resolvers may be
+// created using NewResolver, their lookups emit the usual events.
+func NewConsistencyResolver(
+	trustedServer string, trusted, system modelx.DNSResolver,
+) modelx.DNSResolverWithConsistency {
+	return consistencyresolver.New(trustedServer, trusted, system)
+}
@@ -2,12 +2,21 @@ package netx_test
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx"
 	"github.com/ooni/probe-engine/netx/handlers"
 	"github.com/ooni/probe-engine/netx/internal/resolver/brokenresolver"
+	"github.com/ooni/probe-engine/netx/modelx"
 )
 
 func TestIntegrationResolverLookupAddr(t *testing.T) {
@@ -132,6 +141,37 @@ func TestIntegrationNewResolverInvalid(t *testing.T) {
 	}
 }
 
+func TestIntegrationNewPooledResolver(t *testing.T) {
+	resolver, err := netx.NewPooledResolver("dot", "dns.quad9.net", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		addrs, err := resolver.LookupHost(context.Background(), "dns.google.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) < 1 {
+			t.Fatal("unexpected result")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := resolver.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIntegrationNewPooledResolverInvalid(t *testing.T) {
+	resolver, err := netx.NewPooledResolver("antani", "", time.Minute)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resolver != nil {
+		t.Fatal("expected a nil resolver here")
+	}
+}
+
 func TestIntegrationChainResolvers(t *testing.T) {
 	fallback, err := netx.NewResolver("udp", "1.1.1.1:53")
 	if err != nil {
@@ -151,6 +191,62 @@ func TestIntegrationChainResolvers(t *testing.T) {
 	defer conn.Close()
 }
 
+func TestIntegrationStaticResolver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := brokenresolver.New()
+	dialer := netx.NewDialer()
+	dialer.SetResolver(netx.NewStaticResolver(map[string][]string{
+		"antani.example.com": {"127.0.0.1"},
+	}, fallback))
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("antani.example.com", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if fallback.NumErrors.Load() != 0 {
+		t.Fatal("the fallback should not have been used")
+	}
+	conn, err = dialer.Dial("tcp", net.JoinHostPort("mascetti.example.com", port))
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if conn != nil {
+		t.Fatal("expected a nil conn here")
+	}
+	if fallback.NumErrors.Load() == 0 {
+		t.Fatal("the fallback should have been used")
+	}
+}
+
+func TestIntegrationConsistencyResolver(t *testing.T) {
+	trusted := netx.NewStaticResolver(map[string][]string{
+		"antani.example.com": {"1.2.3.4"},
+	}, brokenresolver.New())
+	system := netx.NewStaticResolver(map[string][]string{
+		"antani.example.com": {"10.0.0.1"},
+	}, brokenresolver.New())
+	reso := netx.NewConsistencyResolver("trusted", trusted, system)
+	result, err := reso.LookupHostConsistency(
+		context.Background(), "antani.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Consistent {
+		t.Fatal("expected inconsistent result")
+	}
+	if result.Trusted.Server != "trusted" || result.System.Server != "system" {
+		t.Fatal("unexpected servers")
+	}
+}
+
 func TestIntegrationResolverLookupMX(t *testing.T) {
 	resolver, err := netx.NewResolver("system", "")
 	if err != nil {
@@ -196,3 +292,519 @@ func TestUnitNewHTTPClientForDoH(t *testing.T) {
 		t.Fatal("expected to see different client here")
 	}
 }
+
+func newDoHServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var (
+				data []byte
+				err  error
+			)
+			if r.Method == "GET" {
+				data, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+			} else {
+				data, err = ioutil.ReadAll(r.Body)
+			}
+			query := new(dns.Msg)
+			if err != nil || query.Unpack(data) != nil {
+				w.WriteHeader(400)
+				return
+			}
+			reply := new(dns.Msg)
+			reply.SetReply(query)
+			if query.Question[0].Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   query.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+					},
+					A: net.IPv4(1, 2, 3, 4),
+				})
+			}
+			data, _ = reply.Pack()
+			w.Header().Set("content-type", "application/dns-message")
+			w.Write(data)
+		}))
+}
+
+func TestIntegrationDoHMethods(t *testing.T) {
+	server := newDoHServer(t)
+	defer server.Close()
+	for _, entry := range []struct {
+		network, address, method string
+	}{
+		{"doh", server.URL, "POST"},
+		{"doh-get", server.URL + "/dns-query{?dns}", "GET"},
+	} {
+		saver := &handlers.SavingHandler{}
+		dialer := netx.NewDialer()
+		dialer.Handler = saver
+		if err := dialer.ConfigureDNS(entry.network, entry.address); err != nil {
+			t.Fatal(err)
+		}
+		addrs, err := dialer.Resolver.LookupHost(context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+			t.Fatal("unexpected addresses")
+		}
+		resolves := saver.Resolves()
+		if len(resolves) != 1 || resolves[0].TransportMethod != entry.method ||
+			resolves[0].TransportAddress != entry.address {
+			t.Fatal("unexpected resolve event")
+		}
+		var roundTrips int
+		for _, ev := range saver.Read() {
+			if ev.HTTPRoundTripDone != nil {
+				if ev.HTTPRoundTripDone.RequestMethod != entry.method {
+					t.Fatal("unexpected HTTP method")
+				}
+				roundTrips++
+			}
+		}
+		if roundTrips != 2 { // one for A and one for AAAA
+			t.Fatal("expected to see the DoH round trips")
+		}
+	}
+}
+
+func TestIntegrationSortingResolver(t *testing.T) {
+	reso := netx.NewSortingResolver(netx.NewStaticResolver(map[string][]string{
+		"antani.example.com": {"::1", "10.0.0.10", "10.0.0.2"},
+	}, brokenresolver.New()))
+	addrs, err := reso.LookupHost(context.Background(), "antani.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 3 || addrs[0] != "10.0.0.2" || addrs[1] != "10.0.0.10" || addrs[2] != "::1" {
+		t.Fatal("unexpected order")
+	}
+}
+
+func TestUnitTimeoutResolver(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	reso, err := netx.NewResolver("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		addrs, err := netx.NewTimeoutResolver(reso, timeout).LookupHost(
+			context.Background(), "www.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatal("unexpected addresses")
+		}
+	}
+}
+
+func TestUnitTimeoutResolverTimeout(t *testing.T) {
+	// Nothing answers on this listener, hence the lookup hangs until
+	// the timeout expires.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	reso, err := netx.NewResolver("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = netx.NewTimeoutResolver(reso, 10*time.Millisecond).LookupHost(
+		context.Background(), "www.example.com")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+}
+
+func TestIntegrationRotatingResolver(t *testing.T) {
+	var servers []*httptest.Server
+	var URLs []string
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(500)
+			}))
+		defer server.Close()
+		servers = append(servers, server)
+		URLs = append(URLs, server.URL)
+	}
+	if _, err := netx.NewRotatingResolver("antani", URLs); err == nil {
+		t.Fatal("expected an error here")
+	}
+	reso, err := netx.NewRotatingResolver(netx.RotatePerLookup, URLs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := &handlers.SavingHandler{}
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   saver,
+	})
+	addrs, err := reso.LookupHost(ctx, "www.example.com")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addrs != nil {
+		t.Fatal("expected nil addrs here")
+	}
+	for idx, usage := range reso.Usage() {
+		if usage.Name != URLs[idx] || usage.Lookups != 1 || usage.Failures != 1 {
+			t.Fatalf("unexpected usage: %+v", usage)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, ev := range saver.Read() {
+		if ev.ResolveDone != nil {
+			seen[ev.ResolveDone.TransportAddress] = true
+		}
+	}
+	if len(seen) != 2 || !seen[URLs[0]] || !seen[URLs[1]] {
+		t.Fatal("expected events from both providers")
+	}
+}
+
+// typeHTTPS is the type of HTTPS records
+const typeHTTPS = 65
+
+// newLocalDNSServer starts a DNS over TCP server where www.example.com
+// is a CNAME for edge.example.net, which resolves to 127.0.0.1, and has
+// a TXT record containing "hello" and a HTTPS record. It returns the server address and a function to stop the server.
+func newLocalDNSServer(t *testing.T) (string, func()) {
+	return newLocalDNSServerWithObserver(t, func(*dns.Msg) {})
+}
+
+// newLocalDNSServerWithObserver is like newLocalDNSServer but calls
+// observe with each incoming query before replying to it.
+func newLocalDNSServerWithObserver(
+	t *testing.T, observe func(req *dns.Msg)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			observe(req)
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			question := req.Question[0]
+			if question.Name == "www.example.com." && question.Qtype == dns.TypeA {
+				reply.Answer = append(reply.Answer, &dns.CNAME{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: dns.TypeCNAME,
+						Class: dns.ClassINET, Ttl: 60,
+					},
+					Target: "edge.example.net.",
+				}, &dns.A{
+					Hdr: dns.RR_Header{
+						Name: "edge.example.net.", Rrtype: dns.TypeA,
+						Class: dns.ClassINET, Ttl: 60,
+					},
+					A: net.IPv4(127, 0, 0, 1),
+				})
+			}
+			if question.Name == "www.example.com." && question.Qtype == dns.TypeTXT {
+				reply.Answer = append(reply.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: dns.TypeTXT,
+						Class: dns.ClassINET, Ttl: 60,
+					},
+					Txt: []string{"hello"},
+				})
+			}
+			if question.Name == "www.example.com." && question.Qtype == typeHTTPS {
+				reply.Answer = append(reply.Answer, &dns.RFC3597{
+					Hdr: dns.RR_Header{
+						Name: question.Name, Rrtype: typeHTTPS,
+						Class: dns.ClassINET, Ttl: 60,
+					},
+					// priority 1, root target, alpn "h2"
+					Rdata: "00010000010003026832",
+				})
+			}
+			w.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	return listener.Addr().String(), func() { server.Shutdown() }
+}
+
+func TestUnitNewResolverLookupHostWithCNAME(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	reso, err := netx.NewResolver("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, ok := reso.(modelx.DNSResolverWithCNAME)
+	if !ok {
+		t.Fatal("the resolver does not support CNAMEs")
+	}
+	addrs, cnames, err := rc.LookupHostWithCNAME(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Fatal("unexpected addresses")
+	}
+	if len(cnames) != 1 || cnames[0] != "edge.example.net." {
+		t.Fatalf("unexpected cnames: %+v", cnames)
+	}
+}
+
+func TestUnitNewResolverLookupType(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	reso, err := netx.NewResolver("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, ok := reso.(modelx.DNSResolverWithType)
+	if !ok {
+		t.Fatal("the resolver does not support LookupType")
+	}
+	records, err := rt.LookupType(context.Background(), "www.example.com", dns.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatal("unexpected number of records")
+	}
+	txt, ok := records[0].(*dns.TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Txt[0] != "hello" {
+		t.Fatal("unexpected record")
+	}
+}
+
+func TestUnitNewResolverLookupHTTPS(t *testing.T) {
+	address, stop := newLocalDNSServer(t)
+	defer stop()
+	reso, err := netx.NewResolver("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh, ok := reso.(modelx.DNSResolverWithHTTPS)
+	if !ok {
+		t.Fatal("the resolver does not support LookupHTTPS")
+	}
+	records, err := rh.LookupHTTPS(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Priority != 1 || records[0].Target != "." {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if len(records[0].ALPN) != 1 || records[0].ALPN[0] != "h2" {
+		t.Fatal("unexpected ALPN")
+	}
+}
+
+func TestUnitNewResolverWithOptionsDNSSEC(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries int
+		withDO  int
+	)
+	address, stop := newLocalDNSServerWithObserver(t, func(req *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		queries++
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			withDO++
+		}
+	})
+	defer stop()
+	reso, err := netx.NewResolverWithOptions(
+		"tcp", address, netx.ResolverOptions{DNSSEC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reso.Close()
+	rd, ok := reso.(modelx.DNSResolverWithDNSSEC)
+	if !ok {
+		t.Fatal("the resolver does not support DNSSEC")
+	}
+	result, err := rd.LookupHostDNSSEC(context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Addresses) != 1 || result.Addresses[0] != "127.0.0.1" {
+		t.Fatal("unexpected addresses")
+	}
+	// The local zone is not signed, so we cannot validate.
+	if result.Validated || result.Unsupported {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if queries <= 0 || withDO != queries {
+		t.Fatal("expected all queries to have the DO bit set")
+	}
+}
+
+func TestUnitNewResolverWithOptionsNoDNSSEC(t *testing.T) {
+	address, stop := newLocalDNSServerWithObserver(t, func(req *dns.Msg) {
+		if opt := req.IsEdns0(); opt != nil && opt.Do() {
+			t.Error("unexpected DO bit")
+		}
+	})
+	defer stop()
+	reso, err := netx.NewResolverWithOptions("tcp", address, netx.ResolverOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reso.Close()
+	result, err := reso.(modelx.DNSResolverWithDNSSEC).LookupHostDNSSEC(
+		context.Background(), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Addresses) != 1 || !result.Unsupported {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitNewResolverWithOptionsDNSSECSystem(t *testing.T) {
+	reso, err := netx.NewResolverWithOptions(
+		"system", "", netx.ResolverOptions{DNSSEC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reso.Close()
+	result, err := reso.(modelx.DNSResolverWithDNSSEC).LookupHostDNSSEC(
+		context.Background(), "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Unsupported || result.Validated || result.Bogus {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+func TestUnitNewResolverWithOptionsInvalid(t *testing.T) {
+	reso, err := netx.NewResolverWithOptions(
+		"doh-put", "https://dns.google/dns-query", netx.ResolverOptions{DNSSEC: true})
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if reso != nil {
+		t.Fatal("expected a nil resolver here")
+	}
+}
+
+func TestUnitNewResolverWithOptionsECSPrefix(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		subnets []string
+	)
+	address, stop := newLocalDNSServerWithObserver(t, func(req *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		if opt := req.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnets = append(subnets, subnet.String())
+				}
+			}
+		}
+	})
+	defer stop()
+	_, prefix, err := net.ParseCIDR("130.192.91.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reso, err := netx.NewResolverWithOptions(
+		"tcp", address, netx.ResolverOptions{ECSPrefix: prefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reso.Close()
+	saver := &handlers.SavingHandler{}
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   saver,
+	})
+	addrs, err := reso.LookupHost(ctx, "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Fatal("unexpected addresses")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(subnets) <= 0 {
+		t.Fatal("expected queries with an ECS option")
+	}
+	for _, subnet := range subnets {
+		if subnet != "130.192.91.0/24/0" {
+			t.Fatalf("unexpected subnet: %s", subnet)
+		}
+	}
+	var found bool
+	for _, ev := range saver.Read() {
+		if ev.DNSQuery != nil {
+			found = true
+			if ev.DNSQuery.ECSPrefix != "130.192.91.0/24" {
+				t.Fatal("unexpected ECSPrefix in the query event")
+			}
+		}
+	}
+	if !found {
+		t.Fatal("did not see any DNSQuery event")
+	}
+}
+
+func TestUnitNewResolverWithOptionsECSFromVantagePoint(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		subnets []string
+	)
+	address, stop := newLocalDNSServerWithObserver(t, func(req *dns.Msg) {
+		mu.Lock()
+		defer mu.Unlock()
+		if opt := req.IsEdns0(); opt != nil {
+			for _, option := range opt.Option {
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+					subnets = append(subnets, subnet.String())
+				}
+			}
+		}
+	})
+	defer stop()
+	reso, err := netx.NewResolverWithOptions(
+		"tcp", address, netx.ResolverOptions{ECSFromVantagePoint: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reso.Close()
+	saver := &handlers.SavingHandler{}
+	ctx := modelx.WithMeasurementRoot(context.Background(), &modelx.MeasurementRoot{
+		Beginning: time.Now(),
+		Handler:   saver,
+	})
+	vp := &modelx.VantagePoint{ProbeASN: "AS137", ProbeIP: "130.192.91.211"}
+	ctx = modelx.WithVantagePoint(ctx, vp)
+	if _, err := reso.LookupHost(ctx, "www.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(subnets) <= 0 {
+		t.Fatal("expected queries with an ECS option")
+	}
+	for _, subnet := range subnets {
+		if subnet != "130.192.91.0/24/0" {
+			t.Fatalf("unexpected subnet: %s", subnet)
+		}
+	}
+	resolves := saver.Resolves()
+	if len(resolves) != 1 || resolves[0].VantagePoint != vp {
+		t.Fatal("expected the resolve event to be tagged")
+	}
+}
@@ -0,0 +1,166 @@
+package netx
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/internal/errwrapper"
+	"github.com/ooni/probe-engine/netx/internal/transactionid"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+// WebSocketDialer dials WebSocket connections and emits measurement
+// events as they happen. Connections are dialed using Dialer, so that
+// we see the DNS, connect and TLS handshake events, and the upgrade is
+// then emitted as WebSocketUpgradeStart and WebSocketUpgradeDone.
+type WebSocketDialer struct {
+	// Dialer is the dialer used for ws and wss connections.
+	Dialer *Dialer
+
+	// HandshakeTimeout is the maximum time allowed for the whole
+	// dial, including the upgrade. If zero, we don't set a timeout.
+	HandshakeTimeout time.Duration
+
+	// ReadBufferSize is the size of the read buffer. If zero, we
+	// use the default size chosen by gorilla/websocket.
+	ReadBufferSize int
+
+	// Subprotocols is the list of subprotocols we offer to the server.
+	Subprotocols []string
+
+	// WriteBufferSize is like ReadBufferSize but for writing.
+	WriteBufferSize int
+}
+
+func newWebSocketDialer(beginning time.Time, handler modelx.Handler) *WebSocketDialer {
+	dialer := newDialer(beginning, handler)
+	// The upgrade only works with HTTP/1.1, so make sure we're not
+	// going to negotiate h2 with servers that support it.
+	dialer.TLSConfig.NextProtos = []string{"http/1.1"}
+	return &WebSocketDialer{Dialer: dialer}
+}
+
+// NewWebSocketDialer creates a new WebSocketDialer.
+func NewWebSocketDialer() *WebSocketDialer {
+	return newWebSocketDialer(time.Now(), handlers.NoHandler)
+}
+
+// DialContext dials the WebSocket at URL, whose scheme must be either
+// "ws" or "wss", using the specified upgrade request headers. On success
+// it returns the connection and the response to the upgrade request.
+// The negotiated subprotocol is available via conn.Subprotocol(). When
+// the server rejects the upgrade, the response may be non-nil even
+// though the error is non-nil. Cancelling the context interrupts any
+// pending operation, including the upgrade itself.
+func (d *WebSocketDialer) DialContext(
+	ctx context.Context, URL string, headers http.Header,
+) (*websocket.Conn, *http.Response, error) {
+	ctx = maybeWithMeasurementRoot(ctx, d.Dialer.Beginning, d.Dialer.Handler)
+	ctx = transactionid.WithTransactionID(ctx)
+	root := modelx.ContextMeasurementRootOrDefault(ctx)
+	tid := transactionid.ContextTransactionID(ctx)
+	root.Handler.OnMeasurement(modelx.Measurement{
+		WebSocketUpgradeStart: &modelx.WebSocketUpgradeStartEvent{
+			DurationSinceBeginning: time.Now().Sub(root.Beginning),
+			RequestHeaders:         headers,
+			TransactionID:          tid,
+			URL:                    URL,
+		},
+	})
+	conn, resp, err := d.dialContext(ctx, URL, headers)
+	err = errwrapper.SafeErrWrapperBuilder{
+		Error:         err,
+		Operation:     "websocket_upgrade",
+		TransactionID: tid,
+	}.MaybeBuild()
+	event := &modelx.WebSocketUpgradeDoneEvent{
+		DurationSinceBeginning: time.Now().Sub(root.Beginning),
+		Error:                  err,
+		TransactionID:          tid,
+		URL:                    URL,
+	}
+	if resp != nil {
+		event.ResponseHeaders = resp.Header
+		event.ResponseStatusCode = int64(resp.StatusCode)
+	}
+	if conn != nil {
+		event.Subprotocol = conn.Subprotocol()
+	}
+	root.Handler.OnMeasurement(modelx.Measurement{
+		WebSocketUpgradeDone: event,
+	})
+	return conn, resp, err
+}
+
+func (d *WebSocketDialer) dialContext(
+	ctx context.Context, URL string, headers http.Header,
+) (*websocket.Conn, *http.Response, error) {
+	parsed, err := url.Parse(URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	dial := d.Dialer.DialContext
+	if parsed.Scheme == "wss" {
+		// We want the TLS handshake to be performed by our TLS dialer
+		// so that we emit TLS events. Hence, we tell gorilla/websocket
+		// to use "ws" and we dial TLS ourselves. Because gorilla would
+		// otherwise use the default port for "ws", we make the port
+		// explicit and restore the original Host header.
+		headers = cloneHeaders(headers)
+		if headers.Get("Host") == "" {
+			headers.Set("Host", parsed.Host)
+		}
+		if parsed.Port() == "" {
+			parsed.Host = net.JoinHostPort(parsed.Hostname(), "443")
+		}
+		parsed.Scheme = "ws"
+		dial = d.Dialer.DialTLSContext
+	}
+	// gorilla/websocket only honours the context deadline once the
+	// connection has been established, so we close the connection
+	// ourselves when the context is cancelled during the upgrade. We
+	// watch our context rather than the one passed to NetDialContext
+	// because gorilla cancels the latter when DialContext returns.
+	done := make(chan interface{})
+	defer close(done)
+	dialer := websocket.Dialer{
+		HandshakeTimeout: d.HandshakeTimeout,
+		NetDialContext: func(
+			dialCtx context.Context, network, address string,
+		) (net.Conn, error) {
+			conn, err := dial(dialCtx, network, address)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			return conn, nil
+		},
+		ReadBufferSize:  d.ReadBufferSize,
+		Subprotocols:    d.Subprotocols,
+		WriteBufferSize: d.WriteBufferSize,
+	}
+	conn, resp, err := dialer.DialContext(ctx, parsed.String(), headers)
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return conn, resp, err
+}
+
+func cloneHeaders(headers http.Header) http.Header {
+	out := make(http.Header)
+	for key, values := range headers {
+		out[key] = values
+	}
+	return out
+}
@@ -0,0 +1,134 @@
+package netx_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ooni/probe-engine/netx"
+	"github.com/ooni/probe-engine/netx/handlers"
+	"github.com/ooni/probe-engine/netx/modelx"
+)
+
+func newWebSocketServer() *httptest.Server {
+	upgrader := websocket.Upgrader{Subprotocols: []string{"antani"}}
+	return httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			conn, err := upgrader.Upgrade(w, r, http.Header{
+				"X-Antani": []string{"mascetti"},
+			})
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}))
+}
+
+func TestIntegrationWebSocketDialerWSS(t *testing.T) {
+	server := newWebSocketServer()
+	server.StartTLS()
+	defer server.Close()
+	saver := &handlers.SavingHandler{}
+	dialer := netx.NewWebSocketDialer()
+	dialer.Dialer.Handler = saver
+	dialer.Subprotocols = []string{"antani"}
+	if err := dialer.Dialer.ForceSkipVerify(); err != nil {
+		t.Fatal(err)
+	}
+	URL := strings.Replace(server.URL, "https://", "wss://", 1)
+	conn, resp, err := dialer.DialContext(context.Background(), URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != "antani" {
+		t.Fatal("unexpected subprotocol")
+	}
+	if resp.Header.Get("X-Antani") != "mascetti" {
+		t.Fatal("missing upgrade response header")
+	}
+	handshakes := saver.TLSHandshakes()
+	if len(handshakes) != 1 || handshakes[0].Error != nil {
+		t.Fatal("expected a successful TLS handshake event")
+	}
+	var start *modelx.WebSocketUpgradeStartEvent
+	var done *modelx.WebSocketUpgradeDoneEvent
+	for _, m := range saver.Read() {
+		if m.WebSocketUpgradeStart != nil {
+			start = m.WebSocketUpgradeStart
+		}
+		if m.WebSocketUpgradeDone != nil {
+			done = m.WebSocketUpgradeDone
+		}
+	}
+	if start == nil || start.URL != URL {
+		t.Fatal("missing or invalid upgrade start event")
+	}
+	if done == nil || done.Error != nil || done.TransactionID != start.TransactionID {
+		t.Fatal("missing or invalid upgrade done event")
+	}
+	if done.Subprotocol != "antani" || done.ResponseStatusCode != 101 {
+		t.Fatal("unexpected upgrade done event")
+	}
+	if done.ResponseHeaders.Get("X-Antani") != "mascetti" {
+		t.Fatal("missing upgrade response header in event")
+	}
+}
+
+func TestIntegrationWebSocketDialerUpgradeRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(403)
+		}))
+	defer server.Close()
+	dialer := netx.NewWebSocketDialer()
+	URL := strings.Replace(server.URL, "http://", "ws://", 1)
+	conn, resp, err := dialer.DialContext(context.Background(), URL, nil)
+	var wrapper *modelx.ErrWrapper
+	if !errors.As(err, &wrapper) || wrapper.Operation != "websocket_upgrade" {
+		t.Fatal("not the error we expected")
+	}
+	if conn != nil {
+		t.Fatal("expected a nil conn here")
+	}
+	if resp == nil || resp.StatusCode != 403 {
+		t.Fatal("expected the upgrade response here")
+	}
+}
+
+func TestIntegrationWebSocketDialerCancelDuringUpgrade(t *testing.T) {
+	// A server that accepts the connection but never replies.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	dialer := netx.NewWebSocketDialer()
+	conn, _, err := dialer.DialContext(ctx, "ws://"+listener.Addr().String(), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("not the error we expected: %+v", err)
+	}
+	if conn != nil {
+		t.Fatal("expected a nil conn here")
+	}
+}
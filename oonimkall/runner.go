@@ -221,7 +221,12 @@ func (r *runner) Run(ctx context.Context) {
 		}
 		r.settings.Inputs = append(r.settings.Inputs, "")
 	}
-	experiment := builder.NewExperiment()
+	experiment, err := builder.NewExperiment()
+	if err != nil {
+		r.emitter.EmitFailureStartup(err.Error())
+		return
+	}
+	defer experiment.Close()
 	if !r.settings.Options.NoCollector {
 		if err := experiment.OpenReport(); err != nil {
 			r.emitter.EmitFailureGeneric(failureReportCreate, err.Error())